@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -48,7 +51,25 @@ type exposeFlags struct {
 	httpRoutes   []string
 	udp          bool
 	udpAddr      string
+	udpProxy     bool
 	tcp          bool
+	ports        []string
+	proxyProto   string
+	multiplex    bool
+	transport    string
+	aliases      []string
+	wildcard     bool
+	domains      []string
+	domainCert   string
+	domainKey    string
+	instanceID   string
+	weight       int
+	policy       string
+	idleTimeout  int
+	lifetime     int
+	drainTimeout int
+	allowCIDRs   []string
+	denyCIDRs    []string
 }
 
 func runExposeCommand(args []string) error {
@@ -69,7 +90,25 @@ func runExposeCommand(args []string) error {
 	utils.RepeatedStringFlag(fs, &flags.httpRoutes, "http-route", "HTTP route mapping in PATH=UPSTREAM form; repeat to aggregate multiple local HTTP services behind one public URL")
 	utils.BoolFlagEnv(fs, &flags.udp, "udp", false, "Enable public UDP relay in addition to the default TCP relay", "UDP_ENABLED")
 	utils.StringFlagEnv(fs, &flags.udpAddr, "udp-addr", "", "Local UDP target address for relayed datagrams (host:port or port only); defaults to the target when --udp is enabled", "UDP_ADDR")
+	utils.BoolFlagEnv(fs, &flags.udpProxy, "udp-proxy-protocol", false, "Prefix each datagram sent to the local UDP target with a PROXY v2 header carrying the client address", "UDP_PROXY_PROTOCOL")
 	utils.BoolFlagEnv(fs, &flags.tcp, "tcp", false, "Request a dedicated TCP port on the relay for raw TCP services (no TLS; e.g., Minecraft, game servers)", "TCP_ENABLED")
+	utils.RepeatedStringFlag(fs, &flags.ports, "port", "Additional relay port in PROTO[:PUBLIC]=TARGET form, e.g. udp:27015=27015; PUBLIC is a preferred port number and the relay may grant another (repeatable)")
+	utils.StringFlagEnv(fs, &flags.proxyProto, "proxy-protocol", "", "Send a PROXY protocol header (v1 or v2) with the original client address to the local target", "PROXY_PROTOCOL")
+	utils.BoolFlagEnv(fs, &flags.multiplex, "multiplex", false, "Carry all reverse sessions to each relay over one multiplexed connection; falls back automatically on relays without support", "MULTIPLEX")
+	utils.StringFlagEnv(fs, &flags.transport, "stream-transport", "", "Reverse session transport: tcp, or quic to carry every session as a stream on one QUIC connection per relay", "STREAM_TRANSPORT")
+	utils.RepeatedStringFlag(fs, &flags.aliases, "alias", "Additional hostname prefix (single DNS label) under the relay root host (repeatable)")
+	utils.BoolFlag(fs, &flags.wildcard, "wildcard", false, "Also route every subdomain of the public hostname (*.<name>.<relay>) to this service")
+	utils.RepeatedStringFlag(fs, &flags.domains, "custom-domain", "Custom domain to route to this service; requires a _portal-challenge TXT record with your identity address (repeatable)")
+	utils.StringFlagEnv(fs, &flags.domainCert, "custom-domain-cert", "", "PEM certificate chain served for custom domains; the relay issues one when omitted", "CUSTOM_DOMAIN_CERT")
+	utils.StringFlagEnv(fs, &flags.domainKey, "custom-domain-key", "", "PEM private key for --custom-domain-cert", "CUSTOM_DOMAIN_KEY")
+	utils.StringFlagEnv(fs, &flags.instanceID, "instance-id", "", "Replica instance ID (single DNS label); replicas sharing an identity and name load-balance one hostname", "INSTANCE_ID")
+	utils.IntFlagEnv(fs, &flags.weight, "replica-weight", 0, parseNonNegativeInt, "Share of claims for this replica under the weighted policy (0=1)", "REPLICA_WEIGHT")
+	utils.StringFlagEnv(fs, &flags.policy, "replica-policy", "", "Replica selection policy: round_robin, least_ready or weighted", "REPLICA_POLICY")
+	utils.IntFlagEnv(fs, &flags.idleTimeout, "idle-timeout", 0, parseNonNegativeInt, "Seconds after which the relay closes a public connection that moved no data (0=relay default; capped by the relay)", "CONN_IDLE_TIMEOUT")
+	utils.IntFlagEnv(fs, &flags.lifetime, "max-lifetime", 0, parseNonNegativeInt, "Seconds after which the relay closes any public connection (0=relay default; capped by the relay)", "CONN_MAX_LIFETIME")
+	utils.IntFlagEnv(fs, &flags.drainTimeout, "drain-timeout", 0, parseNonNegativeInt, "Seconds the relay keeps a public connection open after one side half-closed (0=relay default; capped by the relay)", "CONN_DRAIN_TIMEOUT")
+	utils.RepeatedStringFlag(fs, &flags.allowCIDRs, "allow-cidr", "Client IP or CIDR range the relay admits to this service; all others are dropped once one is set (repeatable)")
+	utils.RepeatedStringFlag(fs, &flags.denyCIDRs, "deny-cidr", "Client IP or CIDR range the relay drops before reaching this service; overrides --allow-cidr (repeatable)")
 
 	if err := utils.ParseFlagSet(fs, args, printExposeUsage); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
@@ -94,6 +133,40 @@ func runExposeCommand(args []string) error {
 	case len(flags.httpRoutes) > 0 && flags.udp:
 		printExposeUsage(os.Stderr)
 		return errors.New("--udp cannot be combined with --http-route")
+	case len(flags.httpRoutes) > 0 && flags.proxyProto != "":
+		printExposeUsage(os.Stderr)
+		return errors.New("--proxy-protocol cannot be combined with --http-route")
+	case len(flags.httpRoutes) > 0 && len(flags.ports) > 0:
+		printExposeUsage(os.Stderr)
+		return errors.New("--port cannot be combined with --http-route")
+	}
+	portSpecs, err := parsePortSpecs(flags.ports)
+	if err != nil {
+		printExposeUsage(os.Stderr)
+		return err
+	}
+	if flags.udpProxy && !flags.udp && !hasUDPPortSpec(portSpecs) {
+		printExposeUsage(os.Stderr)
+		return errors.New("--udp-proxy-protocol requires --udp or a udp --port")
+	}
+	ports, portSpecs := portRequests(portSpecs, flags.tcp, flags.udp)
+	proxyVersion, err := parseProxyProtocolVersion(flags.proxyProto)
+	if err != nil {
+		printExposeUsage(os.Stderr)
+		return err
+	}
+	domainCerts, err := loadCustomDomainCertificates(flags.domainCert, flags.domainKey)
+	if err != nil {
+		printExposeUsage(os.Stderr)
+		return err
+	}
+	if !types.IsReplicaPolicy(flags.policy) {
+		printExposeUsage(os.Stderr)
+		return fmt.Errorf("unknown --replica-policy %q", flags.policy)
+	}
+	if !types.IsStreamTransport(flags.transport) {
+		printExposeUsage(os.Stderr)
+		return fmt.Errorf("unknown --stream-transport %q", flags.transport)
 	}
 	ctx, stop := utils.SignalContext()
 	defer stop()
@@ -109,6 +182,28 @@ func runExposeCommand(args []string) error {
 		TCPEnabled:   flags.tcp,
 		BanMITM:      flags.banMITM,
 		Discovery:    flags.discovery,
+
+		ProxyProtocol: proxyVersion != 0,
+		Multiplex:     flags.multiplex,
+
+		Aliases:                  flags.aliases,
+		Wildcard:                 flags.wildcard,
+		CustomDomains:            flags.domains,
+		CustomDomainCertificates: domainCerts,
+		InstanceID:               flags.instanceID,
+		ReplicaWeight:            flags.weight,
+		ReplicaPolicy:            flags.policy,
+		StreamTransport:          flags.transport,
+		Ports:                    ports,
+		ConnTimeouts: types.ConnTimeouts{
+			IdleSeconds:     flags.idleTimeout,
+			LifetimeSeconds: flags.lifetime,
+			DrainSeconds:    flags.drainTimeout,
+		},
+		Ingress: types.IngressRules{
+			Allow: flags.allowCIDRs,
+			Deny:  flags.denyCIDRs,
+		},
 		Metadata: types.LeaseMetadata{
 			Description: flags.desc,
 			Tags:        utils.SplitCSV(flags.tags),
@@ -129,7 +224,21 @@ func runExposeCommand(args []string) error {
 		defer exposure.Close()
 		return exposure.RunHTTP(ctx, handler, "")
 	}
-	return proxyExposure(ctx, exposure)
+	return proxyExposure(ctx, exposure, proxyVersion, flags.udpProxy, portSpecs)
+}
+
+func loadCustomDomainCertificates(certFile, keyFile string) ([]tls.Certificate, error) {
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("--custom-domain-cert and --custom-domain-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load custom domain certificate: %w", err)
+	}
+	return []tls.Certificate{cert}, nil
 }
 
 type listFlags struct {
@@ -203,6 +312,14 @@ func printExposeUsage(w io.Writer) {
 			"portal expose --http-route /api=http://127.0.0.1:3001 --http-route /=http://127.0.0.1:5173 --name my-app",
 			"portal expose 3000 --udp --udp-addr 127.0.0.1:5353",
 			"portal expose 3000 --ban-mitm",
+			"portal expose 3000 --tcp --proxy-protocol v2",
+			"portal expose 3000 --udp --udp-proxy-protocol",
+			"portal expose 25565 --tcp --port udp:19132=19132 --port tcp:25575=25575",
+			"portal expose 3000 --name my-app --alias my-app-staging --wildcard",
+			"portal expose 3000 --custom-domain shop.example.com",
+			"portal expose 3000 --name my-app --instance-id replica-1 --replica-policy least_ready",
+			"portal expose 3000 --multiplex",
+			"portal expose 3000 --stream-transport quic",
 			"portal expose 3000 --relays https://portal.example.com --discovery=false",
 		},
 	)
@@ -219,3 +336,11 @@ func printListUsage(w io.Writer) {
 		},
 	)
 }
+
+func parseNonNegativeInt(raw string, fallback int) int {
+	weight, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || weight < 0 {
+		return fallback
+	}
+	return weight
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+// portSpec is one --port mapping: the public port requested from the relay
+// and the local target its traffic is forwarded to. An empty target means
+// the default target of the protocol.
+type portSpec struct {
+	request types.PortRequest
+	target  string
+}
+
+// parsePortSpecs parses --port values of the form PROTO[:PUBLIC]=TARGET,
+// where PUBLIC is the preferred public port and TARGET is host:port or port
+// only.
+func parsePortSpecs(rawPorts []string) ([]portSpec, error) {
+	specs := make([]portSpec, 0, len(rawPorts))
+	for _, raw := range rawPorts {
+		spec, err := parsePortSpec(raw)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func parsePortSpec(raw string) (portSpec, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return portSpec{}, errors.New("--port: expected PROTO[:PUBLIC]=TARGET")
+	}
+
+	publicRaw, targetRaw, ok := strings.Cut(raw, "=")
+	if !ok {
+		return portSpec{}, fmt.Errorf("--port %q: expected PROTO[:PUBLIC]=TARGET", raw)
+	}
+	protocol, preferredRaw, hasPreferred := strings.Cut(strings.ToLower(strings.TrimSpace(publicRaw)), ":")
+	if protocol != types.PortProtocolTCP && protocol != types.PortProtocolUDP {
+		return portSpec{}, fmt.Errorf("--port %q: protocol must be tcp or udp", raw)
+	}
+
+	spec := portSpec{request: types.PortRequest{Protocol: protocol}}
+	if hasPreferred {
+		spec.request.Port = utils.ParsePortNumber(preferredRaw, 0)
+		if spec.request.Port == 0 {
+			return portSpec{}, fmt.Errorf("--port %q: invalid public port %q", raw, preferredRaw)
+		}
+	}
+
+	target, err := utils.NormalizeLoopbackTarget(targetRaw)
+	if err != nil || target == "" {
+		return portSpec{}, fmt.Errorf("--port %q: invalid target %q", raw, targetRaw)
+	}
+	spec.target = target
+	return spec, nil
+}
+
+// portRequests lists the port requests of specs after the default ports
+// that --tcp and --udp ask for, so the defaults keep the first positions.
+func portRequests(specs []portSpec, tcp, udp bool) ([]types.PortRequest, []portSpec) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	var all []portSpec
+	if tcp {
+		all = append(all, portSpec{request: types.PortRequest{Protocol: types.PortProtocolTCP}})
+	}
+	if udp {
+		all = append(all, portSpec{request: types.PortRequest{Protocol: types.PortProtocolUDP}})
+	}
+	all = append(all, specs...)
+
+	requests := make([]types.PortRequest, len(all))
+	for i, spec := range all {
+		requests[i] = spec.request
+	}
+	return requests, all
+}
+
+func hasUDPPortSpec(specs []portSpec) bool {
+	for _, spec := range specs {
+		if spec.request.Protocol == types.PortProtocolUDP {
+			return true
+		}
+	}
+	return false
+}
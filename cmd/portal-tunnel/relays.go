@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,9 +16,13 @@ import (
 
 	"github.com/gosuda/portal/v2/sdk"
 	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
 )
 
-func proxyExposure(ctx context.Context, exposure *sdk.Exposure) error {
+// proxyExposure forwards the exposure to its local targets. ports lists the
+// relay ports in RegisterResponse.Ports order; traffic on a port without a
+// target of its own goes to the default target of its protocol.
+func proxyExposure(ctx context.Context, exposure *sdk.Exposure, proxyVersion int, udpProxy bool, ports []portSpec) error {
 	defer exposure.Close()
 	if len(exposure.ActiveRelayURLs()) == 0 {
 		return errors.New("no relay URLs provided")
@@ -26,6 +32,23 @@ func proxyExposure(ctx context.Context, exposure *sdk.Exposure) error {
 	tcpTarget := exposure.TargetAddr
 	udpTarget := exposure.UDPAddr
 	udpEnabled := udpTarget != ""
+	tcpTargets := make([]string, len(ports))
+	udpTargets := make([]string, len(ports))
+	for i, spec := range ports {
+		target := spec.target
+		if spec.request.Protocol == types.PortProtocolUDP {
+			target = utils.StringOrDefault(target, udpTarget)
+			udpTargets[i] = target
+		} else {
+			target = utils.StringOrDefault(target, tcpTarget)
+			tcpTargets[i] = target
+		}
+		log.Info().
+			Str("protocol", spec.request.Protocol).
+			Int("preferred_port", spec.request.Port).
+			Str("target", target).
+			Msg("relay port requested")
+	}
 
 	log.Info().
 		Str("release_version", types.ReleaseVersion).
@@ -47,7 +70,7 @@ func proxyExposure(ctx context.Context, exposure *sdk.Exposure) error {
 	if udpEnabled {
 		udpErrCh = make(chan error, 1)
 		go func() {
-			if err := runUDPProxy(ctx, exposure, udpTarget); err != nil && ctx.Err() == nil {
+			if err := runUDPProxy(ctx, exposure, udpTarget, udpTargets, udpProxy); err != nil && ctx.Err() == nil {
 				udpErrCh <- err
 				_ = exposure.Close()
 			}
@@ -59,7 +82,7 @@ func proxyExposure(ctx context.Context, exposure *sdk.Exposure) error {
 		_ = exposure.Close()
 	}()
 
-	waitErr := proxyRelayConnections(ctx, exposure, tcpTarget, &connWG, &connCount)
+	waitErr := proxyRelayConnections(ctx, exposure, tcpTarget, tcpTargets, proxyVersion, &connWG, &connCount)
 	if waitErr != nil {
 		_ = exposure.Close()
 	}
@@ -103,7 +126,7 @@ func proxyExposure(ctx context.Context, exposure *sdk.Exposure) error {
 	return errors.Join(waitErr, udpErr, closeErr)
 }
 
-func proxyRelayConnections(ctx context.Context, exposure *sdk.Exposure, localAddr string, connWG *sync.WaitGroup, connCount *atomic.Int64) error {
+func proxyRelayConnections(ctx context.Context, exposure *sdk.Exposure, localAddr string, portTargets []string, proxyVersion int, connWG *sync.WaitGroup, connCount *atomic.Int64) error {
 	for {
 		relayConn, err := exposure.Accept()
 		if err != nil {
@@ -117,16 +140,21 @@ func proxyRelayConnections(ctx context.Context, exposure *sdk.Exposure, localAdd
 			}
 		}
 
+		target := localAddr
+		if index, ok := sdk.PortIndex(relayConn); ok && index < len(portTargets) && portTargets[index] != "" {
+			target = portTargets[index]
+		}
 		connID := connCount.Add(1)
 		log.Info().
 			Int64("conn_id", connID).
 			Str("remote_addr", relayConn.RemoteAddr().String()).
+			Str("target", target).
 			Msg("accepted relay connection")
 
 		connWG.Add(1)
 		go func(connID int64, relayConn net.Conn) {
 			defer connWG.Done()
-			if err := proxyConnection(ctx, localAddr, relayConn); err != nil {
+			if err := proxyConnection(ctx, target, proxyVersion, relayConn); err != nil {
 				log.Debug().Err(err).Int64("conn_id", connID).Msg("proxy connection closed with an I/O error")
 			}
 			log.Info().Int64("conn_id", connID).Msg("proxy connection closed")
@@ -141,7 +169,7 @@ var bufferPool = sync.Pool{
 	},
 }
 
-func proxyConnection(ctx context.Context, localAddr string, relayConn net.Conn) error {
+func proxyConnection(ctx context.Context, localAddr string, proxyVersion int, relayConn net.Conn) error {
 	defer relayConn.Close()
 
 	dialer := &net.Dialer{Timeout: 5 * time.Second}
@@ -151,6 +179,10 @@ func proxyConnection(ctx context.Context, localAddr string, relayConn net.Conn)
 	}
 	defer localConn.Close()
 
+	if err := writeProxyHeader(localConn, relayConn, proxyVersion); err != nil {
+		return err
+	}
+
 	errCh := make(chan error, 2)
 	stopCh := make(chan struct{})
 
@@ -195,6 +227,42 @@ func proxyConnection(ctx context.Context, localAddr string, relayConn net.Conn)
 	return firstErr
 }
 
+func parseProxyProtocolVersion(value string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "off":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("invalid --proxy-protocol value %q: want v1 or v2", value)
+	}
+}
+
+// writeProxyHeader forwards the client address the relay reported for
+// relayConn to the local target. Connections without a relay header get a
+// LOCAL/UNKNOWN header so the target can always expect one.
+func writeProxyHeader(localConn, relayConn net.Conn, proxyVersion int) error {
+	if proxyVersion == 0 {
+		return nil
+	}
+
+	header, _ := sdk.ProxyHeader(relayConn)
+	var encoded []byte
+	if proxyVersion == 1 {
+		encoded = types.EncodeProxyHeaderV1(header)
+	} else {
+		var err error
+		encoded, err = types.EncodeProxyHeaderV2(header)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := localConn.Write(encoded)
+	return err
+}
+
 func writeEmptyHTTPResponse(conn net.Conn) error {
 	htmlBody := `<!DOCTYPE html>
 <html>
@@ -215,8 +283,8 @@ func writeEmptyHTTPResponse(conn net.Conn) error {
 }
 
 // runUDPProxy waits for the exposure datagram plane and proxies it to the
-// configured local UDP target.
-func runUDPProxy(ctx context.Context, exposure *sdk.Exposure, udpTarget string) error {
+// configured local UDP targets.
+func runUDPProxy(ctx context.Context, exposure *sdk.Exposure, udpTarget string, portTargets []string, udpProxy bool) error {
 	udpAddrs, err := exposure.WaitDatagramReady(ctx)
 	if err != nil {
 		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
@@ -237,18 +305,29 @@ func runUDPProxy(ctx context.Context, exposure *sdk.Exposure, udpTarget string)
 			Msg("UDP tunnel ready")
 	}
 
-	return proxyExposureDatagrams(ctx, exposure, udpTarget)
+	return proxyExposureDatagrams(ctx, exposure, udpTarget, portTargets, udpProxy)
 }
 
 // proxyExposureDatagrams receives datagrams from the exposure datagram plane
-// and forwards them to the local UDP service, relaying responses back.
-func proxyExposureDatagrams(ctx context.Context, exposure *sdk.Exposure, localAddr string) error {
+// and forwards them to the local UDP service, relaying responses back. Flows
+// announced on a port with an entry in portTargets go to that target
+// instead. With udpProxy every datagram is prefixed with a PROXY v2 header.
+func proxyExposureDatagrams(ctx context.Context, exposure *sdk.Exposure, localAddr string, portTargets []string, udpProxy bool) error {
 	resolvedAddr, err := net.ResolveUDPAddr("udp", localAddr)
 	if err != nil {
 		return fmt.Errorf("resolve udp addr %q: %w", localAddr, err)
 	}
+	resolvedTargets := make([]*net.UDPAddr, len(portTargets))
+	for i, target := range portTargets {
+		if target == "" || target == localAddr {
+			continue
+		}
+		if resolvedTargets[i], err = net.ResolveUDPAddr("udp", target); err != nil {
+			return fmt.Errorf("resolve udp addr %q: %w", target, err)
+		}
+	}
 
-	mgr := newUDPFlowManager(resolvedAddr, exposure)
+	mgr := newUDPFlowManager(resolvedAddr, resolvedTargets, exposure)
 	go mgr.runCleanup(ctx)
 
 	log.Info().Str("target", localAddr).Msg("udp proxy loop started, waiting for datagrams")
@@ -270,6 +349,7 @@ func proxyExposureDatagrams(ctx context.Context, exposure *sdk.Exposure, localAd
 			Str("address", frame.Address).
 			Str("relay_url", frame.RelayURL).
 			Str("udp_addr", frame.UDPAddr).
+			Stringer("source", frame.Source).
 			Str("target", localAddr).
 			Msg("datagram received from relay, forwarding to local")
 
@@ -284,7 +364,20 @@ func proxyExposureDatagrams(ctx context.Context, exposure *sdk.Exposure, localAd
 			continue
 		}
 
-		if _, err := localConn.Write(frame.Payload); err != nil {
+		payload := frame.Payload
+		if udpProxy {
+			header, err := types.EncodeProxyHeaderV2(datagramProxyHeader(frame))
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Uint32("flow_id", frame.FlowID).
+					Msg("encode udp proxy header failed")
+				continue
+			}
+			payload = append(header, payload...)
+		}
+
+		if _, err := localConn.Write(payload); err != nil {
 			log.Warn().
 				Err(err).
 				Uint32("flow_id", frame.FlowID).
@@ -297,6 +390,26 @@ func proxyExposureDatagrams(ctx context.Context, exposure *sdk.Exposure, localAd
 	return nil
 }
 
+// datagramProxyHeader describes the relay client of frame. The destination
+// is the relay's public UDP port on the unspecified address of the client's
+// family; frames whose flow has not been announced get a LOCAL header.
+func datagramProxyHeader(frame types.DatagramFrame) types.ProxyHeader {
+	if frame.Source == nil {
+		return types.ProxyHeader{}
+	}
+	destination := &net.UDPAddr{IP: net.IPv4zero}
+	if frame.Source.IP.To4() == nil {
+		destination.IP = net.IPv6unspecified
+	}
+	if _, port, err := net.SplitHostPort(frame.UDPAddr); err == nil {
+		destination.Port, _ = strconv.Atoi(port)
+	}
+	return types.ProxyHeader{
+		Source:      frame.Source,
+		Destination: destination,
+	}
+}
+
 type udpFlowKey struct {
 	flowID   uint32
 	address  string
@@ -310,17 +423,19 @@ type udpFlowEntry struct {
 }
 
 type udpFlowManager struct {
-	target   *net.UDPAddr
-	exposure *sdk.Exposure
-	mu       sync.Mutex
-	flows    map[udpFlowKey]*udpFlowEntry
+	target      *net.UDPAddr
+	portTargets []*net.UDPAddr
+	exposure    *sdk.Exposure
+	mu          sync.Mutex
+	flows       map[udpFlowKey]*udpFlowEntry
 }
 
-func newUDPFlowManager(target *net.UDPAddr, exposure *sdk.Exposure) *udpFlowManager {
+func newUDPFlowManager(target *net.UDPAddr, portTargets []*net.UDPAddr, exposure *sdk.Exposure) *udpFlowManager {
 	return &udpFlowManager{
-		target:   target,
-		exposure: exposure,
-		flows:    make(map[udpFlowKey]*udpFlowEntry),
+		target:      target,
+		portTargets: portTargets,
+		exposure:    exposure,
+		flows:       make(map[udpFlowKey]*udpFlowEntry),
 	}
 }
 
@@ -360,7 +475,11 @@ func (m *udpFlowManager) getOrCreate(ctx context.Context, frame types.DatagramFr
 	}
 	m.mu.Unlock()
 
-	localConn, err := net.DialUDP("udp", nil, m.target)
+	target := m.target
+	if frame.PortIndex < len(m.portTargets) && m.portTargets[frame.PortIndex] != nil {
+		target = m.portTargets[frame.PortIndex]
+	}
+	localConn, err := net.DialUDP("udp", nil, target)
 	if err != nil {
 		return nil, err
 	}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"crypto/subtle"
+	"encoding/json"
 	"errors"
-	"net"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/gosuda/portal/v2/portal/accesslog"
+	"github.com/gosuda/portal/v2/portal/auth"
 	"github.com/gosuda/portal/v2/portal/policy"
 	"github.com/gosuda/portal/v2/types"
 	"github.com/gosuda/portal/v2/utils"
@@ -19,15 +26,36 @@ import (
 const (
 	cookieName     = "portal_admin"
 	adminBodyLimit = 1 << 16
+
+	adminLoginChallengeTTL  = 5 * time.Minute
+	maxAdminLoginChallenges = 256
+
+	maxEvictCooldownSeconds = 30 * 24 * 60 * 60
+
+	defaultAccessLogLimit = 100
+	maxAccessLogLimit     = 10000
+	accessLogHeartbeat    = 15 * time.Second
 )
 
+var errNotAdminOperator = errors.New("address is not an admin operator")
+
+// adminSession is a logged-in admin. Address is the SIWE operator address,
+// or empty for a login with the admin secret key when no operators are set.
+type adminSession struct {
+	expiresAt time.Time
+	address   string
+}
+
 type adminAuth struct {
-	sessions  map[string]time.Time
-	secretKey string
-	mu        sync.RWMutex
+	sessions   map[string]adminSession
+	tokens     map[string]types.AdminToken
+	challenges map[string]*auth.AdminLoginChallenge
+	operators  map[string]string
+	secretKey  string
+	mu         sync.RWMutex
 }
 
-func newAdminAuth(secretKey string) *adminAuth {
+func newAdminAuth(secretKey string, operators map[string]string) *adminAuth {
 	secretKey = strings.TrimSpace(secretKey)
 	if secretKey == "" {
 		generated, err := utils.RandomHex(16)
@@ -41,15 +69,46 @@ func newAdminAuth(secretKey string) *adminAuth {
 	}
 
 	return &adminAuth{
-		secretKey: secretKey,
-		sessions:  make(map[string]time.Time),
+		secretKey:  secretKey,
+		sessions:   make(map[string]adminSession),
+		tokens:     make(map[string]types.AdminToken),
+		challenges: make(map[string]*auth.AdminLoginChallenge),
+		operators:  operators,
+	}
+}
+
+// parseAdminOperators parses comma-separated ADDRESS=ROLE entries.
+func parseAdminOperators(raw string) (map[string]string, error) {
+	operators := make(map[string]string)
+	for _, entry := range utils.SplitCSV(raw) {
+		rawAddress, role, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("admin operator %q: expected ADDRESS=ROLE", entry)
+		}
+		address, err := utils.NormalizeEVMAddress(rawAddress)
+		if err != nil {
+			return nil, fmt.Errorf("admin operator %q: %w", entry, err)
+		}
+		role = strings.ToLower(strings.TrimSpace(role))
+		if _, ok := adminRoleScopes[role]; !ok {
+			return nil, fmt.Errorf("admin operator %q: role must be viewer, moderator or owner", entry)
+		}
+		operators[address] = role
 	}
+	return operators, nil
 }
 
 func (a *adminAuth) AuthEnabled() bool {
 	return a != nil && a.secretKey != ""
 }
 
+// KeyLoginEnabled reports whether an admin session may be opened with the
+// secret key. Once operators are configured every session must carry an
+// operator address, so only SIWE login remains.
+func (a *adminAuth) KeyLoginEnabled() bool {
+	return a.AuthEnabled() && len(a.operators) == 0
+}
+
 func (a *adminAuth) ValidateKey(key string) bool {
 	if !a.AuthEnabled() {
 		return false
@@ -57,7 +116,68 @@ func (a *adminAuth) ValidateKey(key string) bool {
 	return subtle.ConstantTimeCompare([]byte(a.secretKey), []byte(key)) == 1
 }
 
-func (a *adminAuth) CreateSession() (string, error) {
+// OperatorRole returns the role of a SIWE operator address, or "" when the
+// address is not an operator.
+func (a *adminAuth) OperatorRole(address string) string {
+	return a.operators[address]
+}
+
+// IssueLoginChallenge creates the SIWE message an operator signs to log in.
+func (a *adminAuth) IssueLoginChallenge(address, domain, uri string) (*auth.AdminLoginChallenge, error) {
+	now := time.Now().UTC()
+	challenge, err := auth.NewAdminLoginChallenge(address, domain, uri, now, adminLoginChallengeTTL)
+	if err != nil {
+		return nil, err
+	}
+	if a.OperatorRole(challenge.Address) == "" {
+		return nil, errNotAdminOperator
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, pending := range a.challenges {
+		if pending.Expired(now) {
+			delete(a.challenges, id)
+		}
+	}
+	if len(a.challenges) >= maxAdminLoginChallenges {
+		return nil, errors.New("too many pending admin login challenges")
+	}
+	a.challenges[challenge.ChallengeID] = challenge
+	return challenge, nil
+}
+
+// ConsumeLoginChallenge verifies a signed login challenge and returns the
+// operator address it was issued for. A challenge can be used once.
+func (a *adminAuth) ConsumeLoginChallenge(challengeID, message, signature string) (string, error) {
+	now := time.Now().UTC()
+	a.mu.Lock()
+	challenge := a.challenges[strings.TrimSpace(challengeID)]
+	if challenge == nil {
+		a.mu.Unlock()
+		return "", auth.ErrChallengeNotFound
+	}
+	if challenge.Expired(now) {
+		delete(a.challenges, challenge.ChallengeID)
+		a.mu.Unlock()
+		return "", auth.ErrChallengeExpired
+	}
+	if err := challenge.Verify(message, signature, now); err != nil {
+		a.mu.Unlock()
+		return "", err
+	}
+	delete(a.challenges, challenge.ChallengeID)
+	a.mu.Unlock()
+
+	if a.OperatorRole(challenge.Address) == "" {
+		return "", errNotAdminOperator
+	}
+	return challenge.Address, nil
+}
+
+// CreateSession opens a 24h admin session for the operator address, or for
+// the admin secret key when address is empty.
+func (a *adminAuth) CreateSession(address string) (string, error) {
 	token, err := utils.RandomHex(32)
 	if err != nil {
 		return "", err
@@ -65,21 +185,24 @@ func (a *adminAuth) CreateSession() (string, error) {
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	a.sessions[token] = time.Now().Add(24 * time.Hour)
+	a.sessions[token] = adminSession{expiresAt: time.Now().Add(24 * time.Hour), address: address}
 	a.cleanupExpiredSessionsLocked()
 	return token, nil
 }
 
-func (a *adminAuth) ValidateSession(token string) bool {
+func (a *adminAuth) ValidateSession(token string) (adminSession, bool) {
 	if token == "" {
-		return false
+		return adminSession{}, false
 	}
 
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
-	expiry, ok := a.sessions[token]
-	return ok && time.Now().Before(expiry)
+	session, ok := a.sessions[token]
+	if !ok || !time.Now().Before(session.expiresAt) {
+		return adminSession{}, false
+	}
+	return session, true
 }
 
 func (a *adminAuth) DeleteSession(token string) {
@@ -90,13 +213,58 @@ func (a *adminAuth) DeleteSession(token string) {
 
 func (a *adminAuth) cleanupExpiredSessionsLocked() {
 	now := time.Now()
-	for token, expiry := range a.sessions {
-		if now.After(expiry) {
+	for token, session := range a.sessions {
+		if now.After(session.expiresAt) {
 			delete(a.sessions, token)
 		}
 	}
 }
 
+// adminRoleScopes lists the API token scopes each operator role holds.
+// Requests that need no scope, such as token management, are owner-only.
+var adminRoleScopes = map[string][]string{
+	types.AdminRoleViewer:    {types.AdminScopeRead},
+	types.AdminRoleModerator: {types.AdminScopeRead, types.AdminScopeLeases, types.AdminScopeIPs},
+	types.AdminRoleOwner:     adminTokenScopes,
+}
+
+// adminPrincipal is who an admin request acts as: a logged-in operator with
+// a role, or an API token with the scopes it was created with. A login with
+// the admin secret key, allowed only while no operators are configured, acts
+// as an owner without an address.
+type adminPrincipal struct {
+	address string
+	role    string
+	token   *types.AdminToken
+}
+
+func (p adminPrincipal) allows(scope string) bool {
+	if p.token != nil {
+		return scope != "" && slices.Contains(p.token.Scopes, scope)
+	}
+	if p.role == types.AdminRoleOwner {
+		return true
+	}
+	return scope != "" && slices.Contains(adminRoleScopes[p.role], scope)
+}
+
+// adminScopeFor returns the scope an admin request needs, or "" when only an
+// owner session may make it.
+func adminScopeFor(path, method string) string {
+	switch {
+	case path == types.PathAdminTokens || strings.HasPrefix(path, types.PathAdminTokensPrefix):
+		return ""
+	case method == http.MethodGet || method == http.MethodHead:
+		return types.AdminScopeRead
+	case strings.HasPrefix(path, types.PathAdminLeasesPrefix):
+		return types.AdminScopeLeases
+	case strings.HasPrefix(path, types.PathAdminIPsPrefix):
+		return types.AdminScopeIPs
+	default:
+		return types.AdminScopeSettings
+	}
+}
+
 func loadAdminState(path string, runtime *policy.Runtime) (persistedAdminState, error) {
 	path = strings.TrimSpace(path)
 	if path == "" {
@@ -138,6 +306,9 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 		}
 		utils.MethodNotAllowedError().Write(w)
 		return
+	case types.PathAdminLoginSIWE:
+		f.handleLoginChallenge(w, r)
+		return
 	case types.PathAdminLogout:
 		if !utils.RequireMethod(w, r, http.MethodPost) {
 			return
@@ -160,17 +331,26 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 		if !utils.RequireMethod(w, r, http.MethodGet) {
 			return
 		}
+		principal, ok := f.authorize(r)
 		utils.WriteAPIData(w, http.StatusOK, types.AdminAuthStatusResponse{
-			Authenticated: f.isAuthenticated(r),
-			AuthEnabled:   f.auth.AuthEnabled(),
+			Authenticated:   ok,
+			AuthEnabled:     f.auth.AuthEnabled(),
+			KeyLoginEnabled: f.auth.KeyLoginEnabled(),
+			Address:         principal.address,
+			Role:            principal.role,
 		})
 		return
 	}
 
-	if !f.isAuthenticated(r) {
+	principal, ok := f.authorize(r)
+	if !ok {
 		utils.WriteAPIError(w, http.StatusUnauthorized, types.APIErrorCodeUnauthorized, "unauthorized")
 		return
 	}
+	if !principal.allows(adminScopeFor(path, r.Method)) {
+		utils.WriteAPIError(w, http.StatusForbidden, types.APIErrorCodeForbidden, "not permitted for this admin role or token")
+		return
+	}
 
 	runtime := f.server.PolicyRuntime()
 	methodNotAllowed := utils.MethodNotAllowedError()
@@ -193,6 +373,9 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 				Enabled:   runtime.IsTCPPortEnabled(),
 				MaxLeases: runtime.TCPPortMaxLeases(),
 			},
+			ConnLimits: runtime.ConnLimiter().Defaults(),
+			Quotas:     runtime.Quotas().Defaults(),
+			IPRules:    adminIPRules(runtime),
 		})
 	case types.PathAdminLandingPage:
 		if !utils.RequireMethod(w, r, http.MethodPost) {
@@ -202,25 +385,80 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 		if !ok {
 			return
 		}
+		previous := f.isLandingPageEnabled()
 		f.setLandingPageEnabled(req.Enabled)
-		saveAdminState(f.adminSettingsPath, runtime, f.isLandingPageEnabled())
+		f.saveAdminState()
+		f.audit(r, principal, "settings.landing-page", "", previous, req.Enabled)
 		utils.WriteAPIData(w, http.StatusOK, types.AdminLandingPageSettingsResponse{
 			Enabled: f.isLandingPageEnabled(),
 		})
 	case types.PathAdminUDP:
-		f.handlePortSettings(w, r, invalidRequestBody, runtime,
+		f.handlePortSettings(w, r, principal, "settings.udp", invalidRequestBody,
 			runtime.SetUDPPolicy,
 			func() any {
 				return types.AdminUDPSettingsResponse{Enabled: runtime.IsUDPEnabled(), MaxLeases: runtime.UDPMaxLeases()}
 			},
 		)
 	case types.PathAdminTCPPort:
-		f.handlePortSettings(w, r, invalidRequestBody, runtime,
+		f.handlePortSettings(w, r, principal, "settings.tcp-port", invalidRequestBody,
 			runtime.SetTCPPortPolicy,
 			func() any {
 				return types.AdminTCPPortSettingsResponse{Enabled: runtime.IsTCPPortEnabled(), MaxLeases: runtime.TCPPortMaxLeases()}
 			},
 		)
+	case types.PathAdminConnLimits:
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			req, ok := utils.DecodeJSONRequestAs[types.ConnLimits](w, r, adminBodyLimit, invalidRequestBody)
+			if !ok {
+				return
+			}
+			previous := runtime.ConnLimiter().Defaults()
+			runtime.ConnLimiter().SetDefaults(req)
+			f.saveAdminState()
+			f.audit(r, principal, "settings.conn-limits", "", previous, runtime.ConnLimiter().Defaults())
+		default:
+			methodNotAllowed.Write(w)
+			return
+		}
+		utils.WriteAPIData(w, http.StatusOK, runtime.ConnLimiter().Defaults())
+	case types.PathAdminQuotaLimits:
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			req, ok := utils.DecodeJSONRequestAs[types.QuotaLimits](w, r, adminBodyLimit, invalidRequestBody)
+			if !ok {
+				return
+			}
+			previous := runtime.Quotas().Defaults()
+			runtime.Quotas().SetDefaults(req)
+			f.saveAdminState()
+			f.audit(r, principal, "settings.quotas", "", previous, runtime.Quotas().Defaults())
+		default:
+			methodNotAllowed.Write(w)
+			return
+		}
+		utils.WriteAPIData(w, http.StatusOK, runtime.Quotas().Defaults())
+	case types.PathAdminQuotas:
+		if !utils.RequireMethod(w, r, http.MethodGet) {
+			return
+		}
+		utils.WriteAPIData(w, http.StatusOK, types.AdminQuotasResponse{
+			Defaults: runtime.Quotas().Defaults(),
+			Usage:    f.server.QuotaUsage(),
+		})
+	case types.PathAdminIPs:
+		if !utils.RequireMethod(w, r, http.MethodGet) {
+			return
+		}
+		utils.WriteAPIData(w, http.StatusOK, adminIPRules(runtime))
+	case types.PathAdminAccessLog:
+		f.handleAccessLog(w, r)
+	case types.PathAdminAudit:
+		f.handleAudit(w, r)
+	case types.PathAdminTokens:
+		f.handleAdminTokens(w, r, principal, path, invalidRequestBody)
 	case types.PathAdminApproval:
 		if !utils.RequireMethod(w, r, http.MethodPost) {
 			return
@@ -229,11 +467,13 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 		if !ok {
 			return
 		}
+		previous := string(runtime.Approver().Mode())
 		if err := runtime.Approver().SetMode(policy.Mode(strings.TrimSpace(req.Mode))); err != nil {
 			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidMode, "invalid mode (must be 'auto' or 'manual')")
 			return
 		}
-		saveAdminState(f.adminSettingsPath, runtime, f.isLandingPageEnabled())
+		f.saveAdminState()
+		f.audit(r, principal, "settings.approval-mode", "", previous, string(runtime.Approver().Mode()))
 		utils.WriteAPIData(w, http.StatusOK, types.AdminApprovalModeResponse{
 			ApprovalMode: string(runtime.Approver().Mode()),
 		})
@@ -292,6 +532,21 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 					},
 					delete: func() { runtime.BPSManager().DeleteIdentityBPS(identityKey) },
 				},
+				"conn-limits": {
+					post: func() bool {
+						req, ok := utils.DecodeJSONRequestAs[types.ConnLimits](w, r, adminBodyLimit, invalidRequestBody)
+						if !ok {
+							return true
+						}
+						if req.MaxPerLease <= 0 && req.RatePerIP <= 0 {
+							utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "max_per_lease or rate_per_ip must be greater than zero")
+							return true
+						}
+						runtime.ConnLimiter().SetOverride(identityKey, req)
+						return false
+					},
+					delete: func() { runtime.ConnLimiter().DeleteOverride(identityKey) },
+				},
 				"approve": {
 					post:   func() bool { approver.Approve(identityKey); approver.Undeny(identityKey); return false },
 					delete: func() { approver.Revoke(identityKey) },
@@ -300,6 +555,26 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 					post:   func() bool { approver.Deny(identityKey); return false },
 					delete: func() { approver.Undeny(identityKey) },
 				},
+				"evict": {
+					post: func() bool {
+						// The body is optional; an empty one evicts without a cooldown.
+						var req types.AdminEvictRequest
+						if r.ContentLength != 0 {
+							decoded, ok := utils.DecodeJSONRequestAs[types.AdminEvictRequest](w, r, adminBodyLimit, invalidRequestBody)
+							if !ok {
+								return true
+							}
+							req = decoded
+						}
+						if req.CooldownSeconds < 0 || req.CooldownSeconds > maxEvictCooldownSeconds {
+							utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, fmt.Sprintf("cooldown_seconds must be between 0 and %d", maxEvictCooldownSeconds))
+							return true
+						}
+						f.server.EvictLease(identityKey, time.Duration(req.CooldownSeconds)*time.Second)
+						return false
+					},
+					delete: func() { f.server.ClearLeaseEviction(identityKey) },
+				},
 			}
 
 			action, ok := actions[parts[2]]
@@ -307,6 +582,8 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 				http.NotFound(w, r)
 				return
 			}
+			previous := adminLeaseAuditState(f.server, identityKey)
+			auditAction := "lease." + parts[2]
 			switch r.Method {
 			case http.MethodPost:
 				if action.post() {
@@ -314,43 +591,73 @@ func (f *Frontend) serveAdmin(w http.ResponseWriter, r *http.Request) {
 				}
 			case http.MethodDelete:
 				action.delete()
+				auditAction += ".delete"
 			default:
 				methodNotAllowed.Write(w)
 				return
 			}
-			saveAdminState(f.adminSettingsPath, runtime, f.isLandingPageEnabled())
+			f.saveAdminState()
+			f.audit(r, principal, auditAction, identityKey, previous, adminLeaseAuditState(f.server, identityKey))
 			utils.WriteAPIData(w, http.StatusOK, map[string]any{})
 		case strings.HasPrefix(path, types.PathAdminIPsPrefix):
-			if !strings.HasSuffix(path, "/ban") {
+			// The entry may be a CIDR range, so it can contain a slash:
+			// /admin/ips/10.0.0.0/8/ban.
+			rest := strings.TrimPrefix(path, types.PathAdminIPsPrefix)
+			cut := strings.LastIndex(rest, "/")
+			if cut < 0 {
 				http.NotFound(w, r)
 				return
 			}
+			rawIP, kind := rest[:cut], rest[cut+1:]
 
-			rawIP := strings.TrimSuffix(strings.TrimPrefix(path, types.PathAdminIPsPrefix), "/ban")
-			rawIP = strings.Trim(rawIP, "/")
-			if net.ParseIP(rawIP) == nil {
-				utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidIP, "invalid IP address")
+			filter := runtime.IPFilter()
+			lists := map[string]struct{ add, remove func(string) }{
+				"ban":  {filter.BanIP, filter.UnbanIP},
+				"deny": {filter.DenyIngress, filter.UndenyIngress},
+			}
+			list, ok := lists[kind]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			entry, _, ok := utils.ParseIPRule(rawIP)
+			if !ok {
+				utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidIP, "invalid IP address or CIDR range")
 				return
 			}
 
-			filter := runtime.IPFilter()
+			previous := adminIPAuditState(filter, entry)
+			auditAction := "ip." + kind
 			switch r.Method {
 			case http.MethodPost:
-				filter.BanIP(rawIP)
+				list.add(entry)
 			case http.MethodDelete:
-				filter.UnbanIP(rawIP)
+				list.remove(entry)
+				auditAction += ".delete"
 			default:
 				methodNotAllowed.Write(w)
 				return
 			}
-			saveAdminState(f.adminSettingsPath, runtime, f.isLandingPageEnabled())
+			f.saveAdminState()
+			f.audit(r, principal, auditAction, entry, previous, adminIPAuditState(filter, entry))
 			utils.WriteAPIData(w, http.StatusOK, map[string]any{})
+		case strings.HasPrefix(path, types.PathAdminQuotasPrefix):
+			f.handleQuotaOverride(w, r, principal, strings.TrimPrefix(path, types.PathAdminQuotasPrefix), invalidRequestBody)
+		case strings.HasPrefix(path, types.PathAdminTokensPrefix):
+			f.handleAdminTokens(w, r, principal, path, invalidRequestBody)
 		default:
 			http.NotFound(w, r)
 		}
 	}
 }
 
+func adminIPRules(runtime *policy.Runtime) types.AdminIPRulesResponse {
+	return types.AdminIPRulesResponse{
+		BannedIPs:   runtime.IPFilter().BannedIPs(),
+		IngressDeny: runtime.IPFilter().IngressDenyList(),
+	}
+}
+
 type portSettingsRequest struct {
 	Enabled   bool `json:"enabled"`
 	MaxLeases int  `json:"max_leases"`
@@ -359,8 +666,9 @@ type portSettingsRequest struct {
 func (f *Frontend) handlePortSettings(
 	w http.ResponseWriter,
 	r *http.Request,
+	principal adminPrincipal,
+	auditAction string,
 	invalidBody utils.APIErrorResponse,
-	runtime *policy.Runtime,
 	setPolicy func(bool, int),
 	buildResponse func() any,
 ) {
@@ -375,9 +683,153 @@ func (f *Frontend) handlePortSettings(
 		utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "max_leases must be non-negative")
 		return
 	}
+	previous := buildResponse()
 	setPolicy(req.Enabled, req.MaxLeases)
-	saveAdminState(f.adminSettingsPath, runtime, f.isLandingPageEnabled())
-	utils.WriteAPIData(w, http.StatusOK, buildResponse())
+	f.saveAdminState()
+	current := buildResponse()
+	f.audit(r, principal, auditAction, "", previous, current)
+	utils.WriteAPIData(w, http.StatusOK, current)
+}
+
+// handleQuotaOverride serves /admin/quotas/{address}: GET returns the usage
+// and limits of the address, POST replaces its quota override and DELETE
+// removes it.
+func (f *Frontend) handleQuotaOverride(
+	w http.ResponseWriter,
+	r *http.Request,
+	principal adminPrincipal,
+	rawAddress string,
+	invalidBody utils.APIErrorResponse,
+) {
+	address, err := utils.NormalizeEVMAddress(rawAddress)
+	if err != nil {
+		utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidAddress, "invalid address")
+		return
+	}
+	quotas := f.server.PolicyRuntime().Quotas()
+
+	auditAction := "quota.override"
+	previous := quotaOverrideAuditState(quotas, address)
+	switch r.Method {
+	case http.MethodGet:
+		utils.WriteAPIData(w, http.StatusOK, f.server.QuotaUsageOf(address))
+		return
+	case http.MethodPost:
+		req, ok := utils.DecodeJSONRequestAs[types.QuotaLimits](w, r, adminBodyLimit, invalidBody)
+		if !ok {
+			return
+		}
+		if req.MaxLeasesPerIP != 0 {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "max_leases_per_ip is relay-wide; set it via the quota defaults")
+			return
+		}
+		if req.Normalize().IsZero() {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "at least one quota limit must be greater than zero")
+			return
+		}
+		quotas.SetOverride(address, req)
+	case http.MethodDelete:
+		quotas.DeleteOverride(address)
+		auditAction += ".delete"
+	default:
+		utils.MethodNotAllowedError().Write(w)
+		return
+	}
+	f.saveAdminState()
+	f.audit(r, principal, auditAction, address, previous, quotaOverrideAuditState(quotas, address))
+	utils.WriteAPIData(w, http.StatusOK, f.server.QuotaUsageOf(address))
+}
+
+func quotaOverrideAuditState(quotas *policy.QuotaManager, address string) *types.QuotaLimits {
+	if override, ok := quotas.Override(address); ok {
+		return &override
+	}
+	return nil
+}
+
+// handleAccessLog returns recent access log entries, newest first, filtered by
+// the lease, hostname, client_ip, transport, since and limit query parameters.
+// With follow=1 or an event-stream Accept header it instead streams new
+// matching entries as server-sent events until the client disconnects.
+func (f *Frontend) handleAccessLog(w http.ResponseWriter, r *http.Request) {
+	if !utils.RequireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := accesslog.Filter{
+		LeaseKey:  strings.TrimSpace(query.Get("lease")),
+		Hostname:  utils.NormalizeHostname(query.Get("hostname")),
+		ClientIP:  strings.TrimSpace(query.Get("client_ip")),
+		Transport: strings.TrimSpace(query.Get("transport")),
+		Limit:     defaultAccessLogLimit,
+	}
+	if raw := strings.TrimSpace(query.Get("since")); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "since must be an RFC3339 timestamp")
+			return
+		}
+		filter.Since = since
+	}
+	if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		filter.Limit = min(limit, maxAccessLogLimit)
+	}
+
+	accessLog := f.server.AccessLog()
+	if query.Get("follow") != "1" && !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		utils.WriteAPIData(w, http.StatusOK, types.AdminAccessLogResponse{
+			Entries: accessLog.Query(filter),
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteAPIError(w, http.StatusInternalServerError, types.APIErrorCodeFeatureUnavailable, "streaming is not supported")
+		return
+	}
+	entries, cancel := accessLog.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(accessLogHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if !filter.Match(entry) {
+				continue
+			}
+			payload, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
 }
 
 func (f *Frontend) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -393,11 +845,22 @@ func (f *Frontend) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	if !f.auth.ValidateKey(req.Key) {
+	var address string
+	if strings.TrimSpace(req.ChallengeID) != "" {
+		var err error
+		address, err = f.auth.ConsumeLoginChallenge(req.ChallengeID, req.SIWEMessage, req.SIWESignature)
+		if err != nil {
+			utils.WriteAPIError(w, http.StatusUnauthorized, types.APIErrorCodeUnauthorized, "invalid admin login signature")
+			return
+		}
+	} else if !f.auth.KeyLoginEnabled() {
+		utils.WriteAPIError(w, http.StatusForbidden, types.APIErrorCodeForbidden, "secret key login is disabled while admin operators are configured; sign in with SIWE")
+		return
+	} else if !f.auth.ValidateKey(req.Key) {
 		utils.WriteAPIError(w, http.StatusUnauthorized, types.APIErrorCodeInvalidKey, "Invalid key")
 		return
 	}
-	token, err := f.auth.CreateSession()
+	token, err := f.auth.CreateSession(address)
 	if err != nil {
 		utils.WriteAPIError(w, http.StatusInternalServerError, types.APIErrorCodeSessionCreateFailed, "failed to create admin session")
 		return
@@ -415,56 +878,141 @@ func (f *Frontend) handleLogin(w http.ResponseWriter, r *http.Request) {
 	utils.WriteAPIData(w, http.StatusOK, types.AdminLoginResponse{Success: true})
 }
 
-func (f *Frontend) isAuthenticated(r *http.Request) bool {
+// handleLoginChallenge issues the SIWE message an admin operator signs and
+// posts back to /admin/login.
+func (f *Frontend) handleLoginChallenge(w http.ResponseWriter, r *http.Request) {
+	if !utils.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
 	if !f.auth.AuthEnabled() {
-		return false
+		utils.WriteAPIError(w, http.StatusServiceUnavailable, types.APIErrorCodeAuthDisabled, "admin authentication is not configured")
+		return
 	}
-	cookie, err := r.Cookie(cookieName)
-	if err != nil {
-		return false
+	req, ok := utils.DecodeJSONRequestAs[types.AdminLoginChallengeRequest](w, r, adminBodyLimit, utils.InvalidRequestError(errors.New("invalid request body")))
+	if !ok {
+		return
+	}
+
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
 	}
-	return f.auth.ValidateSession(cookie.Value)
+	domain := strings.TrimSpace(r.Host)
+	loginURI := (&url.URL{Scheme: scheme, Host: domain, Path: types.PathAdminLogin}).String()
+	challenge, err := f.auth.IssueLoginChallenge(req.Address, domain, loginURI)
+	switch {
+	case errors.Is(err, errNotAdminOperator):
+		utils.WriteAPIError(w, http.StatusUnauthorized, types.APIErrorCodeUnauthorized, err.Error())
+		return
+	case err != nil:
+		utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidAddress, err.Error())
+		return
+	}
+	utils.WriteAPIData(w, http.StatusOK, types.AdminLoginChallengeResponse{
+		ChallengeID: challenge.ChallengeID,
+		ExpiresAt:   challenge.ExpiresAt,
+		SIWEMessage: challenge.SIWEMessage,
+	})
 }
 
-func saveAdminState(path string, runtime *policy.Runtime, landingPageEnabled bool) {
-	path = strings.TrimSpace(path)
+// authorize resolves the admin session cookie or an
+// "Authorization: Bearer <token>" API token of r.
+func (f *Frontend) authorize(r *http.Request) (adminPrincipal, bool) {
+	if !f.auth.AuthEnabled() {
+		return adminPrincipal{}, false
+	}
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		if session, ok := f.auth.ValidateSession(cookie.Value); ok {
+			if session.address == "" && f.auth.KeyLoginEnabled() {
+				return adminPrincipal{role: types.AdminRoleOwner}, true
+			}
+			if role := f.auth.OperatorRole(session.address); role != "" {
+				return adminPrincipal{address: session.address, role: role}, true
+			}
+		}
+	}
+	token, ok := f.auth.ValidateToken(bearerToken(r))
+	if !ok {
+		return adminPrincipal{}, false
+	}
+	return adminPrincipal{token: &token}, true
+}
+
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token)
+}
+
+// serveMetrics exposes relay metrics on the API listener. Scrapers
+// authenticate with an admin API token with the read scope, or with
+// "Authorization: Bearer <ADMIN_SECRET_KEY>" while no operators are
+// configured.
+func (f *Frontend) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	keyOK := f.auth.KeyLoginEnabled() && f.auth.ValidateKey(bearerToken(r))
+	principal, ok := f.authorize(r)
+	if !keyOK && (!ok || !principal.allows(types.AdminScopeRead)) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="portal-metrics"`)
+		utils.WriteAPIError(w, http.StatusUnauthorized, types.APIErrorCodeUnauthorized, "unauthorized")
+		return
+	}
+	f.server.MetricsHandler().ServeHTTP(w, r)
+}
+
+func (f *Frontend) saveAdminState() {
+	path := strings.TrimSpace(f.adminSettingsPath)
 	if path == "" {
 		return
 	}
 
+	runtime := f.server.PolicyRuntime()
+	landingPageEnabled := f.isLandingPageEnabled()
 	approver := runtime.Approver()
 	udpEnabled := runtime.IsUDPEnabled()
 	udpMaxLeases := runtime.UDPMaxLeases()
 	tcpPortEnabled := runtime.IsTCPPortEnabled()
 	tcpPortMaxLeases := runtime.TCPPortMaxLeases()
+	connLimits := runtime.ConnLimiter().Defaults()
+	quotas := runtime.Quotas().Defaults()
 	payload := persistedAdminState{
 		ApprovalMode:         string(approver.Mode()),
 		ApprovedIdentityKeys: approver.ApprovedKeys(),
 		DeniedIdentityKeys:   approver.DeniedKeys(),
 		BannedIdentityKeys:   runtime.BannedIdentityKeys(),
 		BannedIPs:            runtime.IPFilter().BannedIPs(),
+		IngressDenyIPs:       runtime.IPFilter().IngressDenyList(),
 		IdentityBPS:          runtime.BPSManager().IdentityBPSLimits(),
+		ConnLimits:           &connLimits,
+		IdentityConnLimits:   runtime.ConnLimiter().Overrides(),
+		Quotas:               &quotas,
+		AddressQuotas:        runtime.Quotas().Overrides(),
 		UDPEnabled:           &udpEnabled,
 		UDPMaxLeases:         &udpMaxLeases,
 		TCPPortEnabled:       &tcpPortEnabled,
 		TCPPortMaxLeases:     &tcpPortMaxLeases,
 		LandingPageEnabled:   &landingPageEnabled,
+		AdminTokens:          f.auth.persistedTokens(),
 	}
 	_ = utils.WriteJSONFile(path, payload, 0o600)
 }
 
 type persistedAdminState struct {
-	ApprovalMode         string           `json:"approval_mode"`
-	ApprovedIdentityKeys []string         `json:"approved_identity_keys,omitempty"`
-	DeniedIdentityKeys   []string         `json:"denied_identity_keys,omitempty"`
-	BannedIdentityKeys   []string         `json:"banned_identity_keys,omitempty"`
-	BannedIPs            []string         `json:"banned_ips,omitempty"`
-	IdentityBPS          map[string]int64 `json:"identity_bps,omitempty"`
-	UDPEnabled           *bool            `json:"udp_enabled,omitempty"`
-	UDPMaxLeases         *int             `json:"udp_max_leases,omitempty"`
-	TCPPortEnabled       *bool            `json:"tcp_port_enabled,omitempty"`
-	TCPPortMaxLeases     *int             `json:"tcp_port_max_leases,omitempty"`
-	LandingPageEnabled   *bool            `json:"landing_page_enabled,omitempty"`
+	ApprovalMode         string                       `json:"approval_mode"`
+	ApprovedIdentityKeys []string                     `json:"approved_identity_keys,omitempty"`
+	DeniedIdentityKeys   []string                     `json:"denied_identity_keys,omitempty"`
+	BannedIdentityKeys   []string                     `json:"banned_identity_keys,omitempty"`
+	BannedIPs            []string                     `json:"banned_ips,omitempty"`
+	IngressDenyIPs       []string                     `json:"ingress_deny_ips,omitempty"`
+	IdentityBPS          map[string]int64             `json:"identity_bps,omitempty"`
+	ConnLimits           *types.ConnLimits            `json:"conn_limits,omitempty"`
+	IdentityConnLimits   map[string]types.ConnLimits  `json:"identity_conn_limits,omitempty"`
+	Quotas               *types.QuotaLimits           `json:"quotas,omitempty"`
+	AddressQuotas        map[string]types.QuotaLimits `json:"address_quotas,omitempty"`
+	UDPEnabled           *bool                        `json:"udp_enabled,omitempty"`
+	UDPMaxLeases         *int                         `json:"udp_max_leases,omitempty"`
+	TCPPortEnabled       *bool                        `json:"tcp_port_enabled,omitempty"`
+	TCPPortMaxLeases     *int                         `json:"tcp_port_max_leases,omitempty"`
+	LandingPageEnabled   *bool                        `json:"landing_page_enabled,omitempty"`
+	AdminTokens          []persistedAdminToken        `json:"admin_tokens,omitempty"`
 }
 
 func applyOptionalPolicy(enabled *bool, maxLeases *int, getEnabled func() bool, getMax func() int, set func(bool, int)) {
@@ -497,7 +1045,16 @@ func (s persistedAdminState) apply(runtime *policy.Runtime) error {
 	)
 	runtime.SetBannedIdentityKeys(utils.NormalizeIdentityKeys(s.BannedIdentityKeys))
 	runtime.IPFilter().SetBannedIPs(s.BannedIPs)
+	runtime.IPFilter().SetIngressDenyList(s.IngressDenyIPs)
 	runtime.BPSManager().SetIdentityBPSLimits(utils.NormalizeIdentityKeyBPS(s.IdentityBPS))
+	if s.ConnLimits != nil {
+		runtime.ConnLimiter().SetDefaults(*s.ConnLimits)
+	}
+	runtime.ConnLimiter().SetOverrides(utils.NormalizeIdentityKeyConnLimits(s.IdentityConnLimits))
+	if s.Quotas != nil {
+		runtime.Quotas().SetDefaults(*s.Quotas)
+	}
+	runtime.Quotas().SetOverrides(s.AddressQuotas)
 	applyOptionalPolicy(s.UDPEnabled, s.UDPMaxLeases, runtime.IsUDPEnabled, runtime.UDPMaxLeases, runtime.SetUDPPolicy)
 	applyOptionalPolicy(s.TCPPortEnabled, s.TCPPortMaxLeases, runtime.IsTCPPortEnabled, runtime.TCPPortMaxLeases, runtime.SetTCPPortPolicy)
 	return nil
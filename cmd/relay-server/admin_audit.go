@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosuda/portal/v2/portal"
+	"github.com/gosuda/portal/v2/portal/auditlog"
+	"github.com/gosuda/portal/v2/portal/policy"
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 10000
+)
+
+// leaseAuditState is the admin policy of one identity key as recorded
+// before and after a lease action.
+type leaseAuditState struct {
+	Banned       bool              `json:"banned"`
+	Approved     bool              `json:"approved"`
+	Denied       bool              `json:"denied"`
+	BPS          int64             `json:"bps,omitempty"`
+	ConnLimits   *types.ConnLimits `json:"conn_limits,omitempty"`
+	EvictedUntil time.Time         `json:"evicted_until,omitzero"`
+}
+
+func adminLeaseAuditState(server *portal.Server, key string) leaseAuditState {
+	runtime := server.PolicyRuntime()
+	state := leaseAuditState{
+		Banned:   runtime.IsIdentityBanned(key),
+		Approved: runtime.Approver().IsApproved(key),
+		Denied:   runtime.Approver().IsDenied(key),
+		BPS:      runtime.BPSManager().IdentityBPS(key),
+	}
+	if limits, ok := runtime.ConnLimiter().Override(key); ok {
+		state.ConnLimits = &limits
+	}
+	if until, ok := server.LeaseEvictedUntil(key); ok {
+		state.EvictedUntil = until.UTC()
+	}
+	return state
+}
+
+// ipAuditState reports whether an IP entry is on the ban and ingress
+// deny lists.
+type ipAuditState struct {
+	Banned bool `json:"banned"`
+	Denied bool `json:"denied"`
+}
+
+func adminIPAuditState(filter *policy.IPFilter, entry string) ipAuditState {
+	return ipAuditState{
+		Banned: slices.Contains(filter.BannedIPs(), entry),
+		Denied: slices.Contains(filter.IngressDenyList(), entry),
+	}
+}
+
+func (p adminPrincipal) actor() string {
+	switch {
+	case p.token != nil:
+		return "token:" + p.token.ID
+	case p.address != "":
+		return p.address
+	default:
+		return "admin_key"
+	}
+}
+
+// audit records an admin mutation made by principal. Nil old or new values
+// are left out of the entry.
+func (f *Frontend) audit(r *http.Request, principal adminPrincipal, action, target string, oldValue, newValue any) {
+	f.auditLog.Record(types.AdminAuditEntry{
+		Actor:    principal.actor(),
+		ClientIP: f.server.ClientIP(r),
+		Action:   action,
+		Target:   target,
+		Old:      auditValue(oldValue),
+		New:      auditValue(newValue),
+	})
+}
+
+func auditValue(value any) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// handleAudit returns audit log entries, newest first, filtered by the
+// actor, action, target, since, until and limit query parameters.
+func (f *Frontend) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !utils.RequireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditlog.Filter{
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Action: strings.TrimSpace(query.Get("action")),
+		Target: strings.TrimSpace(query.Get("target")),
+		Limit:  defaultAuditLimit,
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		raw := strings.TrimSpace(query.Get(name))
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, name+" must be an RFC3339 timestamp")
+			return
+		}
+		*dst = parsed
+	}
+	if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		filter.Limit = min(limit, maxAuditLimit)
+	}
+
+	utils.WriteAPIData(w, http.StatusOK, types.AdminAuditResponse{
+		Entries: f.auditLog.Query(filter),
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosuda/portal/v2/portal/auth"
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+func newTestOperator(t *testing.T) types.Identity {
+	t.Helper()
+
+	identity, err := utils.ResolveSecp256k1Identity("")
+	if err != nil {
+		t.Fatalf("ResolveSecp256k1Identity() error = %v", err)
+	}
+	return identity
+}
+
+func signLoginChallenge(t *testing.T, challenge *auth.AdminLoginChallenge, operator types.Identity) string {
+	t.Helper()
+
+	signature, err := utils.SignEthereumPersonalMessage(challenge.SIWEMessage, operator.PrivateKey)
+	if err != nil {
+		t.Fatalf("SignEthereumPersonalMessage() error = %v", err)
+	}
+	return signature
+}
+
+func TestConsumeLoginChallenge(t *testing.T) {
+	t.Parallel()
+
+	viewer := newTestOperator(t)
+	stranger := newTestOperator(t)
+	a := newAdminAuth("test-admin-secret", map[string]string{viewer.Address: types.AdminRoleViewer})
+	issue := func() *auth.AdminLoginChallenge {
+		t.Helper()
+		challenge, err := a.IssueLoginChallenge(viewer.Address, "portal.example.com", "https://portal.example.com/admin/login")
+		if err != nil {
+			t.Fatalf("IssueLoginChallenge() error = %v", err)
+		}
+		return challenge
+	}
+
+	challenge := issue()
+	signature := signLoginChallenge(t, challenge, viewer)
+	if _, err := a.ConsumeLoginChallenge(challenge.ChallengeID, challenge.SIWEMessage+"\nextra", signature); !errors.Is(err, auth.ErrMessageMismatch) {
+		t.Fatalf("ConsumeLoginChallenge(tampered message) error = %v, want %v", err, auth.ErrMessageMismatch)
+	}
+	address, err := a.ConsumeLoginChallenge(challenge.ChallengeID, challenge.SIWEMessage, signature)
+	if err != nil {
+		t.Fatalf("ConsumeLoginChallenge() error = %v", err)
+	}
+	if address != viewer.Address {
+		t.Fatalf("ConsumeLoginChallenge() address = %q, want %q", address, viewer.Address)
+	}
+	if _, err := a.ConsumeLoginChallenge(challenge.ChallengeID, challenge.SIWEMessage, signature); !errors.Is(err, auth.ErrChallengeNotFound) {
+		t.Fatalf("ConsumeLoginChallenge(replay) error = %v, want %v", err, auth.ErrChallengeNotFound)
+	}
+
+	expired := issue()
+	a.mu.Lock()
+	a.challenges[expired.ChallengeID].ExpiresAt = time.Now().Add(-time.Second)
+	a.mu.Unlock()
+	if _, err := a.ConsumeLoginChallenge(expired.ChallengeID, expired.SIWEMessage, signLoginChallenge(t, expired, viewer)); !errors.Is(err, auth.ErrChallengeExpired) {
+		t.Fatalf("ConsumeLoginChallenge(expired) error = %v, want %v", err, auth.ErrChallengeExpired)
+	}
+
+	if _, err := a.IssueLoginChallenge(stranger.Address, "portal.example.com", "https://portal.example.com/admin/login"); !errors.Is(err, errNotAdminOperator) {
+		t.Fatalf("IssueLoginChallenge(non-operator) error = %v, want %v", err, errNotAdminOperator)
+	}
+
+	// An operator removed between challenge and login is refused.
+	removed := issue()
+	a.operators = map[string]string{}
+	if _, err := a.ConsumeLoginChallenge(removed.ChallengeID, removed.SIWEMessage, signLoginChallenge(t, removed, viewer)); !errors.Is(err, errNotAdminOperator) {
+		t.Fatalf("ConsumeLoginChallenge(removed operator) error = %v, want %v", err, errNotAdminOperator)
+	}
+}
+
+func TestAdminOperatorLoginEnforcesRole(t *testing.T) {
+	t.Parallel()
+
+	viewer := newTestOperator(t)
+	f := newTestFrontend(t, map[string]string{viewer.Address: types.AdminRoleViewer}, "")
+	post := func(path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		f.serveAdmin(rec, req)
+		return rec
+	}
+
+	// The secret key cannot open an owner session once operators exist.
+	if rec := post(types.PathAdminLogin, types.AdminLoginRequest{Key: "test-admin-secret"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("key login status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec := post(types.PathAdminLoginSIWE, types.AdminLoginChallengeRequest{Address: viewer.Address})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login challenge status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var challenge types.APIEnvelope[types.AdminLoginChallengeResponse]
+	if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil {
+		t.Fatalf("decode login challenge: %v", err)
+	}
+	signature, err := utils.SignEthereumPersonalMessage(challenge.Data.SIWEMessage, viewer.PrivateKey)
+	if err != nil {
+		t.Fatalf("SignEthereumPersonalMessage() error = %v", err)
+	}
+	rec = post(types.PathAdminLogin, types.AdminLoginRequest{
+		ChallengeID:   challenge.Data.ChallengeID,
+		SIWEMessage:   challenge.Data.SIWEMessage,
+		SIWESignature: signature,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("SIWE login status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieName {
+		t.Fatalf("SIWE login cookies = %v, want one %s cookie", cookies, cookieName)
+	}
+	withSession := func(req *http.Request) { req.AddCookie(cookies[0]) }
+
+	statusReq := httptest.NewRequest(http.MethodGet, types.PathAdminAuthStatus, nil)
+	withSession(statusReq)
+	statusRec := httptest.NewRecorder()
+	f.serveAdmin(statusRec, statusReq)
+	var status types.APIEnvelope[types.AdminAuthStatusResponse]
+	if err := json.NewDecoder(statusRec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode auth status: %v", err)
+	}
+	if !status.Data.Authenticated || status.Data.Address != viewer.Address || status.Data.Role != types.AdminRoleViewer || status.Data.KeyLoginEnabled {
+		t.Fatalf("auth status = %+v, want the viewer session with key login disabled", status.Data)
+	}
+
+	if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, withSession); got != http.StatusOK {
+		t.Fatalf("viewer GET snapshot status = %d, want %d", got, http.StatusOK)
+	}
+	for _, tc := range []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodPost, path: types.PathAdminLeasesPrefix + "demo/ban"},
+		{method: http.MethodPost, path: types.PathAdminIPsPrefix + "203.0.113.10/ban"},
+		{method: http.MethodPost, path: types.PathAdminApproval},
+		{method: http.MethodGet, path: types.PathAdminTokens},
+		{method: http.MethodPost, path: types.PathAdminTokens},
+	} {
+		if got := serveAdminRequest(f, tc.method, tc.path, withSession); got != http.StatusForbidden {
+			t.Fatalf("viewer %s %s status = %d, want %d", tc.method, tc.path, got, http.StatusForbidden)
+		}
+	}
+
+	// A session without an address is not honored while operators exist.
+	keySession, err := f.auth.CreateSession("")
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	withKeySession := func(req *http.Request) { req.AddCookie(&http.Cookie{Name: cookieName, Value: keySession}) }
+	if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, withKeySession); got != http.StatusUnauthorized {
+		t.Fatalf("addressless session status = %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminKeyLoginWithoutOperators(t *testing.T) {
+	t.Parallel()
+
+	f := newTestFrontend(t, nil, "")
+	body, err := json.Marshal(types.AdminLoginRequest{Key: "test-admin-secret"})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, types.PathAdminLogin, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	f.serveAdmin(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("key login status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("key login cookies = %v, want one session cookie", cookies)
+	}
+	if got := serveAdminRequest(f, http.MethodGet, types.PathAdminTokens, func(req *http.Request) { req.AddCookie(cookies[0]) }); got != http.StatusOK {
+		t.Fatalf("owner GET tokens status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestMetricsRefuseSecretKeyOnceOperatorsAreConfigured(t *testing.T) {
+	t.Parallel()
+
+	scrape := func(f *Frontend, authorize func(*http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, types.PathMetrics, nil)
+		authorize(req)
+		rec := httptest.NewRecorder()
+		f.serveMetrics(rec, req)
+		return rec.Code
+	}
+
+	withoutOperators := newTestFrontend(t, nil, "")
+	if got := scrape(withoutOperators, withBearer("test-admin-secret")); got != http.StatusOK {
+		t.Fatalf("metrics with admin key and no operators status = %d, want %d", got, http.StatusOK)
+	}
+
+	operator := newTestOperator(t)
+	f := newTestFrontend(t, map[string]string{operator.Address: types.AdminRoleOwner}, "")
+	if got := scrape(f, withBearer("test-admin-secret")); got != http.StatusUnauthorized {
+		t.Fatalf("metrics with admin key and operators status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	_, readSecret, err := f.auth.CreateToken("prometheus", []string{types.AdminScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	if got := scrape(f, withBearer(readSecret)); got != http.StatusOK {
+		t.Fatalf("metrics with read token status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestAdminQuotaOverrideRejectsPerIPLimit(t *testing.T) {
+	t.Parallel()
+
+	const address = "0x1111111111111111111111111111111111111111"
+	f := newTestFrontend(t, nil, "")
+	_, secret, err := f.auth.CreateToken("quotas", []string{types.AdminScopeSettings}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, types.PathAdminQuotasPrefix+address, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		withBearer(secret)(req)
+		rec := httptest.NewRecorder()
+		f.serveAdmin(rec, req)
+		return rec
+	}
+
+	for _, body := range []string{
+		`{"max_leases_per_ip":5}`,
+		`{"max_leases_per_address":2,"max_leases_per_ip":5}`,
+	} {
+		rec := post(body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "max_leases_per_ip is relay-wide") {
+			t.Fatalf("POST %s = %d %s, want 400 naming max_leases_per_ip", body, rec.Code, rec.Body.String())
+		}
+	}
+	if _, ok := f.server.PolicyRuntime().Quotas().Override(address); ok {
+		t.Fatal("rejected override was stored")
+	}
+	if rec := post(`{"max_leases_per_address":2}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST max_leases_per_address = %d %s, want %d", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+}
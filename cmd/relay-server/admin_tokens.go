@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	adminTokenPrefix     = "portal_at_"
+	maxAdminTokens       = 100
+	maxAdminTokenNameLen = 64
+)
+
+var adminTokenScopes = []string{
+	types.AdminScopeRead,
+	types.AdminScopeLeases,
+	types.AdminScopeSettings,
+	types.AdminScopeIPs,
+}
+
+// persistedAdminToken is an admin API token as saved in the admin settings
+// file: its description and the SHA-256 hash of its secret.
+type persistedAdminToken struct {
+	types.AdminToken
+	Hash string `json:"hash"`
+}
+
+func hashAdminToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeAdminTokenScopes(scopes []string) ([]string, error) {
+	out := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(adminTokenScopes, scope) {
+			return nil, errors.New("unknown scope " + scope)
+		}
+		if !slices.Contains(out, scope) {
+			out = append(out, scope)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// CreateToken issues a new API token and returns its description and
+// secret. Only the hash of the secret is kept.
+func (a *adminAuth) CreateToken(name string, scopes []string, expiresAt time.Time) (types.AdminToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAdminTokenNameLen {
+		return types.AdminToken{}, "", errors.New("name must be 1 to 64 characters")
+	}
+	scopes, err := normalizeAdminTokenScopes(scopes)
+	if err != nil {
+		return types.AdminToken{}, "", err
+	}
+	now := time.Now().UTC()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return types.AdminToken{}, "", errors.New("expires_at must be in the future")
+	}
+
+	id, err := utils.RandomHex(8)
+	if err != nil {
+		return types.AdminToken{}, "", err
+	}
+	secret, err := utils.RandomHex(32)
+	if err != nil {
+		return types.AdminToken{}, "", err
+	}
+	secret = adminTokenPrefix + secret
+	token := types.AdminToken{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt.UTC(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.tokens) >= maxAdminTokens {
+		return types.AdminToken{}, "", errors.New("too many admin tokens")
+	}
+	a.tokens[hashAdminToken(secret)] = token
+	return token, secret, nil
+}
+
+// ValidateToken returns the unexpired token whose secret is secret.
+func (a *adminAuth) ValidateToken(secret string) (types.AdminToken, bool) {
+	if !strings.HasPrefix(secret, adminTokenPrefix) {
+		return types.AdminToken{}, false
+	}
+	hash := hashAdminToken(secret)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	token, ok := a.tokens[hash]
+	if !ok || (!token.ExpiresAt.IsZero() && !time.Now().Before(token.ExpiresAt)) {
+		return types.AdminToken{}, false
+	}
+	return token, true
+}
+
+// RevokeToken deletes the token with id and returns it.
+func (a *adminAuth) RevokeToken(id string) (types.AdminToken, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for hash, token := range a.tokens {
+		if token.ID == id {
+			delete(a.tokens, hash)
+			return token, true
+		}
+	}
+	return types.AdminToken{}, false
+}
+
+// Tokens lists the API tokens, oldest first.
+func (a *adminAuth) Tokens() []types.AdminToken {
+	a.mu.RLock()
+	out := make([]types.AdminToken, 0, len(a.tokens))
+	for _, token := range a.tokens {
+		out = append(out, token)
+	}
+	a.mu.RUnlock()
+
+	slices.SortFunc(out, func(x, y types.AdminToken) int {
+		return cmp.Or(x.CreatedAt.Compare(y.CreatedAt), cmp.Compare(x.ID, y.ID))
+	})
+	return out
+}
+
+func (a *adminAuth) persistedTokens() []persistedAdminToken {
+	a.mu.RLock()
+	out := make([]persistedAdminToken, 0, len(a.tokens))
+	for hash, token := range a.tokens {
+		out = append(out, persistedAdminToken{AdminToken: token, Hash: hash})
+	}
+	a.mu.RUnlock()
+
+	slices.SortFunc(out, func(x, y persistedAdminToken) int {
+		return cmp.Or(x.CreatedAt.Compare(y.CreatedAt), cmp.Compare(x.ID, y.ID))
+	})
+	return out
+}
+
+func (a *adminAuth) setPersistedTokens(tokens []persistedAdminToken) {
+	next := make(map[string]types.AdminToken, len(tokens))
+	for _, token := range tokens {
+		scopes, err := normalizeAdminTokenScopes(token.Scopes)
+		if err != nil || token.ID == "" || len(token.Hash) != sha256.Size*2 {
+			continue
+		}
+		if _, err := hex.DecodeString(token.Hash); err != nil {
+			continue
+		}
+		token.Scopes = scopes
+		next[strings.ToLower(token.Hash)] = token.AdminToken
+	}
+
+	a.mu.Lock()
+	a.tokens = next
+	a.mu.Unlock()
+}
+
+// handleAdminTokens lists and creates admin API tokens on /admin/tokens and
+// revokes one on DELETE /admin/tokens/{id}.
+func (f *Frontend) handleAdminTokens(w http.ResponseWriter, r *http.Request, principal adminPrincipal, path string, invalidBody utils.APIErrorResponse) {
+	if id, ok := strings.CutPrefix(path, types.PathAdminTokensPrefix); ok {
+		if !utils.RequireMethod(w, r, http.MethodDelete) {
+			return
+		}
+		token, ok := f.auth.RevokeToken(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.saveAdminState()
+		f.audit(r, principal, "token.revoke", token.ID, token, nil)
+		utils.WriteAPIData(w, http.StatusOK, map[string]any{})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		utils.WriteAPIData(w, http.StatusOK, types.AdminTokensResponse{Tokens: f.auth.Tokens()})
+	case http.MethodPost:
+		req, ok := utils.DecodeJSONRequestAs[types.AdminTokenCreateRequest](w, r, adminBodyLimit, invalidBody)
+		if !ok {
+			return
+		}
+		token, secret, err := f.auth.CreateToken(req.Name, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			utils.WriteAPIError(w, http.StatusBadRequest, types.APIErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		f.saveAdminState()
+		f.audit(r, principal, "token.create", token.ID, nil, token)
+		utils.WriteAPIData(w, http.StatusCreated, types.AdminTokenCreateResponse{AdminToken: token, Token: secret})
+	default:
+		utils.MethodNotAllowedError().Write(w)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosuda/portal/v2/portal"
+	"github.com/gosuda/portal/v2/types"
+)
+
+func newTestFrontend(t *testing.T, operators map[string]string, adminSettingsPath string) *Frontend {
+	t.Helper()
+
+	server, err := portal.NewServer(portal.ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: filepath.Join(t.TempDir(), "identity.json"),
+	})
+	if err != nil {
+		t.Fatalf("portal.NewServer() error = %v", err)
+	}
+	frontend, err := NewFrontend(server, "test-admin-secret", operators, adminSettingsPath, "", false)
+	if err != nil {
+		t.Fatalf("NewFrontend() error = %v", err)
+	}
+	return frontend
+}
+
+func serveAdminRequest(f *Frontend, method, path string, authorize func(*http.Request)) int {
+	req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	if authorize != nil {
+		authorize(req)
+	}
+	rec := httptest.NewRecorder()
+	f.serveAdmin(rec, req)
+	return rec.Code
+}
+
+func withBearer(secret string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+}
+
+func TestAdminScopeForAndAllows(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path   string
+		method string
+		scope  string
+	}{
+		{path: types.PathAdminSnapshot, method: http.MethodGet, scope: types.AdminScopeRead},
+		{path: types.PathAdminAudit, method: http.MethodHead, scope: types.AdminScopeRead},
+		{path: types.PathAdminLeasesPrefix + "demo/ban", method: http.MethodPost, scope: types.AdminScopeLeases},
+		{path: types.PathAdminIPsPrefix + "203.0.113.10/ban", method: http.MethodPost, scope: types.AdminScopeIPs},
+		{path: types.PathAdminApproval, method: http.MethodPost, scope: types.AdminScopeSettings},
+		{path: types.PathAdminQuotasPrefix + "demo", method: http.MethodPost, scope: types.AdminScopeSettings},
+		{path: types.PathAdminTokens, method: http.MethodGet, scope: ""},
+		{path: types.PathAdminTokens, method: http.MethodPost, scope: ""},
+		{path: types.PathAdminTokensPrefix + "0123456789abcdef", method: http.MethodDelete, scope: ""},
+	}
+	principals := map[string]adminPrincipal{
+		"owner":        {role: types.AdminRoleOwner},
+		"moderator":    {address: "0x1111111111111111111111111111111111111111", role: types.AdminRoleModerator},
+		"viewer":       {address: "0x2222222222222222222222222222222222222222", role: types.AdminRoleViewer},
+		"read token":   {token: &types.AdminToken{Scopes: []string{types.AdminScopeRead}}},
+		"leases token": {token: &types.AdminToken{Scopes: []string{types.AdminScopeLeases}}},
+		"all scopes":   {token: &types.AdminToken{Scopes: adminTokenScopes}},
+	}
+	// allowed lists the principals admitted for each scope; "" is owner-only.
+	allowed := map[string][]string{
+		types.AdminScopeRead:     {"owner", "moderator", "viewer", "read token", "all scopes"},
+		types.AdminScopeLeases:   {"owner", "moderator", "leases token", "all scopes"},
+		types.AdminScopeIPs:      {"owner", "moderator", "all scopes"},
+		types.AdminScopeSettings: {"owner", "all scopes"},
+		"":                       {"owner"},
+	}
+
+	for _, tc := range tests {
+		scope := adminScopeFor(tc.path, tc.method)
+		if scope != tc.scope {
+			t.Fatalf("adminScopeFor(%q, %s) = %q, want %q", tc.path, tc.method, scope, tc.scope)
+		}
+		for name, principal := range principals {
+			want := slices.Contains(allowed[scope], name)
+			if got := principal.allows(scope); got != want {
+				t.Fatalf("%s allows(%q) for %s %s = %v, want %v", name, scope, tc.method, tc.path, got, want)
+			}
+		}
+	}
+}
+
+func TestAdminTokenScopesEnforcedOnRequests(t *testing.T) {
+	t.Parallel()
+
+	f := newTestFrontend(t, nil, "")
+	_, readSecret, err := f.auth.CreateToken("dashboard", []string{types.AdminScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+
+	if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, withBearer(readSecret)); got != http.StatusOK {
+		t.Fatalf("GET snapshot with read token status = %d, want %d", got, http.StatusOK)
+	}
+	for _, path := range []string{
+		types.PathAdminLeasesPrefix + "demo/ban",
+		types.PathAdminIPsPrefix + "203.0.113.10/ban",
+		types.PathAdminApproval,
+		types.PathAdminTokens,
+	} {
+		if got := serveAdminRequest(f, http.MethodPost, path, withBearer(readSecret)); got != http.StatusForbidden {
+			t.Fatalf("POST %s with read token status = %d, want %d", path, got, http.StatusForbidden)
+		}
+	}
+	if got := serveAdminRequest(f, http.MethodGet, types.PathAdminTokens, withBearer(readSecret)); got != http.StatusForbidden {
+		t.Fatalf("GET tokens with read token status = %d, want %d", got, http.StatusForbidden)
+	}
+	for name, authorize := range map[string]func(*http.Request){
+		"no credentials": nil,
+		"unknown token":  withBearer(adminTokenPrefix + strings.Repeat("0", 64)),
+		"admin key":      withBearer("test-admin-secret"),
+	} {
+		if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, authorize); got != http.StatusUnauthorized {
+			t.Fatalf("GET snapshot with %s status = %d, want %d", name, got, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminTokenExpiryAndRevocation(t *testing.T) {
+	t.Parallel()
+
+	f := newTestFrontend(t, nil, "")
+	if _, _, err := f.auth.CreateToken("stale", []string{types.AdminScopeRead}, time.Now().Add(-time.Minute)); err == nil {
+		t.Fatal("CreateToken(past expiry) error = nil, want error")
+	}
+
+	expiring, expiringSecret, err := f.auth.CreateToken("expiring", []string{types.AdminScopeRead}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	revoked, revokedSecret, err := f.auth.CreateToken("revoked", []string{types.AdminScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	for _, secret := range []string{expiringSecret, revokedSecret} {
+		if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, withBearer(secret)); got != http.StatusOK {
+			t.Fatalf("GET snapshot with live token status = %d, want %d", got, http.StatusOK)
+		}
+	}
+
+	f.auth.mu.Lock()
+	expiring.ExpiresAt = time.Now().Add(-time.Second)
+	f.auth.tokens[hashAdminToken(expiringSecret)] = expiring
+	f.auth.mu.Unlock()
+	if _, ok := f.auth.RevokeToken(revoked.ID); !ok {
+		t.Fatal("RevokeToken() ok = false, want true")
+	}
+	if _, ok := f.auth.RevokeToken(revoked.ID); ok {
+		t.Fatal("second RevokeToken() ok = true, want false")
+	}
+
+	for name, secret := range map[string]string{"expired": expiringSecret, "revoked": revokedSecret} {
+		if got := serveAdminRequest(f, http.MethodGet, types.PathAdminSnapshot, withBearer(secret)); got != http.StatusUnauthorized {
+			t.Fatalf("GET snapshot with %s token status = %d, want %d", name, got, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminTokensPersistAcrossRestart(t *testing.T) {
+	t.Parallel()
+
+	settingsPath := filepath.Join(t.TempDir(), "admin_settings.json")
+	f := newTestFrontend(t, nil, settingsPath)
+	token, secret, err := f.auth.CreateToken("ci", []string{types.AdminScopeLeases, types.AdminScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+	f.saveAdminState()
+
+	restarted := newTestFrontend(t, nil, settingsPath)
+	got, ok := restarted.auth.ValidateToken(secret)
+	if !ok {
+		t.Fatal("ValidateToken() after restart ok = false, want true")
+	}
+	if got.ID != token.ID || !slices.Equal(got.Scopes, token.Scopes) {
+		t.Fatalf("ValidateToken() after restart = %+v, want %+v", got, token)
+	}
+	if _, ok := restarted.auth.ValidateToken(strings.TrimPrefix(secret, adminTokenPrefix)); ok {
+		t.Fatal("ValidateToken(secret without prefix) ok = true, want false")
+	}
+}
+
+func TestSetPersistedTokensSkipsMalformedEntries(t *testing.T) {
+	t.Parallel()
+
+	secret := adminTokenPrefix + strings.Repeat("ab", 32)
+	hash := hashAdminToken(secret)
+	valid := func(id string, scopes ...string) types.AdminToken {
+		return types.AdminToken{ID: id, Name: id, Scopes: scopes}
+	}
+
+	a := newAdminAuth("test-admin-secret", nil)
+	a.setPersistedTokens([]persistedAdminToken{
+		{AdminToken: valid("short", types.AdminScopeRead), Hash: hash[:62]},
+		{AdminToken: valid("not-hex", types.AdminScopeRead), Hash: strings.Repeat("zz", 32)},
+		{AdminToken: valid("unknown-scope", "superuser"), Hash: hashAdminToken(secret + "1")},
+		{AdminToken: valid("no-scope"), Hash: hashAdminToken(secret + "2")},
+		{AdminToken: valid("", types.AdminScopeRead), Hash: hashAdminToken(secret + "3")},
+		{AdminToken: valid("good", " READ ", types.AdminScopeRead), Hash: strings.ToUpper(hash)},
+	})
+
+	tokens := a.Tokens()
+	if len(tokens) != 1 || tokens[0].ID != "good" {
+		t.Fatalf("Tokens() = %+v, want only the well-formed entry", tokens)
+	}
+	token, ok := a.ValidateToken(secret)
+	if !ok {
+		t.Fatal("ValidateToken() ok = false, want the upper-case hash to match")
+	}
+	if !slices.Equal(token.Scopes, []string{types.AdminScopeRead}) {
+		t.Fatalf("token scopes = %v, want normalized [read]", token.Scopes)
+	}
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/gosuda/portal/v2/cmd/portal-tunnel/installer"
 	"github.com/gosuda/portal/v2/portal"
+	"github.com/gosuda/portal/v2/portal/auditlog"
 	"github.com/gosuda/portal/v2/types"
 	"github.com/gosuda/portal/v2/utils"
 )
@@ -35,6 +36,7 @@ type Frontend struct {
 	distFS            readDirFileFS
 	server            *portal.Server
 	auth              *adminAuth
+	auditLog          *auditlog.Log
 	adminSettingsPath string
 
 	cachedPortalHTML     []byte
@@ -42,7 +44,7 @@ type Frontend struct {
 	landingPageEnabled   atomic.Bool
 }
 
-func NewFrontend(server *portal.Server, adminSecret string, adminSettingsPath string, defaultLandingPageEnabled bool) (*Frontend, error) {
+func NewFrontend(server *portal.Server, adminSecret string, adminOperators map[string]string, adminSettingsPath, auditLogPath string, defaultLandingPageEnabled bool) (*Frontend, error) {
 	if server == nil {
 		return nil, errors.New("frontend requires portal server")
 	}
@@ -54,11 +56,16 @@ func NewFrontend(server *portal.Server, adminSecret string, adminSettingsPath st
 	if err != nil {
 		return nil, err
 	}
+	auditLog, err := auditlog.New(auditlog.Config{Path: auditLogPath})
+	if err != nil {
+		return nil, err
+	}
 
 	frontend := &Frontend{
 		distFS:            embeddedDistFS,
 		server:            server,
-		auth:              newAdminAuth(adminSecret),
+		auth:              newAdminAuth(adminSecret, adminOperators),
+		auditLog:          auditLog,
 		adminSettingsPath: strings.TrimSpace(adminSettingsPath),
 	}
 	landingPageEnabled := defaultLandingPageEnabled
@@ -66,9 +73,15 @@ func NewFrontend(server *portal.Server, adminSecret string, adminSettingsPath st
 		landingPageEnabled = *state.LandingPageEnabled
 	}
 	frontend.setLandingPageEnabled(landingPageEnabled)
+	frontend.auth.setPersistedTokens(state.AdminTokens)
 	return frontend, nil
 }
 
+// Close closes the admin audit log.
+func (f *Frontend) Close() error {
+	return f.auditLog.Close()
+}
+
 func (f *Frontend) Handler() *http.ServeMux {
 	mux := http.NewServeMux()
 
@@ -92,6 +105,7 @@ func (f *Frontend) Handler() *http.ServeMux {
 
 	mux.HandleFunc(types.PathAdmin, f.serveAdmin)
 	mux.HandleFunc(types.PathAdminPrefix, f.serveAdmin)
+	mux.HandleFunc(types.PathMetrics, f.serveMetrics)
 	mux.HandleFunc(types.PathTunnelStatus, f.serveTunnelStatus)
 	mux.HandleFunc(types.PathInstallShell, func(w http.ResponseWriter, r *http.Request) {
 		serveInstallScript(w, r, f.server.PortalURL(), false)
@@ -6,8 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -38,15 +42,39 @@ type relayServerConfig struct {
 	MaxPort            int
 	UDPEnabled         bool
 	TCPEnabled         bool
+	MaxLeasePorts      int
+	MaxLeaseConns      int
+	ConnRatePerIP      int
+	MaxConnsPerIP      int
+	ConnIdleTimeout    int
+	ConnMaxLifetime    int
+	ConnDrainTimeout   int
+	MaxConnIdleTimeout int
+	MaxConnLifetime    int
+	MaxConnDrain       int
+	MaxLeasesPerAddr   int
+	MaxLeasesPerIP     int
+	MaxLeaseTTL        int
+	DailyQuotaMB       int
+	MonthlyQuotaMB     int
+	QuotaUsagePath     string
 	LandingPageEnabled bool
 	Bootstraps         string
 	DiscoveryEnabled   bool
 	IdentityPath       string
 	AdminSecretKey     string
+	AdminOperators     string
 	TrustProxyHeaders  bool
 	TrustedProxyCIDRs  string
+	ProxyProtocol      bool
+	OfflinePage        bool
 	AdminSettingsPath  string
+	AdminAuditLogPath  string
 	KeylessDir         string
+	MetricsListenAddr  string
+	AccessLogPath      string
+	AccessLogMaxSizeMB int
+	AccessLogMaxFiles  int
 
 	ACMEDNSProvider    string
 	ENSGaslessEnabled  bool
@@ -72,16 +100,39 @@ func runServeCommand(args []string) error {
 	utils.IntFlagEnv(fs, &cfg.MaxPort, "max-port", 0, utils.ParseOptionalPortNumber, "inclusive maximum lease port shared by UDP and raw TCP transports (0=disabled)", "MAX_PORT")
 	utils.BoolFlagEnv(fs, &cfg.UDPEnabled, "udp-enabled", false, "enable UDP relay transport; requires a valid --min-port/--max-port range", "UDP_ENABLED")
 	utils.BoolFlagEnv(fs, &cfg.TCPEnabled, "tcp-enabled", false, "enable raw TCP port transport; requires a valid --min-port/--max-port range", "TCP_ENABLED")
+	utils.IntFlagEnv(fs, &cfg.MaxLeasePorts, "max-lease-ports", 4, parsePositiveInt, "maximum UDP ports and maximum raw TCP ports one lease may request", "MAX_LEASE_PORTS")
+	utils.IntFlagEnv(fs, &cfg.MaxLeaseConns, "max-lease-conns", 0, parseNonNegativeInt, "default maximum concurrent public connections per lease (0=unlimited)", "MAX_LEASE_CONNS")
+	utils.IntFlagEnv(fs, &cfg.ConnRatePerIP, "conn-rate-per-ip", 0, parseNonNegativeInt, "default maximum new public connections per second from one client IP to one lease (0=unlimited)", "CONN_RATE_PER_IP")
+	utils.IntFlagEnv(fs, &cfg.MaxConnsPerIP, "max-conns-per-ip", 0, parseNonNegativeInt, "maximum concurrent public connections from one client IP across all leases (0=unlimited)", "MAX_CONNS_PER_IP")
+	utils.IntFlagEnv(fs, &cfg.ConnIdleTimeout, "conn-idle-timeout", 0, parseNonNegativeInt, "default seconds a bridged SNI or raw TCP connection may stay idle in both directions (0=disabled)", "CONN_IDLE_TIMEOUT")
+	utils.IntFlagEnv(fs, &cfg.ConnMaxLifetime, "conn-max-lifetime", 0, parseNonNegativeInt, "default maximum seconds a bridged connection may stay open (0=disabled)", "CONN_MAX_LIFETIME")
+	utils.IntFlagEnv(fs, &cfg.ConnDrainTimeout, "conn-drain-timeout", 0, parseNonNegativeInt, "default seconds a bridged connection may keep sending after the other side half-closed (0=disabled)", "CONN_DRAIN_TIMEOUT")
+	utils.IntFlagEnv(fs, &cfg.MaxConnIdleTimeout, "max-conn-idle-timeout", 0, parseNonNegativeInt, "largest idle timeout a lease may request; defaults to conn-idle-timeout", "MAX_CONN_IDLE_TIMEOUT")
+	utils.IntFlagEnv(fs, &cfg.MaxConnLifetime, "max-conn-lifetime", 0, parseNonNegativeInt, "largest connection lifetime a lease may request; defaults to conn-max-lifetime", "MAX_CONN_LIFETIME")
+	utils.IntFlagEnv(fs, &cfg.MaxConnDrain, "max-conn-drain-timeout", 0, parseNonNegativeInt, "largest drain timeout a lease may request; defaults to conn-drain-timeout", "MAX_CONN_DRAIN_TIMEOUT")
+	utils.IntFlagEnv(fs, &cfg.MaxLeasesPerAddr, "max-leases-per-address", 0, parseNonNegativeInt, "default maximum concurrent leases one wallet address may hold (0=unlimited)", "MAX_LEASES_PER_ADDRESS")
+	utils.IntFlagEnv(fs, &cfg.MaxLeasesPerIP, "max-leases-per-ip", 0, parseNonNegativeInt, "maximum concurrent leases registered from one client IP (0=unlimited)", "MAX_LEASES_PER_IP")
+	utils.IntFlagEnv(fs, &cfg.MaxLeaseTTL, "max-lease-ttl", 0, parseNonNegativeInt, "default largest lease TTL in seconds a tunnel may request (0=unlimited)", "MAX_LEASE_TTL")
+	utils.IntFlagEnv(fs, &cfg.DailyQuotaMB, "daily-quota-mb", 0, parseNonNegativeInt, "default MiB one wallet address may relay per UTC day (0=unlimited)", "DAILY_QUOTA_MB")
+	utils.IntFlagEnv(fs, &cfg.MonthlyQuotaMB, "monthly-quota-mb", 0, parseNonNegativeInt, "default MiB one wallet address may relay per UTC month (0=unlimited)", "MONTHLY_QUOTA_MB")
+	utils.StringFlagEnv(fs, &cfg.QuotaUsagePath, "quota-usage-path", "quota_usage.json", "file keeping byte quota usage across restarts; empty keeps usage in memory only", "QUOTA_USAGE_PATH")
 	utils.BoolFlagEnv(fs, &cfg.LandingPageEnabled, "landing-page-enabled", false, "enable landing page by default when no admin setting has been saved yet", "LANDING_PAGE_ENABLED")
 	utils.StringFlagEnv(fs, &cfg.Bootstraps, "bootstraps", "", "additional bootstrap relay API URLs used for discovery expansion", "BOOTSTRAPS")
 	utils.BoolFlagEnv(fs, &cfg.DiscoveryEnabled, "discovery", false, "serve relay discovery endpoints and poll discovery peers", "DISCOVERY")
 	utils.StringFlagEnv(fs, &cfg.IdentityPath, "identity-path", "identity.json", "relay identity json file path", "IDENTITY_PATH")
 	utils.StringFlagEnv(fs, &cfg.AdminSecretKey, "admin-secret-key", "", "admin auth secret", "ADMIN_SECRET_KEY")
+	utils.StringFlagEnv(fs, &cfg.AdminOperators, "admin-operators", "", "wallet addresses allowed to log into /admin with SIWE, comma-separated ADDRESS=ROLE entries with role viewer, moderator or owner", "ADMIN_OPERATORS")
 	utils.BoolFlagEnv(fs, &cfg.TrustProxyHeaders, "trust-proxy-headers", false, "trust X-Forwarded-* and X-Real-IP headers from trusted proxies", "TRUST_PROXY_HEADERS")
 	utils.StringFlagEnv(fs, &cfg.TrustedProxyCIDRs, "trusted-proxy-cidrs", "", "trusted proxy CIDR allowlist for forwarded headers, comma-separated; defaults to private/loopback proxy ranges when trust-proxy-headers is enabled", "TRUSTED_PROXY_CIDRS")
-
+	utils.BoolFlagEnv(fs, &cfg.ProxyProtocol, "accept-proxy-protocol", false, "require PROXY protocol v1/v2 headers on SNI, API and TCP port connections from trusted-proxy-cidrs (e.g. behind nginx, HAProxy or an NLB)", "ACCEPT_PROXY_PROTOCOL")
+	utils.BoolFlagEnv(fs, &cfg.OfflinePage, "offline-page", false, "terminate TLS with the relay wildcard certificate and serve a service-offline page when a lease under the root host has no ready session; bypasses end-to-end TLS only for those connections", "OFFLINE_PAGE")
 	utils.StringFlagEnv(fs, &cfg.KeylessDir, "keyless-dir", "./.portal-certs", "directory path for relay keyless materials", "KEYLESS_DIR")
 	utils.StringFlagEnv(fs, &cfg.AdminSettingsPath, "admin-settings-path", "admin_settings.json", "admin settings file path", "ADMIN_SETTINGS_PATH")
+	utils.StringFlagEnv(fs, &cfg.AdminAuditLogPath, "admin-audit-log", "admin_audit.jsonl", "append-only JSONL file recording every admin change; empty keeps the audit log in memory only", "ADMIN_AUDIT_LOG_PATH")
+	utils.StringFlagEnv(fs, &cfg.MetricsListenAddr, "metrics-listen-addr", "", "optional plain HTTP listen address serving unauthenticated /metrics (e.g. 127.0.0.1:9090); /metrics on the API listener always requires a read API token or the admin secret", "METRICS_LISTEN_ADDR")
+	utils.StringFlagEnv(fs, &cfg.AccessLogPath, "access-log", "", "optional JSONL file recording every SNI, raw TCP and UDP flow; /admin/access-log serves recent entries either way", "ACCESS_LOG_PATH")
+	utils.IntFlagEnv(fs, &cfg.AccessLogMaxSizeMB, "access-log-max-size-mb", 100, parsePositiveInt, "rotate the access log file once it reaches this size in MiB", "ACCESS_LOG_MAX_SIZE_MB")
+	utils.IntFlagEnv(fs, &cfg.AccessLogMaxFiles, "access-log-max-files", 5, parsePositiveInt, "number of rotated access log files to keep", "ACCESS_LOG_MAX_FILES")
 	utils.StringFlagEnv(fs, &cfg.ACMEDNSProvider, "acme-dns-provider", "", "ACME DNS provider for managed DNS-01/A-record sync and ENS gasless DNSSEC/TXT automation (cloudflare|gcloud|route53); leave empty to use manual fullchain.pem/privatekey.pem from KEYLESS_DIR", "ACME_DNS_PROVIDER")
 	utils.BoolFlagEnv(fs, &cfg.ENSGaslessEnabled, "ens-gasless-enabled", false, "enable ENS gasless DNS import automation for the managed DNS zone and lease hostnames", "ENS_GASLESS_ENABLED")
 	utils.StringFlagEnv(fs, &cfg.CloudflareToken, "cloudflare-token", "", "Cloudflare DNS API token (required when acme-dns-provider=cloudflare)", "CLOUDFLARE_TOKEN")
@@ -110,6 +161,10 @@ func runServeCommand(args []string) error {
 		Str("portal_url", cfg.PortalURL).
 		Str("identity_path", cfg.IdentityPath).
 		Str("admin_settings_path", cfg.AdminSettingsPath).
+		Str("admin_audit_log_path", cfg.AdminAuditLogPath).
+		Str("metrics_listen_addr", cfg.MetricsListenAddr).
+		Str("access_log_path", cfg.AccessLogPath).
+		Str("quota_usage_path", cfg.QuotaUsagePath).
 		Int("min_port", cfg.MinPort).
 		Int("max_port", cfg.MaxPort).
 		Bool("landing_page_enabled", cfg.LandingPageEnabled).
@@ -118,6 +173,19 @@ func runServeCommand(args []string) error {
 		Bool("ens_gasless_enabled", cfg.ENSGaslessEnabled).
 		Bool("udp_enabled", cfg.UDPEnabled).
 		Bool("tcp_enabled", cfg.TCPEnabled).
+		Int("max_lease_ports", cfg.MaxLeasePorts).
+		Int("max_lease_conns", cfg.MaxLeaseConns).
+		Int("conn_rate_per_ip", cfg.ConnRatePerIP).
+		Int("max_conns_per_ip", cfg.MaxConnsPerIP).
+		Int("conn_idle_timeout", cfg.ConnIdleTimeout).
+		Int("conn_max_lifetime", cfg.ConnMaxLifetime).
+		Int("conn_drain_timeout", cfg.ConnDrainTimeout).
+		Int("max_leases_per_address", cfg.MaxLeasesPerAddr).
+		Int("max_leases_per_ip", cfg.MaxLeasesPerIP).
+		Int("max_lease_ttl", cfg.MaxLeaseTTL).
+		Int("daily_quota_mb", cfg.DailyQuotaMB).
+		Int("monthly_quota_mb", cfg.MonthlyQuotaMB).
+		Bool("offline_page", cfg.OfflinePage).
 		Msg("configured relay server")
 
 	ctx, stop := utils.SignalContext()
@@ -127,6 +195,10 @@ func runServeCommand(args []string) error {
 }
 
 func runServer(ctx context.Context, cfg relayServerConfig) error {
+	adminOperators, err := parseAdminOperators(cfg.AdminOperators)
+	if err != nil {
+		return err
+	}
 	bootstraps, err := utils.ResolvePortalRelayURLs(ctx, utils.SplitCSV(cfg.Bootstraps), cfg.DiscoveryEnabled)
 	if err != nil {
 		return fmt.Errorf("resolve discovery bootstraps: %w", err)
@@ -150,32 +222,122 @@ func runServer(ctx context.Context, cfg relayServerConfig) error {
 			AWSHostedZoneID:    cfg.AWSHostedZoneID,
 			AWSKMSKeyARN:       cfg.AWSDNSSECKMSKeyARN,
 		},
-		APIPort:           cfg.APIPort,
-		SNIPort:           cfg.SNIPort,
-		TrustedProxyCIDRs: cfg.TrustedProxyCIDRs,
-		TrustProxyHeaders: cfg.TrustProxyHeaders,
-		DiscoveryEnabled:  cfg.DiscoveryEnabled,
-		MinPort:           cfg.MinPort,
-		MaxPort:           cfg.MaxPort,
-		UDPEnabled:        cfg.UDPEnabled,
-		TCPEnabled:        cfg.TCPEnabled,
+		APIPort:             cfg.APIPort,
+		SNIPort:             cfg.SNIPort,
+		TrustedProxyCIDRs:   cfg.TrustedProxyCIDRs,
+		TrustProxyHeaders:   cfg.TrustProxyHeaders,
+		AcceptProxyProtocol: cfg.ProxyProtocol,
+		DiscoveryEnabled:    cfg.DiscoveryEnabled,
+		MinPort:             cfg.MinPort,
+		MaxPort:             cfg.MaxPort,
+		UDPEnabled:          cfg.UDPEnabled,
+		TCPEnabled:          cfg.TCPEnabled,
+		MaxLeasePorts:       cfg.MaxLeasePorts,
+		ConnLimits: types.ConnLimits{
+			MaxPerLease: cfg.MaxLeaseConns,
+			RatePerIP:   cfg.ConnRatePerIP,
+			MaxPerIP:    cfg.MaxConnsPerIP,
+		},
+		ConnTimeouts: types.ConnTimeouts{
+			IdleSeconds:     cfg.ConnIdleTimeout,
+			LifetimeSeconds: cfg.ConnMaxLifetime,
+			DrainSeconds:    cfg.ConnDrainTimeout,
+		},
+		MaxConnTimeouts: types.ConnTimeouts{
+			IdleSeconds:     cfg.MaxConnIdleTimeout,
+			LifetimeSeconds: cfg.MaxConnLifetime,
+			DrainSeconds:    cfg.MaxConnDrain,
+		},
+		Quotas: types.QuotaLimits{
+			MaxLeasesPerAddress: cfg.MaxLeasesPerAddr,
+			MaxLeasesPerIP:      cfg.MaxLeasesPerIP,
+			MaxTTLSeconds:       cfg.MaxLeaseTTL,
+			DailyBytes:          int64(cfg.DailyQuotaMB) << 20,
+			MonthlyBytes:        int64(cfg.MonthlyQuotaMB) << 20,
+		},
+		QuotaUsagePath:     cfg.QuotaUsagePath,
+		AccessLogPath:      cfg.AccessLogPath,
+		AccessLogMaxSizeMB: cfg.AccessLogMaxSizeMB,
+		AccessLogMaxFiles:  cfg.AccessLogMaxFiles,
+		OfflinePageEnabled: cfg.OfflinePage,
 	})
 	if err != nil {
 		return fmt.Errorf("create relay server: %w", err)
 	}
 
-	frontend, err := NewFrontend(server, cfg.AdminSecretKey, cfg.AdminSettingsPath, cfg.LandingPageEnabled)
+	frontend, err := NewFrontend(server, cfg.AdminSecretKey, adminOperators, cfg.AdminSettingsPath, cfg.AdminAuditLogPath, cfg.LandingPageEnabled)
 	if err != nil {
 		return fmt.Errorf("create frontend: %w", err)
 	}
+	defer func() {
+		if err := frontend.Close(); err != nil {
+			log.Warn().Err(err).Str("component", "audit-log").Msg("close admin audit log")
+		}
+	}()
 
 	if err := server.Start(ctx, frontend.Handler()); err != nil {
 		return fmt.Errorf("start relay server: %w", err)
 	}
+	if err := startMetricsServer(ctx, cfg.MetricsListenAddr, server.MetricsHandler()); err != nil {
+		_ = server.Shutdown(context.Background())
+		return fmt.Errorf("start metrics server: %w", err)
+	}
 
 	return server.Wait()
 }
 
+func startMetricsServer(ctx context.Context, addr string, handler http.Handler) error {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(types.PathMetrics, handler)
+	metricsServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = metricsServer.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := metricsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("component", "metrics").Msg("metrics server stopped")
+		}
+	}()
+
+	log.Info().
+		Str("component", "metrics").
+		Str("addr", listener.Addr().String()).
+		Msg("metrics server listening")
+	return nil
+}
+
+func parsePositiveInt(raw string, fallback int) int {
+	v, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || v < 1 {
+		return fallback
+	}
+	return v
+}
+
+func parseNonNegativeInt(raw string, fallback int) int {
+	v, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || v < 0 {
+		return fallback
+	}
+	return v
+}
+
 func runHelpCommand(args []string) error {
 	switch len(args) {
 	case 0:
@@ -209,6 +371,7 @@ func printRootUsage(w io.Writer) {
 			"relay-server --portal-url https://portal.example.com",
 			"relay-server --discovery --udp-enabled --min-port 40000 --max-port 40099",
 			"relay-server --landing-page-enabled",
+			"relay-server --access-log /var/log/portal/access.jsonl",
 			"relay-server help",
 		},
 	)
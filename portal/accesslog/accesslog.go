@@ -0,0 +1,294 @@
+// Package accesslog records one entry per tenant connection or UDP flow.
+// Entries are appended as JSON lines to a size-rotated file by a background
+// writer, kept in a bounded in-memory buffer for queries, and fanned out to
+// live subscribers.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	DefaultMaxBytes   = 100 << 20
+	DefaultMaxFiles   = 5
+	DefaultBufferSize = 10000
+
+	subscriberBuffer = 256
+	writeQueueSize   = 4096
+)
+
+type Config struct {
+	Path       string
+	MaxBytes   int64
+	MaxFiles   int
+	BufferSize int
+}
+
+// Filter selects entries by exact lease key, transport and client IP, and by
+// hostname suffix so a filter on a lease hostname also matches its wildcard
+// subdomains.
+type Filter struct {
+	LeaseKey  string
+	Hostname  string
+	ClientIP  string
+	Transport string
+	Since     time.Time
+	Limit     int
+}
+
+func (f Filter) Match(entry types.AccessLogEntry) bool {
+	switch {
+	case f.LeaseKey != "" && entry.LeaseKey != f.LeaseKey:
+		return false
+	case f.Transport != "" && entry.Transport != f.Transport:
+		return false
+	case f.ClientIP != "" && entry.ClientIP != f.ClientIP:
+		return false
+	case f.Hostname != "" && entry.Hostname != f.Hostname && !strings.HasSuffix(entry.Hostname, "."+f.Hostname):
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+type Log struct {
+	cfg         Config
+	entries     []types.AccessLogEntry
+	head        int
+	subscribers map[chan types.AccessLogEntry]struct{}
+	closed      bool
+	mu          sync.Mutex
+
+	// file and size belong to the writer goroutine.
+	file     *os.File
+	size     int64
+	writes   chan types.AccessLogEntry
+	dropped  atomic.Int64
+	done     chan struct{}
+	closeErr error
+}
+
+// New opens the access log. An empty Path keeps entries in memory only.
+func New(cfg Config) (*Log, error) {
+	cfg.Path = strings.TrimSpace(cfg.Path)
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	cfg.MaxFiles = utils.IntOrDefault(cfg.MaxFiles, DefaultMaxFiles)
+	cfg.BufferSize = utils.IntOrDefault(cfg.BufferSize, DefaultBufferSize)
+
+	l := &Log{
+		cfg:         cfg,
+		entries:     make([]types.AccessLogEntry, 0, cfg.BufferSize),
+		subscribers: make(map[chan types.AccessLogEntry]struct{}),
+	}
+	if cfg.Path != "" {
+		if err := utils.EnsureParentDir(cfg.Path); err != nil {
+			return nil, err
+		}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+		l.writes = make(chan types.AccessLogEntry, writeQueueSize)
+		l.done = make(chan struct{})
+		go l.runWriter()
+	}
+	return l, nil
+}
+
+// Record stores entry and queues it for the file writer, so callers never
+// wait on disk I/O. Entries are dropped from the file when the queue is full.
+// It is safe to call on a nil Log.
+func (l *Log) Record(entry types.AccessLogEntry) {
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < l.cfg.BufferSize {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.head] = entry
+		l.head = (l.head + 1) % len(l.entries)
+	}
+	for ch := range l.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+	if l.writes != nil && !l.closed {
+		select {
+		case l.writes <- entry:
+		default:
+			l.dropped.Add(1)
+		}
+	}
+}
+
+// Query returns buffered entries matching filter, newest first.
+func (l *Log) Query(filter Filter) []types.AccessLogEntry {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]types.AccessLogEntry, 0)
+	for i := range len(l.entries) {
+		entry := l.entries[(l.head+len(l.entries)-1-i)%len(l.entries)]
+		if !filter.Match(entry) {
+			continue
+		}
+		out = append(out, entry)
+		if filter.Limit > 0 && len(out) >= filter.Limit {
+			break
+		}
+	}
+	return out
+}
+
+// Subscribe streams new entries until cancel is called. Entries are dropped
+// for subscribers that fall behind.
+func (l *Log) Subscribe() (<-chan types.AccessLogEntry, func()) {
+	ch := make(chan types.AccessLogEntry, subscriberBuffer)
+	if l == nil {
+		close(ch)
+		return ch, func() {}
+	}
+
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.subscribers, ch)
+			l.mu.Unlock()
+		})
+	}
+}
+
+// Close writes the queued entries and closes the file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.closed || l.writes == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.writes)
+	l.mu.Unlock()
+
+	<-l.done
+	return l.closeErr
+}
+
+func (l *Log) runWriter() {
+	defer close(l.done)
+
+	for entry := range l.writes {
+		if l.file == nil {
+			// A failed rotation leaves no file to write to.
+			continue
+		}
+		if err := l.write(entry); err != nil {
+			log.Warn().
+				Err(err).
+				Str("component", "access-log").
+				Str("path", l.cfg.Path).
+				Msg("write access log entry")
+		}
+		if dropped := l.dropped.Swap(0); dropped > 0 {
+			log.Warn().
+				Int64("dropped", dropped).
+				Str("component", "access-log").
+				Str("path", l.cfg.Path).
+				Msg("access log write queue full; entries dropped")
+		}
+	}
+	if l.file != nil {
+		l.closeErr = l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *Log) write(entry types.AccessLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1, dropping the
+// oldest file beyond MaxFiles.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	_ = os.Remove(rotatedPath(l.cfg.Path, l.cfg.MaxFiles))
+	for i := l.cfg.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(l.cfg.Path, i), rotatedPath(l.cfg.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.cfg.Path, rotatedPath(l.cfg.Path, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("stat access log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func rotatedPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
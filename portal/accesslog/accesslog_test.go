@@ -0,0 +1,153 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+func TestLogRotatesAndQueriesNewestFirst(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	accessLog, err := New(Config{Path: path, MaxBytes: 400, MaxFiles: 2, BufferSize: 3})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = accessLog.Close() })
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 10 {
+		transport := "sni"
+		if i%2 == 1 {
+			transport = "udp"
+		}
+		accessLog.Record(types.AccessLogEntry{
+			Time:        start.Add(time.Duration(i) * time.Second),
+			LeaseKey:    "demo",
+			Hostname:    "api.demo.portal.example.com",
+			ClientIP:    "203.0.113.10",
+			Transport:   transport,
+			BytesIn:     int64(i),
+			CloseReason: "client_closed",
+		})
+	}
+
+	// Close drains the writer queue before the files are inspected.
+	if err := accessLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Fatalf("rotated file .2 missing: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("rotated file .3 should not exist, stat error = %v", err)
+	}
+	if lines := assertJSONLines(t, path); lines == 0 {
+		t.Fatal("access log file is empty")
+	}
+
+	entries := accessLog.Query(Filter{})
+	if len(entries) != 3 {
+		t.Fatalf("Query() len = %d, want 3 buffered entries", len(entries))
+	}
+	if entries[0].BytesIn != 9 || entries[2].BytesIn != 7 {
+		t.Fatalf("Query() order = %d..%d, want 9..7", entries[0].BytesIn, entries[2].BytesIn)
+	}
+
+	filtered := accessLog.Query(Filter{Hostname: "demo.portal.example.com", Transport: "udp", Limit: 1})
+	if len(filtered) != 1 || filtered[0].BytesIn != 9 {
+		t.Fatalf("Query(udp, limit 1) = %+v, want entry 9", filtered)
+	}
+	if got := accessLog.Query(Filter{Since: start.Add(9 * time.Second)}); len(got) != 1 {
+		t.Fatalf("Query(since) len = %d, want 1", len(got))
+	}
+}
+
+func TestLogSubscribeReceivesEntries(t *testing.T) {
+	t.Parallel()
+
+	accessLog, err := New(Config{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	entries, cancel := accessLog.Subscribe()
+
+	accessLog.Record(types.AccessLogEntry{Transport: "tcp", CloseReason: "tenant_closed"})
+	select {
+	case entry := <-entries:
+		if entry.Transport != "tcp" || entry.Time.IsZero() {
+			t.Fatalf("subscribed entry = %+v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber did not receive entry")
+	}
+
+	cancel()
+	accessLog.Record(types.AccessLogEntry{Transport: "tcp"})
+	select {
+	case entry := <-entries:
+		t.Fatalf("received entry after cancel: %+v", entry)
+	default:
+	}
+}
+
+func TestLogCloseWritesQueuedEntries(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.jsonl")
+	accessLog, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				accessLog.Record(types.AccessLogEntry{Transport: "sni", CloseReason: "client_closed"})
+			}
+		}()
+	}
+	wg.Wait()
+	if err := accessLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := accessLog.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	accessLog.Record(types.AccessLogEntry{Transport: "sni"})
+
+	if lines := assertJSONLines(t, path); lines != 800 {
+		t.Fatalf("access log lines = %d, want 800", lines)
+	}
+}
+
+func assertJSONLines(t *testing.T, path string) int {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open access log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lines := 0
+	for scanner.Scan() {
+		var entry types.AccessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %d is not an access log entry: %v", lines+1, err)
+		}
+		lines++
+	}
+	return lines
+}
@@ -0,0 +1,118 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certificate"
+
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const customDomainsDirName = "custom-domains"
+
+var (
+	ErrCustomDomainCertificateMissing     = errors.New("custom domain certificate not issued")
+	ErrCustomDomainCertificateUnavailable = errors.New("relay cannot issue custom domain certificates without ACME_DNS_PROVIDER")
+)
+
+// CustomDomainChallengeTarget is the name inside the relay zone that a tenant
+// must CNAME _acme-challenge.<hostname> to before the relay can answer the
+// DNS-01 challenge for hostname.
+func (m *Manager) CustomDomainChallengeTarget(hostname string) string {
+	if m == nil {
+		return ""
+	}
+	return "_acme-challenge." + hostname + "." + m.cfg.BaseDomain
+}
+
+// CanIssueCustomDomainCertificates reports whether the relay manages a DNS
+// zone it can answer custom domain DNS-01 challenges from.
+func (m *Manager) CanIssueCustomDomainCertificates() bool {
+	return m != nil && !utils.IsLocalRelayHost(m.cfg.BaseDomain) && m.managedACME()
+}
+
+// CustomDomainCertificate returns the cached certificate and key for hostname,
+// which may be a custom domain or a lease wildcard such as *.name.root.
+// It reports ErrCustomDomainCertificateMissing when nothing usable is cached,
+// including certificates that are due for renewal.
+func (m *Manager) CustomDomainCertificate(hostname string) ([]byte, []byte, error) {
+	if m == nil {
+		return nil, nil, errors.New("acme manager is nil")
+	}
+	certFile, keyFile := m.customDomainFiles(hostname)
+	if !utils.FileExists(certFile) || !utils.FileExists(keyFile) {
+		return nil, nil, ErrCustomDomainCertificateMissing
+	}
+	needsRenewal, err := certNeedsRenewal(certFile, []string{hostname})
+	if err != nil {
+		return nil, nil, fmt.Errorf("validate custom domain certificate: %w", err)
+	}
+	if needsRenewal {
+		return nil, nil, ErrCustomDomainCertificateMissing
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read custom domain certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read custom domain private key: %w", err)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// IssueCustomDomainCertificate obtains a certificate for hostname through the
+// relay DNS provider. For custom domains lego follows the tenant's
+// _acme-challenge CNAME into the relay zone; lease wildcards already live there.
+func (m *Manager) IssueCustomDomainCertificate(ctx context.Context, hostname string) error {
+	if !m.CanIssueCustomDomainCertificates() {
+		return ErrCustomDomainCertificateUnavailable
+	}
+
+	certFile, keyFile := m.customDomainFiles(hostname)
+	accountKeyFile := filepath.Join(m.cfg.KeyDir, accountKeyFileName)
+	registrationFile := filepath.Join(m.cfg.KeyDir, registrationFileName)
+	for _, path := range []string{certFile, keyFile, accountKeyFile, registrationFile} {
+		if err := utils.EnsureParentDir(path); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("acme provisioning canceled: %w", err)
+	}
+
+	client, err := newClient(ctx, defaultACMEEmailPrefix+m.cfg.BaseDomain, accountKeyFile, registrationFile, m.dns)
+	if err != nil {
+		return err
+	}
+
+	obtained, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{hostname},
+		Bundle:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("obtain custom domain certificate: %w", err)
+	}
+	if len(obtained.Certificate) == 0 || len(obtained.PrivateKey) == 0 {
+		return errors.New("acme obtain response missing certificate or private key")
+	}
+
+	if err := utils.WriteFileAtomic(certFile, obtained.Certificate, 0o644); err != nil {
+		return fmt.Errorf("write certificate chain: %w", err)
+	}
+	if err := utils.WriteFileAtomic(keyFile, obtained.PrivateKey, 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) customDomainFiles(hostname string) (string, string) {
+	dir := filepath.Join(m.cfg.KeyDir, customDomainsDirName, strings.Replace(hostname, "*", "_wildcard", 1))
+	return filepath.Join(dir, fullChainFileName), filepath.Join(dir, keyFileName)
+}
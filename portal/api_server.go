@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -37,7 +38,12 @@ var (
 	errFeatureUnavailable      = &apiError{types.APIErrorCodeFeatureUnavailable, "feature unavailable", http.StatusServiceUnavailable}
 	errHostnameConflict        = &apiError{types.APIErrorCodeHostnameConflict, "hostname conflict", http.StatusConflict}
 	errIPBanned                = &apiError{types.APIErrorCodeIPBanned, "request denied because source IP is banned", http.StatusForbidden}
+	errLeaseDraining           = &apiError{types.APIErrorCodeLeaseDraining, "lease is draining", http.StatusConflict}
+	errLeaseEvicted            = &apiError{types.APIErrorCodeLeaseEvicted, "lease was evicted and may not register yet", http.StatusForbidden}
 	errLeaseNotFound           = &apiError{types.APIErrorCodeLeaseNotFound, "lease not found", http.StatusNotFound}
+	errLeaseQuotaExceeded      = &apiError{types.APIErrorCodeQuotaExceeded, "lease quota exceeded", http.StatusTooManyRequests}
+	errByteQuotaExceeded       = &apiError{types.APIErrorCodeQuotaExceeded, "byte quota exceeded", http.StatusTooManyRequests}
+	errTTLQuotaExceeded        = &apiError{types.APIErrorCodeQuotaExceeded, "requested ttl exceeds the relay maximum", http.StatusBadRequest}
 	errLeaseRejected           = &apiError{types.APIErrorCodeLeaseRejected, "lease is not approved for routing", http.StatusForbidden}
 	errTransportMismatch       = &apiError{types.APIErrorCodeTransportMismatch, "transport mismatch", http.StatusConflict}
 	errUnauthorized            = &apiError{types.APIErrorCodeUnauthorized, "unauthorized", http.StatusForbidden}
@@ -46,6 +52,10 @@ var (
 	errTCPPortDisabled         = &apiError{types.APIErrorCodeTCPPortDisabled, "tcp port disabled", http.StatusForbidden}
 	errTCPPortCapacityExceeded = &apiError{types.APIErrorCodeTCPPortCapacityExceeded, "tcp port capacity exceeded", http.StatusServiceUnavailable}
 	errTCPPortExhausted        = &apiError{types.APIErrorCodeTCPPortExhausted, "no tcp ports available", http.StatusServiceUnavailable}
+	errDomainVerification      = &apiError{types.APIErrorCodeDomainVerification, "custom domain ownership could not be verified", http.StatusForbidden}
+	errCertificatePending      = &apiError{types.APIErrorCodeCertificatePending, "certificate issuance in progress", http.StatusServiceUnavailable}
+	errTooManyPorts            = &apiError{types.APIErrorCodeTooManyPorts, "too many ports requested", http.StatusBadRequest}
+	errInvalidIngressRules     = &apiError{types.APIErrorCodeInvalidIngressRules, "invalid ingress rules", http.StatusBadRequest}
 )
 
 var quicRejectTable = []struct {
@@ -55,6 +65,7 @@ var quicRejectTable = []struct {
 }{
 	{errLeaseNotFound, types.APIErrorCodeLeaseNotFound, "lease not found"},
 	{errLeaseRejected, types.APIErrorCodeLeaseRejected, "lease rejected"},
+	{errLeaseDraining, types.APIErrorCodeLeaseDraining, "lease draining"},
 	{errUnauthorized, types.APIErrorCodeUnauthorized, "unauthorized"},
 	{errTransportMismatch, types.APIErrorCodeTransportMismatch, "transport mismatch"},
 }
@@ -75,7 +86,9 @@ func (s *Server) newAPIServer(listener net.Listener, apiMux *http.ServeMux, apiT
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("configure api signer: %w", err)
 		}
+		signer.SetKeyAuthorizer(s.authorizeSigningKey)
 		keylessSignerHandler = signer.Handler()
+		s.keylessSigner = signer
 	}
 
 	apiServer := &http.Server{
@@ -89,6 +102,7 @@ func (s *Server) newAPIServer(listener net.Listener, apiMux *http.ServeMux, apiT
 		return nil, nil, nil, fmt.Errorf("configure api tls: %w", err)
 	}
 
+	listener = transport.NewProxyProtocolListener(listener, s.proxyTrust())
 	return tls.NewListener(listener, apiServer.TLSConfig), apiServer, apiCloser, nil
 }
 
@@ -105,13 +119,17 @@ func (s *Server) apiHandler(base *http.ServeMux, keylessSignerHandler http.Handl
 		case types.PathSDKDomain:
 			s.handleDomain(w, r)
 		case types.PathSDKRegisterChallenge:
-			s.handleRegisterChallenge(w, r)
+			recordAPIOutcome("register_challenge", w, r, s.handleRegisterChallenge)
 		case types.PathSDKRegister:
-			s.handleRegister(w, r)
+			recordAPIOutcome("register", w, r, s.handleRegister)
 		case types.PathSDKRenew:
-			s.handleRenew(w, r)
+			recordAPIOutcome("renew", w, r, s.handleRenew)
 		case types.PathSDKUnregister:
-			s.handleUnregister(w, r)
+			recordAPIOutcome("unregister", w, r, s.handleUnregister)
+		case types.PathSDKDrain:
+			recordAPIOutcome("drain", w, r, s.handleDrain)
+		case types.PathSDKDomainCertificate:
+			recordAPIOutcome("domain_certificate", w, r, s.handleDomainCertificate)
 		case types.PathSDKConnect:
 			s.handleConnect(w, r)
 		case types.PathDiscovery:
@@ -280,6 +298,29 @@ func (s *Server) handleRegisterChallenge(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	customDomains, err := s.normalizeCustomDomains(req.CustomDomains)
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	req.CustomDomains = customDomains
+	if len(req.Aliases) > types.MaxLeaseAliases {
+		writeAPIErrorResponse(w, fmt.Errorf("at most %d aliases are allowed per lease", types.MaxLeaseAliases))
+		return
+	}
+	for _, alias := range req.Aliases {
+		if _, err := utils.NormalizeDNSLabel(alias); err != nil {
+			writeAPIErrorResponse(w, fmt.Errorf("invalid alias %q: %w", alias, err))
+			return
+		}
+	}
+	instanceID, err := normalizeReplica(req)
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	req.InstanceID = instanceID
+
 	resp, err := s.registry.issueRegisterChallenge(req, domain, registerURI)
 	if err != nil {
 		writeAPIErrorResponse(w, err)
@@ -310,16 +351,25 @@ func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ttl := defaultLeaseTTL
-	if req.TTL > 0 {
-		ttl = time.Duration(req.TTL) * time.Second
+	if s.registry.policy.Quotas().Exceeded(claims.Identity.Address) {
+		writeAPIErrorResponse(w, errByteQuotaExceeded)
+		return
 	}
-	record, err := s.registry.Renew(claims.Identity, ttl, clientIP, utils.SanitizeReportedIP(req.ReportedIP))
+	if err := s.recheckCustomDomains(r.Context(), claims.Identity, claims.InstanceID, time.Now()); err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	ttl, err := s.leaseTTL(req.TTL, claims.Identity.Address)
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	record, err := s.registry.Renew(claims.Identity, claims.InstanceID, ttl, clientIP, utils.SanitizeReportedIP(req.ReportedIP))
 	if err != nil {
 		writeAPIErrorResponse(w, err)
 		return
 	}
-	nextAccessToken, _, err := auth.IssueLeaseAccessToken(s.identity.PrivateKey, s.identity.Address, s.cfg.PortalURL, record.Copy(), ttl)
+	nextAccessToken, _, err := auth.IssueLeaseAccessToken(s.identity.PrivateKey, s.identity.Address, s.cfg.PortalURL, record.Copy(), record.InstanceID, ttl)
 	if err != nil {
 		utils.WriteAPIError(w, http.StatusInternalServerError, types.APIErrorCodeInternal, err.Error())
 		return
@@ -346,23 +396,12 @@ func (s *Server) handleUnregister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	record, err := s.registry.Unregister(claims.Identity)
+	record, err := s.registry.Unregister(claims.Identity, claims.InstanceID)
 	if err != nil {
 		writeAPIErrorResponse(w, err)
 		return
 	}
-	deleteCtx, cancel := context.WithTimeout(context.Background(), defaultClaimTimeout)
-	defer cancel()
-	if err := s.acmeManager.DeleteENSGaslessHostname(deleteCtx, record.Hostname); err != nil {
-		log.Warn().
-			Err(err).
-			Str("hostname", record.Hostname).
-			Str("address", record.Address).
-			Msg("delete lease ens gasless txt")
-	}
-	if record != nil {
-		record.Close()
-	}
+	s.releaseLease(record, "delete lease ens gasless txt")
 
 	utils.WriteAPIData(w, http.StatusOK, map[string]any{})
 }
@@ -400,7 +439,12 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"); err != nil {
+	multiplex := strings.TrimSpace(r.Header.Get(types.HeaderStreamMux)) == types.StreamMuxVersion
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n"
+	if multiplex {
+		response += types.HeaderStreamMux + ": " + types.StreamMuxVersion + "\r\n"
+	}
+	if _, err := rw.WriteString(response + "\r\n"); err != nil {
 		_ = conn.Close()
 		return
 	}
@@ -413,21 +457,30 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	if conn.RemoteAddr() != nil {
 		remoteAddr = conn.RemoteAddr().String()
 	}
-	if err := lease.stream.OfferConn(conn); err != nil {
+	offer := lease.stream.OfferConn
+	switch {
+	case multiplex:
+		offer = lease.stream.OfferMux
+	case r.Header.Get(types.HeaderReadyDemand) == "1":
+		offer = lease.stream.OfferDemandConn
+	}
+	if err := offer(conn); err != nil {
 		log.Warn().
 			Err(err).
 			Str("address", lease.Address).
 			Str("lease_name", lease.Name).
 			Str("remote_addr", remoteAddr).
+			Bool("multiplex", multiplex).
 			Msg("sdk reverse rejected")
 		return
 	}
 
-	s.registry.Touch(lease.Copy(), clientIP, time.Now())
+	s.registry.Touch(lease.Copy(), lease.InstanceID, clientIP, time.Now())
 	log.Info().
 		Str("address", lease.Address).
 		Str("lease_name", lease.Name).
 		Str("remote_addr", remoteAddr).
+		Bool("multiplex", multiplex).
 		Int("ready", lease.stream.ReadyCount()).
 		Msg("sdk reverse connected")
 }
@@ -457,7 +510,8 @@ func (s *Server) handleQUICTunnelConn(conn *quic.Conn) {
 		_ = conn.CloseWithError(1, reason)
 	}
 
-	lease, err := s.admitLeaseByToken(msg.AccessToken, true)
+	streamMode := msg.Mode == types.QUICModeStream
+	lease, err := s.admitLeaseByToken(msg.AccessToken, !streamMode)
 	if err != nil {
 		code, reason := types.APIErrorCodeInvalidRequest, "invalid control message"
 		for _, entry := range quicRejectTable {
@@ -470,6 +524,11 @@ func (s *Server) handleQUICTunnelConn(conn *quic.Conn) {
 		return
 	}
 
+	if streamMode {
+		s.acceptQUICStreamCarrier(conn, stream, lease)
+		return
+	}
+
 	if err := lease.datagram.Register(conn); err != nil {
 		_ = json.NewEncoder(stream).Encode(types.QUICControlResponse{OK: false, Error: "broker_closed"})
 		_ = conn.CloseWithError(1, "broker closed")
@@ -477,7 +536,7 @@ func (s *Server) handleQUICTunnelConn(conn *quic.Conn) {
 	}
 
 	_ = json.NewEncoder(stream).Encode(types.QUICControlResponse{OK: true})
-	s.registry.Touch(lease.Copy(), conn.RemoteAddr().String(), time.Now())
+	s.registry.Touch(lease.Copy(), lease.InstanceID, conn.RemoteAddr().String(), time.Now())
 	log.Info().
 		Str("component", "quic-tunnel-listener").
 		Str("address", lease.Address).
@@ -486,12 +545,47 @@ func (s *Server) handleQUICTunnelConn(conn *quic.Conn) {
 		Msg("quic tunnel connected")
 }
 
+// acceptQUICStreamCarrier hands a QUIC connection that asked for stream
+// transport to the lease. The control stream stays open so the SDK can
+// announce go-away when it stops taking new streams.
+func (s *Server) acceptQUICStreamCarrier(conn *quic.Conn, control *quic.Stream, lease *leaseRecord) {
+	if err := lease.stream.OfferQUIC(conn, control); err != nil {
+		code := "broker_closed"
+		if errors.Is(err, transport.ErrStreamDraining) {
+			code = types.APIErrorCodeLeaseDraining
+		}
+		_ = json.NewEncoder(control).Encode(types.QUICControlResponse{OK: false, Error: code})
+		_ = conn.CloseWithError(1, "stream carrier rejected")
+		log.Warn().
+			Err(err).
+			Str("component", "quic-tunnel-listener").
+			Str("address", lease.Address).
+			Str("lease_name", lease.Name).
+			Str("remote_addr", conn.RemoteAddr().String()).
+			Msg("sdk quic stream carrier rejected")
+		return
+	}
+	if err := json.NewEncoder(control).Encode(types.QUICControlResponse{OK: true}); err != nil {
+		_ = conn.CloseWithError(1, "control write failed")
+		return
+	}
+
+	s.registry.Touch(lease.Copy(), lease.InstanceID, conn.RemoteAddr().String(), time.Now())
+	log.Info().
+		Str("component", "quic-tunnel-listener").
+		Str("address", lease.Address).
+		Str("lease_name", lease.Name).
+		Str("remote_addr", conn.RemoteAddr().String()).
+		Int("ready", lease.stream.ReadyCount()).
+		Msg("sdk quic stream carrier connected")
+}
+
 func (s *Server) admitLeaseByToken(token string, requireDatagram bool) (*leaseRecord, error) {
 	claims, err := auth.VerifyLeaseAccessToken(token, s.identity.PublicKey, s.cfg.PortalURL, time.Now().UTC())
 	if err != nil {
 		return nil, errUnauthorized
 	}
-	lease, err := s.registry.Find(claims.Identity)
+	lease, err := s.registry.Find(claims.Identity, claims.InstanceID)
 	if err != nil {
 		return nil, err
 	}
@@ -501,9 +595,29 @@ func (s *Server) admitLeaseByToken(token string, requireDatagram bool) (*leaseRe
 	if lease.stream == nil || (requireDatagram && lease.datagram == nil) {
 		return nil, errTransportMismatch
 	}
+	if lease.stream.Draining() {
+		return nil, errLeaseDraining
+	}
 	return lease, nil
 }
 
+// leaseTTL resolves a TTL requested in seconds against the quota of address.
+// Zero picks the default TTL, shortened to the quota if needed.
+func (s *Server) leaseTTL(requested int, address string) (time.Duration, error) {
+	ttl := defaultLeaseTTL
+	if requested > 0 {
+		ttl = time.Duration(requested) * time.Second
+	}
+	maxTTL := s.registry.policy.Quotas().Limits(address).MaxTTLSeconds
+	if maxTTL <= 0 {
+		return ttl, nil
+	}
+	if requested > maxTTL {
+		return 0, errTTLQuotaExceeded
+	}
+	return min(ttl, time.Duration(maxTTL)*time.Second), nil
+}
+
 func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, reportedIP string) (types.RegisterResponse, error) {
 	identity, err := utils.NormalizeIdentity(req.Identity)
 	if err != nil {
@@ -512,16 +626,53 @@ func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, rep
 	if s.registry.policy.IPFilter().IsIPBanned(clientIP) {
 		return types.RegisterResponse{}, errIPBanned
 	}
+	if err := s.registry.checkEvicted(identity); err != nil {
+		return types.RegisterResponse{}, err
+	}
+	if err := s.registry.checkQuota(identity, clientIP); err != nil {
+		return types.RegisterResponse{}, err
+	}
 	hostname, err := utils.LeaseHostname(identity.Name, s.identity.Name)
 	if err != nil {
 		return types.RegisterResponse{}, err
 	}
 
-	ttl := defaultLeaseTTL
-	if req.TTL > 0 {
-		ttl = time.Duration(req.TTL) * time.Second
+	aliases, err := s.leaseAliases(req.Aliases, hostname)
+	if err != nil {
+		return types.RegisterResponse{}, err
+	}
+	var wildcard string
+	if req.Wildcard {
+		wildcard = "*." + hostname
+	}
+	customDomains, err := s.normalizeCustomDomains(req.CustomDomains)
+	if err != nil {
+		return types.RegisterResponse{}, err
+	}
+	if err := s.verifyCustomDomains(context.Background(), customDomains, identity.Address); err != nil {
+		return types.RegisterResponse{}, err
+	}
+	instanceID, err := normalizeReplica(req)
+	if err != nil {
+		return types.RegisterResponse{}, err
+	}
+	ingress, err := utils.NormalizeIngressRules(req.Ingress)
+	if err != nil {
+		return types.RegisterResponse{}, errInvalidIngressRules
 	}
 
+	ttl, err := s.leaseTTL(req.TTL, identity.Address)
+	if err != nil {
+		return types.RegisterResponse{}, err
+	}
+
+	portRequests, portMarkers, err := s.leasePortRequests(req)
+	if err != nil {
+		return types.RegisterResponse{}, err
+	}
+	req.UDPEnabled = slices.ContainsFunc(portRequests, func(p types.PortRequest) bool { return p.Protocol == types.PortProtocolUDP })
+	req.TCPEnabled = slices.ContainsFunc(portRequests, func(p types.PortRequest) bool { return p.Protocol == types.PortProtocolTCP })
+
 	if req.UDPEnabled {
 		if !s.cfg.UDPEnabled || s.group != nil && s.quicTunnel == nil {
 			return types.RegisterResponse{}, errFeatureUnavailable
@@ -544,7 +695,7 @@ func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, rep
 			return types.RegisterResponse{}, errTCPPortCapacityExceeded
 		}
 	}
-	accessToken, claims, err := auth.IssueLeaseAccessToken(s.identity.PrivateKey, s.identity.Address, s.cfg.PortalURL, identity, ttl)
+	accessToken, claims, err := auth.IssueLeaseAccessToken(s.identity.PrivateKey, s.identity.Address, s.cfg.PortalURL, identity, instanceID, ttl)
 	if err != nil {
 		return types.RegisterResponse{}, err
 	}
@@ -552,42 +703,71 @@ func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, rep
 	expiresAt := claims.Expiry.Time().UTC()
 	identityKey := identity.Key()
 	stream := transport.NewRelayStream(identityKey, defaultIdleKeepalive, defaultReadyQueueLimit)
+	stream.SetProxyHeaders(req.ProxyProtocol)
 	record := &leaseRecord{
-		Identity:    identity,
-		Hostname:    hostname,
-		Metadata:    req.Metadata.Copy(),
-		ExpiresAt:   expiresAt,
-		FirstSeenAt: issuedAt,
-		LastSeenAt:  issuedAt,
-		ClientIP:    clientIP,
-		ReportedIP:  utils.SanitizeReportedIP(reportedIP),
-		UDPEnabled:  req.UDPEnabled,
-		TCPEnabled:  req.TCPEnabled,
-		stream:      stream,
+		Identity:      identity,
+		Hostname:      hostname,
+		CustomDomains: customDomains,
+		Aliases:       aliases,
+		Wildcard:      wildcard,
+		InstanceID:    instanceID,
+		ReplicaWeight: req.ReplicaWeight,
+		ReplicaPolicy: req.ReplicaPolicy,
+		Metadata:      req.Metadata.Copy(),
+		ExpiresAt:     expiresAt,
+		FirstSeenAt:   issuedAt,
+		LastSeenAt:    issuedAt,
+		ClientIP:      clientIP,
+		ReportedIP:    utils.SanitizeReportedIP(reportedIP),
+		UDPEnabled:    req.UDPEnabled,
+		TCPEnabled:    req.TCPEnabled,
+		OfflinePage:   s.cfg.OfflinePageEnabled,
+		ConnTimeouts:  req.ConnTimeouts.Within(s.cfg.ConnTimeouts, s.cfg.MaxConnTimeouts),
+		Ingress:       ingress,
+		ingressACL:    policy.NewIngressACL(ingress),
+		quota:         s.registry.policy.Quotas().Meter(identity.Address),
+		stream:        stream,
+	}
+	record.domainsCheckedAt.Store(time.Now().UnixNano())
+	record.Ports, err = s.allocateLeasePorts(identity.Name, portRequests)
+	if err != nil {
+		return types.RegisterResponse{}, err
 	}
-	if req.UDPEnabled {
-		if s.ports == nil {
-			return types.RegisterResponse{}, errors.New("udp port allocation not available")
-		}
-		port, err := s.ports.Allocate(identity.Name)
-		if err != nil {
-			return types.RegisterResponse{}, err
+	var udpPorts, udpIndexes, tcpPorts, tcpIndexes []int
+	for i, mapping := range record.Ports {
+		if mapping.Protocol == types.PortProtocolUDP {
+			udpPorts, udpIndexes = append(udpPorts, mapping.Port), append(udpIndexes, i)
+		} else {
+			tcpPorts, tcpIndexes = append(tcpPorts, mapping.Port), append(tcpIndexes, i)
 		}
-		record.datagram = transport.NewRelayDatagram(identityKey, port)
+	}
+	if len(udpPorts) > 0 {
+		record.datagram = transport.NewRelayDatagram(identityKey, udpPorts, transport.RelayDatagramOptions{
+			BPS:        s.registry.policy.BPSManager(),
+			Indexes:    udpIndexes,
+			Version:    types.NegotiateDatagramVersion(req.DatagramVersion),
+			IPFilter:   s.registry.policy.IPFilter(),
+			IngressACL: record.ingressACL,
+			Quota:      record.quota,
+			RecordFlow: s.leaseAccessRecorder(record),
+		})
 		record.ports = s.ports
 	}
-	if req.TCPEnabled {
-		if s.tcpPorts == nil {
-			return types.RegisterResponse{}, errors.New("tcp port allocation not available")
+	if len(tcpPorts) > 0 {
+		opts := transport.RelayTCPPortOptions{
+			BPS:        s.registry.policy.BPSManager(),
+			ProxyTrust: s.proxyTrust(),
+			ConnLimits: s.registry.policy.ConnLimiter(),
+			IPFilter:   s.registry.policy.IPFilter(),
+			IngressACL: record.ingressACL,
+			Quota:      record.quota,
+			Timeouts:   record.ConnTimeouts,
+			RecordConn: s.leaseAccessRecorder(record),
 		}
-		port, err := s.tcpPorts.Allocate(identity.Name)
-		if err != nil {
-			if errors.Is(err, transport.ErrPortExhausted) {
-				return types.RegisterResponse{}, errTCPPortExhausted
-			}
-			return types.RegisterResponse{}, err
+		if portMarkers {
+			opts.Markers = tcpIndexes
 		}
-		record.tcpPort = transport.NewRelayTCPPort(identityKey, port, stream)
+		record.tcpPort = transport.NewRelayTCPPort(identityKey, tcpPorts, stream, opts)
 		record.tcpPorts = s.tcpPorts
 	}
 
@@ -603,10 +783,11 @@ func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, rep
 	syncCtx, cancel := context.WithTimeout(context.Background(), defaultClaimTimeout)
 	defer cancel()
 	if err := s.acmeManager.SyncENSGaslessHostname(syncCtx, record.Hostname, record.Address); err != nil {
-		_, _ = s.registry.Unregister(record.Copy())
+		_, _ = s.registry.Unregister(record.Copy(), record.InstanceID)
 		record.Close()
 		return types.RegisterResponse{}, err
 	}
+	s.loadCustomDomainKeys(record.certificateHostnames())
 
 	resp := types.RegisterResponse{
 		Identity:    record.Copy(),
@@ -615,18 +796,105 @@ func (s *Server) registerLease(req types.RegisterChallengeRequest, clientIP, rep
 		AccessToken: accessToken,
 		UDPEnabled:  record.UDPEnabled,
 		TCPEnabled:  record.TCPEnabled,
+
+		ProxyProtocol: stream.ProxyHeaders(),
+		OfflinePage:   record.OfflinePage,
+		QUICStreams:   s.quicTunnel != nil,
+		ReadyLimit:    stream.ReadyLimit(),
+		CustomDomains: record.CustomDomains,
+		Aliases:       record.Aliases,
+
+		WildcardHostname: record.Wildcard,
+		InstanceID:       record.InstanceID,
+	}
+	if resp.QUICStreams {
+		resp.SNIPort = s.cfg.SNIPort
 	}
 	if record.datagram != nil {
 		resp.SNIPort = s.cfg.SNIPort
 		resp.UDPAddr = fmt.Sprintf("%s:%d", s.identity.Name, record.datagram.UDPPort())
+		resp.DatagramVersion = record.datagram.Version()
 	}
 	if record.tcpPort != nil {
 		resp.TCPAddr = fmt.Sprintf("%s:%d", s.identity.Name, record.tcpPort.TCPPort())
 	}
+	resp.Ports = record.portMappings(s.identity.Name)
+	resp.ConnTimeouts = record.ConnTimeouts
 
 	return resp, nil
 }
 
+// leasePortRequests returns the ports a registration asks for, in the order
+// RegisterResponse.Ports will list them. Legacy requests that only set
+// UDPEnabled or TCPEnabled get one port of each; markers reports whether the
+// tenant asked for explicit ports and so expects port markers on TCP
+// sessions.
+func (s *Server) leasePortRequests(req types.RegisterChallengeRequest) (requests []types.PortRequest, markers bool, err error) {
+	if len(req.Ports) == 0 {
+		if req.UDPEnabled {
+			requests = append(requests, types.PortRequest{Protocol: types.PortProtocolUDP})
+		}
+		if req.TCPEnabled {
+			requests = append(requests, types.PortRequest{Protocol: types.PortProtocolTCP})
+		}
+		return requests, false, nil
+	}
+
+	counts := make(map[string]int, 2)
+	for _, port := range req.Ports {
+		switch port.Protocol {
+		case types.PortProtocolTCP, types.PortProtocolUDP:
+		default:
+			return nil, false, fmt.Errorf("unsupported port protocol %q", port.Protocol)
+		}
+		if port.Port < 0 || port.Port > 65535 {
+			return nil, false, fmt.Errorf("invalid %s port %d", port.Protocol, port.Port)
+		}
+		counts[port.Protocol]++
+		if counts[port.Protocol] > s.cfg.MaxLeasePorts {
+			return nil, false, errTooManyPorts
+		}
+	}
+	return req.Ports, true, nil
+}
+
+// allocateLeasePorts allocates a public port for each request, preferring
+// the requested port number when it is free or still reserved for name. On
+// failure the ports allocated so far are released.
+func (s *Server) allocateLeasePorts(name string, requests []types.PortRequest) ([]types.PortMapping, error) {
+	mappings := make([]types.PortMapping, 0, len(requests))
+	release := func() {
+		for _, mapping := range mappings {
+			if mapping.Protocol == types.PortProtocolUDP {
+				s.ports.Release(mapping.Port)
+			} else {
+				s.tcpPorts.Release(mapping.Port)
+			}
+		}
+	}
+
+	for _, request := range requests {
+		allocator, label := s.tcpPorts, "tcp"
+		if request.Protocol == types.PortProtocolUDP {
+			allocator, label = s.ports, "udp"
+		}
+		if allocator == nil {
+			release()
+			return nil, fmt.Errorf("%s port allocation not available", label)
+		}
+		port, err := allocator.AllocatePort(name, request.Port)
+		if err != nil {
+			release()
+			if errors.Is(err, transport.ErrPortExhausted) && request.Protocol == types.PortProtocolTCP {
+				return nil, errTCPPortExhausted
+			}
+			return nil, err
+		}
+		mappings = append(mappings, types.PortMapping{Protocol: request.Protocol, Port: port})
+	}
+	return mappings, nil
+}
+
 func (s *Server) runAPIServer() error {
 	err := s.apiServer.Serve(s.apiListener)
 	if err == nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
@@ -0,0 +1,230 @@
+// Package auditlog keeps the append-only record of admin mutations. Entries
+// are appended as JSON lines, and the newest ones are loaded back into a
+// bounded in-memory buffer at startup so queries also cover history from
+// before a restart.
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	DefaultBufferSize = 10000
+
+	maxLineBytes = 1 << 20
+)
+
+type Config struct {
+	Path       string
+	BufferSize int
+}
+
+// Filter selects entries by exact actor and target, by action or action
+// prefix ("lease" matches "lease.ban"), and by time range.
+type Filter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f Filter) Match(entry types.AdminAuditEntry) bool {
+	switch {
+	case f.Actor != "" && !strings.EqualFold(entry.Actor, f.Actor):
+		return false
+	case f.Action != "" && entry.Action != f.Action && !strings.HasPrefix(entry.Action, f.Action+"."):
+		return false
+	case f.Target != "" && entry.Target != f.Target:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+type Log struct {
+	cfg     Config
+	file    *os.File
+	entries []types.AdminAuditEntry
+	head    int
+	mu      sync.Mutex
+}
+
+// New opens the audit log and loads its newest entries. An empty Path keeps
+// entries in memory only.
+func New(cfg Config) (*Log, error) {
+	cfg.Path = strings.TrimSpace(cfg.Path)
+	cfg.BufferSize = utils.IntOrDefault(cfg.BufferSize, DefaultBufferSize)
+
+	l := &Log{
+		cfg:     cfg,
+		entries: make([]types.AdminAuditEntry, 0, cfg.BufferSize),
+	}
+	if cfg.Path == "" {
+		return l, nil
+	}
+	if err := utils.EnsureParentDir(cfg.Path); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	if err := terminateLastLine(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Record appends entry and syncs the file before returning, so an admin
+// action is on disk by the time it is acknowledged. It is safe to call on
+// a nil Log.
+func (l *Log) Record(entry types.AdminAuditEntry) {
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bufferLocked(entry)
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("component", "audit-log").
+			Str("path", l.cfg.Path).
+			Str("action", entry.Action).
+			Msg("write audit log entry")
+	}
+}
+
+// Query returns buffered entries matching filter, newest first.
+func (l *Log) Query(filter Filter) []types.AdminAuditEntry {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]types.AdminAuditEntry, 0)
+	for i := range len(l.entries) {
+		entry := l.entries[(l.head+len(l.entries)-1-i)%len(l.entries)]
+		if !filter.Match(entry) {
+			continue
+		}
+		out = append(out, entry)
+		if filter.Limit > 0 && len(out) >= filter.Limit {
+			break
+		}
+	}
+	return out
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *Log) bufferLocked(entry types.AdminAuditEntry) {
+	if len(l.entries) < l.cfg.BufferSize {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.head] = entry
+	l.head = (l.head + 1) % len(l.entries)
+}
+
+// terminateLastLine appends a newline when the file ends in a partial line,
+// so the next entry starts on a line of its own.
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return fmt.Errorf("read audit log: %w", err)
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	if _, err := file.Write([]byte{'\n'}); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// load buffers the entries already in the file. Lines that do not parse,
+// such as one cut short by a crash, are skipped.
+func (l *Log) load() error {
+	file, err := os.Open(l.cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineBytes)
+	for scanner.Scan() {
+		var entry types.AdminAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		l.bufferLocked(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+func TestLogReloadsEntriesAcrossRestarts(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	auditLog.Record(types.AdminAuditEntry{
+		Time:   start,
+		Actor:  "0x1111111111111111111111111111111111111111",
+		Action: "lease.ban",
+		Target: "demo:0x2222222222222222222222222222222222222222",
+		Old:    json.RawMessage(`{"banned":false}`),
+		New:    json.RawMessage(`{"banned":true}`),
+	})
+	auditLog.Record(types.AdminAuditEntry{
+		Time:   start.Add(time.Second),
+		Actor:  "admin_key",
+		Action: "ip.deny",
+		Target: "198.51.100.0/24",
+	})
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	_, _ = file.WriteString("{\"time\":\"2026-01-02T03:04:0")
+	_ = file.Close()
+
+	reopened, err := New(Config{Path: path, BufferSize: 10})
+	if err != nil {
+		t.Fatalf("New() after restart error = %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+	reopened.Record(types.AdminAuditEntry{
+		Time:   start.Add(2 * time.Second),
+		Actor:  "token:abcd",
+		Action: "lease.ban.delete",
+		Target: "demo:0x2222222222222222222222222222222222222222",
+	})
+
+	entries := reopened.Query(Filter{})
+	if len(entries) != 3 || entries[0].Action != "lease.ban.delete" || entries[2].Action != "lease.ban" {
+		t.Fatalf("Query() = %+v, want the two reloaded entries after the new one", entries)
+	}
+	if string(entries[2].New) != `{"banned":true}` {
+		t.Fatalf("reloaded New = %s, want the recorded value", entries[2].New)
+	}
+
+	leaseEntries := reopened.Query(Filter{Action: "lease.ban"})
+	if len(leaseEntries) != 2 {
+		t.Fatalf("Query(action lease.ban) len = %d, want ban and its delete", len(leaseEntries))
+	}
+	if got := reopened.Query(Filter{Action: "lease"}); len(got) != 2 {
+		t.Fatalf("Query(action lease) len = %d, want 2", len(got))
+	}
+	if got := reopened.Query(Filter{Actor: "ADMIN_KEY"}); len(got) != 1 || got[0].Target != "198.51.100.0/24" {
+		t.Fatalf("Query(actor) = %+v, want the ip.deny entry", got)
+	}
+	if got := reopened.Query(Filter{Since: start.Add(time.Second), Until: start.Add(2 * time.Second)}); len(got) != 1 || got[0].Action != "ip.deny" {
+		t.Fatalf("Query(since, until) = %+v, want the ip.deny entry", got)
+	}
+
+	// The entry written after the partial line must survive another restart.
+	again, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() after second restart error = %v", err)
+	}
+	t.Cleanup(func() { _ = again.Close() })
+	if got := again.Query(Filter{}); len(got) != 3 || got[0].Actor != "token:abcd" {
+		t.Fatalf("Query() after second restart = %+v, want 3 entries", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 
 const (
 	registerStatement        = "Register a portal lease"
+	adminLoginStatement      = "Sign in to the portal relay admin"
 	leaseAccessTokenAudience = "portal-sdk"
 )
 
@@ -33,7 +35,8 @@ const leaseTokenAlgorithm = jose.SignatureAlgorithm("ES256K")
 
 type LeaseAccessTokenClaims struct {
 	jwt.Claims
-	Identity types.Identity `json:"identity"`
+	Identity   types.Identity `json:"identity"`
+	InstanceID string         `json:"instance_id,omitempty"`
 }
 
 type es256kOpaqueSigner struct {
@@ -120,10 +123,15 @@ func NewRegisterChallenge(req types.RegisterChallengeRequest, domain, uri string
 		return nil, err
 	}
 
+	ingress, err := utils.NormalizeIngressRules(req.Ingress)
+	if err != nil {
+		return nil, err
+	}
+
 	challengeID := utils.RandomID("rch_")
 	nonce := siwe.GenerateNonce()
 	expiresAt := now.UTC().Add(ttl)
-	siweMessage, err := BuildRegisterChallengeMessage(domain, normalizedIdentity.Address, uri, challengeID, nonce, now.UTC(), expiresAt)
+	siweMessage, err := BuildRegisterChallengeMessage(domain, normalizedIdentity.Address, uri, challengeID, nonce, now.UTC(), expiresAt, ingress.SIWEResources())
 	if err != nil {
 		return nil, err
 	}
@@ -134,6 +142,19 @@ func NewRegisterChallenge(req types.RegisterChallengeRequest, domain, uri string
 		TTL:        req.TTL,
 		UDPEnabled: req.UDPEnabled,
 		TCPEnabled: req.TCPEnabled,
+
+		ProxyProtocol: req.ProxyProtocol,
+		CustomDomains: append([]string(nil), req.CustomDomains...),
+		Aliases:       append([]string(nil), req.Aliases...),
+		Wildcard:      req.Wildcard,
+		InstanceID:    req.InstanceID,
+		ReplicaWeight: req.ReplicaWeight,
+		ReplicaPolicy: req.ReplicaPolicy,
+
+		DatagramVersion: req.DatagramVersion,
+		Ports:           append([]types.PortRequest(nil), req.Ports...),
+		ConnTimeouts:    req.ConnTimeouts,
+		Ingress:         ingress,
 	}
 
 	return &RegisterChallenge{
@@ -146,14 +167,33 @@ func NewRegisterChallenge(req types.RegisterChallengeRequest, domain, uri string
 	}, nil
 }
 
-func BuildRegisterChallengeMessage(domain, address, uri, challengeID, nonce string, issuedAt, expiresAt time.Time) (string, error) {
-	message, err := siwe.InitMessage(domain, address, uri, nonce, map[string]interface{}{
-		"statement":      registerStatement,
+// BuildRegisterChallengeMessage builds the SIWE message a lease owner signs
+// to register. Resources lists request settings the signature must cover,
+// such as types.IngressRules.SIWEResources.
+func BuildRegisterChallengeMessage(domain, address, uri, challengeID, nonce string, issuedAt, expiresAt time.Time, resources []string) (string, error) {
+	return buildChallengeMessage(registerStatement, domain, address, uri, challengeID, nonce, issuedAt, expiresAt, resources)
+}
+
+func buildChallengeMessage(statement, domain, address, uri, challengeID, nonce string, issuedAt, expiresAt time.Time, resources []string) (string, error) {
+	options := map[string]interface{}{
+		"statement":      statement,
 		"chainId":        1,
 		"issuedAt":       issuedAt.UTC().Format(time.RFC3339),
 		"expirationTime": expiresAt.UTC().Format(time.RFC3339),
 		"requestId":      challengeID,
-	})
+	}
+	if len(resources) > 0 {
+		uris := make([]url.URL, 0, len(resources))
+		for _, resource := range resources {
+			parsed, err := url.Parse(resource)
+			if err != nil {
+				return "", fmt.Errorf("build siwe resource %q: %w", resource, err)
+			}
+			uris = append(uris, *parsed)
+		}
+		options["resources"] = uris
+	}
+	message, err := siwe.InitMessage(domain, address, uri, nonce, options)
 	if err != nil {
 		return "", fmt.Errorf("build siwe message: %w", err)
 	}
@@ -180,6 +220,62 @@ func (c *RegisterChallenge) Verify(req types.RegisterRequest, now time.Time) err
 	return nil
 }
 
+// AdminLoginChallenge is a SIWE message an admin operator signs with the
+// wallet of Address to open an admin session.
+type AdminLoginChallenge struct {
+	ChallengeID string
+	Address     string
+	ExpiresAt   time.Time
+	SIWEMessage string
+
+	domain string
+	nonce  string
+}
+
+func NewAdminLoginChallenge(address, domain, uri string, now time.Time, ttl time.Duration) (*AdminLoginChallenge, error) {
+	normalizedAddress, err := utils.NormalizeEVMAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	challengeID := utils.RandomID("alc_")
+	nonce := siwe.GenerateNonce()
+	expiresAt := now.UTC().Add(ttl)
+	siweMessage, err := buildChallengeMessage(adminLoginStatement, domain, normalizedAddress, uri, challengeID, nonce, now.UTC(), expiresAt, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AdminLoginChallenge{
+		ChallengeID: challengeID,
+		Address:     normalizedAddress,
+		ExpiresAt:   expiresAt,
+		SIWEMessage: siweMessage,
+		domain:      strings.TrimSpace(domain),
+		nonce:       nonce,
+	}, nil
+}
+
+func (c *AdminLoginChallenge) Expired(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	return now.UTC().After(c.ExpiresAt)
+}
+
+func (c *AdminLoginChallenge) Verify(message, signature string, now time.Time) error {
+	if c == nil {
+		return ErrChallengeNotFound
+	}
+	if strings.TrimSpace(message) != c.SIWEMessage {
+		return ErrMessageMismatch
+	}
+	if err := VerifyRegisterChallengeMessage(c.SIWEMessage, signature, c.domain, c.nonce, now.UTC()); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
 func VerifyRegisterChallengeMessage(messageText, signature, domain, nonce string, now time.Time) error {
 	message, err := siwe.ParseMessage(strings.TrimSpace(messageText))
 	if err != nil {
@@ -192,7 +288,7 @@ func VerifyRegisterChallengeMessage(messageText, signature, domain, nonce string
 	return err
 }
 
-func IssueLeaseAccessToken(privateKeyHex, keyID, issuer string, identity types.Identity, ttl time.Duration) (string, LeaseAccessTokenClaims, error) {
+func IssueLeaseAccessToken(privateKeyHex, keyID, issuer string, identity types.Identity, instanceID string, ttl time.Duration) (string, LeaseAccessTokenClaims, error) {
 	privateKey, _, err := utils.ParseSecp256k1PrivateKeyHex(privateKeyHex, false)
 	if err != nil {
 		return "", LeaseAccessTokenClaims{}, err
@@ -225,7 +321,8 @@ func IssueLeaseAccessToken(privateKeyHex, keyID, issuer string, identity types.I
 			NotBefore: jwt.NewNumericDate(now),
 			Expiry:    jwt.NewNumericDate(expiresAt),
 		},
-		Identity: normalizedIdentity,
+		Identity:   normalizedIdentity,
+		InstanceID: strings.TrimSpace(instanceID),
 	}
 
 	token, err := jwt.Signed(signer).Claims(claims).Serialize()
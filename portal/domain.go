@@ -0,0 +1,287 @@
+package portal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/portal/acme"
+	"github.com/gosuda/portal/v2/portal/auth"
+	"github.com/gosuda/portal/v2/portal/keyless"
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	defaultDomainLookupTimeout   = 10 * time.Second
+	defaultDomainIssueTimeout    = 5 * time.Minute
+	defaultDomainRecheckInterval = 5 * time.Minute
+)
+
+// normalizeCustomDomains validates requested custom domains and removes
+// duplicates. Ownership is checked separately by verifyCustomDomains.
+func (s *Server) normalizeCustomDomains(raw []string) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	domains := make([]string, 0, len(raw))
+	for _, entry := range raw {
+		domain, err := utils.NormalizeCustomDomain(entry, s.identity.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) > types.MaxCustomDomains {
+		return nil, fmt.Errorf("at most %d custom domains are allowed per lease", types.MaxCustomDomains)
+	}
+	return domains, nil
+}
+
+// leaseAliases resolves alias labels to hostnames under the root host,
+// skipping the lease's own hostname and duplicates.
+func (s *Server) leaseAliases(labels []string, hostname string) ([]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	aliases := make([]string, 0, len(labels))
+	for _, label := range labels {
+		alias, err := utils.LeaseHostname(label, s.identity.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias %q: %w", label, err)
+		}
+		if alias != hostname && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	if len(aliases) > types.MaxLeaseAliases {
+		return nil, fmt.Errorf("at most %d aliases are allowed per lease", types.MaxLeaseAliases)
+	}
+	return aliases, nil
+}
+
+// verifyCustomDomains checks that every domain publishes the TXT challenge
+// bound to address, the SIWE address that signed the registration.
+func (s *Server) verifyCustomDomains(ctx context.Context, domains []string, address string) error {
+	want := types.CustomDomainChallengeValue(address)
+	for _, domain := range domains {
+		lookupCtx, cancel := context.WithTimeout(ctx, defaultDomainLookupTimeout)
+		records, err := s.lookupTXT(lookupCtx, types.CustomDomainChallengeName(domain))
+		cancel()
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Str("component", "custom-domain").
+				Str("hostname", domain).
+				Msg("custom domain txt lookup failed")
+			return errDomainVerification
+		}
+		if !slices.ContainsFunc(records, func(record string) bool {
+			return strings.EqualFold(strings.TrimSpace(record), want)
+		}) {
+			return errDomainVerification
+		}
+	}
+	return nil
+}
+
+// recheckCustomDomains repeats the TXT ownership check of a renewing lease's
+// custom domains once defaultDomainRecheckInterval has passed. A lease whose
+// domain no longer names its address is unregistered, so the domain stops
+// routing to it and its signing key is released.
+func (s *Server) recheckCustomDomains(ctx context.Context, identity types.Identity, instanceID string, now time.Time) error {
+	record, err := s.registry.Find(identity, instanceID)
+	if err != nil || len(record.CustomDomains) == 0 {
+		return nil
+	}
+	checkedAt := time.Unix(0, record.domainsCheckedAt.Load())
+	if now.Sub(checkedAt) < defaultDomainRecheckInterval {
+		return nil
+	}
+	if err := s.verifyCustomDomains(ctx, record.CustomDomains, record.Address); err != nil {
+		if s.registry.unregisterRecord(record) {
+			s.releaseLease(record, "delete unverified lease ens gasless txt")
+		}
+		log.Info().
+			Str("component", "custom-domain").
+			Str("hostname", record.Hostname).
+			Str("address", record.Address).
+			Strs("custom_domains", record.CustomDomains).
+			Msg("custom domain no longer verified; lease unregistered")
+		return err
+	}
+	record.domainsCheckedAt.Store(now.UnixNano())
+	return nil
+}
+
+// authorizeSigningKey admits a keyless sign request for a custom domain or
+// wildcard key only from the lease that routes its hostname, identified by
+// the lease access token in the request header.
+func (s *Server) authorizeSigningKey(r *http.Request, keyID string) bool {
+	hostname, ok := keyless.CustomDomainHostname(keyID)
+	if !ok {
+		return false
+	}
+	claims, err := auth.VerifyLeaseAccessToken(r.Header.Get(types.HeaderAccessToken), s.identity.PublicKey, s.cfg.PortalURL, time.Now().UTC())
+	if err != nil {
+		return false
+	}
+	record, err := s.registry.Find(claims.Identity, claims.InstanceID)
+	if err != nil || !slices.Contains(record.certificateHostnames(), hostname) {
+		return false
+	}
+	if !s.keylessSigner.HasKey(keyID) {
+		// A lease that took over the hostname may race the release of the
+		// previous owner's key.
+		s.loadCustomDomainKeys([]string{hostname})
+	}
+	return true
+}
+
+func (s *Server) handleDomainCertificate(w http.ResponseWriter, r *http.Request) {
+	if !utils.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req, ok := utils.DecodeJSONRequest[types.DomainCertificateRequest](w, r, defaultControlBodyLimit)
+	if !ok {
+		return
+	}
+	claims, err := auth.VerifyLeaseAccessToken(req.AccessToken, s.identity.PublicKey, s.cfg.PortalURL, time.Now().UTC())
+	if err != nil {
+		utils.WriteAPIError(w, http.StatusForbidden, types.APIErrorCodeUnauthorized, errUnauthorized.Error())
+		return
+	}
+	record, err := s.registry.Find(claims.Identity, claims.InstanceID)
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+
+	hostname := utils.NormalizeHostname(req.Hostname)
+	if hostname == "" || !slices.Contains(record.certificateHostnames(), hostname) {
+		utils.WriteAPIError(w, http.StatusNotFound, types.APIErrorCodeLeaseNotFound, "custom domain is not registered on this lease")
+		return
+	}
+
+	resp, err := s.customDomainCertificate(hostname)
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	utils.WriteAPIData(w, http.StatusOK, resp)
+}
+
+// customDomainCertificate returns the relay-issued certificate for hostname
+// and installs its key in the keyless signer. When no certificate is cached
+// it starts issuance in the background and reports errCertificatePending.
+func (s *Server) customDomainCertificate(hostname string) (types.DomainCertificateResponse, error) {
+	if s.keylessSigner == nil || s.acmeManager == nil {
+		return types.DomainCertificateResponse{}, errFeatureUnavailable
+	}
+
+	certPEM, keyPEM, err := s.acmeManager.CustomDomainCertificate(hostname)
+	switch {
+	case errors.Is(err, acme.ErrCustomDomainCertificateMissing):
+		if !s.acmeManager.CanIssueCustomDomainCertificates() {
+			return types.DomainCertificateResponse{}, errFeatureUnavailable
+		}
+		s.issueCustomDomainCertificate(hostname)
+		return types.DomainCertificateResponse{}, errCertificatePending
+	case err != nil:
+		return types.DomainCertificateResponse{}, err
+	}
+
+	leaf, err := utils.ParseCertificatePEM(certPEM)
+	if err != nil {
+		return types.DomainCertificateResponse{}, err
+	}
+	keyID := keyless.CustomDomainKeyID(hostname)
+	if err := s.keylessSigner.PutKeyPEM(keyID, keyPEM); err != nil {
+		return types.DomainCertificateResponse{}, err
+	}
+	return types.DomainCertificateResponse{
+		Hostname:       hostname,
+		KeyID:          keyID,
+		CertificatePEM: string(certPEM),
+		NotAfter:       leaf.NotAfter.UTC(),
+	}, nil
+}
+
+// loadCustomDomainKeys reinstalls the signing keys of cached relay-issued
+// certificates so tenants keep their certificates across relay restarts.
+func (s *Server) loadCustomDomainKeys(domains []string) {
+	if s.keylessSigner == nil || s.acmeManager == nil {
+		return
+	}
+	for _, hostname := range domains {
+		_, keyPEM, err := s.acmeManager.CustomDomainCertificate(hostname)
+		if err != nil {
+			continue
+		}
+		if err := s.keylessSigner.PutKeyPEM(keyless.CustomDomainKeyID(hostname), keyPEM); err != nil {
+			log.Warn().
+				Err(err).
+				Str("component", "custom-domain").
+				Str("hostname", hostname).
+				Msg("load custom domain signing key")
+		}
+	}
+}
+
+// releaseDomainKeys removes the signing keys of hostnames that no lease
+// routes any more.
+func (s *Server) releaseDomainKeys(hostnames []string) {
+	if s.keylessSigner == nil {
+		return
+	}
+	for _, hostname := range hostnames {
+		if !s.registry.isRouted(hostname) {
+			s.keylessSigner.DeleteKey(keyless.CustomDomainKeyID(hostname))
+		}
+	}
+}
+
+func (s *Server) issueCustomDomainCertificate(hostname string) {
+	s.domainMu.Lock()
+	if _, ok := s.domainIssuing[hostname]; ok {
+		s.domainMu.Unlock()
+		return
+	}
+	s.domainIssuing[hostname] = struct{}{}
+	s.domainMu.Unlock()
+
+	go func() {
+		defer func() {
+			s.domainMu.Lock()
+			delete(s.domainIssuing, hostname)
+			s.domainMu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDomainIssueTimeout)
+		defer cancel()
+		if err := s.acmeManager.IssueCustomDomainCertificate(ctx, hostname); err != nil {
+			log.Warn().
+				Err(err).
+				Str("component", "custom-domain").
+				Str("hostname", hostname).
+				Str("challenge_cname", s.acmeManager.CustomDomainChallengeTarget(hostname)).
+				Msg("issue custom domain certificate")
+			return
+		}
+		log.Info().
+			Str("component", "custom-domain").
+			Str("hostname", hostname).
+			Msg("issued custom domain certificate")
+	}()
+}
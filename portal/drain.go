@@ -0,0 +1,109 @@
+package portal
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/portal/auth"
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	defaultDrainTimeout      = 30 * time.Second
+	maxDrainTimeout          = 10 * time.Minute
+	defaultDrainPollInterval = time.Second
+)
+
+// handleDrain stops routing new claims to the caller's replica and unregisters
+// it once its bridged connections finish or the deadline passes. Repeated
+// calls report progress without moving the deadline.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !utils.RequireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req, ok := utils.DecodeJSONRequest[types.DrainRequest](w, r, defaultControlBodyLimit)
+	if !ok {
+		return
+	}
+	claims, err := auth.VerifyLeaseAccessToken(req.AccessToken, s.identity.PublicKey, s.cfg.PortalURL, time.Now().UTC())
+	if err != nil {
+		utils.WriteAPIError(w, http.StatusForbidden, types.APIErrorCodeUnauthorized, errUnauthorized.Error())
+		return
+	}
+
+	timeout := defaultDrainTimeout
+	if req.Timeout > 0 {
+		timeout = min(time.Duration(req.Timeout)*time.Second, maxDrainTimeout)
+	}
+	record, started, err := s.registry.Drain(claims.Identity, claims.InstanceID, time.Now().Add(timeout))
+	if err != nil {
+		writeAPIErrorResponse(w, err)
+		return
+	}
+	if record.stream == nil {
+		writeAPIErrorResponse(w, errTransportMismatch)
+		return
+	}
+	if started {
+		record.stream.Drain()
+		go s.finishDrain(record)
+		log.Info().
+			Str("component", "lease-drain").
+			Str("hostname", record.Hostname).
+			Str("address", record.Address).
+			Str("instance_id", record.InstanceID).
+			Time("deadline", record.DrainDeadline).
+			Msg("lease draining")
+	}
+
+	utils.WriteAPIData(w, http.StatusOK, types.DrainResponse{
+		Deadline: record.DrainDeadline,
+		Active:   record.stream.ActiveCount(),
+	})
+}
+
+// finishDrain waits for record to go idle or reach its drain deadline, then
+// unregisters it.
+func (s *Server) finishDrain(record *leaseRecord) {
+	ticker := time.NewTicker(defaultDrainPollInterval)
+	defer ticker.Stop()
+
+	for record.stream.ActiveCount() > 0 && time.Now().Before(record.DrainDeadline) {
+		<-ticker.C
+	}
+	if !s.registry.unregisterRecord(record) {
+		return
+	}
+	s.releaseLease(record, "delete drained lease ens gasless txt")
+}
+
+// releaseLease closes an unregistered record and withdraws its ENS gasless
+// hostname unless another replica still serves it.
+func (s *Server) releaseLease(record *leaseRecord, msg string) {
+	s.withdrawLeaseHostname(record, msg)
+	record.Close()
+}
+
+// withdrawLeaseHostname deletes the ENS gasless record of an unregistered
+// lease's hostname and the signing keys of its custom domains and wildcard
+// unless another replica still serves them.
+func (s *Server) withdrawLeaseHostname(record *leaseRecord, msg string) {
+	s.releaseDomainKeys(record.certificateHostnames())
+	if s.registry.isRouted(record.Hostname) {
+		return
+	}
+	deleteCtx, cancel := context.WithTimeout(context.Background(), defaultClaimTimeout)
+	defer cancel()
+	if err := s.acmeManager.DeleteENSGaslessHostname(deleteCtx, record.Hostname); err != nil {
+		log.Warn().
+			Err(err).
+			Str("hostname", record.Hostname).
+			Str("address", record.Address).
+			Msg(msg)
+	}
+}
@@ -152,3 +152,46 @@ func FetchEndpointCertificateChain(ctx context.Context, endpoint, serverName str
 	}
 	return chainPEM, nil
 }
+
+// BuildDomainCertificate returns a TLS certificate for a relay-issued custom
+// domain certificate whose private key stays on the relay under keyID. The
+// relay signs only for the lease whose access token accessToken returns.
+func BuildDomainCertificate(relayURL string, certPEM []byte, keyID string, accessToken func() string) (tls.Certificate, ioCloser, error) {
+	normalizedRelayURL, err := utils.NormalizeRelayURL(relayURL)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	parsed, err := url.Parse(normalizedRelayURL)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("parse relay url: %w", err)
+	}
+	serverName := parsed.Hostname()
+	if serverName == "" {
+		return tls.Certificate{}, nil, errors.New("relay hostname is required")
+	}
+
+	_, rootCAPEM, err := ResolveMaterials(context.Background(), normalizedRelayURL, serverName)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("prepare keyless materials: %w", err)
+	}
+
+	remoteSigner, err := newDomainSigner(normalizedRelayURL, serverName, keyID, rootCAPEM, certPEM, accessToken)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("create keyless remote signer: %w", err)
+	}
+
+	tlsConfig, err := keylesstls.NewServerTLSConfig(keylesstls.ServerTLSConfig{
+		CertPEM:    certPEM,
+		Signer:     remoteSigner,
+		MinVersion: tls.VersionTLS12,
+	})
+	if err != nil || len(tlsConfig.Certificates) == 0 {
+		_ = remoteSigner.Close()
+		if err == nil {
+			err = errors.New("keyless certificate is missing")
+		}
+		return tls.Certificate{}, nil, fmt.Errorf("create keyless tls config: %w", err)
+	}
+	return tlsConfig.Certificates[0], remoteSigner, nil
+}
@@ -0,0 +1,152 @@
+package keyless
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gosuda/keyless_tls/relay/signrpc"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const domainSignTimeout = 5 * time.Second
+
+// domainSigner signs with a relay-held custom domain or wildcard key. The
+// relay serves those keys only to the lease that routes the hostname, so
+// every request carries the current lease access token.
+type domainSigner struct {
+	publicKey   crypto.PublicKey
+	keyID       string
+	endpoint    string
+	accessToken func() string
+	client      *http.Client
+}
+
+func newDomainSigner(relayURL, serverName, keyID string, rootCAPEM, certPEM []byte, accessToken func() string) (*domainSigner, error) {
+	if accessToken == nil {
+		return nil, errors.New("lease access token is required")
+	}
+	leaf, err := utils.ParseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootCAPEM) {
+		return nil, errors.New("failed to parse root CA PEM")
+	}
+
+	return &domainSigner{
+		publicKey:   leaf.PublicKey,
+		keyID:       keyID,
+		endpoint:    strings.TrimRight(relayURL, "/") + signrpc.SignPath,
+		accessToken: accessToken,
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS13,
+				ServerName: serverName,
+				RootCAs:    pool,
+			},
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 5 * time.Second,
+		}},
+	}, nil
+}
+
+func (s *domainSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *domainSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := signAlgorithm(s.publicKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("random: %w", err)
+	}
+	body, err := json.Marshal(&signrpc.SignRequest{
+		KeyID:         s.keyID,
+		Algorithm:     algorithm,
+		Digest:        digest,
+		TimestampUnix: time.Now().Unix(),
+		Nonce:         hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode sign request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), domainSignTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build sign request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(types.HeaderAccessToken, s.accessToken())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("remote sign request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp signrpc.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != "" {
+			return nil, fmt.Errorf("remote sign request failed: %s", errResp.Error)
+		}
+		return nil, fmt.Errorf("remote sign request failed: http %d", resp.StatusCode)
+	}
+
+	var signed signrpc.SignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("decode sign response: %w", err)
+	}
+	return signed.Signature, nil
+}
+
+func (s *domainSigner) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func signAlgorithm(publicKey crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	if opts == nil {
+		return "", errors.New("signer opts is required")
+	}
+	suffix := map[crypto.Hash]string{
+		crypto.SHA256: "SHA256",
+		crypto.SHA384: "SHA384",
+		crypto.SHA512: "SHA512",
+	}[opts.HashFunc()]
+	if suffix == "" {
+		return "", fmt.Errorf("unsupported hash: %v", opts.HashFunc())
+	}
+
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA_" + suffix, nil
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "RSA_PSS_" + suffix, nil
+		}
+		return "RSA_PKCS1V15_" + suffix, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", publicKey)
+	}
+}
@@ -2,11 +2,15 @@ package keyless
 
 import (
 	"context"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	ksigner "github.com/gosuda/keyless_tls/relay/signer"
@@ -18,9 +22,29 @@ const (
 	defaultAllowedSkew = 30 * time.Second
 )
 
+const customDomainKeyPrefix = "custom-domain:"
+
+// KeyAuthorizer reports whether r may sign with keyID. It is consulted for
+// every key except the relay certificate key.
+type KeyAuthorizer func(r *http.Request, keyID string) bool
+
 type Signer struct {
-	service *ksigner.Service
-	keyID   string
+	service   *ksigner.Service
+	store     *keyStore
+	keyID     string
+	authorize KeyAuthorizer
+}
+
+// CustomDomainKeyID names the signing key of a relay-issued custom domain
+// or lease wildcard certificate.
+func CustomDomainKeyID(hostname string) string {
+	return customDomainKeyPrefix + hostname
+}
+
+// CustomDomainHostname returns the hostname named by a CustomDomainKeyID.
+func CustomDomainHostname(keyID string) (string, bool) {
+	hostname, ok := strings.CutPrefix(keyID, customDomainKeyPrefix)
+	return hostname, ok && hostname != ""
 }
 
 func NewSigner(keyPEM []byte) (*Signer, error) {
@@ -29,16 +53,15 @@ func NewSigner(keyPEM []byte) (*Signer, error) {
 		return nil, fmt.Errorf("parse keyless signing key: %w", err)
 	}
 
-	store := ksigner.NewStaticKeyStore()
-	if err := store.Put(RelayKeyID, signingKey); err != nil {
-		return nil, fmt.Errorf("register keyless signing key: %w", err)
-	}
+	store := newKeyStore()
+	store.Put(RelayKeyID, signingKey)
 
 	return &Signer{
 		service: &ksigner.Service{
 			Store:       store,
 			AllowedSkew: defaultAllowedSkew,
 		},
+		store: store,
 		keyID: RelayKeyID,
 	}, nil
 }
@@ -50,6 +73,57 @@ func (s *Signer) KeyID() string {
 	return s.keyID
 }
 
+// SetKeyAuthorizer guards every key other than the relay certificate key.
+// Without an authorizer, Handler refuses to sign with those keys. It must be
+// called before Handler serves requests.
+func (s *Signer) SetKeyAuthorizer(authorize KeyAuthorizer) {
+	if s == nil {
+		return
+	}
+	s.authorize = authorize
+}
+
+// PutKeyPEM registers an additional signing key, replacing any key already
+// stored under keyID.
+func (s *Signer) PutKeyPEM(keyID string, keyPEM []byte) error {
+	if s == nil || s.store == nil {
+		return errors.New("keyless signer is disabled")
+	}
+	if keyID == "" || keyID == s.keyID {
+		return errors.New("invalid keyless key id")
+	}
+	signingKey, err := ksigner.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return fmt.Errorf("parse keyless signing key: %w", err)
+	}
+	s.store.Put(keyID, signingKey)
+	return nil
+}
+
+// DeleteKey removes a key registered with PutKeyPEM.
+func (s *Signer) DeleteKey(keyID string) {
+	if s == nil || s.store == nil || keyID == s.keyID {
+		return
+	}
+	s.store.Delete(keyID)
+}
+
+func (s *Signer) HasKey(keyID string) bool {
+	if s == nil || s.store == nil {
+		return false
+	}
+	_, err := s.store.Signer(context.Background(), keyID)
+	return err == nil
+}
+
+// KeyIDs lists the keys registered with PutKeyPEM.
+func (s *Signer) KeyIDs() []string {
+	if s == nil || s.store == nil {
+		return nil
+	}
+	return slices.DeleteFunc(s.store.KeyIDs(), func(keyID string) bool { return keyID == s.keyID })
+}
+
 func (s *Signer) Sign(ctx context.Context, req *signrpc.SignRequest) (*signrpc.SignResponse, error) {
 	if s == nil || s.service == nil {
 		return nil, errors.New("keyless signer is disabled")
@@ -79,6 +153,11 @@ func (s *Signer) Handler() http.Handler {
 			return
 		}
 
+		if req.KeyID != s.keyID && (s.authorize == nil || !s.authorize(r, req.KeyID)) {
+			writeJSONError(w, http.StatusForbidden, "not authorized to sign with this key")
+			return
+		}
+
 		resp, err := s.Sign(r.Context(), &req)
 		if err != nil {
 			status := http.StatusInternalServerError
@@ -103,3 +182,41 @@ func writeJSONError(w http.ResponseWriter, status int, message string) {
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(signrpc.ErrorResponse{Error: message})
 }
+
+// keyStore is a ksigner.KeyStore whose keys can also be removed.
+type keyStore struct {
+	signers map[string]crypto.Signer
+	mu      sync.RWMutex
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{signers: make(map[string]crypto.Signer)}
+}
+
+func (s *keyStore) Put(keyID string, signer crypto.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signers[keyID] = signer
+}
+
+func (s *keyStore) Delete(keyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.signers, keyID)
+}
+
+func (s *keyStore) KeyIDs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Collect(maps.Keys(s.signers))
+}
+
+func (s *keyStore) Signer(_ context.Context, keyID string) (crypto.Signer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	signer, ok := s.signers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", keyID)
+	}
+	return signer, nil
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gosuda/portal/v2/portal/auth"
+	"github.com/gosuda/portal/v2/portal/metrics"
 	"github.com/gosuda/portal/v2/portal/policy"
 	"github.com/gosuda/portal/v2/portal/transport"
 	"github.com/gosuda/portal/v2/types"
@@ -19,8 +22,10 @@ const defaultRegisterChallengeTTL = 2 * time.Minute
 
 type leaseRegistry struct {
 	routes             map[string]string
+	groups             map[string]*replicaGroup
 	leasesByKey        map[string]*leaseRecord
 	registerChallenges map[string]*auth.RegisterChallenge
+	evictedUntil       map[string]time.Time
 	policy             *policy.Runtime
 	mu                 sync.RWMutex
 }
@@ -32,8 +37,10 @@ func newLeaseRegistry(runtime *policy.Runtime) *leaseRegistry {
 
 	return &leaseRegistry{
 		routes:             make(map[string]string),
+		groups:             make(map[string]*replicaGroup),
 		leasesByKey:        make(map[string]*leaseRecord),
 		registerChallenges: make(map[string]*auth.RegisterChallenge),
+		evictedUntil:       make(map[string]time.Time),
 		policy:             runtime,
 	}
 }
@@ -46,8 +53,10 @@ func (r *leaseRegistry) CloseAll() []*leaseRecord {
 	for _, record := range r.leasesByKey {
 		out = append(out, record)
 		r.policy.ForgetIdentity(record.Key())
+		metrics.ForgetLease(record.Key())
 	}
 	r.routes = make(map[string]string)
+	r.groups = make(map[string]*replicaGroup)
 	r.leasesByKey = make(map[string]*leaseRecord)
 	r.registerChallenges = make(map[string]*auth.RegisterChallenge)
 	return out
@@ -73,8 +82,12 @@ func (r *leaseRegistry) Lookup(host string) (*leaseRecord, bool) {
 			return nil, false
 		}
 	}
-	record, ok := r.leasesByKey[key]
-	return record, ok && record != nil
+	group, ok := r.groups[key]
+	if !ok {
+		return nil, false
+	}
+	record := group.pick(time.Now())
+	return record, record != nil
 }
 
 func (r *leaseRegistry) Register(record *leaseRecord) error {
@@ -91,22 +104,40 @@ func (r *leaseRegistry) Register(record *leaseRecord) error {
 		return errors.New("lease hostname is required")
 	}
 
+	record.Hostname = hostname
+
 	r.mu.Lock()
 
-	if existingKey, ok := r.routes[hostname]; ok && existingKey != key {
+	for _, route := range record.routeHostnames() {
+		if existingKey, ok := r.routes[route]; ok && existingKey != key {
+			r.mu.Unlock()
+			return errHostnameConflict
+		}
+	}
+	// The lease caps are checked again here, under the same lock as the
+	// insert, so concurrent registrations cannot all pass the early check.
+	if err := r.checkLeaseCapsLocked(record.Address, record.ClientIP, key); err != nil {
 		r.mu.Unlock()
-		return errHostnameConflict
+		return err
 	}
 
 	var replaced *leaseRecord
-	if existing, ok := r.leasesByKey[key]; ok && existing != nil {
+	if existing, ok := r.leasesByKey[record.replicaKey()]; ok && existing != nil {
 		replaced = existing
-		delete(r.routes, utils.NormalizeHostname(existing.Hostname))
-		r.policy.ForgetIdentity(existing.Key())
+		if r.detachLocked(existing) {
+			r.policy.ForgetIdentity(key)
+		}
+	}
+	r.leasesByKey[record.replicaKey()] = record
+	group, ok := r.groups[key]
+	if !ok {
+		group = &replicaGroup{}
+		r.groups[key] = group
+	}
+	group.add(record)
+	for _, route := range record.routeHostnames() {
+		r.routes[route] = key
 	}
-	record.Hostname = hostname
-	r.leasesByKey[key] = record
-	r.routes[hostname] = key
 	r.policy.IPFilter().RegisterIdentityIP(key, record.ClientIP)
 	r.mu.Unlock()
 
@@ -116,11 +147,45 @@ func (r *leaseRegistry) Register(record *leaseRecord) error {
 	return nil
 }
 
-func (r *leaseRegistry) Renew(identity types.Identity, ttl time.Duration, clientIP, reportedIP string) (*leaseRecord, error) {
+// detachLocked removes record from its replica group and drops the routes no
+// remaining replica serves, leaving routes that have since been claimed by
+// another lease untouched. It reports whether the group is now empty.
+func (r *leaseRegistry) detachLocked(record *leaseRecord) bool {
+	key := record.Key()
+	if r.leasesByKey[record.replicaKey()] == record {
+		delete(r.leasesByKey, record.replicaKey())
+	}
+
+	group := r.groups[key]
+	if group != nil {
+		group.remove(record)
+	}
+	for _, route := range record.routeHostnames() {
+		if r.routes[route] == key && (group == nil || !group.serves(route)) {
+			delete(r.routes, route)
+		}
+	}
+	if group != nil && len(group.members) > 0 {
+		return false
+	}
+	delete(r.groups, key)
+	return true
+}
+
+// isRouted reports whether hostname still routes to a registered lease.
+func (r *leaseRegistry) isRouted(hostname string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.routes[utils.NormalizeHostname(hostname)]
+	return ok
+}
+
+func (r *leaseRegistry) Renew(identity types.Identity, instanceID string, ttl time.Duration, clientIP, reportedIP string) (*leaseRecord, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	record, ok := r.leasesByKey[identity.Key()]
+	record, ok := r.leasesByKey[replicaKey(identity.Key(), instanceID)]
 	if !ok {
 		return nil, errLeaseNotFound
 	}
@@ -138,27 +203,117 @@ func (r *leaseRegistry) Renew(identity types.Identity, ttl time.Duration, client
 	return record, nil
 }
 
-func (r *leaseRegistry) Unregister(identity types.Identity) (*leaseRecord, error) {
+func (r *leaseRegistry) Unregister(identity types.Identity, instanceID string) (*leaseRecord, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	key := identity.Key()
-	record, ok := r.leasesByKey[key]
+	record, ok := r.leasesByKey[replicaKey(key, instanceID)]
 	if !ok {
 		return nil, errLeaseNotFound
 	}
 
-	delete(r.leasesByKey, key)
-	delete(r.routes, utils.NormalizeHostname(record.Hostname))
-	r.policy.ForgetIdentity(key)
+	if r.detachLocked(record) {
+		r.policy.ForgetIdentity(key)
+		metrics.ForgetLease(key)
+	}
 	return record, nil
 }
 
-func (r *leaseRegistry) Find(identity types.Identity) (*leaseRecord, error) {
+// Evict unregisters every replica of the identity key and returns them.
+// When cooldown is positive, the key may not register again until it has
+// passed.
+func (r *leaseRegistry) Evict(key string, cooldown time.Duration) []*leaseRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cooldown > 0 {
+		r.evictedUntil[key] = time.Now().Add(cooldown)
+	}
+	group := r.groups[key]
+	if group == nil {
+		return nil
+	}
+	evicted := append([]*leaseRecord(nil), group.members...)
+	for _, record := range evicted {
+		r.detachLocked(record)
+	}
+	r.policy.ForgetIdentity(key)
+	metrics.ForgetLease(key)
+	return evicted
+}
+
+// ClearEviction lifts the eviction cooldown of the identity key.
+func (r *leaseRegistry) ClearEviction(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.evictedUntil, key)
+}
+
+// EvictedUntil returns the end of the eviction cooldown of the identity
+// key, if one is running.
+func (r *leaseRegistry) EvictedUntil(key string) (time.Time, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	until, ok := r.evictedUntil[key]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// checkEvicted returns errLeaseEvicted while identity is in an eviction
+// cooldown.
+func (r *leaseRegistry) checkEvicted(identity types.Identity) error {
+	identity, err := utils.NormalizeIdentity(identity)
+	if err != nil {
+		return nil
+	}
+	if _, ok := r.EvictedUntil(identity.Key()); ok {
+		return errLeaseEvicted
+	}
+	return nil
+}
+
+// Drain marks the replica as draining until deadline. A replica that is
+// already draining keeps its original deadline; started reports whether this
+// call began the drain.
+func (r *leaseRegistry) Drain(identity types.Identity, instanceID string, deadline time.Time) (*leaseRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.leasesByKey[replicaKey(identity.Key(), instanceID)]
+	if !ok || time.Now().After(record.ExpiresAt) {
+		return nil, false, errLeaseNotFound
+	}
+	if !record.DrainDeadline.IsZero() {
+		return record, false, nil
+	}
+	record.DrainDeadline = deadline
+	return record, true, nil
+}
+
+// unregisterRecord removes record unless it has already been removed or
+// replaced by a newer registration of the same replica.
+func (r *leaseRegistry) unregisterRecord(record *leaseRecord) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.leasesByKey[record.replicaKey()] != record {
+		return false
+	}
+	if r.detachLocked(record) {
+		r.policy.ForgetIdentity(record.Key())
+		metrics.ForgetLease(record.Key())
+	}
+	return true
+}
+
+func (r *leaseRegistry) Find(identity types.Identity, instanceID string) (*leaseRecord, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	record, ok := r.leasesByKey[identity.Key()]
+	record, ok := r.leasesByKey[replicaKey(identity.Key(), instanceID)]
 	if !ok || time.Now().After(record.ExpiresAt) {
 		return nil, errLeaseNotFound
 	}
@@ -166,6 +321,12 @@ func (r *leaseRegistry) Find(identity types.Identity) (*leaseRecord, error) {
 }
 
 func (r *leaseRegistry) issueRegisterChallenge(req types.RegisterChallengeRequest, domain, uri string) (types.RegisterChallengeResponse, error) {
+	if _, err := utils.NormalizeIngressRules(req.Ingress); err != nil {
+		return types.RegisterChallengeResponse{}, errInvalidIngressRules
+	}
+	if err := r.checkEvicted(req.Identity); err != nil {
+		return types.RegisterChallengeResponse{}, err
+	}
 	if req.UDPEnabled {
 		if !r.policy.IsUDPEnabled() {
 			return types.RegisterChallengeResponse{}, errUDPDisabled
@@ -226,11 +387,11 @@ func (r *leaseRegistry) consumeVerifiedRegisterChallenge(req types.RegisterReque
 	return challenge, nil
 }
 
-func (r *leaseRegistry) Touch(identity types.Identity, clientIP string, now time.Time) *leaseRecord {
+func (r *leaseRegistry) Touch(identity types.Identity, instanceID, clientIP string, now time.Time) *leaseRecord {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	record, ok := r.leasesByKey[identity.Key()]
+	record, ok := r.leasesByKey[replicaKey(identity.Key(), instanceID)]
 	if !ok {
 		return nil
 	}
@@ -247,12 +408,13 @@ func (r *leaseRegistry) cleanupExpired(now time.Time) []*leaseRecord {
 	defer r.mu.Unlock()
 
 	expired := make([]*leaseRecord, 0)
-	for key, record := range r.leasesByKey {
+	for _, record := range r.leasesByKey {
 		if now.After(record.ExpiresAt) {
 			expired = append(expired, record)
-			delete(r.leasesByKey, key)
-			delete(r.routes, utils.NormalizeHostname(record.Hostname))
-			r.policy.ForgetIdentity(key)
+			if r.detachLocked(record) {
+				r.policy.ForgetIdentity(record.Key())
+				metrics.ForgetLease(record.Key())
+			}
 		}
 	}
 	for challengeID, challenge := range r.registerChallenges {
@@ -260,9 +422,73 @@ func (r *leaseRegistry) cleanupExpired(now time.Time) []*leaseRecord {
 			delete(r.registerChallenges, challengeID)
 		}
 	}
+	for key, until := range r.evictedUntil {
+		if !now.Before(until) {
+			delete(r.evictedUntil, key)
+		}
+	}
 	return expired
 }
 
+// checkQuota returns a quota error when the address of identity has used up
+// its bytes, or when registering identity from clientIP would exceed the
+// lease caps. Replicas of identity itself do not count against the caps.
+// The cap check only fails registrations early; Register repeats it
+// atomically with the insert.
+func (r *leaseRegistry) checkQuota(identity types.Identity, clientIP string) error {
+	if r.policy.Quotas().Exceeded(identity.Address) {
+		return errByteQuotaExceeded
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkLeaseCapsLocked(identity.Address, clientIP, identity.Key())
+}
+
+// checkLeaseCapsLocked returns errLeaseQuotaExceeded when one more lease of
+// address from clientIP would exceed MaxLeasesPerAddress or MaxLeasesPerIP.
+func (r *leaseRegistry) checkLeaseCapsLocked(address, clientIP, key string) error {
+	limits := r.policy.Quotas().Limits(address)
+	if limits.MaxLeasesPerAddress <= 0 && limits.MaxLeasesPerIP <= 0 {
+		return nil
+	}
+
+	byAddress, byIP := r.countLeasesLocked(address, clientIP, key)
+	if limits.MaxLeasesPerAddress > 0 && byAddress >= limits.MaxLeasesPerAddress {
+		return errLeaseQuotaExceeded
+	}
+	if limits.MaxLeasesPerIP > 0 && clientIP != "" && byIP >= limits.MaxLeasesPerIP {
+		return errLeaseQuotaExceeded
+	}
+	return nil
+}
+
+func (r *leaseRegistry) countLeases(address, clientIP, exceptKey string) (byAddress, byIP int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.countLeasesLocked(address, clientIP, exceptKey)
+}
+
+// countLeasesLocked counts the live leases, other than exceptKey, of address
+// and those with a replica registered from clientIP. Replicas of one
+// identity count as a single lease.
+func (r *leaseRegistry) countLeasesLocked(address, clientIP, exceptKey string) (byAddress, byIP int) {
+	now := time.Now()
+	for key, group := range r.groups {
+		live := group.live(now)
+		if key == exceptKey || len(live) == 0 {
+			continue
+		}
+		if strings.EqualFold(live[0].Address, address) {
+			byAddress++
+		}
+		if clientIP != "" && slices.ContainsFunc(live, func(record *leaseRecord) bool { return record.ClientIP == clientIP }) {
+			byIP++
+		}
+	}
+	return byAddress, byIP
+}
+
 func (r *leaseRegistry) countDatagramLeases() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -291,21 +517,31 @@ func (r *leaseRegistry) countTCPPortLeases() int {
 	return count
 }
 
+// activeAdminSnapshots returns one snapshot per replica group, describing the
+// group through its oldest live replica.
 func (r *leaseRegistry) activeAdminSnapshots() []types.AdminLease {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	now := time.Now()
-	out := make([]types.AdminLease, 0, len(r.leasesByKey))
-	for _, record := range r.leasesByKey {
-		if !now.After(record.ExpiresAt) {
-			out = append(out, r.AdminSnapshot(record))
+	out := make([]types.AdminLease, 0, len(r.groups))
+	for _, group := range r.groups {
+		if live := group.live(now); len(live) > 0 {
+			out = append(out, r.adminSnapshotLocked(live[0]))
 		}
 	}
 	return out
 }
 
 func (r *leaseRegistry) Snapshot(record *leaseRecord) types.Lease {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotLocked(record)
+}
+
+// snapshotLocked describes record with Ready and Replicas summed over the
+// live replicas of its group.
+func (r *leaseRegistry) snapshotLocked(record *leaseRecord) types.Lease {
 	snapshot := types.Lease{
 		Name:        record.Name,
 		ExpiresAt:   record.ExpiresAt,
@@ -314,45 +550,91 @@ func (r *leaseRegistry) Snapshot(record *leaseRecord) types.Lease {
 		Hostname:    record.Hostname,
 		UDPEnabled:  record.UDPEnabled,
 		TCPEnabled:  record.TCPEnabled,
+		OfflinePage: record.OfflinePage,
 		Metadata:    record.Metadata.Copy(),
 	}
+	if len(record.CustomDomains) > 0 {
+		snapshot.CustomDomains = append([]string(nil), record.CustomDomains...)
+	}
+	if len(record.Aliases) > 0 {
+		snapshot.Aliases = append([]string(nil), record.Aliases...)
+	}
+	snapshot.Wildcard = record.Wildcard
 	if record.tcpPort != nil {
 		snapshot.TCPAddr = fmt.Sprintf("%s:%d", record.Hostname, record.tcpPort.TCPPort())
 	}
-	if record.stream != nil {
-		snapshot.Ready = record.stream.ReadyCount()
+	snapshot.Ports = record.portMappings(record.Hostname)
+	replicas := []*leaseRecord{record}
+	if group := r.groups[record.Key()]; group != nil {
+		if live := group.live(time.Now()); len(live) > 0 {
+			replicas = live
+		}
+	}
+	snapshot.Replicas = len(replicas)
+	for _, replica := range replicas {
+		if replica.stream != nil {
+			snapshot.Ready += replica.stream.ReadyCount()
+		}
 	}
 	return snapshot
 }
 
 type leaseRecord struct {
 	types.Identity
-	ExpiresAt   time.Time
-	FirstSeenAt time.Time
-	LastSeenAt  time.Time
-	ClientIP    string
-	ReportedIP  string
-	Hostname    string
-	UDPEnabled  bool
-	TCPEnabled  bool
-	Metadata    types.LeaseMetadata
-	datagram    *transport.RelayDatagram
-	ports       *transport.PortAllocator
-	tcpPort     *transport.RelayTCPPort
-	tcpPorts    *transport.PortAllocator
-	stream      *transport.RelayStream
-	startErr    error
-	startOnce   sync.Once
+	ExpiresAt     time.Time
+	FirstSeenAt   time.Time
+	LastSeenAt    time.Time
+	ClientIP      string
+	ReportedIP    string
+	Hostname      string
+	CustomDomains []string
+	Aliases       []string
+	Wildcard      string
+	InstanceID    string
+	ReplicaWeight int
+	ReplicaPolicy string
+	DrainDeadline time.Time
+	UDPEnabled    bool
+	TCPEnabled    bool
+	OfflinePage   bool
+	Metadata      types.LeaseMetadata
+	Ports         []types.PortMapping
+	ConnTimeouts  types.ConnTimeouts
+	Ingress       types.IngressRules
+	ingressACL    *policy.IngressACL
+	quota         *policy.QuotaMeter
+	datagram      *transport.RelayDatagram
+	ports         *transport.PortAllocator
+	tcpPort       *transport.RelayTCPPort
+	tcpPorts      *transport.PortAllocator
+	stream        *transport.RelayStream
+	startErr      error
+	startOnce     sync.Once
+
+	// domainsCheckedAt is when the custom domain TXT records were last
+	// verified, in Unix nanoseconds.
+	domainsCheckedAt atomic.Int64
 }
 
 func (r *leaseRegistry) AdminSnapshot(record *leaseRecord) types.AdminLease {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.adminSnapshotLocked(record)
+}
+
+func (r *leaseRegistry) adminSnapshotLocked(record *leaseRecord) types.AdminLease {
 	clientIP := record.ClientIP
 	identityKey := record.Key()
+	var connLimits *types.ConnLimits
+	if limits, ok := r.policy.ConnLimiter().Override(identityKey); ok {
+		connLimits = &limits
+	}
 	return types.AdminLease{
-		Lease:       r.Snapshot(record),
+		Lease:       r.snapshotLocked(record),
 		IdentityKey: identityKey,
 		Address:     record.Address,
 		BPS:         r.policy.BPSManager().IdentityBPS(identityKey),
+		ConnLimits:  connLimits,
 		ClientIP:    clientIP,
 		ReportedIP:  record.ReportedIP,
 		IsApproved:  r.policy.EffectiveApproval(identityKey),
@@ -362,6 +644,39 @@ func (r *leaseRegistry) AdminSnapshot(record *leaseRecord) types.AdminLease {
 	}
 }
 
+// routeHostnames lists the relay hostname followed by its aliases, wildcard
+// and verified custom domains; all of them route to this lease.
+func (r *leaseRecord) routeHostnames() []string {
+	routes := make([]string, 0, 2+len(r.Aliases)+len(r.CustomDomains))
+	if hostname := utils.NormalizeHostname(r.Hostname); hostname != "" {
+		routes = append(routes, hostname)
+	}
+	for _, alias := range r.Aliases {
+		if alias = utils.NormalizeHostname(alias); alias != "" {
+			routes = append(routes, alias)
+		}
+	}
+	if r.Wildcard != "" {
+		routes = append(routes, r.Wildcard)
+	}
+	for _, domain := range r.CustomDomains {
+		if domain = utils.NormalizeHostname(domain); domain != "" {
+			routes = append(routes, domain)
+		}
+	}
+	return routes
+}
+
+// certificateHostnames lists the routes not covered by the relay certificate,
+// which need a relay-issued or tenant-supplied certificate.
+func (r *leaseRecord) certificateHostnames() []string {
+	hostnames := append([]string(nil), r.CustomDomains...)
+	if r.Wildcard != "" {
+		hostnames = append(hostnames, r.Wildcard)
+	}
+	return hostnames
+}
+
 func (r *leaseRecord) Start() error {
 	r.startOnce.Do(func() {
 		if r.datagram != nil {
@@ -384,18 +699,49 @@ func (r *leaseRecord) Close() {
 	if r.stream != nil {
 		r.stream.Close()
 	}
+	r.closePorts((*transport.PortAllocator).Release)
+}
+
+// Evict closes the lease and cuts its bridged connections. Its ports go
+// straight back to the pool instead of staying reserved for the lease.
+func (r *leaseRecord) Evict() {
+	if r == nil {
+		return
+	}
+	if r.stream != nil {
+		r.stream.Evict()
+	}
+	r.closePorts((*transport.PortAllocator).Free)
+}
+
+func (r *leaseRecord) closePorts(release func(*transport.PortAllocator, int)) {
 	if r.datagram != nil {
-		port := r.datagram.UDPPort()
 		r.datagram.Close()
-		if port > 0 && r.ports != nil {
-			r.ports.Release(port)
+		if r.ports != nil {
+			for _, port := range r.datagram.UDPPorts() {
+				release(r.ports, port)
+			}
 		}
 	}
 	if r.tcpPort != nil {
-		port := r.tcpPort.TCPPort()
 		r.tcpPort.Close()
-		if port > 0 && r.tcpPorts != nil {
-			r.tcpPorts.Release(port)
+		if r.tcpPorts != nil {
+			for _, port := range r.tcpPort.TCPPorts() {
+				release(r.tcpPorts, port)
+			}
 		}
 	}
 }
+
+// portMappings returns the public ports of the lease addressed on host.
+func (r *leaseRecord) portMappings(host string) []types.PortMapping {
+	if len(r.Ports) == 0 {
+		return nil
+	}
+	mappings := make([]types.PortMapping, len(r.Ports))
+	for i, mapping := range r.Ports {
+		mapping.Addr = fmt.Sprintf("%s:%d", host, mapping.Port)
+		mappings[i] = mapping
+	}
+	return mappings
+}
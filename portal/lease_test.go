@@ -36,7 +36,7 @@ func TestLeaseRegistryLifecycle(t *testing.T) {
 		t.Fatalf("Lookup() = %v, %v, want registered lease", lookedUp, ok)
 	}
 
-	renewed, err := registry.Renew(record.Copy(), time.Minute, "203.0.113.10", "")
+	renewed, err := registry.Renew(record.Copy(), record.InstanceID, time.Minute, "203.0.113.10", "")
 	if err != nil {
 		t.Fatalf("Renew() error = %v", err)
 	}
@@ -47,7 +47,7 @@ func TestLeaseRegistryLifecycle(t *testing.T) {
 		t.Fatalf("Renew() did not register client IP for lease")
 	}
 
-	removed, err := registry.Unregister(record.Copy())
+	removed, err := registry.Unregister(record.Copy(), record.InstanceID)
 	if err != nil {
 		t.Fatalf("Unregister() error = %v", err)
 	}
@@ -102,6 +102,41 @@ func TestLeaseRegistryWildcardAndConflict(t *testing.T) {
 	}
 }
 
+func TestLeaseRegistryWeightedReplicas(t *testing.T) {
+	t.Parallel()
+
+	registry := newLeaseRegistry(policy.NewRuntime())
+	weights := map[string]int{"heavy": 3, "light": 1}
+	for _, instanceID := range []string{"heavy", "light"} {
+		record := &leaseRecord{
+			Identity: types.Identity{
+				Name:    "demo",
+				Address: "addr-replicas",
+			},
+			Hostname:      "demo.example.com",
+			InstanceID:    instanceID,
+			ReplicaWeight: weights[instanceID],
+			ReplicaPolicy: types.ReplicaPolicyWeighted,
+			ExpiresAt:     time.Now().Add(30 * time.Second),
+		}
+		if err := registry.Register(record); err != nil {
+			t.Fatalf("Register(%q) error = %v", instanceID, err)
+		}
+	}
+
+	got := make(map[string]int)
+	for range 8 {
+		record, ok := registry.Lookup("demo.example.com")
+		if !ok {
+			t.Fatal("Lookup() = false, want a replica")
+		}
+		got[record.InstanceID]++
+	}
+	if got["heavy"] != 6 || got["light"] != 2 {
+		t.Fatalf("Lookup() spread = %v, want heavy:6 light:2", got)
+	}
+}
+
 func TestLeaseRegistrySnapshotAndRoutableUsePolicy(t *testing.T) {
 	t.Parallel()
 
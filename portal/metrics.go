@@ -0,0 +1,158 @@
+package portal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gosuda/portal/v2/portal/metrics"
+	"github.com/gosuda/portal/v2/portal/transport"
+	"github.com/gosuda/portal/v2/types"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteMetrics renders relay metrics in the Prometheus text format, including
+// gauges sampled from the live lease table and port allocators.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	leases := metrics.GaugeSnapshot{
+		Name:   "portal_leases",
+		Help:   "Registered leases that have not expired.",
+		Labels: []string{"routable"},
+	}
+	ready := metrics.GaugeSnapshot{
+		Name:   "portal_lease_ready_sessions",
+		Help:   "Idle reverse sessions waiting in the lease ready queue.",
+		Labels: []string{metrics.LeaseLabel},
+	}
+	flows := metrics.GaugeSnapshot{
+		Name:   "portal_lease_udp_active_flows",
+		Help:   "UDP flows currently tracked per lease.",
+		Labels: []string{metrics.LeaseLabel},
+	}
+
+	routable, unroutable := 0, 0
+	now := time.Now()
+	s.registry.mu.RLock()
+	for key, group := range s.registry.groups {
+		live := group.live(now)
+		if len(live) == 0 {
+			continue
+		}
+		if s.registry.policy.IsIdentityRoutable(key) {
+			routable++
+		} else {
+			unroutable++
+		}
+
+		readyCount, flowCount := 0, 0
+		hasStream, hasDatagram := false, false
+		for _, record := range live {
+			if record.stream != nil {
+				hasStream = true
+				readyCount += record.stream.ReadyCount()
+			}
+			if record.datagram != nil {
+				hasDatagram = true
+				flowCount += record.datagram.FlowCount()
+			}
+		}
+		if hasStream {
+			ready.Samples = append(ready.Samples, metrics.Sample{Values: []string{key}, Value: float64(readyCount)})
+		}
+		if hasDatagram {
+			flows.Samples = append(flows.Samples, metrics.Sample{Values: []string{key}, Value: float64(flowCount)})
+		}
+	}
+	s.registry.mu.RUnlock()
+	leases.Samples = []metrics.Sample{
+		{Values: []string{"true"}, Value: float64(routable)},
+		{Values: []string{"false"}, Value: float64(unroutable)},
+	}
+
+	ports := metrics.GaugeSnapshot{
+		Name:   "portal_port_allocator_ports",
+		Help:   "Lease ports by allocator and state.",
+		Labels: []string{"protocol", "state"},
+	}
+	for _, allocator := range []struct {
+		protocol  string
+		allocator *transport.PortAllocator
+	}{
+		{"udp", s.ports},
+		{"tcp", s.tcpPorts},
+	} {
+		if allocator.allocator == nil {
+			continue
+		}
+		available, inUse, reserved := allocator.allocator.Usage()
+		ports.Samples = append(ports.Samples,
+			metrics.Sample{Values: []string{allocator.protocol, "available"}, Value: float64(available)},
+			metrics.Sample{Values: []string{allocator.protocol, "in_use"}, Value: float64(inUse)},
+			metrics.Sample{Values: []string{allocator.protocol, "reserved"}, Value: float64(reserved)},
+		)
+	}
+
+	return metrics.Default.WriteText(w, leases, ready, flows, ports)
+}
+
+// MetricsHandler serves WriteMetrics. It performs no authentication; callers
+// mount it behind admin auth or on a private bind address.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		_ = s.WriteMetrics(w)
+	})
+}
+
+// outcomeRecorder captures the status and leading body bytes of a control
+// plane response so the API error code can be counted after the handler runs.
+type outcomeRecorder struct {
+	http.ResponseWriter
+	body   []byte
+	status int
+}
+
+const outcomeBodyLimit = 1 << 10
+
+func (o *outcomeRecorder) WriteHeader(status int) {
+	if o.status == 0 {
+		o.status = status
+	}
+	o.ResponseWriter.WriteHeader(status)
+}
+
+func (o *outcomeRecorder) Write(p []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	if room := outcomeBodyLimit - len(o.body); room > 0 {
+		o.body = append(o.body, p[:min(room, len(p))]...)
+	}
+	return o.ResponseWriter.Write(p)
+}
+
+func (o *outcomeRecorder) code() string {
+	if o.status == 0 || o.status < http.StatusBadRequest {
+		return "ok"
+	}
+	var envelope types.APIEnvelope[json.RawMessage]
+	if err := json.Unmarshal(o.body, &envelope); err == nil && envelope.Error != nil && envelope.Error.Code != "" {
+		return envelope.Error.Code
+	}
+	return "http_" + strconv.Itoa(o.status)
+}
+
+func recordAPIOutcome(endpoint string, w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	recorder := &outcomeRecorder{ResponseWriter: w}
+	handler(recorder, r)
+	metrics.APIOutcomes.With(endpoint, recorder.code()).Inc()
+}
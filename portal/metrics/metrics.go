@@ -0,0 +1,382 @@
+// Package metrics keeps relay counters and gauges in memory and renders them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseLabel is the label name carrying the lease identity key. Series with
+// this label are dropped by ForgetLease when the lease goes away.
+const LeaseLabel = "lease"
+
+// Family is one named metric with HELP/TYPE metadata and zero or more series.
+type Family interface {
+	writeText(w *bufio.Writer)
+}
+
+type Registry struct {
+	families []Family
+	mu       sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default holds every relay metric defined in this package.
+var Default = NewRegistry()
+
+func (r *Registry) Register(families ...Family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, families...)
+}
+
+// ForgetLease drops every series labelled with the given lease key.
+func (r *Registry) ForgetLease(key string) {
+	if key == "" {
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, family := range r.families {
+		if v, ok := family.(interface{ deleteLabel(string, string) }); ok {
+			v.deleteLabel(LeaseLabel, key)
+		}
+	}
+}
+
+// WriteText renders the registry followed by any scrape-time families.
+func (r *Registry) WriteText(w io.Writer, extra ...Family) error {
+	bw := bufio.NewWriter(w)
+
+	r.mu.RLock()
+	for _, family := range r.families {
+		family.writeText(bw)
+	}
+	r.mu.RUnlock()
+	for _, family := range extra {
+		family.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.value.Load()
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	g.value.Add(n)
+}
+
+func (g *Gauge) Set(n int64) {
+	if g == nil {
+		return
+	}
+	g.value.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.value.Load()
+}
+
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+	mu          sync.Mutex
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.upperBounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// DefaultLatencyBuckets covers claim and handshake waits from 1ms to 10s.
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type series[T any] struct {
+	metric *T
+	values []string
+}
+
+type vec[T any] struct {
+	newMetric  func() *T
+	children   map[string]*series[T]
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	mu         sync.RWMutex
+}
+
+func newVec[T any](name, help, metricType string, labels []string, newMetric func() *T) *vec[T] {
+	return &vec[T]{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		newMetric:  newMetric,
+		children:   make(map[string]*series[T]),
+	}
+}
+
+// With returns the series for the given label values, creating it on first
+// use. Missing values are treated as empty strings.
+func (v *vec[T]) With(values ...string) *T {
+	values = v.normalize(values)
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok = v.children[key]; ok {
+		return child.metric
+	}
+	child = &series[T]{metric: v.newMetric(), values: values}
+	v.children[key] = child
+	return child.metric
+}
+
+func (v *vec[T]) normalize(values []string) []string {
+	out := make([]string, len(v.labels))
+	copy(out, values)
+	return out
+}
+
+func (v *vec[T]) deleteLabel(label, value string) {
+	idx := slices.Index(v.labels, label)
+	if idx < 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, child := range v.children {
+		if child.values[idx] == value {
+			delete(v.children, key)
+		}
+	}
+}
+
+func (v *vec[T]) sortedSeries() []*series[T] {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	out := make([]*series[T], 0, len(keys))
+	for _, key := range keys {
+		out = append(out, v.children[key])
+	}
+	v.mu.RUnlock()
+	return out
+}
+
+func (v *vec[T]) writeHeader(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, v.metricType)
+}
+
+type CounterVec struct {
+	*vec[Counter]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+}
+
+func (v *CounterVec) writeText(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sortedSeries() {
+		writeSample(w, v.name, v.labels, s.values, float64(s.metric.Value()))
+	}
+}
+
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+}
+
+func (v *GaugeVec) writeText(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sortedSeries() {
+		writeSample(w, v.name, v.labels, s.values, float64(s.metric.Value()))
+	}
+}
+
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upperBounds: buckets, counts: make([]uint64, len(buckets))}
+	})}
+}
+
+func (v *HistogramVec) writeText(w *bufio.Writer) {
+	v.writeHeader(w)
+	bucketLabels := append(slices.Clone(v.labels), "le")
+	for _, s := range v.sortedSeries() {
+		h := s.metric
+		h.mu.Lock()
+		counts := slices.Clone(h.counts)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		values := append(slices.Clone(s.values), "")
+		for i, bound := range h.upperBounds {
+			values[len(values)-1] = formatFloat(bound)
+			writeSample(w, v.name+"_bucket", bucketLabels, values, float64(counts[i]))
+		}
+		values[len(values)-1] = "+Inf"
+		writeSample(w, v.name+"_bucket", bucketLabels, values, float64(count))
+		writeSample(w, v.name+"_sum", v.labels, s.values, sum)
+		writeSample(w, v.name+"_count", v.labels, s.values, float64(count))
+	}
+}
+
+// Sample is one series value of a GaugeSnapshot.
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// GaugeSnapshot is a gauge family computed at scrape time, for values that
+// already live elsewhere such as ready queue depth or port pool usage.
+type GaugeSnapshot struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Samples []Sample
+}
+
+func (g GaugeSnapshot) writeText(w *bufio.Writer) {
+	writeHeader(w, g.Name, g.Help, "gauge")
+	for _, s := range g.Samples {
+		values := make([]string, len(g.Labels))
+		copy(values, s.Values)
+		writeSample(w, g.Name, g.Labels, values, s.Value)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, metricType string) {
+	_, _ = w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, value float64) {
+	_, _ = w.WriteString(name)
+	if len(labels) > 0 {
+		_ = w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = w.WriteString(label + `="` + escapeLabelValue(values[i]) + `"`)
+		}
+		_ = w.WriteByte('}')
+	}
+	_ = w.WriteByte(' ')
+	_, _ = w.WriteString(formatFloat(value))
+	_ = w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+// Relay data-path and control-plane metrics. Per-lease series carry the
+// lease identity key in the "lease" label; global totals survive lease
+// removal so rates stay continuous across re-registration.
+var (
+	BridgeBytes = NewCounterVec("portal_bridge_bytes_total",
+		"Bytes relayed through bridged connections. direction=in is client to tenant.",
+		"transport", "direction")
+	LeaseBridgeBytes = NewCounterVec("portal_lease_bridge_bytes_total",
+		"Bytes relayed through bridged connections per lease.",
+		LeaseLabel, "transport", "direction")
+	BridgeActive = NewGaugeVec("portal_lease_bridge_active_connections",
+		"Bridged connections currently open per lease.",
+		LeaseLabel, "transport")
+
+	ClaimDuration = NewHistogramVec("portal_stream_claim_duration_seconds",
+		"Time spent waiting for a ready reverse session, by outcome.",
+		DefaultLatencyBuckets, "marker", "outcome")
+	ClaimTimeouts = NewCounterVec("portal_lease_claim_timeouts_total",
+		"Reverse session claims that gave up before a session became ready.",
+		LeaseLabel)
+	ConnRejects = NewCounterVec("portal_lease_rejected_connections_total",
+		"Public connections rejected by connection limits or byte quotas before claiming a reverse session.",
+		LeaseLabel, "transport", "reason")
+	IngressBlocked = NewCounterVec("portal_ingress_blocked_total",
+		"Public connections and UDP datagrams dropped because the client IP is banned (reason=banned), on the ingress deny list (reason=denied) or not admitted by the lease ingress rules (reason=lease).",
+		"transport", "reason")
+
+	SNINoRoute = NewCounterVec("portal_sni_no_route_total",
+		"SNI connections closed because no routable lease matched.",
+		"reason")
+	SNIClientHelloFailures = NewCounterVec("portal_sni_client_hello_failures_total",
+		"SNI connections closed because the ClientHello could not be inspected.",
+		"reason")
+	SNIOfflinePages = NewCounterVec("portal_sni_offline_pages_total",
+		"SNI connections answered with the relay offline page instead of a tenant session.",
+		"reason")
+
+	APIOutcomes = NewCounterVec("portal_api_requests_total",
+		"Lease control-plane requests by endpoint and result code (ok or an API error code).",
+		"endpoint", "code")
+
+	UDPFlows = NewCounterVec("portal_lease_udp_flows_total",
+		"UDP flows created per lease.",
+		LeaseLabel)
+	UDPDrops = NewCounterVec("portal_lease_udp_dropped_packets_total",
+		"UDP packets dropped per lease. direction=in is client to tenant.",
+		LeaseLabel, "direction", "reason")
+)
+
+func init() {
+	Default.Register(
+		BridgeBytes,
+		LeaseBridgeBytes,
+		BridgeActive,
+		ClaimDuration,
+		ClaimTimeouts,
+		ConnRejects,
+		IngressBlocked,
+		SNINoRoute,
+		SNIClientHelloFailures,
+		SNIOfflinePages,
+		APIOutcomes,
+		UDPFlows,
+		UDPDrops,
+	)
+}
+
+// ForgetLease drops the per-lease series of key from the default registry.
+func ForgetLease(key string) {
+	Default.ForgetLease(key)
+}
@@ -0,0 +1,162 @@
+package portal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/portal/metrics"
+)
+
+const (
+	defaultOfflineHandshakeTimeout = 5 * time.Second
+	defaultOfflineRetryAfter       = 30 * time.Second
+)
+
+var offlinePageTemplate = template.Must(template.New("offline").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>{{.Name}} is offline</title>
+<style>
+body{margin:0;min-height:100vh;display:flex;align-items:center;justify-content:center;background:#0b0d12;color:#e6e8ee;font-family:system-ui,-apple-system,"Segoe UI",sans-serif}
+main{max-width:32rem;padding:2rem}
+h1{margin:0 0 .5rem;font-size:1.5rem}
+p{margin:.25rem 0;color:#9aa3b2}
+dl{display:grid;grid-template-columns:auto 1fr;gap:.25rem 1rem;margin:1.5rem 0 0;font-size:.9rem}
+dt{color:#6b7385}
+footer{margin-top:2rem;font-size:.8rem;color:#6b7385}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Name}} is offline</h1>
+<p>{{.Reason}}</p>
+{{with .Description}}<p>{{.}}</p>{{end}}
+<dl>
+<dt>Hostname</dt><dd>{{.Hostname}}</dd>
+{{with .Owner}}<dt>Owner</dt><dd>{{.}}</dd>{{end}}
+{{if .LastSeen}}<dt>Last seen</dt><dd>{{.LastSeen}}</dd>{{end}}
+{{if .Replicas}}<dt>Replicas</dt><dd>{{.Replicas}}</dd>{{end}}
+</dl>
+<footer>Served by the Portal relay at {{.RelayHost}} because the service has no active connection. This page never reaches the service itself.</footer>
+</main>
+</body>
+</html>
+`))
+
+type offlinePageData struct {
+	Name        string
+	Hostname    string
+	Reason      string
+	Description string
+	Owner       string
+	LastSeen    string
+	Replicas    int
+	RelayHost   string
+	RetryAfter  int
+}
+
+// offlineTLSConfig returns the relay certificate config used to terminate
+// offline-page connections, or nil when the mode is disabled.
+func (s *Server) offlineTLSConfig(apiTLS *tls.Config) *tls.Config {
+	if !s.cfg.OfflinePageEnabled || apiTLS == nil {
+		return nil
+	}
+	conf := apiTLS.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+	return conf
+}
+
+// relayCertificateCovers reports whether hostname matches the relay's own
+// "*.<root>" certificate, which is the only case the relay can answer for
+// without the tenant's keys.
+func (s *Server) relayCertificateCovers(hostname string) bool {
+	label, ok := strings.CutSuffix(hostname, "."+s.identity.Name)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// serveOfflinePage answers a routed hostname that has no usable reverse
+// session. It terminates TLS with the relay certificate, which breaks the
+// end-to-end path, so it only runs for leases flagged OfflinePage and only
+// after the relay has given up on reaching the tenant. It reports whether
+// the connection was handled.
+func (s *Server) serveOfflinePage(conn net.Conn, hostname, reason string, record *leaseRecord) bool {
+	if s.offlineTLS == nil || record == nil || !record.OfflinePage || !s.relayCertificateCovers(hostname) {
+		return false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(defaultOfflineHandshakeTimeout))
+	tlsConn := tls.Server(conn, s.offlineTLS)
+	if err := tlsConn.Handshake(); err != nil {
+		return true
+	}
+	req, err := http.ReadRequest(bufio.NewReader(tlsConn))
+	if err != nil {
+		return true
+	}
+	_ = req.Body.Close()
+
+	snapshot := s.registry.Snapshot(record)
+	data := offlinePageData{
+		Name:        snapshot.Name,
+		Hostname:    hostname,
+		Reason:      offlinePageReason(reason),
+		Description: snapshot.Metadata.Description,
+		Owner:       snapshot.Metadata.Owner,
+		Replicas:    snapshot.Replicas,
+		RelayHost:   s.identity.Name,
+		RetryAfter:  int(defaultOfflineRetryAfter.Seconds()),
+	}
+	if !snapshot.LastSeenAt.IsZero() {
+		data.LastSeen = snapshot.LastSeenAt.UTC().Format(time.RFC1123)
+	}
+
+	var body bytes.Buffer
+	if err := offlinePageTemplate.Execute(&body, data); err != nil {
+		log.Warn().Err(err).Str("hostname", hostname).Msg("render offline page")
+		return true
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		ContentLength: int64(body.Len()),
+		Body:          io.NopCloser(&body),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("Retry-After", strconv.Itoa(data.RetryAfter))
+	resp.Header.Set("X-Portal-Offline", reason)
+	if err := resp.Write(tlsConn); err == nil {
+		metrics.SNIOfflinePages.With(reason).Inc()
+	}
+	return true
+}
+
+func offlinePageReason(reason string) string {
+	switch reason {
+	case "expired":
+		return "The service's lease with this relay has expired."
+	case "not_routable":
+		return "The service is not currently accepting traffic through this relay."
+	default:
+		return "The service has no open connection to this relay right now. It will be reachable again once it reconnects."
+	}
+}
@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BPSLimiter is a bytes-per-second token bucket shared by every relayed
+// connection of one identity. A rate of zero or less disables throttling.
+//
+// Callers charge bytes after reading them, so the bucket may go into debt
+// for large reads; the next caller then waits for the debt to be repaid.
+type BPSLimiter struct {
+	changed chan struct{}
+	last    time.Time
+	tokens  float64
+	bps     int64
+	mu      sync.Mutex
+}
+
+func NewBPSLimiter(bps int64) *BPSLimiter {
+	l := &BPSLimiter{changed: make(chan struct{})}
+	l.SetBPS(bps)
+	l.tokens = float64(l.bps)
+	return l
+}
+
+func (l *BPSLimiter) BPS() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bps
+}
+
+// SetBPS updates the rate in place. Bytes already charged stay owed, and
+// goroutines blocked in WaitN repay the rest of their debt at the new rate.
+func (l *BPSLimiter) SetBPS(bps int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bps < 0 {
+		bps = 0
+	}
+	if bps == l.bps {
+		return
+	}
+	now := time.Now()
+	if l.bps > 0 {
+		l.refillLocked(now)
+		l.tokens = min(l.tokens, float64(bps))
+	} else {
+		// The bucket was idle while throttling was off.
+		l.tokens = float64(bps)
+	}
+	l.bps = bps
+	l.last = now
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// WaitN charges n bytes against the bucket and blocks until they are paid for
+// or ctx is done. A rate change mid-wait reprices the remaining debt; turning
+// throttling off releases the wait.
+func (l *BPSLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.bps <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refillLocked(time.Now())
+	l.tokens -= float64(n)
+	owed := -l.tokens
+
+	for owed > 0 {
+		bps := float64(l.bps)
+		changed := l.changed
+		start := time.Now()
+		l.mu.Unlock()
+
+		timer := time.NewTimer(time.Duration(owed / bps * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed:
+			timer.Stop()
+		}
+
+		l.mu.Lock()
+		owed -= time.Since(start).Seconds() * bps
+		if l.bps <= 0 {
+			break
+		}
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// AllowN charges n bytes against the bucket without blocking. It reports
+// false and charges nothing while the bucket is in debt, so callers that
+// cannot wait, such as the shared UDP loops, drop the data instead.
+func (l *BPSLimiter) AllowN(n int) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bps <= 0 {
+		return true
+	}
+	l.refillLocked(time.Now())
+	if l.tokens <= 0 {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+func (l *BPSLimiter) refillLocked(now time.Time) {
+	burst := float64(l.bps)
+	l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*burst)
+	l.last = now
+}
@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBPSLimiterThrottlesAfterBurst(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewBPSLimiter(10000)
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := limiter.WaitN(ctx, 10000); err != nil {
+		t.Fatalf("WaitN(burst) error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("WaitN(burst) took %s, want the full bucket at once", elapsed)
+	}
+
+	// 5000 bytes past the burst at 10000 B/s must take about half a second.
+	for range 5 {
+		if err := limiter.WaitN(ctx, 1000); err != nil {
+			t.Fatalf("WaitN() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("15000 bytes at 10000 B/s took %s, want about 500ms", elapsed)
+	}
+}
+
+func TestBPSLimiterRepricesDebtOnRateChange(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewBPSLimiter(1000)
+	ctx := context.Background()
+	if err := limiter.WaitN(ctx, 1000); err != nil {
+		t.Fatalf("WaitN(burst) error = %v", err)
+	}
+
+	// 2000 bytes owed at 1000 B/s would take two seconds. Raising the rate
+	// after 100ms leaves about 1900 bytes to repay at 10000 B/s.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		limiter.SetBPS(10000)
+	}()
+	start := time.Now()
+	if err := limiter.WaitN(ctx, 2000); err != nil {
+		t.Fatalf("WaitN() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("WaitN() across a rate increase took %s, want about 290ms", elapsed)
+	}
+
+	// The debt left by a rate decrease must still be paid.
+	limiter.SetBPS(1000)
+	start = time.Now()
+	if err := limiter.WaitN(ctx, 300); err != nil {
+		t.Fatalf("WaitN() after a rate decrease error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("WaitN() after a rate decrease took %s, want about 300ms", elapsed)
+	}
+
+	// Turning throttling off releases a blocked caller.
+	done := make(chan error, 1)
+	go func() { done <- limiter.WaitN(ctx, 10000) }()
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetBPS(0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitN() after SetBPS(0) error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitN() still blocked after SetBPS(0)")
+	}
+}
+
+func TestBPSLimiterAllowNDropsWhileInDebt(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewBPSLimiter(1000)
+	if !limiter.AllowN(600) || !limiter.AllowN(600) {
+		t.Fatal("AllowN() refused bytes while the bucket still had tokens")
+	}
+	// The second charge left the bucket 200 bytes in debt.
+	if limiter.AllowN(1) {
+		t.Fatal("AllowN() accepted bytes while the bucket was in debt")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if !limiter.AllowN(100) {
+		t.Fatal("AllowN() refused bytes after the debt was repaid")
+	}
+
+	limiter.SetBPS(0)
+	if !limiter.AllowN(1 << 20) {
+		t.Fatal("AllowN() refused bytes with throttling off")
+	}
+}
+
+func TestBPSManagerKeepsHeldLimiterAcrossReregistration(t *testing.T) {
+	t.Parallel()
+
+	const key = "demo:0x1111111111111111111111111111111111111111"
+	manager := NewBPSManager()
+	manager.SetIdentityBPS(key, 1000)
+
+	held, release := manager.AcquireLimiter(key)
+	manager.ForgetLimiter(key)
+	if got := manager.Limiter(key); got != held {
+		t.Fatal("Limiter() after ForgetLimiter returned a new bucket while a connection still holds the old one")
+	}
+	manager.SetIdentityBPS(key, 2000)
+	if got := held.BPS(); got != 2000 {
+		t.Fatalf("held limiter BPS = %d, want 2000", got)
+	}
+
+	release()
+	release()
+	manager.ForgetLimiter(key)
+	if got := manager.Limiter(key); got == held {
+		t.Fatal("Limiter() after the last release and ForgetLimiter returned the dropped bucket")
+	}
+	if got := manager.Limiter(key).BPS(); got != 2000 {
+		t.Fatalf("new limiter BPS = %d, want the configured 2000", got)
+	}
+}
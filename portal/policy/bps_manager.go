@@ -7,12 +7,18 @@ import (
 
 type BPSManager struct {
 	identityBPS map[string]int64
+	limiters    map[string]*BPSLimiter
+	users       map[string]int
+	forgotten   map[string]struct{}
 	mu          sync.RWMutex
 }
 
 func NewBPSManager() *BPSManager {
 	return &BPSManager{
 		identityBPS: make(map[string]int64),
+		limiters:    make(map[string]*BPSLimiter),
+		users:       make(map[string]int),
+		forgotten:   make(map[string]struct{}),
 	}
 }
 
@@ -35,19 +41,17 @@ func (m *BPSManager) SetIdentityBPS(key string, bps int64) {
 	defer m.mu.Unlock()
 	if bps <= 0 {
 		delete(m.identityBPS, key)
-		return
+		bps = 0
+	} else {
+		m.identityBPS[key] = bps
+	}
+	if limiter, ok := m.limiters[key]; ok {
+		limiter.SetBPS(bps)
 	}
-	m.identityBPS[key] = bps
 }
 
 func (m *BPSManager) DeleteIdentityBPS(key string) {
-	if m == nil || key == "" {
-		return
-	}
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.identityBPS, key)
+	m.SetIdentityBPS(key, 0)
 }
 
 func (m *BPSManager) IdentityBPSLimits() map[string]int64 {
@@ -78,5 +82,78 @@ func (m *BPSManager) SetIdentityBPSLimits(limits map[string]int64) {
 
 	m.mu.Lock()
 	m.identityBPS = next
+	for key, limiter := range m.limiters {
+		limiter.SetBPS(next[key])
+	}
 	m.mu.Unlock()
 }
+
+// Limiter returns the limiter shared by all data-path connections of key.
+// It is created on first use and follows later limit changes in place.
+func (m *BPSManager) Limiter(key string) *BPSLimiter {
+	if m == nil || key == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limiterLocked(key)
+}
+
+// AcquireLimiter returns the limiter of key and holds it for the caller until
+// release is called. A held limiter survives ForgetLimiter, so connections
+// that outlive their lease and a re-registered lease share one bucket.
+func (m *BPSManager) AcquireLimiter(key string) (limiter *BPSLimiter, release func()) {
+	if m == nil || key == "" {
+		return nil, func() {}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limiter = m.limiterLocked(key)
+	m.users[key]++
+	delete(m.forgotten, key)
+
+	var once sync.Once
+	return limiter, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.users[key]--
+			if m.users[key] > 0 {
+				return
+			}
+			delete(m.users, key)
+			if _, ok := m.forgotten[key]; ok {
+				delete(m.forgotten, key)
+				delete(m.limiters, key)
+			}
+		})
+	}
+}
+
+// ForgetLimiter drops the runtime limiter for key once no connection holds
+// it. The configured limit is kept so a re-registered lease is throttled
+// again.
+func (m *BPSManager) ForgetLimiter(key string) {
+	if m == nil || key == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.users[key] > 0 {
+		m.forgotten[key] = struct{}{}
+		return
+	}
+	delete(m.limiters, key)
+}
+
+func (m *BPSManager) limiterLocked(key string) *BPSLimiter {
+	limiter, ok := m.limiters[key]
+	if !ok {
+		limiter = NewBPSLimiter(m.identityBPS[key])
+		m.limiters[key] = limiter
+	}
+	return limiter
+}
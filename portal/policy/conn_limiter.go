@@ -0,0 +1,209 @@
+package policy
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+// Reasons reported by ConnLimiter.Acquire for a rejected connection.
+const (
+	ConnRejectLeaseLimit = "lease_limit"
+	ConnRejectRateLimit  = "rate_limit"
+	ConnRejectIPLimit    = "ip_limit"
+)
+
+const connRateSweepInterval = time.Minute
+
+type connRateKey struct {
+	leaseKey string
+	clientIP string
+}
+
+// connRate is a token bucket refilled at the per-IP rate and holding at most
+// one second worth of connections.
+type connRate struct {
+	tokens  float64
+	updated time.Time
+}
+
+// ConnLimiter enforces types.ConnLimits on public connections. Per-lease
+// overrides replace the defaults field by field where they are non-zero;
+// MaxPerIP is relay-wide and only taken from the defaults.
+type ConnLimiter struct {
+	defaults    types.ConnLimits
+	overrides   map[string]types.ConnLimits
+	leaseActive map[string]int
+	ipActive    map[string]int
+	rates       map[connRateKey]*connRate
+	sweptAt     time.Time
+	mu          sync.Mutex
+}
+
+func NewConnLimiter() *ConnLimiter {
+	return &ConnLimiter{
+		overrides:   make(map[string]types.ConnLimits),
+		leaseActive: make(map[string]int),
+		ipActive:    make(map[string]int),
+		rates:       make(map[connRateKey]*connRate),
+	}
+}
+
+func (l *ConnLimiter) Defaults() types.ConnLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.defaults
+}
+
+func (l *ConnLimiter) SetDefaults(limits types.ConnLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaults = limits.Normalize()
+}
+
+// Override returns the limits configured for key, if any.
+func (l *ConnLimiter) Override(key string) (types.ConnLimits, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits, ok := l.overrides[key]
+	return limits, ok
+}
+
+// SetOverride replaces the limits of key. Limits without a positive field
+// remove the override.
+func (l *ConnLimiter) SetOverride(key string, limits types.ConnLimits) {
+	if key == "" {
+		return
+	}
+	limits = limits.Normalize()
+	limits.MaxPerIP = 0
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits.IsZero() {
+		delete(l.overrides, key)
+		return
+	}
+	l.overrides[key] = limits
+}
+
+func (l *ConnLimiter) DeleteOverride(key string) {
+	l.SetOverride(key, types.ConnLimits{})
+}
+
+func (l *ConnLimiter) Overrides() map[string]types.ConnLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]types.ConnLimits, len(l.overrides))
+	maps.Copy(out, l.overrides)
+	return out
+}
+
+func (l *ConnLimiter) SetOverrides(overrides map[string]types.ConnLimits) {
+	next := make(map[string]types.ConnLimits, len(overrides))
+	for key, limits := range overrides {
+		limits = limits.Normalize()
+		limits.MaxPerIP = 0
+		if key == "" || limits.IsZero() {
+			continue
+		}
+		next[key] = limits
+	}
+
+	l.mu.Lock()
+	l.overrides = next
+	l.mu.Unlock()
+}
+
+// Acquire admits one connection from clientIP to the lease key. It returns
+// a release func to call once the connection closes, or the reason the
+// connection was rejected.
+func (l *ConnLimiter) Acquire(key, clientIP string) (release func(), reason string) {
+	if l == nil {
+		return func() {}, ""
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := l.effectiveLocked(key)
+	if limits.MaxPerLease > 0 && l.leaseActive[key] >= limits.MaxPerLease {
+		return nil, ConnRejectLeaseLimit
+	}
+	if clientIP != "" && limits.MaxPerIP > 0 && l.ipActive[clientIP] >= limits.MaxPerIP {
+		return nil, ConnRejectIPLimit
+	}
+	if clientIP != "" && limits.RatePerIP > 0 && !l.takeRateLocked(connRateKey{key, clientIP}, limits.RatePerIP, now) {
+		return nil, ConnRejectRateLimit
+	}
+
+	l.leaseActive[key]++
+	if clientIP != "" {
+		l.ipActive[clientIP]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(key, clientIP) })
+	}, ""
+}
+
+// Active reports the open connections admitted for the lease key.
+func (l *ConnLimiter) Active(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leaseActive[key]
+}
+
+func (l *ConnLimiter) release(key, clientIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leaseActive[key]--; l.leaseActive[key] <= 0 {
+		delete(l.leaseActive, key)
+	}
+	if clientIP == "" {
+		return
+	}
+	if l.ipActive[clientIP]--; l.ipActive[clientIP] <= 0 {
+		delete(l.ipActive, clientIP)
+	}
+}
+
+func (l *ConnLimiter) effectiveLocked(key string) types.ConnLimits {
+	limits := l.defaults
+	if override, ok := l.overrides[key]; ok {
+		if override.MaxPerLease > 0 {
+			limits.MaxPerLease = override.MaxPerLease
+		}
+		if override.RatePerIP > 0 {
+			limits.RatePerIP = override.RatePerIP
+		}
+	}
+	return limits
+}
+
+func (l *ConnLimiter) takeRateLocked(rateKey connRateKey, perSecond int, now time.Time) bool {
+	if now.Sub(l.sweptAt) >= connRateSweepInterval {
+		l.sweptAt = now
+		for candidate, bucket := range l.rates {
+			if now.Sub(bucket.updated) >= connRateSweepInterval {
+				delete(l.rates, candidate)
+			}
+		}
+	}
+
+	capacity := float64(perSecond)
+	bucket, ok := l.rates[rateKey]
+	if !ok {
+		bucket = &connRate{tokens: capacity, updated: now}
+		l.rates[rateKey] = bucket
+	}
+	bucket.tokens = min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*capacity)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+func TestConnLimiterRefillsRatePerIP(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewConnLimiter()
+	limiter.SetDefaults(types.ConnLimits{RatePerIP: 10})
+
+	// The bucket holds one second worth of connections.
+	for i := range 10 {
+		if _, reason := limiter.Acquire("demo", "198.51.100.7"); reason != "" {
+			t.Fatalf("Acquire(#%d) reason = %q, want admitted", i+1, reason)
+		}
+	}
+	if _, reason := limiter.Acquire("demo", "198.51.100.7"); reason != ConnRejectRateLimit {
+		t.Fatalf("Acquire(over burst) reason = %q, want %q", reason, ConnRejectRateLimit)
+	}
+	// Buckets are kept per lease and client IP.
+	if _, reason := limiter.Acquire("demo", "198.51.100.8"); reason != "" {
+		t.Fatalf("Acquire(other ip) reason = %q, want admitted", reason)
+	}
+	if _, reason := limiter.Acquire("other", "198.51.100.7"); reason != "" {
+		t.Fatalf("Acquire(other lease) reason = %q, want admitted", reason)
+	}
+
+	// At 10 per second, 250ms refills two connections but not three.
+	time.Sleep(250 * time.Millisecond)
+	for i := range 2 {
+		if _, reason := limiter.Acquire("demo", "198.51.100.7"); reason != "" {
+			t.Fatalf("Acquire(refilled #%d) reason = %q, want admitted", i+1, reason)
+		}
+	}
+	if _, reason := limiter.Acquire("demo", "198.51.100.7"); reason != ConnRejectRateLimit {
+		t.Fatalf("Acquire(after refill) reason = %q, want %q", reason, ConnRejectRateLimit)
+	}
+
+	// A lease override replaces the default rate for the next refill.
+	limiter.SetOverride("demo", types.ConnLimits{RatePerIP: 1000})
+	time.Sleep(20 * time.Millisecond)
+	if _, reason := limiter.Acquire("demo", "198.51.100.7"); reason != "" {
+		t.Fatalf("Acquire(override) reason = %q, want admitted", reason)
+	}
+}
+
+func TestConnLimiterCapsClientIPAcrossLeases(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewConnLimiter()
+	limiter.SetDefaults(types.ConnLimits{MaxPerIP: 2})
+	// MaxPerIP is relay-wide; a lease override cannot raise it.
+	limiter.SetOverride("gamma", types.ConnLimits{MaxPerIP: 10, MaxPerLease: 10})
+
+	releaseAlpha, reason := limiter.Acquire("alpha", "198.51.100.7")
+	if reason != "" {
+		t.Fatalf("Acquire(alpha) reason = %q, want admitted", reason)
+	}
+	if _, reason := limiter.Acquire("beta", "198.51.100.7"); reason != "" {
+		t.Fatalf("Acquire(beta) reason = %q, want admitted", reason)
+	}
+	if _, reason := limiter.Acquire("gamma", "198.51.100.7"); reason != ConnRejectIPLimit {
+		t.Fatalf("Acquire(gamma) reason = %q, want %q", reason, ConnRejectIPLimit)
+	}
+	if _, reason := limiter.Acquire("gamma", "198.51.100.8"); reason != "" {
+		t.Fatalf("Acquire(gamma, other ip) reason = %q, want admitted", reason)
+	}
+
+	// A release frees the slot once, however often it is called.
+	releaseAlpha()
+	releaseAlpha()
+	if got := limiter.Active("alpha"); got != 0 {
+		t.Fatalf("Active(alpha) = %d, want 0", got)
+	}
+	if _, reason := limiter.Acquire("gamma", "198.51.100.7"); reason != "" {
+		t.Fatalf("Acquire(gamma after release) reason = %q, want admitted", reason)
+	}
+	if _, reason := limiter.Acquire("alpha", "198.51.100.7"); reason != ConnRejectIPLimit {
+		t.Fatalf("Acquire(alpha again) reason = %q, want %q", reason, ConnRejectIPLimit)
+	}
+}
+
+func TestConnLimiterAppliesLeaseOverride(t *testing.T) {
+	t.Parallel()
+
+	limiter := NewConnLimiter()
+	limiter.SetDefaults(types.ConnLimits{MaxPerLease: 1})
+	limiter.SetOverride("beta", types.ConnLimits{MaxPerLease: 2})
+
+	if _, reason := limiter.Acquire("alpha", ""); reason != "" {
+		t.Fatalf("Acquire(alpha) reason = %q, want admitted", reason)
+	}
+	if _, reason := limiter.Acquire("alpha", ""); reason != ConnRejectLeaseLimit {
+		t.Fatalf("Acquire(alpha over limit) reason = %q, want %q", reason, ConnRejectLeaseLimit)
+	}
+	for i := range 2 {
+		if _, reason := limiter.Acquire("beta", ""); reason != "" {
+			t.Fatalf("Acquire(beta #%d) reason = %q, want admitted", i+1, reason)
+		}
+	}
+	if _, reason := limiter.Acquire("beta", ""); reason != ConnRejectLeaseLimit {
+		t.Fatalf("Acquire(beta over override) reason = %q, want %q", reason, ConnRejectLeaseLimit)
+	}
+
+	limiter.DeleteOverride("beta")
+	if _, ok := limiter.Override("beta"); ok {
+		t.Fatal("Override(beta) still set after DeleteOverride")
+	}
+}
@@ -1,66 +1,170 @@
 package policy
 
 import (
+	"net/netip"
 	"slices"
 	"strings"
 	"sync"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+// Reasons public ingress is blocked: the operator ban list, the operator
+// ingress deny list, or the IngressACL of the lease.
+const (
+	IngressBlockBanned = "banned"
+	IngressBlockDenied = "denied"
+	IngressBlockLease  = "lease"
 )
 
+// IPFilter holds two lists of IP addresses and CIDR ranges. Banned entries
+// are refused on the control plane and on public ingress; ingress deny
+// entries only on public ingress, so tenants behind them can still register.
 type IPFilter struct {
-	bannedIPs      map[string]struct{}
+	banned         ipRules
+	ingressDeny    ipRules
 	identityToIP   map[string]string
 	ipToIdentities map[string][]string
 	mu             sync.RWMutex
 }
 
+// ipRules maps the canonical text of an IP address or CIDR range to the
+// prefix it covers.
+type ipRules map[string]netip.Prefix
+
+func newIPRules(entries []string) ipRules {
+	rules := make(ipRules, len(entries))
+	for _, entry := range entries {
+		if key, prefix, ok := utils.ParseIPRule(entry); ok {
+			rules[key] = prefix
+		}
+	}
+	return rules
+}
+
+func (r ipRules) add(raw string) {
+	if key, prefix, ok := utils.ParseIPRule(raw); ok {
+		r[key] = prefix
+	}
+}
+
+func (r ipRules) remove(raw string) {
+	if key, _, ok := utils.ParseIPRule(raw); ok {
+		delete(r, key)
+	}
+}
+
+func (r ipRules) matches(ip string) bool {
+	if len(r) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range r {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ipRules) keys() []string {
+	out := make([]string, 0, len(r))
+	for key := range r {
+		out = append(out, key)
+	}
+	slices.Sort(out)
+	return out
+}
+
 func NewIPFilter() *IPFilter {
 	return &IPFilter{
-		bannedIPs:      make(map[string]struct{}),
+		banned:         make(ipRules),
+		ingressDeny:    make(ipRules),
 		identityToIP:   make(map[string]string),
 		ipToIdentities: make(map[string][]string),
 	}
 }
 
+// BanIP bans an IP address or CIDR range. Invalid entries are ignored.
 func (f *IPFilter) BanIP(ip string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.bannedIPs[strings.TrimSpace(ip)] = struct{}{}
+	f.banned.add(ip)
 }
 
 func (f *IPFilter) UnbanIP(ip string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	delete(f.bannedIPs, strings.TrimSpace(ip))
+	f.banned.remove(ip)
 }
 
+// IsIPBanned reports whether ip falls in a banned address or range.
 func (f *IPFilter) IsIPBanned(ip string) bool {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	_, ok := f.bannedIPs[strings.TrimSpace(ip)]
-	return ok
+	return f.banned.matches(ip)
 }
 
 func (f *IPFilter) BannedIPs() []string {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	out := make([]string, 0, len(f.bannedIPs))
-	for ip := range f.bannedIPs {
-		out = append(out, ip)
-	}
-	return out
+	return f.banned.keys()
 }
 
 func (f *IPFilter) SetBannedIPs(ips []string) {
+	rules := newIPRules(ips)
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.bannedIPs = make(map[string]struct{}, len(ips))
-	for _, ip := range ips {
-		ip = strings.TrimSpace(ip)
-		if ip == "" {
-			continue
-		}
-		f.bannedIPs[ip] = struct{}{}
+	f.banned = rules
+}
+
+// DenyIngress blocks an IP address or CIDR range from public ingress.
+// Invalid entries are ignored.
+func (f *IPFilter) DenyIngress(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ingressDeny.add(ip)
+}
+
+func (f *IPFilter) UndenyIngress(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ingressDeny.remove(ip)
+}
+
+func (f *IPFilter) IngressDenyList() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.ingressDeny.keys()
+}
+
+func (f *IPFilter) SetIngressDenyList(ips []string) {
+	rules := newIPRules(ips)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ingressDeny = rules
+}
+
+// IngressBlockReason returns why public ingress from ip must be dropped, or
+// "" when it is allowed. A nil filter allows everything.
+func (f *IPFilter) IngressBlockReason(ip string) string {
+	if f == nil {
+		return ""
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	switch {
+	case f.banned.matches(ip):
+		return IngressBlockBanned
+	case f.ingressDeny.matches(ip):
+		return IngressBlockDenied
 	}
+	return ""
 }
 
 func (f *IPFilter) RegisterIdentityIP(key, ip string) {
@@ -121,3 +225,32 @@ func (f *IPFilter) removeIdentityFromIPLocked(key, ip string) {
 		delete(f.ipToIdentities, ip)
 	}
 }
+
+// IngressACL enforces the types.IngressRules a tenant registered for its
+// lease. A nil ACL admits every client.
+type IngressACL struct {
+	allow ipRules
+	deny  ipRules
+}
+
+// NewIngressACL compiles rules, skipping invalid entries. It returns nil for
+// empty rules.
+func NewIngressACL(rules types.IngressRules) *IngressACL {
+	if rules.IsZero() {
+		return nil
+	}
+	return &IngressACL{
+		allow: newIPRules(rules.Allow),
+		deny:  newIPRules(rules.Deny),
+	}
+}
+
+func (a *IngressACL) Allows(ip string) bool {
+	if a == nil {
+		return true
+	}
+	if a.deny.matches(ip) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.matches(ip)
+}
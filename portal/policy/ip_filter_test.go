@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+func TestIPRulesMatches(t *testing.T) {
+	t.Parallel()
+
+	rules := newIPRules([]string{
+		"203.0.113.0/24",
+		"198.51.100.7",
+		"2001:db8:abcd::/48",
+		"::ffff:192.0.2.0/120",
+		"not-an-ip",
+	})
+	if got, want := rules.keys(), []string{"192.0.2.0/24", "198.51.100.7", "2001:db8:abcd::/48", "203.0.113.0/24"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "203.0.113.200", want: true},
+		{ip: "203.0.114.1", want: false},
+		{ip: "198.51.100.7", want: true},
+		{ip: "198.51.100.8", want: false},
+		{ip: "2001:db8:abcd:12::1", want: true},
+		{ip: "2001:db8:abce::1", want: false},
+		{ip: "::ffff:203.0.113.5", want: true},
+		{ip: "::ffff:198.51.100.7", want: true},
+		{ip: "192.0.2.44", want: true},
+		{ip: "::ffff:192.0.2.44", want: true},
+		{ip: "", want: false},
+		{ip: "portal.example.com", want: false},
+	}
+	for _, tc := range tests {
+		if got := rules.matches(tc.ip); got != tc.want {
+			t.Fatalf("matches(%q) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	rules.remove("203.0.113.9/24")
+	if rules.matches("203.0.113.200") {
+		t.Fatal("matches() after remove(equivalent CIDR) = true, want false")
+	}
+}
+
+func TestIPFilterIngressBlockReason(t *testing.T) {
+	t.Parallel()
+
+	filter := NewIPFilter()
+	filter.BanIP("2001:db8::/32")
+	filter.DenyIngress("203.0.113.0/24")
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "2001:db8::1", want: IngressBlockBanned},
+		{ip: "2001:db9::1", want: ""},
+		{ip: "203.0.113.10", want: IngressBlockDenied},
+		{ip: "::ffff:203.0.113.10", want: IngressBlockDenied},
+		{ip: "198.51.100.7", want: ""},
+	}
+	for _, tc := range tests {
+		if got := filter.IngressBlockReason(tc.ip); got != tc.want {
+			t.Fatalf("IngressBlockReason(%q) = %q, want %q", tc.ip, got, tc.want)
+		}
+	}
+	if filter.IsIPBanned("203.0.113.10") {
+		t.Fatal("IsIPBanned(ingress denied ip) = true, want false")
+	}
+	if got := filter.IngressDenyList(); !reflect.DeepEqual(got, []string{"203.0.113.0/24"}) {
+		t.Fatalf("IngressDenyList() = %v, want [203.0.113.0/24]", got)
+	}
+
+	filter.UndenyIngress("203.0.113.0/24")
+	if got := filter.IngressBlockReason("203.0.113.10"); got != "" {
+		t.Fatalf("IngressBlockReason() after UndenyIngress = %q, want allowed", got)
+	}
+	if got := (*IPFilter)(nil).IngressBlockReason("2001:db8::1"); got != "" {
+		t.Fatalf("nil IPFilter IngressBlockReason() = %q, want allowed", got)
+	}
+}
+
+func TestIngressACLAllows(t *testing.T) {
+	t.Parallel()
+
+	if acl := NewIngressACL(types.IngressRules{}); acl != nil || !acl.Allows("198.51.100.7") {
+		t.Fatalf("NewIngressACL(empty) = %v, want a nil ACL admitting every client", acl)
+	}
+
+	acl := NewIngressACL(types.IngressRules{
+		Allow: []string{"10.0.0.0/8"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	denyOnly := NewIngressACL(types.IngressRules{Deny: []string{"10.1.0.0/16"}})
+	tests := []struct {
+		ip       string
+		allowed  bool
+		denyOnly bool
+	}{
+		{ip: "10.2.3.4", allowed: true, denyOnly: true},
+		{ip: "10.1.2.3", allowed: false, denyOnly: false},
+		{ip: "::ffff:10.2.3.4", allowed: true, denyOnly: true},
+		{ip: "::ffff:10.1.2.3", allowed: false, denyOnly: false},
+		{ip: "127.0.0.1", allowed: false, denyOnly: true},
+		{ip: "2001:db8::1", allowed: false, denyOnly: true},
+	}
+	for _, tc := range tests {
+		if got := acl.Allows(tc.ip); got != tc.allowed {
+			t.Fatalf("Allows(%q) = %v, want %v", tc.ip, got, tc.allowed)
+		}
+		if got := denyOnly.Allows(tc.ip); got != tc.denyOnly {
+			t.Fatalf("deny-only Allows(%q) = %v, want %v", tc.ip, got, tc.denyOnly)
+		}
+	}
+}
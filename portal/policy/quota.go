@@ -0,0 +1,322 @@
+package policy
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+const (
+	quotaDayLayout   = "2006-01-02"
+	quotaMonthLayout = "2006-01"
+)
+
+// QuotaManager enforces types.QuotaLimits per wallet address. Per-address
+// overrides replace the defaults field by field where they are non-zero;
+// MaxLeasesPerIP is relay-wide and only taken from the defaults. Relayed
+// bytes are counted by one QuotaMeter per address.
+type QuotaManager struct {
+	defaults  types.QuotaLimits
+	overrides map[string]types.QuotaLimits
+	meters    map[string]*QuotaMeter
+	crossed   chan struct{}
+	mu        sync.Mutex
+}
+
+func NewQuotaManager() *QuotaManager {
+	return &QuotaManager{
+		overrides: make(map[string]types.QuotaLimits),
+		meters:    make(map[string]*QuotaMeter),
+		crossed:   make(chan struct{}, 1),
+	}
+}
+
+// Crossed signals when a meter has just used up its daily or monthly bytes,
+// so the usage can be saved before the relay stops. Signals that arrive
+// while one is pending are merged.
+func (m *QuotaManager) Crossed() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	return m.crossed
+}
+
+func normalizeQuotaAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func (m *QuotaManager) Defaults() types.QuotaLimits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.defaults
+}
+
+func (m *QuotaManager) SetDefaults(limits types.QuotaLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaults = limits.Normalize()
+	for address, meter := range m.meters {
+		meter.setLimits(m.effectiveLocked(address))
+	}
+}
+
+// Limits returns the limits in effect for address.
+func (m *QuotaManager) Limits(address string) types.QuotaLimits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.effectiveLocked(normalizeQuotaAddress(address))
+}
+
+// Override returns the limits configured for address, if any.
+func (m *QuotaManager) Override(address string) (types.QuotaLimits, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limits, ok := m.overrides[normalizeQuotaAddress(address)]
+	return limits, ok
+}
+
+// SetOverride replaces the limits of address. Limits without a positive
+// field remove the override.
+func (m *QuotaManager) SetOverride(address string, limits types.QuotaLimits) {
+	address = normalizeQuotaAddress(address)
+	if address == "" {
+		return
+	}
+	limits = limits.Normalize()
+	limits.MaxLeasesPerIP = 0
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limits.IsZero() {
+		delete(m.overrides, address)
+	} else {
+		m.overrides[address] = limits
+	}
+	if meter, ok := m.meters[address]; ok {
+		meter.setLimits(m.effectiveLocked(address))
+	}
+}
+
+func (m *QuotaManager) DeleteOverride(address string) {
+	m.SetOverride(address, types.QuotaLimits{})
+}
+
+func (m *QuotaManager) Overrides() map[string]types.QuotaLimits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]types.QuotaLimits, len(m.overrides))
+	maps.Copy(out, m.overrides)
+	return out
+}
+
+func (m *QuotaManager) SetOverrides(overrides map[string]types.QuotaLimits) {
+	next := make(map[string]types.QuotaLimits, len(overrides))
+	for address, limits := range overrides {
+		address = normalizeQuotaAddress(address)
+		limits = limits.Normalize()
+		limits.MaxLeasesPerIP = 0
+		if address == "" || limits.IsZero() {
+			continue
+		}
+		next[address] = limits
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides = next
+	for address, meter := range m.meters {
+		meter.setLimits(m.effectiveLocked(address))
+	}
+}
+
+// Meter returns the byte meter shared by every lease of address. It is
+// created on first use and follows later limit changes in place.
+func (m *QuotaManager) Meter(address string) *QuotaMeter {
+	address = normalizeQuotaAddress(address)
+	if m == nil || address == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.meterLocked(address)
+}
+
+// Usage returns the traffic of every address that relayed bytes this UTC
+// month, sorted by address.
+func (m *QuotaManager) Usage() []types.QuotaUsage {
+	m.mu.Lock()
+	meters := maps.Clone(m.meters)
+	m.mu.Unlock()
+
+	now := time.Now()
+	out := make([]types.QuotaUsage, 0, len(meters))
+	for address, meter := range meters {
+		usage := meter.usage(address, now)
+		if usage.MonthBytes > 0 {
+			out = append(out, usage)
+		}
+	}
+	slices.SortFunc(out, func(x, y types.QuotaUsage) int {
+		return cmp.Compare(x.Address, y.Address)
+	})
+	return out
+}
+
+// UsageOf returns the traffic of address in the current UTC day and month.
+func (m *QuotaManager) UsageOf(address string) types.QuotaUsage {
+	address = normalizeQuotaAddress(address)
+	m.mu.Lock()
+	meter, ok := m.meters[address]
+	m.mu.Unlock()
+	if !ok {
+		now := time.Now().UTC()
+		return types.QuotaUsage{
+			Address: address,
+			Day:     now.Format(quotaDayLayout),
+			Month:   now.Format(quotaMonthLayout),
+		}
+	}
+	return meter.usage(address, time.Now())
+}
+
+// SetUsage restores usage saved by an earlier run. Entries from a past day
+// or month only keep the counters that are still current.
+func (m *QuotaManager) SetUsage(usage []types.QuotaUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range usage {
+		address := normalizeQuotaAddress(entry.Address)
+		if address == "" {
+			continue
+		}
+		meter := m.meterLocked(address)
+		meter.mu.Lock()
+		meter.day, meter.dayBytes = entry.Day, max(entry.DayBytes, 0)
+		meter.month, meter.monthBytes = entry.Month, max(entry.MonthBytes, 0)
+		meter.mu.Unlock()
+	}
+}
+
+// Exceeded reports whether address has used up its daily or monthly bytes.
+func (m *QuotaManager) Exceeded(address string) bool {
+	return m.Meter(address).Exceeded()
+}
+
+func (m *QuotaManager) meterLocked(address string) *QuotaMeter {
+	meter, ok := m.meters[address]
+	if !ok {
+		meter = &QuotaMeter{crossed: m.crossed}
+		meter.setLimits(m.effectiveLocked(address))
+		m.meters[address] = meter
+	}
+	return meter
+}
+
+func (m *QuotaManager) effectiveLocked(address string) types.QuotaLimits {
+	limits := m.defaults
+	if override, ok := m.overrides[address]; ok {
+		if override.MaxLeasesPerAddress > 0 {
+			limits.MaxLeasesPerAddress = override.MaxLeasesPerAddress
+		}
+		if override.MaxTTLSeconds > 0 {
+			limits.MaxTTLSeconds = override.MaxTTLSeconds
+		}
+		if override.DailyBytes > 0 {
+			limits.DailyBytes = override.DailyBytes
+		}
+		if override.MonthlyBytes > 0 {
+			limits.MonthlyBytes = override.MonthlyBytes
+		}
+	}
+	return limits
+}
+
+// QuotaMeter counts the bytes relayed for one address in the current UTC day
+// and month. A nil meter admits everything.
+type QuotaMeter struct {
+	day        string
+	month      string
+	dayBytes   int64
+	monthBytes int64
+	daily      int64
+	monthly    int64
+	crossed    chan<- struct{}
+	mu         sync.Mutex
+}
+
+// Charge counts n relayed bytes. It reports false, without counting them,
+// once the daily or monthly quota is used up; the chunk that crosses a limit
+// is still admitted.
+func (q *QuotaMeter) Charge(n int) bool {
+	if q == nil || n <= 0 {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(time.Now())
+	if q.exceededLocked() {
+		return false
+	}
+	q.dayBytes += int64(n)
+	q.monthBytes += int64(n)
+	if q.exceededLocked() && q.crossed != nil {
+		select {
+		case q.crossed <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Exceeded reports whether the daily or monthly quota is used up.
+func (q *QuotaMeter) Exceeded() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(time.Now())
+	return q.exceededLocked()
+}
+
+func (q *QuotaMeter) setLimits(limits types.QuotaLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.daily = limits.DailyBytes
+	q.monthly = limits.MonthlyBytes
+}
+
+func (q *QuotaMeter) usage(address string, now time.Time) types.QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(now)
+	return types.QuotaUsage{
+		Address:    address,
+		Day:        q.day,
+		DayBytes:   q.dayBytes,
+		Month:      q.month,
+		MonthBytes: q.monthBytes,
+	}
+}
+
+func (q *QuotaMeter) exceededLocked() bool {
+	return q.daily > 0 && q.dayBytes >= q.daily || q.monthly > 0 && q.monthBytes >= q.monthly
+}
+
+func (q *QuotaMeter) rollLocked(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(quotaDayLayout); q.day != day {
+		q.day, q.dayBytes = day, 0
+	}
+	if month := now.Format(quotaMonthLayout); q.month != month {
+		q.month, q.monthBytes = month, 0
+	}
+}
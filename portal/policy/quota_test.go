@@ -0,0 +1,46 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+func TestQuotaMeterSignalsWhenLimitIsCrossed(t *testing.T) {
+	t.Parallel()
+
+	const address = "0x1111111111111111111111111111111111111111"
+	quotas := NewQuotaManager()
+	quotas.SetDefaults(types.QuotaLimits{DailyBytes: 10})
+	meter := quotas.Meter(address)
+
+	if !meter.Charge(6) {
+		t.Fatal("Charge(6) = false, want admitted below the limit")
+	}
+	select {
+	case <-quotas.Crossed():
+		t.Fatal("Crossed() fired below the limit")
+	default:
+	}
+
+	// The chunk that crosses the limit is admitted and signals once.
+	if !meter.Charge(6) {
+		t.Fatal("Charge(6) crossing the limit = false, want admitted")
+	}
+	select {
+	case <-quotas.Crossed():
+	default:
+		t.Fatal("Crossed() did not fire when the limit was crossed")
+	}
+	if meter.Charge(1) {
+		t.Fatal("Charge(1) over the limit = true, want refused")
+	}
+	select {
+	case <-quotas.Crossed():
+		t.Fatal("Crossed() fired again for a refused charge")
+	default:
+	}
+	if usage := quotas.UsageOf(address); usage.DayBytes != 12 {
+		t.Fatalf("UsageOf().DayBytes = %d, want 12", usage.DayBytes)
+	}
+}
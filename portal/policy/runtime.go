@@ -20,7 +20,9 @@ func (p *PortPolicy) Set(enabled bool, maxLeases int) {
 type Runtime struct {
 	approver           *Approver
 	bpsManager         *BPSManager
+	connLimiter        *ConnLimiter
 	ipFilter           *IPFilter
+	quotas             *QuotaManager
 	bannedIdentityKeys map[string]struct{}
 	udp                PortPolicy
 	tcpPort            PortPolicy
@@ -31,7 +33,9 @@ func NewRuntime() *Runtime {
 	return &Runtime{
 		approver:           NewApprover(),
 		bpsManager:         NewBPSManager(),
+		connLimiter:        NewConnLimiter(),
 		ipFilter:           NewIPFilter(),
+		quotas:             NewQuotaManager(),
 		bannedIdentityKeys: make(map[string]struct{}),
 	}
 }
@@ -48,6 +52,14 @@ func (r *Runtime) BPSManager() *BPSManager {
 	return r.bpsManager
 }
 
+func (r *Runtime) ConnLimiter() *ConnLimiter {
+	return r.connLimiter
+}
+
+func (r *Runtime) Quotas() *QuotaManager {
+	return r.quotas
+}
+
 func (r *Runtime) BanIdentity(key string) {
 	if key == "" {
 		return
@@ -165,6 +177,6 @@ func (r *Runtime) ForgetIdentity(key string) {
 		r.ipFilter.RemoveIdentityIP(key)
 	}
 	if r.bpsManager != nil {
-		r.bpsManager.DeleteIdentityBPS(key)
+		r.bpsManager.ForgetLimiter(key)
 	}
 }
@@ -0,0 +1,112 @@
+package portal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const defaultQuotaSaveInterval = time.Minute
+
+// loadQuotaUsage restores the byte usage saved in cfg.QuotaUsagePath.
+func (s *Server) loadQuotaUsage() error {
+	path := strings.TrimSpace(s.cfg.QuotaUsagePath)
+	if path == "" {
+		return nil
+	}
+
+	var usage []types.QuotaUsage
+	if _, err := utils.ReadJSONFileIfExists(path, &usage); err != nil {
+		return err
+	}
+	s.registry.policy.Quotas().SetUsage(usage)
+	return nil
+}
+
+// saveQuotaUsage writes the byte usage of this month to cfg.QuotaUsagePath.
+func (s *Server) saveQuotaUsage() {
+	path := strings.TrimSpace(s.cfg.QuotaUsagePath)
+	if path == "" {
+		return
+	}
+
+	if err := utils.WriteJSONFile(path, s.registry.policy.Quotas().Usage(), 0o600); err != nil {
+		log.Warn().
+			Err(err).
+			Str("component", "quota").
+			Str("path", path).
+			Msg("save quota usage")
+	}
+}
+
+// runQuotaUsageSaver saves the usage every interval and as soon as an
+// address uses up its quota, so a crash cannot forget that it is exhausted.
+func (s *Server) runQuotaUsageSaver(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("quota save interval must be positive")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	crossed := s.registry.policy.Quotas().Crossed()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.saveQuotaUsage()
+		case <-crossed:
+			s.saveQuotaUsage()
+		}
+	}
+}
+
+// QuotaUsage describes every address that relayed bytes this UTC month or
+// has a quota override, sorted by address.
+func (s *Server) QuotaUsage() []types.AdminQuotaUsage {
+	quotas := s.registry.policy.Quotas()
+	usage := quotas.Usage()
+	for address := range quotas.Overrides() {
+		if !slices.ContainsFunc(usage, func(entry types.QuotaUsage) bool { return entry.Address == address }) {
+			usage = append(usage, quotas.UsageOf(address))
+		}
+	}
+	slices.SortFunc(usage, func(x, y types.QuotaUsage) int {
+		return cmp.Compare(x.Address, y.Address)
+	})
+
+	out := make([]types.AdminQuotaUsage, 0, len(usage))
+	for _, entry := range usage {
+		out = append(out, s.adminQuotaUsage(entry))
+	}
+	return out
+}
+
+// QuotaUsageOf describes the usage and limits of address.
+func (s *Server) QuotaUsageOf(address string) types.AdminQuotaUsage {
+	return s.adminQuotaUsage(s.registry.policy.Quotas().UsageOf(address))
+}
+
+func (s *Server) adminQuotaUsage(usage types.QuotaUsage) types.AdminQuotaUsage {
+	quotas := s.registry.policy.Quotas()
+	leases, _ := s.registry.countLeases(usage.Address, "", "")
+	out := types.AdminQuotaUsage{
+		QuotaUsage: usage,
+		Limits:     quotas.Limits(usage.Address),
+		Leases:     leases,
+		Exceeded:   quotas.Exceeded(usage.Address),
+	}
+	if override, ok := quotas.Override(usage.Address); ok {
+		out.Override = &override
+	}
+	return out
+}
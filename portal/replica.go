@@ -0,0 +1,176 @@
+package portal
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+// replicaKey identifies one registration inside a replica group. Leases
+// registered without an instance ID keep the plain identity key.
+func replicaKey(identityKey, instanceID string) string {
+	if instanceID == "" {
+		return identityKey
+	}
+	return identityKey + "/" + instanceID
+}
+
+func (r *leaseRecord) replicaKey() string {
+	return replicaKey(r.Key(), r.InstanceID)
+}
+
+// normalizeReplica validates the replica fields of a registration and returns
+// the normalized instance ID.
+func normalizeReplica(req types.RegisterChallengeRequest) (string, error) {
+	if !types.IsReplicaPolicy(req.ReplicaPolicy) {
+		return "", fmt.Errorf("unknown replica policy %q", req.ReplicaPolicy)
+	}
+	if req.ReplicaWeight < 0 || req.ReplicaWeight > types.MaxReplicaWeight {
+		return "", fmt.Errorf("replica weight must be between 0 and %d", types.MaxReplicaWeight)
+	}
+	if req.InstanceID == "" {
+		return "", nil
+	}
+	instanceID, err := utils.NormalizeDNSLabel(req.InstanceID)
+	if err != nil {
+		return "", fmt.Errorf("invalid instance id %q: %w", req.InstanceID, err)
+	}
+	return instanceID, nil
+}
+
+// replicaGroup holds every lease one identity registered under its hostname
+// and spreads claims across them. The policy of the most recent registration
+// applies to the whole group.
+type replicaGroup struct {
+	members []*leaseRecord
+	policy  string
+	current map[*leaseRecord]int
+	next    int
+	mu      sync.Mutex
+}
+
+func (g *replicaGroup) add(record *leaseRecord) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.members = append(g.members, record)
+	g.policy = record.ReplicaPolicy
+}
+
+func (g *replicaGroup) remove(record *leaseRecord) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.members = slices.DeleteFunc(g.members, func(member *leaseRecord) bool {
+		return member == record
+	})
+	delete(g.current, record)
+}
+
+// serves reports whether any replica still routes hostname.
+func (g *replicaGroup) serves(hostname string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, member := range g.members {
+		if slices.Contains(member.routeHostnames(), hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// live returns the unexpired replicas in registration order.
+func (g *replicaGroup) live(now time.Time) []*leaseRecord {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.liveLocked(now)
+}
+
+func (g *replicaGroup) liveLocked(now time.Time) []*leaseRecord {
+	out := make([]*leaseRecord, 0, len(g.members))
+	for _, member := range g.members {
+		if !now.After(member.ExpiresAt) {
+			out = append(out, member)
+		}
+	}
+	return out
+}
+
+// pick chooses the replica for the next claim, skipping draining replicas.
+// Replicas with idle reverse sessions are preferred; only when every replica
+// has an empty ready queue does the policy pick among all of them, so a claim
+// still waits on one queue.
+func (g *replicaGroup) pick(now time.Time) *leaseRecord {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	candidates := g.liveLocked(now)
+	if len(candidates) == 0 {
+		candidates = g.members
+	}
+	candidates = slices.DeleteFunc(slices.Clone(candidates), func(member *leaseRecord) bool {
+		return member.stream != nil && member.stream.Draining()
+	})
+	if ready := slices.DeleteFunc(slices.Clone(candidates), func(member *leaseRecord) bool {
+		return readyCount(member) == 0
+	}); len(ready) > 0 {
+		candidates = ready
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	switch g.policy {
+	case types.ReplicaPolicyLeastReady:
+		// Most idle sessions means the least loaded replica.
+		best := candidates[0]
+		for _, member := range candidates[1:] {
+			if readyCount(member) > readyCount(best) {
+				best = member
+			}
+		}
+		return best
+	case types.ReplicaPolicyWeighted:
+		return g.pickWeightedLocked(candidates)
+	default:
+		g.next++
+		return candidates[g.next%len(candidates)]
+	}
+}
+
+// pickWeightedLocked runs smooth weighted round robin so heavier replicas
+// receive proportionally more claims without bursts.
+func (g *replicaGroup) pickWeightedLocked(candidates []*leaseRecord) *leaseRecord {
+	if g.current == nil {
+		g.current = make(map[*leaseRecord]int)
+	}
+
+	var best *leaseRecord
+	total := 0
+	for _, member := range candidates {
+		weight := max(member.ReplicaWeight, 1)
+		total += weight
+		g.current[member] += weight
+		if best == nil || g.current[member] > g.current[best] {
+			best = member
+		}
+	}
+	g.current[best] -= total
+	return best
+}
+
+func readyCount(record *leaseRecord) int {
+	if record.stream == nil {
+		return 0
+	}
+	return record.stream.ReadyCount()
+}
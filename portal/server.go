@@ -17,9 +17,11 @@ import (
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/gosuda/portal/v2/portal/accesslog"
 	"github.com/gosuda/portal/v2/portal/acme"
 	"github.com/gosuda/portal/v2/portal/discovery"
 	"github.com/gosuda/portal/v2/portal/keyless"
+	"github.com/gosuda/portal/v2/portal/metrics"
 	"github.com/gosuda/portal/v2/portal/policy"
 	"github.com/gosuda/portal/v2/portal/transport"
 	"github.com/gosuda/portal/v2/types"
@@ -31,26 +33,38 @@ const (
 	defaultClaimTimeout     = 10 * time.Second
 	defaultIdleKeepalive    = 15 * time.Second
 	defaultReadyQueueLimit  = 8
+	defaultMaxLeasePorts    = 4
 	defaultClientHelloWait  = 2 * time.Second
 	defaultControlBodyLimit = 4 << 20
 )
 
 type ServerConfig struct {
-	PortalURL         string
-	IdentityPath      string
-	Bootstraps        []string
-	ACME              acme.Config
-	APIPort           int
-	SNIPort           int
-	APIListenAddr     string
-	SNIListenAddr     string
-	TrustedProxyCIDRs string
-	TrustProxyHeaders bool
-	DiscoveryEnabled  bool
-	MinPort           int
-	MaxPort           int
-	UDPEnabled        bool
-	TCPEnabled        bool
+	PortalURL           string
+	IdentityPath        string
+	Bootstraps          []string
+	ACME                acme.Config
+	APIPort             int
+	SNIPort             int
+	APIListenAddr       string
+	SNIListenAddr       string
+	TrustedProxyCIDRs   string
+	TrustProxyHeaders   bool
+	AcceptProxyProtocol bool
+	DiscoveryEnabled    bool
+	MinPort             int
+	MaxPort             int
+	UDPEnabled          bool
+	TCPEnabled          bool
+	MaxLeasePorts       int
+	ConnLimits          types.ConnLimits
+	Quotas              types.QuotaLimits
+	QuotaUsagePath      string
+	ConnTimeouts        types.ConnTimeouts
+	MaxConnTimeouts     types.ConnTimeouts
+	AccessLogPath       string
+	AccessLogMaxSizeMB  int
+	AccessLogMaxFiles   int
+	OfflinePageEnabled  bool
 }
 
 type Server struct {
@@ -58,7 +72,9 @@ type Server struct {
 	apiListener       net.Listener
 	apiServer         *http.Server
 	apiTLSClose       io.Closer
+	offlineTLS        *tls.Config
 	acmeManager       *acme.Manager
+	keylessSigner     *keyless.Signer
 	quicTunnel        *quic.Listener
 	cancel            context.CancelFunc
 	group             *errgroup.Group
@@ -69,6 +85,10 @@ type Server struct {
 	cfg               ServerConfig
 	trustedProxyCIDRs []*net.IPNet
 	relaySet          *discovery.RelaySet
+	accessLog         *accesslog.Log
+	lookupTXT         func(ctx context.Context, name string) ([]string, error)
+	domainIssuing     map[string]struct{}
+	domainMu          sync.Mutex
 	shutdownOnce      sync.Once
 }
 
@@ -107,6 +127,12 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 
 	cfg.UDPEnabled = cfg.UDPEnabled && hasPortRange
 	cfg.TCPEnabled = cfg.TCPEnabled && hasPortRange
+	if cfg.MaxLeasePorts <= 0 {
+		cfg.MaxLeasePorts = defaultMaxLeasePorts
+	}
+	// Leases may shorten the default timeouts, but only lengthen them up to
+	// an explicit maximum.
+	cfg.MaxConnTimeouts = cfg.MaxConnTimeouts.Within(cfg.ConnTimeouts, types.ConnTimeouts{})
 
 	portMin, portMax := 0, 0
 	if cfg.UDPEnabled {
@@ -139,9 +165,19 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 	policy := policy.NewRuntime()
 	policy.SetUDPPolicy(cfg.UDPEnabled, 0)
 	policy.SetTCPPortPolicy(cfg.TCPEnabled, 0)
+	policy.ConnLimiter().SetDefaults(cfg.ConnLimits)
+	policy.Quotas().SetDefaults(cfg.Quotas)
 	registry := newLeaseRegistry(policy)
 	ports := transport.NewPortAllocator(portMin, portMax, 5*time.Minute)
 	tcpPorts := transport.NewPortAllocator(tcpPortMin, tcpPortMax, 5*time.Minute)
+	accessLog, err := accesslog.New(accesslog.Config{
+		Path:     cfg.AccessLogPath,
+		MaxBytes: int64(cfg.AccessLogMaxSizeMB) << 20,
+		MaxFiles: cfg.AccessLogMaxFiles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
 
 	s := &Server{
 		cfg:               cfg,
@@ -150,6 +186,12 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		tcpPorts:          tcpPorts,
 		identity:          identity,
 		trustedProxyCIDRs: trustedProxyCIDRs,
+		accessLog:         accessLog,
+		lookupTXT:         net.DefaultResolver.LookupTXT,
+		domainIssuing:     make(map[string]struct{}),
+	}
+	if err := s.loadQuotaUsage(); err != nil {
+		return nil, fmt.Errorf("load quota usage: %w", err)
 	}
 
 	if cfg.DiscoveryEnabled {
@@ -204,9 +246,10 @@ func (s *Server) Start(ctx context.Context, apiMux *http.ServeMux) error {
 	}
 
 	s.apiListener = wrappedAPIListener
-	s.sniListener = sniListener
+	s.sniListener = transport.NewProxyProtocolListener(sniListener, s.proxyTrust())
 	s.apiServer = apiServer
 	s.apiTLSClose = apiCloser
+	s.offlineTLS = s.offlineTLSConfig(apiServer.TLSConfig)
 	s.acmeManager = acmeManager
 	s.cancel = cancel
 	s.group = group
@@ -215,6 +258,7 @@ func (s *Server) Start(ctx context.Context, apiMux *http.ServeMux) error {
 	group.Go(s.runAPIServer)
 	group.Go(func() error { return s.runSNIListener(groupCtx) })
 	group.Go(func() error { return s.runLeaseJanitor(groupCtx, 5*time.Second) })
+	group.Go(func() error { return s.runQuotaUsageSaver(groupCtx, defaultQuotaSaveInterval) })
 	if s.cfg.DiscoveryEnabled {
 		group.Go(func() error { return s.relaySet.RunLoop(groupCtx, nil, nil) })
 	}
@@ -240,6 +284,8 @@ func (s *Server) Start(ctx context.Context, apiMux *http.ServeMux) error {
 		Int("min_port", s.cfg.MinPort).
 		Int("max_port", s.cfg.MaxPort).
 		Bool("discovery_enabled", s.cfg.DiscoveryEnabled).
+		Bool("accept_proxy_protocol", s.cfg.AcceptProxyProtocol).
+		Bool("offline_page_enabled", s.offlineTLS != nil).
 		Bool("udp_enabled", s.cfg.UDPEnabled).
 		Bool("tcp_enabled", s.cfg.TCPEnabled)
 	if s.quicTunnel != nil {
@@ -300,6 +346,8 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		if s.acmeManager != nil {
 			s.acmeManager.Stop()
 		}
+		s.saveQuotaUsage()
+		_ = s.accessLog.Close()
 	})
 	return shutdownErr
 }
@@ -308,6 +356,16 @@ func (s *Server) PolicyRuntime() *policy.Runtime {
 	return s.registry.policy
 }
 
+func (s *Server) AccessLog() *accesslog.Log {
+	return s.accessLog
+}
+
+// ClientIP returns the client IP of an API request, honoring trusted proxy
+// headers as configured.
+func (s *Server) ClientIP(r *http.Request) string {
+	return policy.ExtractClientIP(r, s.cfg.TrustProxyHeaders, s.trustedProxyCIDRs)
+}
+
 func (s *Server) PortalURL() string {
 	return s.cfg.PortalURL
 }
@@ -336,6 +394,38 @@ func (s *Server) AdminLeaseSnapshots() []types.AdminLease {
 	return s.registry.activeAdminSnapshots()
 }
 
+// EvictLease unregisters every replica of the identity key, cuts their
+// bridged connections and frees their ports at once. A positive cooldown
+// refuses new registrations of the key until it has passed. It returns the
+// number of replicas evicted.
+func (s *Server) EvictLease(key string, cooldown time.Duration) int {
+	records := s.registry.Evict(key, cooldown)
+	for _, record := range records {
+		record.Evict()
+		s.withdrawLeaseHostname(record, "delete evicted lease ens gasless txt")
+		log.Info().
+			Str("component", "lease-evict").
+			Str("hostname", record.Hostname).
+			Str("address", record.Address).
+			Str("instance_id", record.InstanceID).
+			Dur("cooldown", cooldown).
+			Msg("lease evicted")
+	}
+	return len(records)
+}
+
+// ClearLeaseEviction lets an evicted identity key register again before its
+// cooldown ends.
+func (s *Server) ClearLeaseEviction(key string) {
+	s.registry.ClearEviction(key)
+}
+
+// LeaseEvictedUntil returns the end of the eviction cooldown of the identity
+// key, if one is running.
+func (s *Server) LeaseEvictedUntil(key string) (time.Time, bool) {
+	return s.registry.EvictedUntil(key)
+}
+
 func (s *Server) LeaseSnapshotByHostname(hostname string) (types.Lease, bool) {
 	record, ok := s.registry.Lookup(hostname)
 	if !ok || record == nil || time.Now().After(record.ExpiresAt) {
@@ -389,6 +479,7 @@ func (s *Server) runSNIListener(ctx context.Context) error {
 			go func(conn net.Conn) {
 				clientHello, wrappedConn, err := l4.InspectClientHello(conn, defaultClientHelloWait)
 				if err != nil {
+					metrics.SNIClientHelloFailures.With("inspect").Inc()
 					if wrappedConn != nil {
 						_ = wrappedConn.Close()
 					} else {
@@ -399,6 +490,7 @@ func (s *Server) runSNIListener(ctx context.Context) error {
 
 				serverName := utils.NormalizeHostname(clientHello.ServerName)
 				if serverName == "" {
+					metrics.SNIClientHelloFailures.With("missing_sni").Inc()
 					_ = wrappedConn.Close()
 					return
 				}
@@ -414,26 +506,103 @@ func (s *Server) runSNIListener(ctx context.Context) error {
 						_ = wrappedConn.Close()
 						return
 					}
-					BridgeConns(wrappedConn, upstream)
+					if err := s.forwardProxyHeader(upstream, wrappedConn); err != nil {
+						_ = upstream.Close()
+						_ = wrappedConn.Close()
+						return
+					}
+					transport.BridgeConns(ctx, wrappedConn, upstream, transport.BridgeOptions{Transport: "api"})
 					return
 				}
+				if reason := s.registry.policy.IPFilter().IngressBlockReason(transport.RemoteIP(wrappedConn)); reason != "" {
+					metrics.IngressBlocked.With("sni", reason).Inc()
+					_ = wrappedConn.Close()
+					return
+				}
+
+				startedAt := time.Now()
+				entry := types.AccessLogEntry{
+					Time:      startedAt.UTC(),
+					Hostname:  serverName,
+					ClientIP:  transport.RemoteIP(wrappedConn),
+					Transport: "sni",
+				}
+				defer func() {
+					entry.DurationMS = time.Since(startedAt).Milliseconds()
+					s.accessLog.Record(entry)
+				}()
 
 				record, ok := s.registry.Lookup(serverName)
-				if !ok || record == nil || time.Now().After(record.ExpiresAt) || !s.registry.policy.IsIdentityRoutable(record.Key()) || record.stream == nil {
+				if reason := s.sniNoRouteReason(record, ok); reason != "" {
+					metrics.SNINoRoute.With(reason).Inc()
+					entry.CloseReason = transport.CloseReasonNoRoute
+					if !s.serveOfflinePage(wrappedConn, serverName, reason, record) {
+						_ = wrappedConn.Close()
+					}
+					return
+				}
+				entry.LeaseKey = record.Key()
+
+				if reason := s.sniRejectReason(record, entry.ClientIP); reason != "" {
+					entry.CloseReason = reason
 					_ = wrappedConn.Close()
 					return
 				}
+				release, reason := s.registry.policy.ConnLimiter().Acquire(record.Key(), entry.ClientIP)
+				if reason != "" {
+					metrics.ConnRejects.With(record.Key(), "sni", reason).Inc()
+					entry.CloseReason = transport.CloseReasonRejected
+					_ = wrappedConn.Close()
+					return
+				}
+				defer release()
 
 				claimCtx, cancel := context.WithTimeout(ctx, defaultClaimTimeout)
 				defer cancel()
 
 				session, err := record.stream.Claim(claimCtx)
+				// A replica that starts draining mid-claim hands over to the
+				// next replica of its group, which must admit the client too.
+				for errors.Is(err, transport.ErrStreamDraining) {
+					record, ok = s.registry.Lookup(serverName)
+					if s.sniNoRouteReason(record, ok) != "" {
+						break
+					}
+					if reason := s.sniRejectReason(record, entry.ClientIP); reason != "" {
+						entry.CloseReason = reason
+						_ = wrappedConn.Close()
+						return
+					}
+					session, err = record.stream.Claim(claimCtx)
+				}
+				entry.ClaimWaitMS = time.Since(startedAt).Milliseconds()
 				if err != nil {
+					metrics.SNINoRoute.With("claim_failed").Inc()
+					entry.CloseReason = transport.CloseReasonClaimFailed
+					if !s.serveOfflinePage(wrappedConn, serverName, "claim_failed", record) {
+						_ = wrappedConn.Close()
+					}
+					return
+				}
+				entry.InstanceID = record.InstanceID
+				if err := record.stream.WriteProxyHeader(session, transport.NewProxyHeader(wrappedConn, serverName)); err != nil {
+					entry.CloseReason = transport.CloseReasonTenantError
+					_ = session.Close()
 					_ = wrappedConn.Close()
 					return
 				}
 
-				BridgeConns(wrappedConn, session)
+				limiter, releaseLimiter := s.registry.policy.BPSManager().AcquireLimiter(record.Key())
+				defer releaseLimiter()
+				stats := transport.BridgeConns(ctx, wrappedConn, session, transport.BridgeOptions{
+					Limiter:   limiter,
+					Quota:     record.quota,
+					Evicted:   record.stream.Evicted(),
+					LeaseKey:  record.Key(),
+					Transport: "sni",
+					Timeouts:  record.ConnTimeouts,
+				})
+				entry.BytesIn, entry.BytesOut, entry.CloseReason = stats.BytesIn, stats.BytesOut, stats.Reason
 			}(conn)
 		case errors.Is(err, net.ErrClosed):
 			return nil
@@ -443,6 +612,78 @@ func (s *Server) runSNIListener(ctx context.Context) error {
 	}
 }
 
+// proxyTrust returns the peers whose connections must carry a PROXY header,
+// or nil when PROXY protocol is disabled.
+func (s *Server) proxyTrust() transport.ProxyTrustFunc {
+	if !s.cfg.AcceptProxyProtocol {
+		return nil
+	}
+	return func(remote net.Addr) bool {
+		return remote != nil && policy.IsTrustedProxyRemoteAddr(remote.String(), s.trustedProxyCIDRs)
+	}
+}
+
+// leaseAccessRecorder stamps entries from record's port relays with the lease
+// they belong to before adding them to the access log.
+func (s *Server) leaseAccessRecorder(record *leaseRecord) transport.AccessRecorder {
+	return func(entry types.AccessLogEntry) {
+		entry.LeaseKey = record.Key()
+		entry.InstanceID = record.InstanceID
+		entry.Hostname = record.Hostname
+		s.accessLog.Record(entry)
+	}
+}
+
+// forwardProxyHeader passes the client address on to the API listener when
+// that listener expects a PROXY header from upstream's local address.
+func (s *Server) forwardProxyHeader(upstream, client net.Conn) error {
+	trusted := s.proxyTrust()
+	if trusted == nil || !trusted(upstream.LocalAddr()) {
+		return nil
+	}
+	header, err := types.EncodeProxyHeaderV2(types.ProxyHeader{
+		Source:      client.RemoteAddr(),
+		Destination: client.LocalAddr(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = upstream.Write(header)
+	return err
+}
+
+// sniNoRouteReason reports why an SNI connection cannot be routed to record,
+// or "" when it can.
+func (s *Server) sniNoRouteReason(record *leaseRecord, ok bool) string {
+	switch {
+	case !ok || record == nil:
+		return "unknown_host"
+	case time.Now().After(record.ExpiresAt):
+		return "expired"
+	case !s.registry.policy.IsIdentityRoutable(record.Key()):
+		return "not_routable"
+	case record.stream == nil:
+		return "no_stream"
+	default:
+		return ""
+	}
+}
+
+// sniRejectReason applies the admission checks of one replica to an SNI
+// client and returns the close reason when the replica refuses it.
+func (s *Server) sniRejectReason(record *leaseRecord, clientIP string) string {
+	switch {
+	case !record.ingressACL.Allows(clientIP):
+		metrics.IngressBlocked.With("sni", policy.IngressBlockLease).Inc()
+		return transport.CloseReasonRejected
+	case record.quota.Exceeded():
+		metrics.ConnRejects.With(record.Key(), "sni", transport.CloseReasonQuota).Inc()
+		return transport.CloseReasonQuota
+	default:
+		return ""
+	}
+}
+
 func (s *Server) runLeaseJanitor(ctx context.Context, interval time.Duration) error {
 	if interval <= 0 {
 		return errors.New("janitor interval must be positive")
@@ -457,17 +698,7 @@ func (s *Server) runLeaseJanitor(ctx context.Context, interval time.Duration) er
 			return nil
 		case <-ticker.C:
 			for _, lease := range s.registry.cleanupExpired(time.Now()) {
-				deleteCtx, cancel := context.WithTimeout(context.Background(), defaultClaimTimeout)
-				err := s.acmeManager.DeleteENSGaslessHostname(deleteCtx, lease.Hostname)
-				cancel()
-				if err != nil {
-					log.Warn().
-						Err(err).
-						Str("hostname", lease.Hostname).
-						Str("address", lease.Address).
-						Msg("delete expired lease ens gasless txt")
-				}
-				lease.Close()
+				s.releaseLease(lease, "delete expired lease ens gasless txt")
 			}
 		}
 	}
@@ -520,28 +751,3 @@ func (s *Server) runQUICTunnelListener(listener *quic.Listener) error {
 		go s.handleQUICTunnelConn(conn)
 	}
 }
-
-func BridgeConns(left, right net.Conn) {
-	defer left.Close()
-	defer right.Close()
-
-	type closeWriter interface {
-		CloseWrite() error
-	}
-	var group errgroup.Group
-	group.Go(func() error {
-		_, err := io.Copy(right, left)
-		if cw, ok := right.(closeWriter); ok {
-			_ = cw.CloseWrite()
-		}
-		return err
-	})
-	group.Go(func() error {
-		_, err := io.Copy(left, right)
-		if cw, ok := left.(closeWriter); ok {
-			_ = cw.CloseWrite()
-		}
-		return err
-	})
-	_ = group.Wait()
-}
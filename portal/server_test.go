@@ -1,6 +1,8 @@
 package portal
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -11,19 +13,33 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gosuda/keyless_tls/relay/signrpc"
+	"github.com/quic-go/quic-go"
+
+	"github.com/gosuda/portal/v2/portal/accesslog"
 	"github.com/gosuda/portal/v2/portal/acme"
+	"github.com/gosuda/portal/v2/portal/auth"
 	"github.com/gosuda/portal/v2/portal/discovery"
+	"github.com/gosuda/portal/v2/portal/keyless"
+	"github.com/gosuda/portal/v2/portal/metrics"
+	"github.com/gosuda/portal/v2/portal/policy"
+	"github.com/gosuda/portal/v2/portal/transport"
 	"github.com/gosuda/portal/v2/types"
 	"github.com/gosuda/portal/v2/utils"
 )
@@ -198,87 +214,1859 @@ func TestServerStartDomainReportsCompatibilityInfo(t *testing.T) {
 		t.Fatalf("NewServer() error = %v", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := server.Start(ctx, nil); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	client := newTestClient(t, cancel, server)
+
+	resp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathSDKDomain)
+	if err != nil {
+		t.Fatalf("GET /sdk/domain error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /sdk/domain status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read /sdk/domain response: %v", err)
+	}
+
+	var envelope types.APIEnvelope[types.DomainResponse]
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("decode /sdk/domain response: %v", err)
+	}
+	if !envelope.OK {
+		t.Fatalf("GET /sdk/domain response = %+v, want ok=true", envelope)
+	}
+	if envelope.Data.ProtocolVersion != types.ProtocolVersion {
+		t.Fatalf("DomainResponse.ProtocolVersion = %q, want %q", envelope.Data.ProtocolVersion, types.ProtocolVersion)
+	}
+	if envelope.Data.ReleaseVersion != types.ReleaseVersion {
+		t.Fatalf("DomainResponse.ReleaseVersion = %q, want %q", envelope.Data.ReleaseVersion, types.ReleaseVersion)
+	}
+}
+
+func TestRegisterLeaseOmitsSNIPortWithoutUDP(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com:4017",
+		IdentityPath: tempIdentityPath(t),
+		SNIPort:      4443,
+		MinPort:      40000,
+		MaxPort:      40009,
+		TCPEnabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-tcp",
+			Address: server.identity.Address,
+		},
+		TCPEnabled: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if record, err := server.registry.Find(resp.Identity, resp.InstanceID); err == nil {
+			record.Close()
+		}
+	})
+
+	if resp.SNIPort != 0 {
+		t.Fatalf("RegisterResponse.SNIPort = %d, want 0 without udp", resp.SNIPort)
+	}
+}
+
+func TestServerStartUsesManualCertificateWithoutACMEProvider(t *testing.T) {
+	t.Parallel()
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:     "https://portal.example.com",
+		IdentityPath:  tempIdentityPath(t),
+		ACME:          acme.Config{KeyDir: keyDir},
+		APIListenAddr: "127.0.0.1:0",
+		SNIListenAddr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := server.Start(ctx, nil); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	client := newTestClient(t, cancel, server)
+
+	healthResp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathHealthz)
+	if err != nil {
+		t.Fatalf("GET /healthz error = %v", err)
+	}
+	defer healthResp.Body.Close()
+
+	if healthResp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /healthz status = %d, want %d", healthResp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServerStartDiscoveryIncludesIdentityAndOmitsSignerFields(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:        "https://localhost:4017",
+		IdentityPath:     tempIdentityPath(t),
+		ACME:             acme.Config{KeyDir: t.TempDir()},
+		APIListenAddr:    "127.0.0.1:0",
+		SNIListenAddr:    "127.0.0.1:0",
+		DiscoveryEnabled: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := server.Start(ctx, nil); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	client := newTestClient(t, cancel, server)
+
+	resp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathDiscovery)
+	if err != nil {
+		t.Fatalf("GET /discovery error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /discovery status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read /discovery response: %v", err)
+	}
+	for _, key := range []string{"\"address\"", "\"name\"", "signer_public_key", "descriptor_signature"} {
+		if key == "\"address\"" || key == "\"name\"" {
+			if !strings.Contains(string(body), key) {
+				t.Fatalf("/discovery body = %q, want %q present", string(body), key)
+			}
+			continue
+		}
+		if strings.Contains(string(body), key) {
+			t.Fatalf("/discovery body = %q, want %q omitted", string(body), key)
+		}
+	}
+}
+
+func TestServerStartRejectsMismatchedACMEBaseDomain(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:     "https://portal.example.com",
+		IdentityPath:  tempIdentityPath(t),
+		ACME:          acme.Config{BaseDomain: "other.example.com", KeyDir: t.TempDir()},
+		APIListenAddr: "127.0.0.1:0",
+		SNIListenAddr: "127.0.0.1:0",
+		MinPort:       40000,
+		MaxPort:       40000,
+		UDPEnabled:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	err = server.Start(context.Background(), nil)
+	if err == nil {
+		t.Fatal("Start() error = nil, want mismatch error")
+	}
+	if !strings.Contains(err.Error(), "does not match portal root host") {
+		t.Fatalf("Start() error = %v, want base domain mismatch", err)
+	}
+}
+
+func TestRegisterLeaseDerivesFixedHostnameFromName(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40000,
+		MaxPort:      40000,
+		UDPEnabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "Demo-App",
+			Address: server.identity.Address,
+		},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+
+	wantHostname := "demo-app.portal.example.com"
+	if resp.Hostname != wantHostname {
+		t.Fatalf("registerLease() hostname = %q, want %q", resp.Hostname, wantHostname)
+	}
+
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	snapshot := server.registry.Snapshot(record)
+	if snapshot.Name != "demo-app" {
+		t.Fatalf("Snapshot().Name = %q, want %q", snapshot.Name, "demo-app")
+	}
+	if snapshot.Hostname != wantHostname {
+		t.Fatalf("Snapshot().Hostname = %q, want %q", snapshot.Hostname, wantHostname)
+	}
+}
+
+func TestRegisterLeaseBuildsUDPEnabledRuntime(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40000,
+		MaxPort:      40009,
+		UDPEnabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	server.registry.policy.SetUDPPolicy(true, 0)
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-udp",
+			Address: server.identity.Address,
+		},
+		UDPEnabled: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if record, err := server.registry.Find(resp.Identity, resp.InstanceID); err == nil {
+			record.Close()
+		}
+	})
+
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	if record.stream == nil {
+		t.Fatal("stream = nil, want stream runtime")
+	}
+	if record.datagram == nil {
+		t.Fatal("datagram = nil, want datagram runtime")
+	}
+	if got := record.datagram.UDPPort(); got < 40000 || got > 40009 {
+		t.Fatalf("UDPPort() = %d, want port within %d-%d", got, 40000, 40009)
+	}
+	if resp.SNIPort != server.cfg.SNIPort {
+		t.Fatalf("RegisterResponse.SNIPort = %d, want %d", resp.SNIPort, server.cfg.SNIPort)
+	}
+	if resp.UDPAddr == "" {
+		t.Fatal("RegisterResponse.UDPAddr = empty, want public udp address")
+	}
+}
+
+func TestRegisterLeaseNegotiatesProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-proxy",
+			Address: server.identity.Address,
+		},
+		ProxyProtocol: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+	if !resp.ProxyProtocol {
+		t.Fatal("RegisterResponse.ProxyProtocol = false, want true")
+	}
+
+	sdkSide, relaySide := net.Pipe()
+	t.Cleanup(func() {
+		_ = sdkSide.Close()
+		_ = relaySide.Close()
+	})
+	if err := record.stream.OfferConn(relaySide); err != nil {
+		t.Fatalf("OfferConn() error = %v", err)
+	}
+
+	type received struct {
+		header types.ProxyHeader
+		marker byte
+		err    error
+	}
+	recvCh := make(chan received, 1)
+	go func() {
+		var marker [1]byte
+		if _, err := io.ReadFull(sdkSide, marker[:]); err != nil {
+			recvCh <- received{err: err}
+			return
+		}
+		header, err := types.ReadProxyHeader(sdkSide)
+		recvCh <- received{header: header, marker: marker[0], err: err}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := record.stream.Claim(ctx)
+	if err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51234}
+	public := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 443}
+	if err := record.stream.WriteProxyHeader(session, types.ProxyHeader{
+		Source:       client,
+		Destination:  public,
+		ServerName:   resp.Hostname,
+		ConnectionID: "conn_test",
+	}); err != nil {
+		t.Fatalf("WriteProxyHeader() error = %v", err)
+	}
+
+	got := <-recvCh
+	if got.err != nil {
+		t.Fatalf("ReadProxyHeader() error = %v", got.err)
+	}
+	if got.marker != types.MarkerTLSStart {
+		t.Fatalf("marker = %#x, want %#x", got.marker, types.MarkerTLSStart)
+	}
+	if got.header.Source.String() != client.String() {
+		t.Fatalf("header.Source = %v, want %v", got.header.Source, client)
+	}
+	if got.header.ServerName != resp.Hostname || got.header.ConnectionID != "conn_test" {
+		t.Fatalf("header TLVs = (%q, %q), want (%q, %q)", got.header.ServerName, got.header.ConnectionID, resp.Hostname, "conn_test")
+	}
+}
+
+func TestRelayStreamMultiplexesClaimsOverOneConnection(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-mux",
+			Address: server.identity.Address,
+		},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+
+	sdkSide, relaySide := net.Pipe()
+	if err := record.stream.OfferMux(relaySide); err != nil {
+		t.Fatalf("OfferMux() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := transport.NewClientStream(2, time.Second)
+	client.SetMultiplex(true)
+	for range 2 {
+		go client.RunLoop(ctx, func(context.Context) (net.Conn, error) {
+			return transport.MultiplexedConn{Conn: sdkSide}, nil
+		}, nil, nil)
+	}
+	go func() {
+		for {
+			conn, err := client.Accept(ctx.Done())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	const streams = 3
+	conns := make([]net.Conn, 0, streams)
+	for i := range streams {
+		conn, err := record.stream.ClaimRaw(ctx)
+		if err != nil {
+			t.Fatalf("ClaimRaw() #%d error = %v", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	if got := record.stream.ActiveCount(); got != streams {
+		t.Fatalf("ActiveCount() = %d, want %d", got, streams)
+	}
+	if got, want := record.stream.ReadyCount(), types.MuxMaxStreams-streams; got != want {
+		t.Fatalf("ReadyCount() = %d, want %d free streams", got, want)
+	}
+
+	payload := bytes.Repeat([]byte("portal"), types.MuxInitialWindow/3)
+	for i, conn := range conns {
+		want := append([]byte{byte('a' + i)}, payload...)
+		go func() { _, _ = conn.Write(want) }()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("stream %d echo error = %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("stream %d echo mismatch", i)
+		}
+	}
+	if got := client.ActiveSessions(); got != 1 {
+		t.Fatalf("ActiveSessions() = %d, want one shared connection", got)
+	}
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for record.stream.ActiveCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ActiveCount() = %d after close, want 0", record.stream.ActiveCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadyPoolShrinksOnIdleDemand(t *testing.T) {
+	t.Parallel()
+
+	relay := transport.NewRelayStream("addr-demand", 20*time.Millisecond, 4)
+	t.Cleanup(relay.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := transport.NewClientStream(2, time.Second)
+	client.SetReadyBounds(1, 8)
+	client.SetReadyLimit(relay.ReadyLimit())
+	for range 4 {
+		go client.RunLoop(ctx, func(context.Context) (net.Conn, error) {
+			sdkSide, relaySide := net.Pipe()
+			if err := relay.OfferDemandConn(relaySide); err != nil {
+				_ = sdkSide.Close()
+				return nil, err
+			}
+			return sdkSide, nil
+		}, nil, nil)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for client.ReadyTarget() != 1 || relay.ReadyCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ReadyTarget() = %d, relay ReadyCount() = %d, want 1 and 1", client.ReadyTarget(), relay.ReadyCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if demand := relay.Demand(); demand.ReadyLimit != 4 || demand.ClaimsPerMinute != 0 {
+		t.Fatalf("Demand() = %+v, want limit 4 and no claims", demand)
+	}
+
+	claimCtx, claimCancel := context.WithTimeout(ctx, time.Second)
+	defer claimCancel()
+	if _, err := relay.ClaimRaw(claimCtx); err != nil {
+		t.Fatalf("ClaimRaw() error = %v", err)
+	}
+	if demand := relay.Demand(); demand.ClaimsPerMinute != 1 {
+		t.Fatalf("Demand().ClaimsPerMinute = %d, want 1", demand.ClaimsPerMinute)
+	}
+}
+
+func TestQUICStreamCarrierServesClaims(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-quic",
+			Address: server.identity.Address,
+		},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(keyDir, "fullchain.pem"), filepath.Join(keyDir, "privatekey.pem"))
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"portal-tunnel"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("quic.ListenAddr() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err == nil {
+			server.handleQUICTunnelConn(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"portal-tunnel"},
+	}, &quic.Config{MaxIncomingStreams: types.MuxMaxStreams})
+	if err != nil {
+		t.Fatalf("quic.DialAddr() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(0, "") })
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync() error = %v", err)
+	}
+	if err := json.NewEncoder(control).Encode(types.QUICControlMessage{
+		AccessToken: resp.AccessToken,
+		Mode:        types.QUICModeStream,
+	}); err != nil {
+		t.Fatalf("write control message: %v", err)
+	}
+	var controlResp types.QUICControlResponse
+	if err := json.NewDecoder(control).Decode(&controlResp); err != nil || !controlResp.OK {
+		t.Fatalf("control response = (%+v, %v), want ok", controlResp, err)
+	}
+
+	client := transport.NewClientStream(1, time.Second)
+	opened := false
+	go client.RunQUICLoop(ctx, func(context.Context) (*quic.Conn, *quic.Stream, error) {
+		if opened {
+			return nil, nil, net.ErrClosed
+		}
+		opened = true
+		return conn, control, nil
+	}, nil, nil)
+	go func() {
+		for {
+			tenant, err := client.Accept(ctx.Done())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer tenant.Close()
+				_, _ = io.Copy(tenant, tenant)
+			}()
+		}
+	}()
+
+	for i := range 2 {
+		claimed, err := record.stream.ClaimRaw(ctx)
+		if err != nil {
+			t.Fatalf("ClaimRaw() #%d error = %v", i, err)
+		}
+		want := []byte(fmt.Sprintf("hello over quic stream %d", i))
+		if _, err := claimed.Write(want); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(claimed, got); err != nil {
+			t.Fatalf("stream %d echo error = %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("stream %d echo = %q, want %q", i, got, want)
+		}
+		_ = claimed.Close()
+	}
+}
+
+func TestDatagramTunnelAnnouncesClientAndFragments(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40010,
+		MaxPort:      40019,
+		UDPEnabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	server.registry.policy.SetUDPPolicy(true, 0)
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-udp-source",
+			Address: server.identity.Address,
+		},
+		UDPEnabled:      true,
+		DatagramVersion: types.DatagramVersion2,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+	if resp.DatagramVersion != types.DatagramVersion2 {
+		t.Fatalf("RegisterResponse.DatagramVersion = %d, want %d", resp.DatagramVersion, types.DatagramVersion2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := connectTestDatagramClient(t, ctx, server, resp)
+
+	udpClient, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: record.datagram.UDPPort()})
+	if err != nil {
+		t.Fatalf("DialUDP() error = %v", err)
+	}
+	t.Cleanup(func() { _ = udpClient.Close() })
+	if _, err := udpClient.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	frame, err := client.Accept(ctx.Done())
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	if string(frame.Payload) != "ping" {
+		t.Fatalf("frame.Payload = %q, want %q", frame.Payload, "ping")
+	}
+	want := udpClient.LocalAddr().(*net.UDPAddr)
+	if frame.Source == nil || !frame.Source.IP.Equal(want.IP) || frame.Source.Port != want.Port {
+		t.Fatalf("frame.Source = %v, want %v", frame.Source, want)
+	}
+
+	if err := client.Send(frame.FlowID, []byte("pong")); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	_ = udpClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, 16)
+	n, err := udpClient.Read(reply)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(reply[:n]) != "pong" {
+		t.Fatalf("reply = %q, want %q", reply[:n], "pong")
+	}
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 20000/16)
+	if _, err := udpClient.Write(large); err != nil {
+		t.Fatalf("Write(large) error = %v", err)
+	}
+	frame, err = client.Accept(ctx.Done())
+	if err != nil {
+		t.Fatalf("Accept(large) error = %v", err)
+	}
+	if !bytes.Equal(frame.Payload, large) {
+		t.Fatalf("large frame.Payload = %d bytes, want %d intact bytes", len(frame.Payload), len(large))
+	}
+	if err := client.Send(frame.FlowID, large); err != nil {
+		t.Fatalf("Send(large) error = %v", err)
+	}
+	reply = make([]byte, types.MaxDatagramPayload)
+	n, err = udpClient.Read(reply)
+	if err != nil {
+		t.Fatalf("Read(large) error = %v", err)
+	}
+	if !bytes.Equal(reply[:n], large) {
+		t.Fatalf("large reply = %d bytes, want %d intact bytes", n, len(large))
+	}
+}
+
+// connectTestDatagramClient opens a QUIC datagram tunnel for the lease in
+// resp and returns the client side once the relay accepted it.
+func connectTestDatagramClient(t *testing.T, ctx context.Context, server *Server, resp types.RegisterResponse) *transport.ClientDatagram {
+	t.Helper()
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(keyDir, "fullchain.pem"), filepath.Join(keyDir, "privatekey.pem"))
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"portal-tunnel"},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("quic.ListenAddr() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err == nil {
+			server.handleQUICTunnelConn(conn)
+		}
+	}()
+
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"portal-tunnel"},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("quic.DialAddr() error = %v", err)
+	}
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync() error = %v", err)
+	}
+	if err := json.NewEncoder(control).Encode(types.QUICControlMessage{AccessToken: resp.AccessToken}); err != nil {
+		t.Fatalf("write control message: %v", err)
+	}
+	var controlResp types.QUICControlResponse
+	if err := json.NewDecoder(control).Decode(&controlResp); err != nil || !controlResp.OK {
+		t.Fatalf("control response = (%+v, %v), want ok", controlResp, err)
+	}
+
+	client := transport.NewClientDatagram(nil)
+	t.Cleanup(client.Close)
+	client.SetVersion(resp.DatagramVersion)
+	opened := false
+	go client.RunLoop(ctx, func() (transport.ClientDatagramState, bool) {
+		return transport.ClientDatagramState{}, true
+	}, func(context.Context, transport.ClientDatagramState) (*quic.Conn, error) {
+		if opened {
+			return nil, net.ErrClosed
+		}
+		opened = true
+		return conn, nil
+	})
+	for !client.Connected() {
+		if ctx.Err() != nil {
+			t.Fatal("datagram client did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client
+}
+
+func TestRegisterLeaseVerifiesCustomDomains(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	server.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		if name == types.CustomDomainChallengeName("shop.example.net") {
+			return []string{types.CustomDomainChallengeValue(server.identity.Address)}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-shop",
+			Address: server.identity.Address,
+		},
+		CustomDomains: []string{"Shop.Example.net"},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+	if len(resp.CustomDomains) != 1 || resp.CustomDomains[0] != "shop.example.net" {
+		t.Fatalf("RegisterResponse.CustomDomains = %v, want [shop.example.net]", resp.CustomDomains)
+	}
+	if routed, ok := server.registry.Lookup("shop.example.net"); !ok || routed != record {
+		t.Fatal("registry.Lookup(custom domain) did not return the lease")
+	}
+
+	_, err = server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-other",
+			Address: server.identity.Address,
+		},
+		CustomDomains: []string{"other.example.net"},
+	}, "203.0.113.10", "")
+	if !errors.Is(err, errDomainVerification) {
+		t.Fatalf("registerLease() error = %v, want %v", err, errDomainVerification)
+	}
+	if _, ok := server.registry.Lookup("other.example.net"); ok {
+		t.Fatal("registry.Lookup(unverified domain) found a lease")
+	}
+
+	if _, err := server.registry.Unregister(record.Copy(), record.InstanceID); err != nil {
+		t.Fatalf("registry.Unregister() error = %v", err)
+	}
+	if _, ok := server.registry.Lookup("shop.example.net"); ok {
+		t.Fatal("registry.Lookup(custom domain) found a lease after unregister")
+	}
+}
+
+func TestKeylessSignerServesDomainKeysOnlyToOwningLease(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	var challengeAddress atomic.Value
+	challengeAddress.Store(server.identity.Address)
+	server.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		if name == types.CustomDomainChallengeName("shop.example.net") {
+			return []string{types.CustomDomainChallengeValue(challengeAddress.Load().(string))}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	server.keylessSigner, err = keyless.NewSigner(testECPrivateKeyPEM(t))
+	if err != nil {
+		t.Fatalf("keyless.NewSigner() error = %v", err)
+	}
+	server.keylessSigner.SetKeyAuthorizer(server.authorizeSigningKey)
+	handler := server.keylessSigner.Handler()
+
+	owner, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity:      types.Identity{Name: "demo-shop", Address: server.identity.Address},
+		CustomDomains: []string{"shop.example.net"},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease(owner) error = %v", err)
+	}
+	other, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-other", Address: server.identity.Address},
+	}, "203.0.113.11", "")
+	if err != nil {
+		t.Fatalf("registerLease(other) error = %v", err)
+	}
+	for _, resp := range []types.RegisterResponse{owner, other} {
+		record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+		if err != nil {
+			t.Fatalf("registry.Find() error = %v", err)
+		}
+		t.Cleanup(record.Close)
+	}
+
+	domainKeyID := keyless.CustomDomainKeyID("shop.example.net")
+	if err := server.keylessSigner.PutKeyPEM(domainKeyID, testECPrivateKeyPEM(t)); err != nil {
+		t.Fatalf("PutKeyPEM() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		keyID       string
+		accessToken string
+		want        int
+	}{
+		{name: "relay key", keyID: keyless.RelayKeyID, want: http.StatusOK},
+		{name: "no token", keyID: domainKeyID, want: http.StatusForbidden},
+		{name: "other lease", keyID: domainKeyID, accessToken: other.AccessToken, want: http.StatusForbidden},
+		{name: "owning lease", keyID: domainKeyID, accessToken: owner.AccessToken, want: http.StatusOK},
+	} {
+		if got := keylessSignStatus(t, handler, tc.keyID, tc.accessToken); got != tc.want {
+			t.Fatalf("sign(%s) status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// A domain whose TXT record moves to another address is dropped at the
+	// next renew recheck, together with its signing key.
+	challengeAddress.Store("0x2222222222222222222222222222222222222222")
+	err = server.recheckCustomDomains(context.Background(), owner.Identity, owner.InstanceID, time.Now().Add(defaultDomainRecheckInterval))
+	if !errors.Is(err, errDomainVerification) {
+		t.Fatalf("recheckCustomDomains() error = %v, want %v", err, errDomainVerification)
+	}
+	if _, ok := server.registry.Lookup("shop.example.net"); ok {
+		t.Fatal("registry.Lookup(custom domain) found a lease after a failed recheck")
+	}
+	if server.keylessSigner.HasKey(domainKeyID) {
+		t.Fatal("custom domain key still signable after its lease was unregistered")
+	}
+	if got := keylessSignStatus(t, handler, domainKeyID, owner.AccessToken); got != http.StatusForbidden {
+		t.Fatalf("sign(released key) status = %d, want %d", got, http.StatusForbidden)
+	}
+}
+
+func TestKeylessSignerReleasesWildcardKeyWithLease(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	server.keylessSigner, err = keyless.NewSigner(testECPrivateKeyPEM(t))
+	if err != nil {
+		t.Fatalf("keyless.NewSigner() error = %v", err)
+	}
+	server.keylessSigner.SetKeyAuthorizer(server.authorizeSigningKey)
+	handler := server.keylessSigner.Handler()
+
+	owner, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-multi", Address: server.identity.Address},
+		Wildcard: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease(owner) error = %v", err)
+	}
+	record, err := server.registry.Find(owner.Identity, owner.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v", err)
+	}
+	other, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-other", Address: server.identity.Address},
+	}, "203.0.113.11", "")
+	if err != nil {
+		t.Fatalf("registerLease(other) error = %v", err)
+	}
+	otherRecord, err := server.registry.Find(other.Identity, other.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v", err)
+	}
+	t.Cleanup(otherRecord.Close)
+
+	wildcardKeyID := keyless.CustomDomainKeyID(owner.WildcardHostname)
+	if err := server.keylessSigner.PutKeyPEM(wildcardKeyID, testECPrivateKeyPEM(t)); err != nil {
+		t.Fatalf("PutKeyPEM() error = %v", err)
+	}
+	if got := keylessSignStatus(t, handler, wildcardKeyID, other.AccessToken); got != http.StatusForbidden {
+		t.Fatalf("sign(wildcard, other lease) status = %d, want %d", got, http.StatusForbidden)
+	}
+	if got := keylessSignStatus(t, handler, wildcardKeyID, owner.AccessToken); got != http.StatusOK {
+		t.Fatalf("sign(wildcard, owning lease) status = %d, want %d", got, http.StatusOK)
+	}
+
+	if !server.registry.unregisterRecord(record) {
+		t.Fatal("registry.unregisterRecord() = false, want true")
+	}
+	server.releaseLease(record, "delete lease ens gasless txt")
+	if server.keylessSigner.HasKey(wildcardKeyID) {
+		t.Fatal("wildcard key still signable after its lease was released")
+	}
+}
+
+func keylessSignStatus(t *testing.T, handler http.Handler, keyID, accessToken string) int {
+	t.Helper()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	body, err := json.Marshal(signrpc.SignRequest{
+		KeyID:         keyID,
+		Algorithm:     "ECDSA_SHA256",
+		Digest:        make([]byte, 32),
+		TimestampUnix: time.Now().Unix(),
+		Nonce:         fmt.Sprintf("%x", nonce),
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, signrpc.SignPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set(types.HeaderAccessToken, accessToken)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func testECPrivateKeyPEM(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey() error = %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func TestRegisterLeaseRoutesAliasesAndWildcard(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-multi",
+			Address: server.identity.Address,
+		},
+		Aliases:  []string{"Demo-Staging", "demo-multi"},
+		Wildcard: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+	if !reflect.DeepEqual(resp.Aliases, []string{"demo-staging.portal.example.com"}) {
+		t.Fatalf("RegisterResponse.Aliases = %v, want [demo-staging.portal.example.com]", resp.Aliases)
+	}
+	if resp.WildcardHostname != "*.demo-multi.portal.example.com" {
+		t.Fatalf("RegisterResponse.WildcardHostname = %q, want %q", resp.WildcardHostname, "*.demo-multi.portal.example.com")
+	}
+	for _, host := range []string{"demo-staging.portal.example.com", "tenant1.demo-multi.portal.example.com"} {
+		if routed, ok := server.registry.Lookup(host); !ok || routed != record {
+			t.Fatalf("registry.Lookup(%q) did not return the lease", host)
+		}
+	}
+
+	_, err = server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-staging",
+			Address: server.identity.Address,
+		},
+	}, "203.0.113.11", "")
+	if !errors.Is(err, errHostnameConflict) {
+		t.Fatalf("registerLease() error = %v, want %v", err, errHostnameConflict)
+	}
+
+	if _, err := server.registry.Unregister(record.Copy(), record.InstanceID); err != nil {
+		t.Fatalf("registry.Unregister() error = %v", err)
+	}
+	for _, host := range []string{"demo-staging.portal.example.com", "tenant1.demo-multi.portal.example.com"} {
+		if _, ok := server.registry.Lookup(host); ok {
+			t.Fatalf("registry.Lookup(%q) found a lease after unregister", host)
+		}
+	}
+}
+
+func TestRegisterLeaseGroupsReplicas(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	replicas := make([]*leaseRecord, 0, 2)
+	for _, instanceID := range []string{"Replica-A", "replica-b"} {
+		resp, err := server.registerLease(types.RegisterChallengeRequest{
+			Identity: types.Identity{
+				Name:    "demo-replicas",
+				Address: server.identity.Address,
+			},
+			InstanceID: instanceID,
+		}, "203.0.113.10", "")
+		if err != nil {
+			t.Fatalf("registerLease(%q) error = %v", instanceID, err)
+		}
+		record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+		if err != nil {
+			t.Fatalf("registry.Find(%q) error = %v, want registered lease", resp.InstanceID, err)
+		}
+		t.Cleanup(record.Close)
+		replicas = append(replicas, record)
+	}
+	if replicas[0].InstanceID != "replica-a" {
+		t.Fatalf("InstanceID = %q, want %q", replicas[0].InstanceID, "replica-a")
+	}
+
+	seen := make(map[*leaseRecord]int)
+	for range 4 {
+		routed, ok := server.registry.Lookup("demo-replicas.portal.example.com")
+		if !ok {
+			t.Fatal("registry.Lookup() = false, want a replica")
+		}
+		seen[routed]++
+	}
+	if seen[replicas[0]] != 2 || seen[replicas[1]] != 2 {
+		t.Fatalf("registry.Lookup() spread = %v, want 2 claims per replica", seen)
+	}
+	snapshot, ok := server.LeaseSnapshotByHostname("demo-replicas.portal.example.com")
+	if !ok || snapshot.Replicas != 2 {
+		t.Fatalf("LeaseSnapshotByHostname() replicas = %d, %v, want 2", snapshot.Replicas, ok)
+	}
+
+	if _, err := server.registry.Unregister(replicas[0].Copy(), replicas[0].InstanceID); err != nil {
+		t.Fatalf("registry.Unregister() error = %v", err)
+	}
+	if routed, ok := server.registry.Lookup("demo-replicas.portal.example.com"); !ok || routed != replicas[1] {
+		t.Fatal("registry.Lookup() after one unregister did not return the remaining replica")
+	}
+	if _, err := server.registry.Unregister(replicas[1].Copy(), replicas[1].InstanceID); err != nil {
+		t.Fatalf("registry.Unregister() error = %v", err)
+	}
+	if _, ok := server.registry.Lookup("demo-replicas.portal.example.com"); ok {
+		t.Fatal("registry.Lookup() found a lease after every replica unregistered")
+	}
+}
+
+func TestDrainRoutesToRemainingReplicaThenUnregisters(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	replicas := make([]*leaseRecord, 0, 2)
+	for _, instanceID := range []string{"old", "new"} {
+		resp, err := server.registerLease(types.RegisterChallengeRequest{
+			Identity: types.Identity{
+				Name:    "demo-drain",
+				Address: server.identity.Address,
+			},
+			InstanceID: instanceID,
+		}, "203.0.113.10", "")
+		if err != nil {
+			t.Fatalf("registerLease(%q) error = %v", instanceID, err)
+		}
+		record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+		if err != nil {
+			t.Fatalf("registry.Find(%q) error = %v, want registered lease", instanceID, err)
+		}
+		t.Cleanup(record.Close)
+		replicas = append(replicas, record)
+	}
+	draining := replicas[0]
+
+	record, started, err := server.registry.Drain(draining.Copy(), draining.InstanceID, time.Now().Add(time.Minute))
+	if err != nil || !started || record != draining {
+		t.Fatalf("registry.Drain() = %v, %v, %v, want the draining replica", record, started, err)
+	}
+	draining.stream.Drain()
+	if _, started, _ := server.registry.Drain(draining.Copy(), draining.InstanceID, time.Now().Add(time.Hour)); started {
+		t.Fatal("registry.Drain() started twice")
+	}
+	token, _, err := auth.IssueLeaseAccessToken(server.identity.PrivateKey, server.identity.Address, server.cfg.PortalURL, draining.Copy(), draining.InstanceID, time.Minute)
+	if err != nil {
+		t.Fatalf("IssueLeaseAccessToken() error = %v", err)
+	}
+	if _, err := server.admitLeaseByToken(token, false); !errors.Is(err, errLeaseDraining) {
+		t.Fatalf("admitLeaseByToken() error = %v, want %v", err, errLeaseDraining)
+	}
+	if _, err := draining.stream.Claim(context.Background()); !errors.Is(err, transport.ErrStreamDraining) {
+		t.Fatalf("Claim() error = %v, want %v", err, transport.ErrStreamDraining)
+	}
+	for range 3 {
+		if routed, ok := server.registry.Lookup("demo-drain.portal.example.com"); !ok || routed != replicas[1] {
+			t.Fatal("registry.Lookup() did not skip the draining replica")
+		}
+	}
+
+	server.finishDrain(draining)
+	if _, err := server.registry.Find(draining.Copy(), draining.InstanceID); !errors.Is(err, errLeaseNotFound) {
+		t.Fatalf("registry.Find() after drain error = %v, want %v", err, errLeaseNotFound)
+	}
+	if _, ok := server.registry.Lookup("demo-drain.portal.example.com"); !ok {
+		t.Fatal("registry.Lookup() lost the remaining replica")
+	}
+}
+
+func TestServerServesOfflinePageForUnroutableLease(t *testing.T) {
+	t.Parallel()
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:          "https://portal.example.com",
+		IdentityPath:       tempIdentityPath(t),
+		ACME:               acme.Config{KeyDir: keyDir},
+		APIListenAddr:      "127.0.0.1:0",
+		SNIListenAddr:      "127.0.0.1:0",
+		OfflinePageEnabled: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx, nil); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	_ = newTestClient(t, cancel, server)
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-offline",
+			Address: server.identity.Address,
+		},
+		Metadata: types.LeaseMetadata{Description: "Demo <service>"},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	if !resp.OfflinePage {
+		t.Fatal("RegisterResponse.OfflinePage = false, want true")
+	}
+	server.registry.policy.BanIdentity(resp.Identity.Key())
+
+	conn, err := tls.Dial("tcp", server.sniListener.Addr().String(), &tls.Config{
+		ServerName:         resp.Hostname,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+resp.Hostname+"/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	page, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	defer page.Body.Close()
+	body, err := io.ReadAll(page.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	if page.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", page.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := page.Header.Get("X-Portal-Offline"); got != "not_routable" {
+		t.Fatalf("X-Portal-Offline = %q, want not_routable", got)
+	}
+	if !strings.Contains(string(body), "demo-offline is offline") || !strings.Contains(string(body), "Demo &lt;service&gt;") {
+		t.Fatalf("body = %q, want escaped lease status", body)
+	}
+
+	if _, err := tls.Dial("tcp", server.sniListener.Addr().String(), &tls.Config{
+		ServerName:         "unknown.portal.example.com",
+		InsecureSkipVerify: true,
+	}); err == nil {
+		t.Fatal("tls.Dial(unknown host) succeeded, want connection closed without a page")
+	}
+}
+
+func TestServerProxyProtocolRecoversClientAddress(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:           "https://portal.example.com",
+		IdentityPath:        tempIdentityPath(t),
+		TrustedProxyCIDRs:   "127.0.0.0/8",
+		AcceptProxyProtocol: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	listener := transport.NewProxyProtocolListener(inner, server.proxyTrust())
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 198.51.100.7 203.0.113.1 51234 443\r\nhello"))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+
+	payload := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("payload = %q, want %q", payload, "hello")
+	}
+	if got := conn.RemoteAddr().String(); got != "198.51.100.7:51234" {
+		t.Fatalf("RemoteAddr() = %q, want %q", got, "198.51.100.7:51234")
+	}
+	header, ok := transport.ProxyHeaderOf(conn)
+	if !ok || header.Version != 1 {
+		t.Fatalf("ProxyHeaderOf() = (%+v, %v), want v1 header", header, ok)
+	}
+}
+
+// testLease is a lease registered on a test relay whose tenant holds one
+// reverse session.
+type testLease struct {
+	server *Server
+	resp   types.RegisterResponse
+	record *leaseRecord
+	client *transport.ClientStream
+}
+
+// startTestLease creates a relay from cfg, registers req from 203.0.113.10
+// and connects a tenant client over one reverse session. An empty identity
+// address defaults to the relay's own. With SNIListenAddr set the relay is
+// started, and the tenant terminates TLS with the certificate in
+// cfg.ACME.KeyDir.
+func startTestLease(t *testing.T, cfg ServerConfig, req types.RegisterChallengeRequest) *testLease {
+	t.Helper()
+
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var tenantTLS func() *tls.Config
+	if cfg.SNIListenAddr != "" {
+		if err := server.Start(ctx, nil); err != nil {
+			cancel()
+			t.Fatalf("Start() error = %v", err)
+		}
+		_ = newTestClient(t, cancel, server)
+		cert, err := tls.LoadX509KeyPair(filepath.Join(cfg.ACME.KeyDir, "fullchain.pem"), filepath.Join(cfg.ACME.KeyDir, "privatekey.pem"))
+		if err != nil {
+			t.Fatalf("LoadX509KeyPair() error = %v", err)
+		}
+		tenantTLS = func() *tls.Config { return &tls.Config{Certificates: []tls.Certificate{cert}} }
+	} else {
+		t.Cleanup(cancel)
+	}
+
+	if req.Identity.Address == "" {
+		req.Identity.Address = server.identity.Address
+	}
+	resp, err := server.registerLease(req, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+	if err != nil {
+		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+	}
+	t.Cleanup(record.Close)
+
+	sdkSide, relaySide := net.Pipe()
+	if err := record.stream.OfferConn(relaySide); err != nil {
+		t.Fatalf("OfferConn() error = %v", err)
+	}
+	client := transport.NewClientStream(1, time.Second)
+	go client.RunLoop(ctx, func(context.Context) (net.Conn, error) {
+		return sdkSide, nil
+	}, tenantTLS, nil)
+
+	return &testLease{server: server, resp: resp, record: record, client: client}
+}
+
+// accept returns the next public connection handed to the tenant.
+func (l *testLease) accept(t *testing.T) net.Conn {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := l.client.Accept(ctx.Done())
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// dialPort connects to the public port of the lease at index.
+func (l *testLease) dialPort(t *testing.T, index int) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.resp.Ports[index].Port))
+	if err != nil {
+		t.Fatalf("dial tcp port: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// dialSNI connects to the relay SNI listener.
+func (l *testLease) dialSNI(t *testing.T) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", l.server.sniListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial sni listener: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestRegisterLeaseGrantsRequestedPorts(t *testing.T) {
+	t.Parallel()
+
+	req := types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-ports"},
+		Ports: []types.PortRequest{
+			{Protocol: types.PortProtocolTCP},
+			{Protocol: types.PortProtocolUDP, Port: 40027},
+			{Protocol: types.PortProtocolTCP, Port: 40025},
+		},
+	}
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:     "https://portal.example.com",
+		IdentityPath:  tempIdentityPath(t),
+		MinPort:       40020,
+		MaxPort:       40029,
+		UDPEnabled:    true,
+		TCPEnabled:    true,
+		MaxLeasePorts: 2,
+	}, req)
+	resp := lease.resp
+
+	if !resp.UDPEnabled || !resp.TCPEnabled {
+		t.Fatalf("RegisterResponse UDPEnabled=%v TCPEnabled=%v, want both", resp.UDPEnabled, resp.TCPEnabled)
+	}
+	if len(resp.Ports) != 3 {
+		t.Fatalf("RegisterResponse.Ports = %+v, want 3 mappings", resp.Ports)
+	}
+	for i, want := range req.Ports {
+		got := resp.Ports[i]
+		if got.Protocol != want.Protocol || want.Port != 0 && got.Port != want.Port {
+			t.Fatalf("RegisterResponse.Ports[%d] = %+v, want %+v", i, got, want)
+		}
+		if wantAddr := fmt.Sprintf("%s:%d", lease.server.identity.Name, got.Port); got.Addr != wantAddr {
+			t.Fatalf("RegisterResponse.Ports[%d].Addr = %q, want %q", i, got.Addr, wantAddr)
+		}
+	}
+	if resp.TCPAddr != resp.Ports[0].Addr || resp.UDPAddr != resp.Ports[1].Addr {
+		t.Fatalf("TCPAddr=%q UDPAddr=%q, want the first port of each protocol", resp.TCPAddr, resp.UDPAddr)
+	}
+
+	lease.dialPort(t, 2)
+	if index, ok := transport.PortIndexOf(lease.accept(t)); !ok || index != 2 {
+		t.Fatalf("PortIndexOf() = %d, %v, want 2, true", index, ok)
+	}
+
+	req.Identity = types.Identity{Name: "demo-ports-limit", Address: lease.record.Address}
+	req.Ports = append(req.Ports, types.PortRequest{Protocol: types.PortProtocolTCP})
+	if _, err := lease.server.registerLease(req, "203.0.113.10", ""); !errors.Is(err, errTooManyPorts) {
+		t.Fatalf("registerLease() error = %v, want %v", err, errTooManyPorts)
+	}
+}
+
+func TestPortAllocatorPrefersRequestedAndReservedPorts(t *testing.T) {
+	t.Parallel()
+
+	allocator := transport.NewPortAllocator(41000, 41003, time.Minute)
+	port, err := allocator.AllocatePort("alpha", 41002)
+	if err != nil || port != 41002 {
+		t.Fatalf("AllocatePort(alpha, 41002) = %d, %v, want 41002", port, err)
+	}
+	if port, err = allocator.AllocatePort("beta", 41002); err != nil || port != 41000 {
+		t.Fatalf("AllocatePort(beta, 41002) = %d, %v, want the first free port 41000", port, err)
+	}
+
+	allocator.Release(41002)
+	if port, err = allocator.AllocatePort("beta", 41002); err != nil || port == 41002 {
+		t.Fatalf("AllocatePort(beta, 41002) = %d, %v, want a port other than the one reserved for alpha", port, err)
+	}
+	if port, err = allocator.Allocate("alpha"); err != nil || port != 41002 {
+		t.Fatalf("Allocate(alpha) = %d, %v, want its reserved port 41002", port, err)
+	}
+}
+
+func TestTCPPortRejectsConnectionsOverLeaseLimit(t *testing.T) {
+	t.Parallel()
+
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40030,
+		MaxPort:      40039,
+		TCPEnabled:   true,
+		ConnLimits:   types.ConnLimits{MaxPerLease: 4},
+	}, types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-conn-limit"},
+		TCPEnabled: true,
+	})
+	key := lease.record.Key()
+
+	limiter := lease.server.registry.policy.ConnLimiter()
+	limiter.SetOverride(key, types.ConnLimits{MaxPerLease: 1})
+	if snapshot := lease.server.registry.AdminSnapshot(lease.record); snapshot.ConnLimits == nil || snapshot.ConnLimits.MaxPerLease != 1 {
+		t.Fatalf("AdminLease.ConnLimits = %+v, want the lease override", snapshot.ConnLimits)
+	}
+
+	lease.dialPort(t, 0)
+	lease.accept(t)
+
+	second := lease.dialPort(t, 0)
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("second connection Read() error = %v, want EOF from a rejected connection", err)
+	}
+	if got := limiter.Active(key); got != 1 {
+		t.Fatalf("ConnLimiter.Active() = %d, want 1", got)
+	}
+}
+
+func TestSNIRejectsConnectionsOverLeaseLimit(t *testing.T) {
+	t.Parallel()
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:     "https://portal.example.com",
+		IdentityPath:  tempIdentityPath(t),
+		ACME:          acme.Config{KeyDir: keyDir},
+		APIListenAddr: "127.0.0.1:0",
+		SNIListenAddr: "127.0.0.1:0",
+	}, types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-sni-limit"},
+	})
+	key := lease.record.Key()
+	clientTLS := &tls.Config{ServerName: lease.resp.Hostname, InsecureSkipVerify: true}
+
+	limiter := lease.server.registry.policy.ConnLimiter()
+	limiter.SetOverride(key, types.ConnLimits{MaxPerLease: 1})
+
+	first := lease.dialSNI(t)
+	go func() { _ = tls.Client(first, clientTLS).Handshake() }()
+	lease.accept(t)
+
+	second := lease.dialSNI(t)
+	_ = second.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tls.Client(second, clientTLS).Handshake(); err == nil {
+		t.Fatal("second SNI handshake succeeded, want connection closed over the lease limit")
+	}
+	if got := limiter.Active(key); got != 1 {
+		t.Fatalf("ConnLimiter.Active() = %d, want 1", got)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries := lease.server.accessLog.Query(accesslog.Filter{LeaseKey: key})
+		if len(entries) > 0 {
+			if entries[0].CloseReason != transport.CloseReasonRejected {
+				t.Fatalf("access log close reason = %q, want %q", entries[0].CloseReason, transport.CloseReasonRejected)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rejected SNI connection was not recorded in the access log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterLeaseBoundsConnTimeouts(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:       "https://portal.example.com",
+		IdentityPath:    tempIdentityPath(t),
+		ConnTimeouts:    types.ConnTimeouts{IdleSeconds: 30, DrainSeconds: 10},
+		MaxConnTimeouts: types.ConnTimeouts{LifetimeSeconds: 600},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-timeouts",
+			Address: server.identity.Address,
+		},
+		ConnTimeouts: types.ConnTimeouts{IdleSeconds: 3600, LifetimeSeconds: 7200, DrainSeconds: 5},
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	want := types.ConnTimeouts{IdleSeconds: 30, LifetimeSeconds: 600, DrainSeconds: 5}
+	if resp.ConnTimeouts != want {
+		t.Fatalf("RegisterResponse.ConnTimeouts = %+v, want %+v", resp.ConnTimeouts, want)
+	}
+}
+
+func TestBridgeConnsClosesIdleAndDrainingConnections(t *testing.T) {
+	t.Parallel()
+
+	client, clientPeer := net.Pipe()
+	session, sessionPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer sessionPeer.Close()
+	go func() {
+		_, _ = clientPeer.Write([]byte("ping"))
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, sessionPeer)
+	}()
+	stats := transport.BridgeConns(context.Background(), client, session, transport.BridgeOptions{
+		Timeouts: types.ConnTimeouts{IdleSeconds: 1},
+	})
+	if stats.Reason != transport.CloseReasonIdle || stats.BytesIn != 4 {
+		t.Fatalf("BridgeConns() = %+v, want 4 bytes in and reason %q", stats, transport.CloseReasonIdle)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+	public, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	defer public.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	session, sessionPeer = net.Pipe()
+	defer sessionPeer.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, sessionPeer)
+	}()
+	_ = public.(*net.TCPConn).CloseWrite()
+
+	startedAt := time.Now()
+	stats = transport.BridgeConns(context.Background(), accepted, session, transport.BridgeOptions{
+		Timeouts: types.ConnTimeouts{IdleSeconds: 30, DrainSeconds: 1},
+	})
+	if stats.Reason != transport.CloseReasonDrainTimeout {
+		t.Fatalf("BridgeConns() reason = %q, want %q", stats.Reason, transport.CloseReasonDrainTimeout)
+	}
+	if elapsed := time.Since(startedAt); elapsed < time.Second || elapsed > 10*time.Second {
+		t.Fatalf("BridgeConns() returned after %v, want the 1s drain timeout", elapsed)
+	}
+}
+
+func TestTCPPortDropsDeniedClientIPs(t *testing.T) {
+	t.Parallel()
+
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40040,
+		MaxPort:      40049,
+		TCPEnabled:   true,
+	}, types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-ingress-deny"},
+		TCPEnabled: true,
+	})
+	lease.server.registry.policy.IPFilter().DenyIngress("127.0.0.0/8")
+
+	// An ingress deny entry only covers public clients, not tenants.
+	resp, err := lease.server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-ingress-deny-tenant", Address: lease.record.Address},
+	}, "127.0.0.1", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v, want tenants behind an ingress deny entry to register", err)
+	}
+	if record, err := lease.server.registry.Find(resp.Identity, resp.InstanceID); err == nil {
+		t.Cleanup(record.Close)
+	}
+
+	publicConn := lease.dialPort(t, 0)
+	_ = publicConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := publicConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("Read() error = %v, want EOF from a denied client", err)
+	}
+}
+
+func TestSNIDropsDeniedClientIPs(t *testing.T) {
+	t.Parallel()
+
+	keyDir := t.TempDir()
+	writeManualRelayCertificate(t, keyDir, "portal.example.com")
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:     "https://portal.example.com",
+		IdentityPath:  tempIdentityPath(t),
+		ACME:          acme.Config{KeyDir: keyDir},
+		APIListenAddr: "127.0.0.1:0",
+		SNIListenAddr: "127.0.0.1:0",
+	}, types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-sni-deny"},
+	})
+	lease.server.registry.policy.IPFilter().DenyIngress("127.0.0.0/8")
+	blocked := metrics.IngressBlocked.With("sni", policy.IngressBlockDenied)
+	before := blocked.Value()
+
+	conn := lease.dialSNI(t)
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tls.Client(conn, &tls.Config{ServerName: lease.resp.Hostname, InsecureSkipVerify: true}).Handshake(); err == nil {
+		t.Fatal("SNI handshake from a denied client succeeded, want the connection dropped")
+	}
+	if got := blocked.Value(); got <= before {
+		t.Fatalf("portal_ingress_blocked_total{sni,denied} = %d, want more than %d", got, before)
+	}
+	if entries := lease.server.accessLog.Query(accesslog.Filter{Hostname: lease.resp.Hostname}); len(entries) != 0 {
+		t.Fatalf("access log entries = %+v, want blocked attempts left out", entries)
+	}
+}
+
+func TestUDPPortDropsDeniedClientIPs(t *testing.T) {
+	t.Parallel()
+
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40062,
+		MaxPort:      40069,
+		UDPEnabled:   true,
+	}, types.RegisterChallengeRequest{
+		Identity:        types.Identity{Name: "demo-udp-deny"},
+		UDPEnabled:      true,
+		DatagramVersion: types.DatagramVersion2,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	client := connectTestDatagramClient(t, ctx, lease.server, lease.resp)
 
-	if err := server.Start(ctx, nil); err != nil {
-		t.Fatalf("Start() error = %v", err)
-	}
-
-	client := newTestClient(t, cancel, server)
-
-	resp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathSDKDomain)
+	udpClient, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: lease.record.datagram.UDPPort()})
 	if err != nil {
-		t.Fatalf("GET /sdk/domain error = %v", err)
+		t.Fatalf("DialUDP() error = %v", err)
 	}
-	defer resp.Body.Close()
+	t.Cleanup(func() { _ = udpClient.Close() })
 
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("GET /sdk/domain status = %d, want %d", resp.StatusCode, http.StatusOK)
+	filter := lease.server.registry.policy.IPFilter()
+	blocked := metrics.IngressBlocked.With("udp", policy.IngressBlockBanned)
+	before := blocked.Value()
+	// The 4-in-6 form bans the same range as 127.0.0.0/8 and unbans under it.
+	filter.BanIP("::ffff:127.0.0.0/104")
+	if _, err := udpClient.Write([]byte("banned")); err != nil {
+		t.Fatalf("Write() error = %v", err)
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatalf("read /sdk/domain response: %v", err)
+	for blocked.Value() == before {
+		if ctx.Err() != nil {
+			t.Fatal("banned datagram was not counted as blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	filter.UnbanIP("127.0.0.0/8")
 
-	var envelope types.APIEnvelope[types.DomainResponse]
-	if err := json.Unmarshal(body, &envelope); err != nil {
-		t.Fatalf("decode /sdk/domain response: %v", err)
-	}
-	if !envelope.OK {
-		t.Fatalf("GET /sdk/domain response = %+v, want ok=true", envelope)
+	if _, err := udpClient.Write([]byte("allowed")); err != nil {
+		t.Fatalf("Write() error = %v", err)
 	}
-	if envelope.Data.ProtocolVersion != types.ProtocolVersion {
-		t.Fatalf("DomainResponse.ProtocolVersion = %q, want %q", envelope.Data.ProtocolVersion, types.ProtocolVersion)
+	frame, err := client.Accept(ctx.Done())
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
 	}
-	if envelope.Data.ReleaseVersion != types.ReleaseVersion {
-		t.Fatalf("DomainResponse.ReleaseVersion = %q, want %q", envelope.Data.ReleaseVersion, types.ReleaseVersion)
+	if string(frame.Payload) != "allowed" {
+		t.Fatalf("frame.Payload = %q, want the banned datagram dropped", frame.Payload)
 	}
 }
 
-func TestRegisterLeaseOmitsSNIPortWithoutUDP(t *testing.T) {
+func TestTCPPortEnforcesLeaseIngressRules(t *testing.T) {
 	t.Parallel()
 
-	server, err := NewServer(ServerConfig{
-		PortalURL:    "https://portal.example.com:4017",
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:    "https://portal.example.com",
 		IdentityPath: tempIdentityPath(t),
-		SNIPort:      4443,
-		MinPort:      40000,
-		MaxPort:      40009,
+		MinPort:      40050,
+		MaxPort:      40059,
 		TCPEnabled:   true,
+	}, types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-ingress-allow"},
+		TCPEnabled: true,
+		Ingress:    types.IngressRules{Allow: []string{"10.0.0.0/8", "10.0.0.0/8"}},
 	})
-	if err != nil {
-		t.Fatalf("NewServer() error = %v", err)
+	if !reflect.DeepEqual(lease.record.Ingress.Allow, []string{"10.0.0.0/8"}) {
+		t.Fatalf("record.Ingress.Allow = %v, want [10.0.0.0/8]", lease.record.Ingress.Allow)
 	}
 
-	resp, err := server.registerLease(types.RegisterChallengeRequest{
-		Identity: types.Identity{
-			Name:    "demo-tcp",
-			Address: server.identity.Address,
-		},
-		TCPEnabled: true,
+	_, err := lease.server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-ingress-invalid", Address: lease.record.Address},
+		Ingress:  types.IngressRules{Allow: []string{"10.0.0.0/33"}},
 	}, "203.0.113.10", "")
-	if err != nil {
-		t.Fatalf("registerLease() error = %v", err)
+	if !errors.Is(err, errInvalidIngressRules) {
+		t.Fatalf("registerLease() error = %v, want %v", err, errInvalidIngressRules)
 	}
-	t.Cleanup(func() {
-		if record, err := server.registry.Find(resp.Identity); err == nil {
-			record.Close()
-		}
-	})
 
-	if resp.SNIPort != 0 {
-		t.Fatalf("RegisterResponse.SNIPort = %d, want 0 without udp", resp.SNIPort)
+	publicConn := lease.dialPort(t, 0)
+	_ = publicConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := publicConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("Read() error = %v, want EOF from a client outside the allow list", err)
 	}
 }
 
-func TestServerStartUsesManualCertificateWithoutACMEProvider(t *testing.T) {
+func TestSNIHandoverAppliesNextReplicaIngressRules(t *testing.T) {
 	t.Parallel()
 
 	keyDir := t.TempDir()
 	writeManualRelayCertificate(t, keyDir, "portal.example.com")
-
 	server, err := NewServer(ServerConfig{
 		PortalURL:     "https://portal.example.com",
 		IdentityPath:  tempIdentityPath(t),
@@ -289,195 +2077,322 @@ func TestServerStartUsesManualCertificateWithoutACMEProvider(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewServer() error = %v", err)
 	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-
 	if err := server.Start(ctx, nil); err != nil {
 		t.Fatalf("Start() error = %v", err)
 	}
+	_ = newTestClient(t, cancel, server)
+
+	register := func(instanceID string, ingress types.IngressRules) *leaseRecord {
+		t.Helper()
+		resp, err := server.registerLease(types.RegisterChallengeRequest{
+			Identity: types.Identity{
+				Name:    "demo-handover",
+				Address: server.identity.Address,
+			},
+			InstanceID: instanceID,
+			Ingress:    ingress,
+		}, "203.0.113.10", "")
+		if err != nil {
+			t.Fatalf("registerLease(%q) error = %v", instanceID, err)
+		}
+		record, err := server.registry.Find(resp.Identity, resp.InstanceID)
+		if err != nil {
+			t.Fatalf("registry.Find(%q) error = %v, want registered lease", instanceID, err)
+		}
+		return record
+	}
+	old := register("old", types.IngressRules{})
+	blocked := metrics.IngressBlocked.With("sni", policy.IngressBlockLease)
+	before := blocked.Value()
 
-	client := newTestClient(t, cancel, server)
-
-	healthResp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathHealthz)
+	// The client waits for a session on the only replica, which admits it.
+	conn, err := net.Dial("tcp", server.sniListener.Addr().String())
 	if err != nil {
-		t.Fatalf("GET /healthz error = %v", err)
+		t.Fatalf("dial sni listener: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	handshake := make(chan error, 1)
+	go func() {
+		handshake <- tls.Client(conn, &tls.Config{ServerName: old.Hostname, InsecureSkipVerify: true}).Handshake()
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for old.stream.Demand().Waiting == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("SNI client never waited for a claim on the first replica")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	defer healthResp.Body.Close()
 
-	if healthResp.StatusCode != http.StatusOK {
-		t.Fatalf("GET /healthz status = %d, want %d", healthResp.StatusCode, http.StatusOK)
+	// Draining hands the claim over to a replica whose signed rules leave the
+	// client out.
+	register("new", types.IngressRules{Allow: []string{"203.0.113.0/24"}})
+	if _, started, err := server.registry.Drain(old.Copy(), old.InstanceID, time.Now().Add(time.Minute)); err != nil || !started {
+		t.Fatalf("registry.Drain() = %v, %v, want the first replica draining", started, err)
+	}
+	old.stream.Drain()
+
+	select {
+	case err := <-handshake:
+		if err == nil {
+			t.Fatal("SNI handshake succeeded, want the client refused by the next replica")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SNI client still waits for a claim on a replica that refuses it")
+	}
+	if got := blocked.Value(); got <= before {
+		t.Fatalf("portal_ingress_blocked_total{sni,lease} = %d, want more than %d", got, before)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		entries := server.accessLog.Query(accesslog.Filter{Hostname: old.Hostname})
+		if len(entries) > 0 {
+			if entries[0].CloseReason != transport.CloseReasonRejected {
+				t.Fatalf("access log close reason = %q, want %q", entries[0].CloseReason, transport.CloseReasonRejected)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refused SNI connection was not recorded in the access log")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func TestServerStartDiscoveryIncludesIdentityAndOmitsSignerFields(t *testing.T) {
+func TestEvictLeaseCutsConnectionsAndFreesPorts(t *testing.T) {
 	t.Parallel()
 
-	server, err := NewServer(ServerConfig{
-		PortalURL:        "https://localhost:4017",
-		IdentityPath:     tempIdentityPath(t),
-		ACME:             acme.Config{KeyDir: t.TempDir()},
-		APIListenAddr:    "127.0.0.1:0",
-		SNIListenAddr:    "127.0.0.1:0",
-		DiscoveryEnabled: true,
-	})
-	if err != nil {
-		t.Fatalf("NewServer() error = %v", err)
+	req := types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-evict"},
+		TCPEnabled: true,
 	}
+	lease := startTestLease(t, ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40060,
+		MaxPort:      40060,
+		TCPEnabled:   true,
+	}, req)
+	server, key := lease.server, lease.record.Key()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	if err := server.Start(ctx, nil); err != nil {
-		t.Fatalf("Start() error = %v", err)
+	publicConn := lease.dialPort(t, 0)
+	if _, err := lease.accept(t).Write([]byte("x")); err != nil {
+		t.Fatalf("tenant Write() error = %v", err)
 	}
-
-	client := newTestClient(t, cancel, server)
-
-	resp, err := client.Get("https://" + utils.HostPortOrLoopback(server.apiListener.Addr().String()) + types.PathDiscovery)
-	if err != nil {
-		t.Fatalf("GET /discovery error = %v", err)
+	_ = publicConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(publicConn, make([]byte, 1)); err != nil {
+		t.Fatalf("public Read() error = %v, want bridged byte", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("GET /discovery status = %d, want %d", resp.StatusCode, http.StatusOK)
+	if got := server.EvictLease(key, time.Minute); got != 1 {
+		t.Fatalf("EvictLease() = %d, want 1 replica", got)
+	}
+	if _, err := publicConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("public Read() after evict error = %v, want EOF from a cut bridge", err)
+	}
+	if _, err := server.registry.Find(lease.resp.Identity, lease.resp.InstanceID); !errors.Is(err, errLeaseNotFound) {
+		t.Fatalf("registry.Find() after evict error = %v, want %v", err, errLeaseNotFound)
+	}
+	req.Identity.Address = lease.record.Address
+	if _, err := server.registerLease(req, "203.0.113.10", ""); !errors.Is(err, errLeaseEvicted) {
+		t.Fatalf("registerLease() during cooldown error = %v, want %v", err, errLeaseEvicted)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	// The only port in the range must be free for another lease at once.
+	next, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-evict-next", Address: lease.record.Address},
+		TCPEnabled: true,
+	}, "203.0.113.11", "")
 	if err != nil {
-		t.Fatalf("read /discovery response: %v", err)
+		t.Fatalf("registerLease() for another lease error = %v, want the evicted port", err)
 	}
-	for _, key := range []string{"\"address\"", "\"name\"", "signer_public_key", "descriptor_signature"} {
-		if key == "\"address\"" || key == "\"name\"" {
-			if !strings.Contains(string(body), key) {
-				t.Fatalf("/discovery body = %q, want %q present", string(body), key)
-			}
-			continue
-		}
-		if strings.Contains(string(body), key) {
-			t.Fatalf("/discovery body = %q, want %q omitted", string(body), key)
-		}
+	if nextRecord, err := server.registry.Find(next.Identity, next.InstanceID); err == nil {
+		t.Cleanup(nextRecord.Close)
+	}
+	if next.Ports[0].Port != lease.resp.Ports[0].Port {
+		t.Fatalf("next lease port = %d, want %d", next.Ports[0].Port, lease.resp.Ports[0].Port)
+	}
+
+	server.ClearLeaseEviction(key)
+	if _, ok := server.LeaseEvictedUntil(key); ok {
+		t.Fatal("LeaseEvictedUntil() ok = true, want cooldown lifted")
 	}
 }
 
-func TestServerStartRejectsMismatchedACMEBaseDomain(t *testing.T) {
+func TestRegisterLeaseEnforcesQuotas(t *testing.T) {
 	t.Parallel()
 
-	server, err := NewServer(ServerConfig{
-		PortalURL:     "https://portal.example.com",
-		IdentityPath:  tempIdentityPath(t),
-		ACME:          acme.Config{BaseDomain: "other.example.com", KeyDir: t.TempDir()},
-		APIListenAddr: "127.0.0.1:0",
-		SNIListenAddr: "127.0.0.1:0",
-		MinPort:       40000,
-		MaxPort:       40000,
-		UDPEnabled:    true,
-	})
-	if err != nil {
-		t.Fatalf("NewServer() error = %v", err)
+	cfg := ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40061,
+		MaxPort:      40061,
+		TCPEnabled:   true,
+		Quotas: types.QuotaLimits{
+			MaxLeasesPerAddress: 1,
+			MaxTTLSeconds:       60,
+			DailyBytes:          4,
+		},
+		QuotaUsagePath: filepath.Join(t.TempDir(), "quota_usage.json"),
+	}
+	req := types.RegisterChallengeRequest{
+		Identity:   types.Identity{Name: "demo-quota"},
+		TCPEnabled: true,
 	}
+	lease := startTestLease(t, cfg, req)
+	server, address := lease.server, lease.record.Address
 
-	err = server.Start(context.Background(), nil)
-	if err == nil {
-		t.Fatal("Start() error = nil, want mismatch error")
+	if ttl := time.Until(lease.record.ExpiresAt); ttl > time.Minute {
+		t.Fatalf("lease ttl = %s, want at most the 60s maximum", ttl)
 	}
-	if !strings.Contains(err.Error(), "does not match portal root host") {
-		t.Fatalf("Start() error = %v, want base domain mismatch", err)
+	req.Identity.Address = address
+	req.TTL = 120
+	if _, err := server.registerLease(req, "203.0.113.10", ""); !errors.Is(err, errTTLQuotaExceeded) {
+		t.Fatalf("registerLease() with ttl 120 error = %v, want %v", err, errTTLQuotaExceeded)
+	}
+	req.TTL = 0
+	if _, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{Name: "demo-quota-second", Address: address},
+	}, "203.0.113.21", ""); !errors.Is(err, errLeaseQuotaExceeded) {
+		t.Fatalf("registerLease() over the address limit error = %v, want %v", err, errLeaseQuotaExceeded)
 	}
-}
 
-func TestRegisterLeaseDerivesFixedHostnameFromName(t *testing.T) {
-	t.Parallel()
+	publicConn := lease.dialPort(t, 0)
+	conn := lease.accept(t)
 
-	server, err := NewServer(ServerConfig{
-		PortalURL:    "https://portal.example.com",
-		IdentityPath: tempIdentityPath(t),
-		MinPort:      40000,
-		MaxPort:      40000,
-		UDPEnabled:   true,
-	})
-	if err != nil {
-		t.Fatalf("NewServer() error = %v", err)
+	// The chunk that crosses the daily quota is still relayed; the next one
+	// closes the bridge.
+	if _, err := conn.Write([]byte("12345678")); err != nil {
+		t.Fatalf("tenant Write() error = %v", err)
+	}
+	_ = publicConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(publicConn, make([]byte, 8)); err != nil {
+		t.Fatalf("public Read() error = %v, want bridged bytes", err)
+	}
+	_, _ = conn.Write([]byte("9"))
+	if _, err := publicConn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("public Read() over quota error = %v, want EOF from a closed bridge", err)
 	}
 
-	resp, err := server.registerLease(types.RegisterChallengeRequest{
-		Identity: types.Identity{
-			Name:    "Demo-App",
-			Address: server.identity.Address,
-		},
-	}, "203.0.113.10", "")
-	if err != nil {
-		t.Fatalf("registerLease() error = %v", err)
+	rejected := lease.dialPort(t, 0)
+	_ = rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("Read() on a connection over quota error = %v, want EOF", err)
+	}
+	if _, err := server.registerLease(req, "203.0.113.10", ""); !errors.Is(err, errByteQuotaExceeded) {
+		t.Fatalf("registerLease() over the byte quota error = %v, want %v", err, errByteQuotaExceeded)
 	}
 
-	wantHostname := "demo-app.portal.example.com"
-	if resp.Hostname != wantHostname {
-		t.Fatalf("registerLease() hostname = %q, want %q", resp.Hostname, wantHostname)
+	usage := server.QuotaUsageOf(address)
+	if usage.DayBytes != 8 || !usage.Exceeded || usage.Leases != 1 {
+		t.Fatalf("QuotaUsageOf() = %+v, want 8 bytes, exceeded and 1 lease", usage)
 	}
 
-	record, err := server.registry.Find(resp.Identity)
+	// A restarted relay picks the usage up again.
+	server.saveQuotaUsage()
+	restarted, err := NewServer(cfg)
 	if err != nil {
-		t.Fatalf("registry.Find() error = %v, want registered lease", err)
+		t.Fatalf("NewServer() after restart error = %v", err)
 	}
-	snapshot := server.registry.Snapshot(record)
-	if snapshot.Name != "demo-app" {
-		t.Fatalf("Snapshot().Name = %q, want %q", snapshot.Name, "demo-app")
+	if !restarted.PolicyRuntime().Quotas().Exceeded(address) {
+		t.Fatal("Quotas().Exceeded() after restart = false, want the saved usage")
 	}
-	if snapshot.Hostname != wantHostname {
-		t.Fatalf("Snapshot().Hostname = %q, want %q", snapshot.Hostname, wantHostname)
+	server.PolicyRuntime().Quotas().SetOverride(address, types.QuotaLimits{DailyBytes: 1 << 20})
+	if server.PolicyRuntime().Quotas().Exceeded(address) {
+		t.Fatal("Quotas().Exceeded() with a larger override = true, want false")
 	}
 }
 
-func TestRegisterLeaseBuildsUDPEnabledRuntime(t *testing.T) {
+func TestQuotaUsageSavedWhenQuotaIsCrossed(t *testing.T) {
 	t.Parallel()
 
+	usagePath := filepath.Join(t.TempDir(), "quota_usage.json")
 	server, err := NewServer(ServerConfig{
-		PortalURL:    "https://portal.example.com",
-		IdentityPath: tempIdentityPath(t),
-		MinPort:      40000,
-		MaxPort:      40009,
-		UDPEnabled:   true,
+		PortalURL:      "https://portal.example.com",
+		IdentityPath:   tempIdentityPath(t),
+		Quotas:         types.QuotaLimits{DailyBytes: 4},
+		QuotaUsagePath: usagePath,
 	})
 	if err != nil {
 		t.Fatalf("NewServer() error = %v", err)
 	}
-	server.registry.policy.SetUDPPolicy(true, 0)
-
-	resp, err := server.registerLease(types.RegisterChallengeRequest{
-		Identity: types.Identity{
-			Name:    "demo-udp",
-			Address: server.identity.Address,
-		},
-		UDPEnabled: true,
-	}, "203.0.113.10", "")
-	if err != nil {
-		t.Fatalf("registerLease() error = %v", err)
-	}
-	t.Cleanup(func() {
-		if record, err := server.registry.Find(resp.Identity); err == nil {
-			record.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = server.runQuotaUsageSaver(ctx, time.Hour) }()
+
+	server.PolicyRuntime().Quotas().Meter(server.identity.Address).Charge(8)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var usage []types.QuotaUsage
+		if found, err := utils.ReadJSONFileIfExists(usagePath, &usage); err == nil && found && len(usage) == 1 && usage[0].DayBytes == 8 {
+			break
 		}
-	})
+		if time.Now().After(deadline) {
+			t.Fatal("quota usage was not saved when the daily quota was used up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterLeaseCapHoldsUnderConcurrentRegistrations(t *testing.T) {
+	t.Parallel()
 
-	record, err := server.registry.Find(resp.Identity)
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		Quotas:       types.QuotaLimits{MaxLeasesPerAddress: 1},
+	})
 	if err != nil {
-		t.Fatalf("registry.Find() error = %v, want registered lease", err)
-	}
-	if record.stream == nil {
-		t.Fatal("stream = nil, want stream runtime")
-	}
-	if record.datagram == nil {
-		t.Fatal("datagram = nil, want datagram runtime")
+		t.Fatalf("NewServer() error = %v", err)
 	}
-	if got := record.datagram.UDPPort(); got < 40000 || got > 40009 {
-		t.Fatalf("UDPPort() = %d, want port within %d-%d", got, 40000, 40009)
+	// Both registrations block in the TXT lookup until each has passed the
+	// early quota check, so only the check in Register can tell them apart.
+	const registrations = 2
+	var arrived sync.WaitGroup
+	arrived.Add(registrations)
+	server.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		arrived.Done()
+		arrived.Wait()
+		return []string{types.CustomDomainChallengeValue(server.identity.Address)}, nil
+	}
+
+	results := make(chan error, registrations)
+	for i := range registrations {
+		go func() {
+			resp, err := server.registerLease(types.RegisterChallengeRequest{
+				Identity: types.Identity{
+					Name:    fmt.Sprintf("demo-race-%d", i),
+					Address: server.identity.Address,
+				},
+				CustomDomains: []string{fmt.Sprintf("race-%d.example.net", i)},
+			}, "203.0.113.10", "")
+			if err == nil {
+				if record, findErr := server.registry.Find(resp.Identity, resp.InstanceID); findErr == nil {
+					t.Cleanup(record.Close)
+				}
+			}
+			results <- err
+		}()
+	}
+
+	var registered, rejected int
+	for range registrations {
+		switch err := <-results; {
+		case err == nil:
+			registered++
+		case errors.Is(err, errLeaseQuotaExceeded):
+			rejected++
+		default:
+			t.Fatalf("registerLease() error = %v, want nil or %v", err, errLeaseQuotaExceeded)
+		}
 	}
-	if resp.SNIPort != server.cfg.SNIPort {
-		t.Fatalf("RegisterResponse.SNIPort = %d, want %d", resp.SNIPort, server.cfg.SNIPort)
+	if registered != 1 || rejected != 1 {
+		t.Fatalf("registered = %d, rejected = %d, want exactly one lease under MaxLeasesPerAddress=1", registered, rejected)
 	}
-	if resp.UDPAddr == "" {
-		t.Fatal("RegisterResponse.UDPAddr = empty, want public udp address")
+	if leases, _ := server.registry.countLeases(server.identity.Address, "", ""); leases != 1 {
+		t.Fatalf("live leases = %d, want 1", leases)
 	}
 }
 
@@ -925,3 +2840,52 @@ func TestServerStartHidesDiscoveryRoutesWhenDisabled(t *testing.T) {
 		t.Fatal("cfg.DiscoveryEnabled = true, want false without configured discovery service")
 	}
 }
+
+func TestServerWriteMetricsReportsLeaseAndPortGauges(t *testing.T) {
+	t.Parallel()
+
+	server, err := NewServer(ServerConfig{
+		PortalURL:    "https://portal.example.com",
+		IdentityPath: tempIdentityPath(t),
+		MinPort:      40100,
+		MaxPort:      40109,
+		TCPEnabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	resp, err := server.registerLease(types.RegisterChallengeRequest{
+		Identity: types.Identity{
+			Name:    "demo-metrics",
+			Address: server.identity.Address,
+		},
+		TCPEnabled: true,
+	}, "203.0.113.10", "")
+	if err != nil {
+		t.Fatalf("registerLease() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if record, err := server.registry.Find(resp.Identity, resp.InstanceID); err == nil {
+			record.Close()
+		}
+	})
+
+	var out strings.Builder
+	if err := server.WriteMetrics(&out); err != nil {
+		t.Fatalf("WriteMetrics() error = %v", err)
+	}
+	body := out.String()
+
+	for _, want := range []string{
+		"# TYPE portal_lease_ready_sessions gauge",
+		`portal_lease_ready_sessions{lease="` + resp.Identity.Key() + `"} 0`,
+		`portal_port_allocator_ports{protocol="tcp",state="in_use"} 1`,
+		`portal_port_allocator_ports{protocol="tcp",state="available"} 9`,
+		"# TYPE portal_stream_claim_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("WriteMetrics() output missing %q:\n%s", want, body)
+		}
+	}
+}
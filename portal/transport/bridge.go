@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosuda/portal/v2/portal/metrics"
+	"github.com/gosuda/portal/v2/portal/policy"
+	"github.com/gosuda/portal/v2/types"
+)
+
+const bridgeBufferSize = 32 * 1024
+
+// BridgeOptions describes how one bridged connection is throttled, bounded
+// and accounted. Transport names the ingress path ("sni", "tcp" or "api").
+// Closing Evicted cuts the bridge, and so does Quota once it is used up.
+type BridgeOptions struct {
+	Limiter   *policy.BPSLimiter
+	Quota     *policy.QuotaMeter
+	Evicted   <-chan struct{}
+	LeaseKey  string
+	Transport string
+	Timeouts  types.ConnTimeouts
+}
+
+// AccessRecorder receives one access log entry per finished connection or
+// flow. The transport fills the connection fields; the recorder adds lease
+// details it knows about.
+type AccessRecorder func(types.AccessLogEntry)
+
+// BridgeStats summarizes a finished bridge. BytesIn counts client-to-tenant
+// bytes. Reason names whichever side ended the bridge first.
+type BridgeStats struct {
+	BytesIn  int64
+	BytesOut int64
+	Reason   string
+}
+
+// Close reasons reported in BridgeStats and access log entries.
+const (
+	CloseReasonClientClosed = "client_closed"
+	CloseReasonTenantClosed = "tenant_closed"
+	CloseReasonClientError  = "client_error"
+	CloseReasonTenantError  = "tenant_error"
+	CloseReasonShutdown     = "shutdown"
+	CloseReasonNoRoute      = "no_route"
+	CloseReasonClaimFailed  = "claim_failed"
+	CloseReasonRejected     = "rejected"
+	CloseReasonIdle         = "idle"
+	CloseReasonMaxLifetime  = "max_lifetime"
+	CloseReasonDrainTimeout = "drain_timeout"
+	CloseReasonEvicted      = "evicted"
+	CloseReasonQuota        = "quota_exceeded"
+)
+
+var errQuotaExceeded = errors.New("byte quota exceeded")
+
+// BridgeConns copies data bidirectionally between a client connection and a
+// claimed reverse session until both directions finish, ctx is done,
+// opts.Evicted is closed, opts.Quota is used up or one of opts.Timeouts
+// expires. When opts.Limiter is non-nil, bytes in both directions are
+// charged against it before being forwarded.
+func BridgeConns(ctx context.Context, client, session net.Conn, opts BridgeOptions) BridgeStats {
+	defer client.Close()
+	defer session.Close()
+
+	if opts.LeaseKey != "" {
+		active := metrics.BridgeActive.With(opts.LeaseKey, opts.Transport)
+		active.Inc()
+		defer active.Dec()
+	}
+
+	bridgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-bridgeCtx.Done()
+		if ctx.Err() != nil {
+			_ = client.Close()
+			_ = session.Close()
+		}
+	}()
+
+	var (
+		stats  BridgeStats
+		once   sync.Once
+		inErr  error
+		outErr error
+	)
+	finish := func(reason string) {
+		once.Do(func() { stats.Reason = reason })
+	}
+	// A timeout takes precedence over the reason of a direction that had
+	// already finished, so drain timeouts are told apart from clean closes.
+	var expired atomic.Pointer[string]
+	expire := func(reason string) {
+		if bridgeCtx.Err() != nil || !expired.CompareAndSwap(nil, &reason) {
+			return
+		}
+		_ = client.Close()
+		_ = session.Close()
+	}
+
+	var lastRead atomic.Int64
+	lastRead.Store(time.Now().UnixNano())
+	if idle := opts.Timeouts.Idle(); idle > 0 {
+		go func() {
+			timer := time.NewTimer(idle)
+			defer timer.Stop()
+			for {
+				select {
+				case <-bridgeCtx.Done():
+					return
+				case <-timer.C:
+				}
+				if remaining := idle - time.Since(time.Unix(0, lastRead.Load())); remaining > 0 {
+					timer.Reset(remaining)
+					continue
+				}
+				expire(CloseReasonIdle)
+				return
+			}
+		}()
+	}
+	if opts.Evicted != nil {
+		go func() {
+			select {
+			case <-bridgeCtx.Done():
+			case <-opts.Evicted:
+				expire(CloseReasonEvicted)
+			}
+		}()
+	}
+	if lifetime := opts.Timeouts.Lifetime(); lifetime > 0 {
+		lifetimeTimer := time.AfterFunc(lifetime, func() { expire(CloseReasonMaxLifetime) })
+		defer lifetimeTimer.Stop()
+	}
+
+	// The first direction to finish has half-closed its peer; the other one
+	// gets the drain timeout to deliver what is left.
+	var drainOnce sync.Once
+	var drainTimer *time.Timer
+	halfClosed := func() {
+		drain := opts.Timeouts.Drain()
+		if drain <= 0 {
+			return
+		}
+		drainOnce.Do(func() {
+			drainTimer = time.AfterFunc(drain, func() { expire(CloseReasonDrainTimeout) })
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stats.BytesIn, inErr = copyAndCloseWrite(bridgeCtx, session, client, opts, "in", &lastRead)
+		if errors.Is(inErr, errQuotaExceeded) {
+			expire(CloseReasonQuota)
+		}
+		halfClosed()
+		finish(closeReason(inErr, CloseReasonClientClosed, CloseReasonClientError))
+	}()
+	stats.BytesOut, outErr = copyAndCloseWrite(bridgeCtx, client, session, opts, "out", &lastRead)
+	if errors.Is(outErr, errQuotaExceeded) {
+		expire(CloseReasonQuota)
+	}
+	halfClosed()
+	finish(closeReason(outErr, CloseReasonTenantClosed, CloseReasonTenantError))
+	<-done
+	cancel()
+	if drainTimer != nil {
+		drainTimer.Stop()
+	}
+	if reason := expired.Load(); reason != nil {
+		stats.Reason = *reason
+	}
+	if ctx.Err() != nil {
+		stats.Reason = CloseReasonShutdown
+	}
+	return stats
+}
+
+// closeReason maps the error that ended one copy direction to a close reason.
+// A clean EOF or a peer closing the connection counts as a normal close.
+func closeReason(err error, closed, failed string) string {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return closed
+	}
+	return failed
+}
+
+// copyAndCloseWrite forwards src to dst and half-closes dst when src ends,
+// storing the time of every successful read in lastRead. It returns the bytes
+// written and the read or write error that stopped it.
+func copyAndCloseWrite(ctx context.Context, dst, src net.Conn, opts BridgeOptions, direction string, lastRead *atomic.Int64) (int64, error) {
+	total := metrics.BridgeBytes.With(opts.Transport, direction)
+	var lease *metrics.Counter
+	if opts.LeaseKey != "" {
+		lease = metrics.LeaseBridgeBytes.With(opts.LeaseKey, opts.Transport, direction)
+	}
+
+	var (
+		written int64
+		copyErr error
+	)
+	buf := make([]byte, bridgeBufferSize)
+	for {
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			lastRead.Store(time.Now().UnixNano())
+			if !opts.Quota.Charge(nr) {
+				copyErr = errQuotaExceeded
+				break
+			}
+			if err := opts.Limiter.WaitN(ctx, nr); err != nil {
+				copyErr = err
+				break
+			}
+			nw, writeErr := dst.Write(buf[:nr])
+			written += int64(nw)
+			total.Add(uint64(nw))
+			lease.Add(uint64(nw))
+			if writeErr != nil {
+				copyErr = writeErr
+				break
+			}
+		}
+		if readErr != nil {
+			copyErr = readErr
+			break
+		}
+	}
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+	return written, copyErr
+}
+
+// RemoteIP returns the host part of conn's remote address, which reflects a
+// PROXY header when one was accepted.
+func RemoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
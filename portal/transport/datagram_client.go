@@ -22,9 +22,14 @@ type ClientDatagram struct {
 }
 
 func NewClientDatagram(onReceiveError func(error)) *ClientDatagram {
-	return &ClientDatagram{
-		session: newDatagramSession(256, false, onReceiveError),
+	session := newDatagramSession(256, false, onReceiveError)
+	session.onDrop = func(reason string) {
+		log.Debug().
+			Str("component", "sdk-datagram-plane").
+			Str("reason", reason).
+			Msg("datagram dropped")
 	}
+	return &ClientDatagram{session: session}
 }
 
 func (d *ClientDatagram) RunLoop(
@@ -118,6 +123,15 @@ func (d *ClientDatagram) Send(flowID uint32, payload []byte) error {
 	return d.session.Send(flowID, payload)
 }
 
+// SetVersion selects the datagram wire version the relay returned at
+// registration.
+func (d *ClientDatagram) SetVersion(version int) {
+	if d == nil || d.session == nil {
+		return
+	}
+	d.session.SetVersion(version)
+}
+
 func (d *ClientDatagram) Connected() bool {
 	return d != nil && d.session != nil && d.session.hasConnection()
 }
@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+const (
+	fragmentReassemblyTimeout = 2 * time.Second
+	maxPartialDatagrams       = 64
+	maxDatagramFragments      = 255
+
+	// quic-go reports the path MTU rather than the room left after packet
+	// headers once MTU discovery has raised it, and silently discards
+	// DATAGRAM frames that do not fit. Fragments leave room for a short
+	// header, the longest connection ID, the packet number, the AEAD tag and
+	// the frame header.
+	fragmentHeadroom = 48
+)
+
+type fragmentKey struct {
+	flowID   uint32
+	packetID uint16
+}
+
+// partialDatagram collects the chunks of one fragmented payload.
+type partialDatagram struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// sendFragments splits payload into DatagramKindFragment frames that fit in
+// limit bytes each.
+func (s *datagramSession) sendFragments(conn *quic.Conn, flowID uint32, payload []byte, limit int) error {
+	overhead := 1 + len(binary.AppendUvarint(nil, uint64(flowID))) + types.DatagramFragmentHeaderSize
+	chunkSize := limit - overhead - fragmentHeadroom
+	if chunkSize <= 0 || len(payload) > types.MaxDatagramPayload {
+		return fmt.Errorf("%w: %d bytes", types.ErrDatagramTooLarge, len(payload))
+	}
+	count := (len(payload) + chunkSize - 1) / chunkSize
+	if count > maxDatagramFragments {
+		return fmt.Errorf("%w: %d bytes in %d fragments", types.ErrDatagramTooLarge, len(payload), count)
+	}
+
+	s.mu.Lock()
+	s.packetID++
+	packetID := s.packetID
+	s.mu.Unlock()
+
+	for i := range count {
+		chunk := payload[i*chunkSize : min((i+1)*chunkSize, len(payload))]
+		if err := conn.SendDatagram(types.EncodeDatagramFragment(flowID, packetID, byte(i), byte(count), chunk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassemble stores one fragment and returns the full payload once every
+// chunk of its packet has arrived.
+func (s *datagramSession) reassemble(flowID uint32, payload []byte) ([]byte, bool) {
+	fragment, chunk, err := types.SplitDatagramFragment(payload)
+	if err != nil {
+		s.drop("fragment_invalid")
+		return nil, false
+	}
+
+	now := time.Now()
+	key := fragmentKey{flowID: flowID, packetID: fragment.PacketID}
+	var dropped []string
+
+	s.mu.Lock()
+	for k, partial := range s.partials {
+		if now.Sub(partial.started) > fragmentReassemblyTimeout {
+			delete(s.partials, k)
+			dropped = append(dropped, "fragment_timeout")
+		}
+	}
+	partial, ok := s.partials[key]
+	if !ok {
+		if len(s.partials) >= maxPartialDatagrams {
+			s.evictOldestPartialLocked()
+			dropped = append(dropped, "fragment_overflow")
+		}
+		partial = &partialDatagram{
+			chunks:  make([][]byte, fragment.Count),
+			started: now,
+		}
+		s.partials[key] = partial
+	}
+
+	var full []byte
+	switch {
+	case len(partial.chunks) != int(fragment.Count):
+		dropped = append(dropped, "fragment_invalid")
+	case partial.chunks[fragment.Index] != nil:
+	case partial.size+len(chunk) > types.MaxDatagramPayload:
+		delete(s.partials, key)
+		dropped = append(dropped, "too_large")
+	default:
+		partial.chunks[fragment.Index] = chunk
+		partial.received++
+		partial.size += len(chunk)
+		if partial.received == len(partial.chunks) {
+			delete(s.partials, key)
+			full = make([]byte, 0, partial.size)
+			for _, c := range partial.chunks {
+				full = append(full, c...)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, reason := range dropped {
+		s.drop(reason)
+	}
+	return full, full != nil
+}
+
+func (s *datagramSession) evictOldestPartialLocked() {
+	var (
+		oldest    fragmentKey
+		oldestAt  time.Time
+		hasOldest bool
+	)
+	for key, partial := range s.partials {
+		if !hasOldest || partial.started.Before(oldestAt) {
+			oldest, oldestAt, hasOldest = key, partial.started, true
+		}
+	}
+	delete(s.partials, oldest)
+}
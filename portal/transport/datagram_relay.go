@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -12,13 +13,15 @@ import (
 	"github.com/quic-go/quic-go"
 	"github.com/rs/zerolog/log"
 
+	"github.com/gosuda/portal/v2/portal/metrics"
+	"github.com/gosuda/portal/v2/portal/policy"
 	"github.com/gosuda/portal/v2/types"
 )
 
 const (
-	DefaultMaxPacketSize       = 1350
 	defaultFlowIdleTimeout     = 30 * time.Second
 	defaultFlowCleanupInterval = 30 * time.Second
+	flowAnnounceInterval       = 10 * time.Second
 )
 
 var ErrPortExhausted = errors.New("no ports available")
@@ -26,21 +29,41 @@ var ErrPortExhausted = errors.New("no ports available")
 type flowReplyFunc func([]byte) error
 
 type flowState struct {
-	key      string
-	lastSeen time.Time
-	reply    flowReplyFunc
+	key       string
+	index     int
+	clientIP  string
+	startedAt time.Time
+	lastSeen  time.Time
+	announced time.Time
+	bytesIn   int64
+	bytesOut  int64
+	reply     flowReplyFunc
+}
+
+func (f *flowState) accessLogEntry(reason string) types.AccessLogEntry {
+	return types.AccessLogEntry{
+		Time:        f.startedAt.UTC(),
+		ClientIP:    f.clientIP,
+		Transport:   "udp",
+		BytesIn:     f.bytesIn,
+		BytesOut:    f.bytesOut,
+		DurationMS:  f.lastSeen.Sub(f.startedAt).Milliseconds(),
+		CloseReason: reason,
+	}
 }
 
 type portReservation struct {
-	port      int
+	name      string
 	expiresAt time.Time
 }
 
 // PortAllocator manages a pool of ports for dynamic per-lease allocation.
+// A released port stays reserved for its lease name for the grace period,
+// so a lease that re-registers gets the same ports back.
 type PortAllocator struct {
 	available []int
 	inUse     map[int]string
-	reserved  map[string]portReservation
+	reserved  map[int]portReservation
 	grace     time.Duration
 	mu        sync.Mutex
 }
@@ -50,7 +73,7 @@ func NewPortAllocator(min, max int, grace time.Duration) *PortAllocator {
 		return &PortAllocator{
 			available: nil,
 			inUse:     make(map[int]string),
-			reserved:  make(map[string]portReservation),
+			reserved:  make(map[int]portReservation),
 			grace:     grace,
 		}
 	}
@@ -61,21 +84,47 @@ func NewPortAllocator(min, max int, grace time.Duration) *PortAllocator {
 	return &PortAllocator{
 		available: available,
 		inUse:     make(map[int]string),
-		reserved:  make(map[string]portReservation),
+		reserved:  make(map[int]portReservation),
 		grace:     grace,
 	}
 }
 
 func (a *PortAllocator) Allocate(name string) (int, error) {
+	return a.AllocatePort(name, 0)
+}
+
+// AllocatePort allocates preferred to name when it is free or reserved for
+// name. Otherwise it falls back to a port reserved for name, then to the
+// lowest free port.
+func (a *PortAllocator) AllocatePort(name string, preferred int) (int, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	a.cleanupExpiredLocked(time.Now())
 
-	if res, ok := a.reserved[name]; ok {
-		delete(a.reserved, name)
-		a.inUse[res.port] = name
-		return res.port, nil
+	if preferred > 0 {
+		if res, ok := a.reserved[preferred]; ok && res.name == name {
+			delete(a.reserved, preferred)
+			a.inUse[preferred] = name
+			return preferred, nil
+		}
+		if i, ok := slices.BinarySearch(a.available, preferred); ok {
+			a.available = slices.Delete(a.available, i, i+1)
+			a.inUse[preferred] = name
+			return preferred, nil
+		}
+	}
+
+	reservedPort := 0
+	for port, res := range a.reserved {
+		if res.name == name && (reservedPort == 0 || port < reservedPort) {
+			reservedPort = port
+		}
+	}
+	if reservedPort > 0 {
+		delete(a.reserved, reservedPort)
+		a.inUse[reservedPort] = name
+		return reservedPort, nil
 	}
 
 	if len(a.available) == 0 {
@@ -98,23 +147,42 @@ func (a *PortAllocator) Release(port int) {
 	}
 	delete(a.inUse, port)
 
-	if prev, exists := a.reserved[name]; exists {
-		a.sortedInsertLocked(prev.port)
+	a.reserved[port] = portReservation{
+		name:      name,
+		expiresAt: time.Now().Add(a.grace),
 	}
 
-	a.reserved[name] = portReservation{
-		port:      port,
-		expiresAt: time.Now().Add(a.grace),
+	a.cleanupExpiredLocked(time.Now())
+}
+
+// Free returns port to the pool at once, without the sticky reservation
+// Release keeps for the lease.
+func (a *PortAllocator) Free(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.inUse[port]; !ok {
+		return
 	}
+	delete(a.inUse, port)
+	a.sortedInsertLocked(port)
+}
+
+// Usage reports how many ports are free, held by live leases, and held back
+// as sticky reservations for recently released leases.
+func (a *PortAllocator) Usage() (available, inUse, reserved int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
 	a.cleanupExpiredLocked(time.Now())
+	return len(a.available), len(a.inUse), len(a.reserved)
 }
 
 func (a *PortAllocator) cleanupExpiredLocked(now time.Time) {
-	for name, res := range a.reserved {
+	for port, res := range a.reserved {
 		if now.After(res.expiresAt) {
-			delete(a.reserved, name)
-			a.sortedInsertLocked(res.port)
+			delete(a.reserved, port)
+			a.sortedInsertLocked(port)
 		}
 	}
 }
@@ -128,24 +196,55 @@ func (a *PortAllocator) sortedInsertLocked(port int) {
 
 // Datagram owns the UDP and QUIC datagram runtime for one lease.
 type RelayDatagram struct {
-	identityKey string
-	port        int
-	session     *datagramSession
-	flowTable   map[uint32]*flowState
-	addrIndex   map[string]uint32
-	nextFlow    uint32
-
-	conn *net.UDPConn
+	identityKey    string
+	ports          []int
+	indexes        []int
+	session        *datagramSession
+	flowTable      map[uint32]*flowState
+	addrIndex      map[string]uint32
+	nextFlow       uint32
+	bps            *policy.BPSManager
+	limiter        *policy.BPSLimiter
+	releaseLimiter func()
+	quota          *policy.QuotaMeter
+	ipFilter       *policy.IPFilter
+	ingressACL     *policy.IngressACL
+	recordFlow     AccessRecorder
+
+	conns []*net.UDPConn
 
 	cancel    context.CancelFunc
 	closeOnce sync.Once
 	mu        sync.Mutex
 }
 
-func NewRelayDatagram(identityKey string, port int) *RelayDatagram {
+// RelayDatagramOptions configures the public UDP ports of one lease.
+// Indexes holds the RegisterResponse.Ports index announced for flows on
+// each port, defaulting to the port's position in ports. Version is the
+// datagram wire version negotiated with the SDK at registration. IPFilter,
+// IngressACL and Quota drop datagrams before they are relayed. RecordFlow
+// receives each flow once it expires or the relay closes.
+type RelayDatagramOptions struct {
+	BPS        *policy.BPSManager
+	Indexes    []int
+	Version    int
+	IPFilter   *policy.IPFilter
+	IngressACL *policy.IngressACL
+	Quota      *policy.QuotaMeter
+	RecordFlow AccessRecorder
+}
+
+// NewRelayDatagram relays UDP for one lease on each of ports.
+func NewRelayDatagram(identityKey string, ports []int, opts RelayDatagramOptions) *RelayDatagram {
 	d := &RelayDatagram{
 		identityKey: identityKey,
-		port:        port,
+		ports:       ports,
+		indexes:     opts.Indexes,
+		bps:         opts.BPS,
+		quota:       opts.Quota,
+		ipFilter:    opts.IPFilter,
+		ingressACL:  opts.IngressACL,
+		recordFlow:  opts.RecordFlow,
 		session: newDatagramSession(256, true, func(err error) {
 			log.Warn().
 				Err(err).
@@ -157,31 +256,55 @@ func NewRelayDatagram(identityKey string, port int) *RelayDatagram {
 		addrIndex: make(map[string]uint32),
 		nextFlow:  1,
 	}
+	if opts.Version != 0 {
+		d.session.SetVersion(opts.Version)
+	}
+	d.session.onDrop = func(reason string) {
+		metrics.UDPDrops.With(identityKey, "out", reason).Inc()
+	}
 	go d.runDispatchLoop()
 	go d.runCleanupLoop()
 	return d
 }
 
+func (d *RelayDatagram) Version() int {
+	if d == nil {
+		return types.DatagramVersion1
+	}
+	return d.session.Version()
+}
+
 func (d *RelayDatagram) Start(ctx context.Context) error {
-	if d == nil || d.port <= 0 {
+	if d == nil || len(d.ports) == 0 {
 		return nil
 	}
 
-	addr := &net.UDPAddr{Port: d.port}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return fmt.Errorf("listen udp :%d: %w", d.port, err)
+	conns := make([]*net.UDPConn, 0, len(d.ports))
+	for _, port := range d.ports {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			for _, opened := range conns {
+				_ = opened.Close()
+			}
+			return fmt.Errorf("listen udp :%d: %w", port, err)
+		}
+		conns = append(conns, conn)
 	}
-	d.conn = conn
+	d.conns = conns
+	// Hold the limiter for the life of the relay so an eviction that forgets
+	// it cannot leave the UDP ports charging a fresh, orphaned bucket.
+	d.limiter, d.releaseLimiter = d.bps.AcquireLimiter(d.identityKey)
 
 	relayCtx, cancel := context.WithCancel(ctx)
 	d.cancel = cancel
-	go d.readLoop(relayCtx)
+	for i, conn := range conns {
+		go d.readLoop(relayCtx, conn, d.portIndex(i))
+	}
 
 	log.Info().
 		Str("component", "udp-relay").
 		Str("identity_key", d.identityKey).
-		Int("port", d.port).
+		Ints("ports", d.ports).
 		Msg("udp relay started")
 
 	return nil
@@ -197,13 +320,29 @@ func (d *RelayDatagram) Close() {
 			d.cancel()
 		}
 		d.session.Stop("lease stopped")
-		if d.conn != nil {
-			_ = d.conn.Close()
+		for _, conn := range d.conns {
+			_ = conn.Close()
 		}
+		if d.releaseLimiter != nil {
+			d.releaseLimiter()
+		}
+
+		d.mu.Lock()
+		flows := make([]*flowState, 0, len(d.flowTable))
+		for flowID, flow := range d.flowTable {
+			if flow != nil {
+				flows = append(flows, flow)
+			}
+			delete(d.flowTable, flowID)
+		}
+		clear(d.addrIndex)
+		d.mu.Unlock()
+		d.recordFlows(flows, CloseReasonShutdown)
+
 		log.Info().
 			Str("component", "udp-relay").
 			Str("identity_key", d.identityKey).
-			Int("port", d.port).
+			Ints("ports", d.ports).
 			Msg("udp relay stopped")
 	})
 }
@@ -228,7 +367,9 @@ func (d *RelayDatagram) SendDatagram(flowID uint32, payload []byte) error {
 	return d.session.Send(flowID, payload)
 }
 
-func (d *RelayDatagram) TouchFlow(key string, reply func([]byte) error) uint32 {
+// TouchFlow returns the flow for key, creating it on first use for the
+// public port at index, and charges size inbound bytes from clientIP to it.
+func (d *RelayDatagram) TouchFlow(key string, index int, clientIP string, size int, reply func([]byte) error) uint32 {
 	now := time.Now()
 
 	d.mu.Lock()
@@ -237,6 +378,7 @@ func (d *RelayDatagram) TouchFlow(key string, reply func([]byte) error) uint32 {
 	if id, ok := d.addrIndex[key]; ok {
 		if flow, exists := d.flowTable[id]; exists && flow != nil {
 			flow.lastSeen = now
+			flow.bytesIn += int64(size)
 			if reply != nil {
 				flow.reply = reply
 			}
@@ -247,20 +389,72 @@ func (d *RelayDatagram) TouchFlow(key string, reply func([]byte) error) uint32 {
 
 	id := d.nextFlow
 	d.nextFlow++
+	metrics.UDPFlows.With(d.identityKey).Inc()
 	d.flowTable[id] = &flowState{
-		key:      key,
-		lastSeen: now,
-		reply:    reply,
+		key:       key,
+		index:     index,
+		clientIP:  clientIP,
+		startedAt: now,
+		lastSeen:  now,
+		bytesIn:   int64(size),
+		reply:     reply,
 	}
 	d.addrIndex[key] = id
 	return id
 }
 
+// announceFlow sends the client address of flowID to the SDK when the flow
+// is new or its last announcement is older than flowAnnounceInterval.
+func (d *RelayDatagram) announceFlow(flowID uint32, addr *net.UDPAddr) {
+	now := time.Now()
+
+	d.mu.Lock()
+	flow, ok := d.flowTable[flowID]
+	if !ok || flow == nil || now.Sub(flow.announced) < flowAnnounceInterval {
+		d.mu.Unlock()
+		return
+	}
+	flow.announced = now
+	index := flow.index
+	d.mu.Unlock()
+
+	if err := d.session.SendFlow(flowID, addr, index); err != nil {
+		d.mu.Lock()
+		flow.announced = time.Time{}
+		d.mu.Unlock()
+	}
+}
+
+// UDPPort returns the first public port of the lease.
 func (d *RelayDatagram) UDPPort() int {
+	if d == nil || len(d.ports) == 0 {
+		return 0
+	}
+	return d.ports[0]
+}
+
+func (d *RelayDatagram) UDPPorts() []int {
+	if d == nil {
+		return nil
+	}
+	return append([]int(nil), d.ports...)
+}
+
+func (d *RelayDatagram) portIndex(i int) int {
+	if i < len(d.indexes) {
+		return d.indexes[i]
+	}
+	return i
+}
+
+func (d *RelayDatagram) FlowCount() int {
 	if d == nil {
 		return 0
 	}
-	return d.port
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.flowTable)
 }
 
 func (d *RelayDatagram) runDispatchLoop() {
@@ -275,10 +469,20 @@ func (d *RelayDatagram) runDispatchLoop() {
 }
 
 func (d *RelayDatagram) dispatch(frame types.DatagramFrame) {
+	if !d.limiter.AllowN(len(frame.Payload)) {
+		metrics.UDPDrops.With(d.identityKey, "out", "rate_limited").Inc()
+		return
+	}
+	if !d.quota.Charge(len(frame.Payload)) {
+		metrics.UDPDrops.With(d.identityKey, "out", CloseReasonQuota).Inc()
+		return
+	}
+
 	d.mu.Lock()
 	flow, ok := d.flowTable[frame.FlowID]
 	if !ok || flow == nil || flow.reply == nil {
 		d.mu.Unlock()
+		metrics.UDPDrops.With(d.identityKey, "out", "unknown_flow").Inc()
 		return
 	}
 
@@ -293,8 +497,14 @@ func (d *RelayDatagram) dispatch(frame types.DatagramFrame) {
 			Str("identity_key", d.identityKey).
 			Uint32("flow_id", frame.FlowID).
 			Msg("flow writeback failed")
-		d.forgetFlow(frame.FlowID)
+		metrics.UDPDrops.With(d.identityKey, "out", "writeback_failed").Inc()
+		d.forgetFlow(frame.FlowID, CloseReasonClientError)
+		return
 	}
+
+	d.mu.Lock()
+	flow.bytesOut += int64(len(frame.Payload))
+	d.mu.Unlock()
 }
 
 func (d *RelayDatagram) runCleanupLoop() {
@@ -313,34 +523,50 @@ func (d *RelayDatagram) runCleanupLoop() {
 
 func (d *RelayDatagram) expireIdleFlows(now time.Time) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
+	var expired []*flowState
 	for flowID, flow := range d.flowTable {
 		if flow == nil || now.Sub(flow.lastSeen) > defaultFlowIdleTimeout {
 			if flow != nil {
 				delete(d.addrIndex, flow.key)
+				expired = append(expired, flow)
 			}
 			delete(d.flowTable, flowID)
 		}
 	}
+	d.mu.Unlock()
+
+	d.recordFlows(expired, CloseReasonIdle)
 }
 
-func (d *RelayDatagram) forgetFlow(flowID uint32) {
+func (d *RelayDatagram) forgetFlow(flowID uint32, reason string) {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
 	flow, ok := d.flowTable[flowID]
 	if !ok {
+		d.mu.Unlock()
 		return
 	}
 	if flow != nil {
 		delete(d.addrIndex, flow.key)
 	}
 	delete(d.flowTable, flowID)
+	d.mu.Unlock()
+
+	if flow != nil {
+		d.recordFlows([]*flowState{flow}, reason)
+	}
 }
 
-func (d *RelayDatagram) readLoop(ctx context.Context) {
-	buf := make([]byte, DefaultMaxPacketSize)
+func (d *RelayDatagram) recordFlows(flows []*flowState, reason string) {
+	if d.recordFlow == nil {
+		return
+	}
+	for _, flow := range flows {
+		d.recordFlow(flow.accessLogEntry(reason))
+	}
+}
+
+func (d *RelayDatagram) readLoop(ctx context.Context, conn *net.UDPConn, index int) {
+	buf := make([]byte, types.MaxDatagramPayload)
 	for {
 		select {
 		case <-ctx.Done():
@@ -348,8 +574,8 @@ func (d *RelayDatagram) readLoop(ctx context.Context) {
 		default:
 		}
 
-		_ = d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		n, clientAddr, err := d.conn.ReadFromUDP(buf)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, clientAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			if ctx.Err() != nil {
 				return
@@ -365,15 +591,37 @@ func (d *RelayDatagram) readLoop(ctx context.Context) {
 				Msg("readLoop exiting: unexpected read error")
 			return
 		}
+		clientIP := clientAddr.IP.String()
+		if reason := d.ipFilter.IngressBlockReason(clientIP); reason != "" {
+			metrics.IngressBlocked.With("udp", reason).Inc()
+			continue
+		}
+		if !d.ingressACL.Allows(clientIP) {
+			metrics.IngressBlocked.With("udp", policy.IngressBlockLease).Inc()
+			continue
+		}
+		if !d.limiter.AllowN(n) {
+			metrics.UDPDrops.With(d.identityKey, "in", "rate_limited").Inc()
+			continue
+		}
+		if !d.quota.Charge(n) {
+			metrics.UDPDrops.With(d.identityKey, "in", CloseReasonQuota).Inc()
+			continue
+		}
 
-		flowID := d.TouchFlow("udp:"+clientAddr.String(), func(payload []byte) error {
-			_, err := d.conn.WriteToUDP(payload, clientAddr)
+		flowID := d.TouchFlow(fmt.Sprintf("udp:%d:%s", index, clientAddr), index, clientIP, n, func(payload []byte) error {
+			_, err := conn.WriteToUDP(payload, clientAddr)
 			return err
 		})
+		d.announceFlow(flowID, clientAddr)
 		payload := make([]byte, n)
 		copy(payload, buf[:n])
 
 		if err := d.SendDatagram(flowID, payload); err != nil {
+			reason := "tunnel_send_failed"
+			if errors.Is(err, types.ErrDatagramTooLarge) {
+				reason = "too_large"
+			}
 			log.Warn().
 				Str("component", "udp-relay").
 				Str("identity_key", d.identityKey).
@@ -381,6 +629,7 @@ func (d *RelayDatagram) readLoop(ctx context.Context) {
 				Uint32("flow_id", flowID).
 				Int("bytes", n).
 				Msg("send datagram to tunnel failed, dropping packet")
+			metrics.UDPDrops.With(d.identityKey, "in", reason).Inc()
 			continue
 		}
 	}
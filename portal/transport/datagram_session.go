@@ -3,8 +3,10 @@ package transport
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
 
@@ -18,11 +20,25 @@ type datagramSession struct {
 	incoming       chan types.DatagramFrame
 	dropIncoming   bool
 	onReceiveError func(error)
+	onDrop         func(reason string)
 	done           chan struct{}
 
-	mu     sync.Mutex
-	conn   *quic.Conn
-	closed bool
+	mu       sync.Mutex
+	conn     *quic.Conn
+	closed   bool
+	version  int
+	sources  map[uint32]flowSource
+	sweptAt  time.Time
+	packetID uint16
+	partials map[fragmentKey]*partialDatagram
+}
+
+// flowSource is the client address and port index the relay last announced
+// for a flow.
+type flowSource struct {
+	addr  *net.UDPAddr
+	index int
+	seen  time.Time
 }
 
 func newDatagramSession(bufferSize int, dropIncoming bool, onReceiveError func(error)) *datagramSession {
@@ -35,9 +51,25 @@ func newDatagramSession(bufferSize int, dropIncoming bool, onReceiveError func(e
 		dropIncoming:   dropIncoming,
 		onReceiveError: onReceiveError,
 		done:           make(chan struct{}),
+		version:        types.DatagramVersion1,
+		sources:        make(map[uint32]flowSource),
+		partials:       make(map[fragmentKey]*partialDatagram),
 	}
 }
 
+// SetVersion selects the datagram wire version negotiated for the lease.
+func (s *datagramSession) SetVersion(version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+func (s *datagramSession) Version() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
 // Bind installs a new active QUIC connection and starts the receive loop.
 // Any previously active connection is replaced and closed.
 func (s *datagramSession) Bind(conn *quic.Conn) (<-chan struct{}, error) {
@@ -78,6 +110,7 @@ func (s *datagramSession) Send(flowID uint32, payload []byte) error {
 	s.mu.Lock()
 	conn := s.conn
 	closed := s.closed
+	version := s.version
 	s.mu.Unlock()
 
 	if closed {
@@ -86,7 +119,37 @@ func (s *datagramSession) Send(flowID uint32, payload []byte) error {
 	if conn == nil {
 		return errNoConnection
 	}
-	return conn.SendDatagram(types.EncodeDatagram(flowID, payload))
+	err := conn.SendDatagram(types.EncodeDatagramData(version, flowID, payload))
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	if version < types.DatagramVersion2 {
+		return fmt.Errorf("%w: %d bytes", types.ErrDatagramTooLarge, len(payload))
+	}
+	return s.sendFragments(conn, flowID, payload, int(tooLarge.MaxDatagramPayloadSize))
+}
+
+// SendFlow announces addr as the client of flowID on the public port at
+// portIndex. It is a no-op below version 2, where the wire format has no
+// room for the address.
+func (s *datagramSession) SendFlow(flowID uint32, addr *net.UDPAddr, portIndex int) error {
+	s.mu.Lock()
+	conn := s.conn
+	closed := s.closed
+	version := s.version
+	s.mu.Unlock()
+
+	if closed {
+		return net.ErrClosed
+	}
+	if conn == nil {
+		return errNoConnection
+	}
+	if version < types.DatagramVersion2 {
+		return nil
+	}
+	return conn.SendDatagram(types.EncodeDatagramFlow(flowID, addr, portIndex))
 }
 
 // Clear closes the active connection but keeps the session reusable.
@@ -94,6 +157,8 @@ func (s *datagramSession) Clear(reason string) {
 	s.mu.Lock()
 	conn := s.conn
 	s.conn = nil
+	clear(s.sources)
+	clear(s.partials)
 	s.mu.Unlock()
 
 	if conn != nil {
@@ -140,15 +205,29 @@ func (s *datagramSession) receiveLoop(conn *quic.Conn, recvDone chan struct{}) {
 			return
 		}
 
-		frame, err := types.DecodeDatagram(data)
+		frame, kind, err := types.DecodeDatagramFrame(s.Version(), data)
 		if err != nil {
 			continue
 		}
+		switch kind {
+		case types.DatagramKindFlow:
+			s.rememberSource(frame)
+			continue
+		case types.DatagramKindFragment:
+			payload, ok := s.reassemble(frame.FlowID, frame.Payload)
+			if !ok {
+				continue
+			}
+			frame.Payload = payload
+		}
+		source := s.source(frame.FlowID)
+		frame.Source, frame.PortIndex = source.addr, source.index
 
 		if s.dropIncoming {
 			select {
 			case s.incoming <- frame:
 			default:
+				s.drop("queue_full")
 			}
 			continue
 		}
@@ -160,3 +239,32 @@ func (s *datagramSession) receiveLoop(conn *quic.Conn, recvDone chan struct{}) {
 		}
 	}
 }
+
+func (s *datagramSession) rememberSource(frame types.DatagramFrame) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[frame.FlowID] = flowSource{addr: frame.Source, index: frame.PortIndex, seen: now}
+	if now.Sub(s.sweptAt) < defaultFlowCleanupInterval {
+		return
+	}
+	s.sweptAt = now
+	for id, source := range s.sources {
+		if now.Sub(source.seen) > defaultFlowIdleTimeout {
+			delete(s.sources, id)
+		}
+	}
+}
+
+func (s *datagramSession) source(flowID uint32) flowSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sources[flowID]
+}
+
+func (s *datagramSession) drop(reason string) {
+	if s.onDrop != nil {
+		s.onDrop(reason)
+	}
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+// SetProxyHeaders enables writing a PROXY v2 header after every activation
+// marker. It is set once at lease registration when the SDK opted in.
+func (b *RelayStream) SetProxyHeaders(enabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.proxyHeaders = enabled
+}
+
+func (b *RelayStream) ProxyHeaders() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.proxyHeaders
+}
+
+// WriteProxyHeader sends header on a freshly claimed session when the lease
+// negotiated PROXY headers, and is a no-op otherwise.
+func (b *RelayStream) WriteProxyHeader(session net.Conn, header types.ProxyHeader) error {
+	if !b.ProxyHeaders() {
+		return nil
+	}
+
+	encoded, err := types.EncodeProxyHeaderV2(header)
+	if err != nil {
+		return err
+	}
+	_ = session.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
+	_, err = session.Write(encoded)
+	_ = session.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// NewProxyHeader describes an accepted client connection for the tenant,
+// tagging it with a fresh connection ID.
+func NewProxyHeader(conn net.Conn, serverName string) types.ProxyHeader {
+	return types.ProxyHeader{
+		Source:       conn.RemoteAddr(),
+		Destination:  conn.LocalAddr(),
+		ServerName:   serverName,
+		ConnectionID: utils.RandomID("conn_"),
+	}
+}
+
+// proxiedConn reports the client address recovered from a PROXY header as
+// its RemoteAddr.
+type proxiedConn struct {
+	net.Conn
+	header types.ProxyHeader
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) ProxyHeader() (types.ProxyHeader, bool) {
+	return c.header, true
+}
+
+func (c *proxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// portConn remembers which public port of the lease a raw session was
+// claimed for.
+type portConn struct {
+	net.Conn
+	index int
+}
+
+func (c *portConn) PortIndex() int {
+	return c.index
+}
+
+func (c *portConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *portConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// PortIndexOf returns the RegisterResponse.Ports index of the public port
+// conn arrived on. It reports false for sessions claimed without a port
+// marker, such as TLS sessions and single-port leases.
+func PortIndexOf(conn net.Conn) (int, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ PortIndex() int }:
+			return c.PortIndex(), true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// ProxyHeaderOf returns the PROXY header received on conn, looking through
+// *tls.Conn and other wrappers that expose NetConn.
+func ProxyHeaderOf(conn net.Conn) (types.ProxyHeader, bool) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface {
+			ProxyHeader() (types.ProxyHeader, bool)
+		}:
+			return c.ProxyHeader()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return types.ProxyHeader{}, false
+		}
+	}
+	return types.ProxyHeader{}, false
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// ProxyTrustFunc reports whether a peer is a load balancer whose
+// connections must start with a PROXY v1/v2 header.
+type ProxyTrustFunc func(remote net.Addr) bool
+
+// proxyProtocolListener accepts PROXY headers from trusted peers. Headers are
+// parsed lazily on the first Read or address lookup so a slow proxy cannot
+// stall the accept loop.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted ProxyTrustFunc
+}
+
+// NewProxyProtocolListener wraps listener so connections from trusted peers
+// report the client recovered from their PROXY header as RemoteAddr.
+// Connections from untrusted peers pass through untouched, and a trusted
+// peer that omits or corrupts the header fails its first Read.
+func NewProxyProtocolListener(listener net.Listener, trusted ProxyTrustFunc) net.Listener {
+	if listener == nil || trusted == nil {
+		return listener
+	}
+	return &proxyProtocolListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	readDeadline time.Time
+	header       types.ProxyHeader
+	err          error
+	once         sync.Once
+	mu           sync.Mutex
+}
+
+// proxyHeaderError waits for conn's PROXY header, if it is expected, and
+// reports whether it was valid.
+func proxyHeaderError(conn net.Conn) error {
+	if c, ok := conn.(*proxyProtocolConn); ok {
+		c.parse()
+		return c.err
+	}
+	return nil
+}
+
+func (c *proxyProtocolConn) parse() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(defaultProxyHeaderTimeout))
+		c.header, c.err = types.ReadProxyHeader(c.Conn)
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		_ = c.Conn.SetReadDeadline(deadline)
+
+		if c.err != nil {
+			log.Debug().
+				Str("component", "proxy-protocol").
+				Str("peer_addr", c.Conn.RemoteAddr().String()).
+				Err(c.err).
+				Msg("rejecting connection without valid proxy header")
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.parse()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.parse()
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.parse()
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) ProxyHeader() (types.ProxyHeader, bool) {
+	c.parse()
+	return c.header, c.err == nil
+}
+
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
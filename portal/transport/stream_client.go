@@ -8,22 +8,60 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go"
+
 	"github.com/gosuda/portal/v2/types"
 )
 
+// MultiplexedConn marks a reverse connection on which the relay agreed to
+// stream multiplexing. The open function passed to RunLoop returns it so the
+// stream switches to mux framing for that connection.
+type MultiplexedConn struct {
+	net.Conn
+}
+
+// Demand signals adjust the idle pool at most once per
+// demandAdjustInterval; a claim wait average of demandGrowWait or more
+// doubles the target.
+const (
+	demandAdjustInterval = 5 * time.Second
+	demandGrowWait       = 50 * time.Millisecond
+)
+
+var errUnexpectedMarker = errors.New("unexpected reverse marker")
+
 type ClientStream struct {
 	accepted         chan net.Conn
 	activeSessions   int
 	handshakeTimeout time.Duration
+	proxyHeaders     atomic.Bool
+	multiplex        bool
+	muxBusy          bool
+	muxLegacy        bool
+	idle             int
+	readyTarget      int
+	readyMin         int
+	readyMax         int
+	readyLimit       int
+	demandAt         time.Time
+	changed          chan struct{}
 	mu               sync.Mutex
 }
 
+// NewClientStream keeps readyTarget idle reverse sessions open. The target
+// stays fixed unless SetReadyBounds lets relay demand signals move it.
 func NewClientStream(readyTarget int, handshakeTimeout time.Duration) *ClientStream {
+	readyTarget = max(readyTarget, 1)
 	return &ClientStream{
-		accepted:         make(chan net.Conn, max(readyTarget*2, 1)),
+		accepted:         make(chan net.Conn, readyTarget*2),
 		handshakeTimeout: handshakeTimeout,
+		readyTarget:      readyTarget,
+		readyMin:         readyTarget,
+		readyMax:         readyTarget,
+		changed:          make(chan struct{}),
 	}
 }
 
@@ -47,11 +85,49 @@ func (s *ClientStream) RunLoop(
 	open func(context.Context) (net.Conn, error),
 	currentTLSConfig func() *tls.Config,
 	retry func(context.Context, string, error, int) bool,
+) {
+	s.runLoop(ctx, "reverse session connect", retry, func(ctx context.Context) (bool, error) {
+		owned, ok := s.acquireMux(ctx)
+		if !ok {
+			return false, ctx.Err()
+		}
+		if owned {
+			defer s.releaseMux()
+		}
+		return s.runSession(ctx, open, currentTLSConfig)
+	})
+}
+
+// RunQUICLoop keeps one QUIC stream transport connection open and serves
+// every stream the relay opens on it. open returns the connection together
+// with the control stream on which the relay accepted stream mode.
+func (s *ClientStream) RunQUICLoop(
+	ctx context.Context,
+	open func(context.Context) (*quic.Conn, *quic.Stream, error),
+	currentTLSConfig func() *tls.Config,
+	retry func(context.Context, string, error, int) bool,
+) {
+	s.runLoop(ctx, "quic stream connect", retry, func(ctx context.Context) (bool, error) {
+		conn, control, err := open(ctx)
+		if err != nil {
+			return false, err
+		}
+		s.sessionOpened()
+		defer s.sessionClosed()
+		return s.runCarrier(ctx, newQUICAcceptor(conn, control), currentTLSConfig)
+	})
+}
+
+func (s *ClientStream) runLoop(
+	ctx context.Context,
+	operation string,
+	retry func(context.Context, string, error, int) bool,
+	run func(context.Context) (bool, error),
 ) {
 	var retries int
 
 	for {
-		claimed, err := s.runSession(ctx, open, currentTLSConfig)
+		claimed, err := run(ctx)
 		switch {
 		case err == nil:
 			retries = 0
@@ -61,13 +137,76 @@ func (s *ClientStream) RunLoop(
 			retries = 0
 		default:
 			retries++
-			if retry == nil || !retry(ctx, "reverse session connect", err, retries) {
+			if retry == nil || !retry(ctx, operation, err, retries) {
 				return
 			}
 		}
 	}
 }
 
+// SetProxyHeaders tells the stream whether the relay follows each activation
+// marker with a PROXY v2 header, as negotiated at registration.
+func (s *ClientStream) SetProxyHeaders(enabled bool) {
+	if s == nil {
+		return
+	}
+	s.proxyHeaders.Store(enabled)
+}
+
+// SetMultiplex tells the stream that reverse connections request
+// multiplexing. Concurrent RunLoops then keep a single connection open and
+// fall back to one session per connection if the relay declines.
+func (s *ClientStream) SetMultiplex(enabled bool) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.multiplex = enabled
+	s.mu.Unlock()
+}
+
+// SetReadyBounds lets demand signals from the relay move the idle session
+// target between minReady and maxReady.
+func (s *ClientStream) SetReadyBounds(minReady, maxReady int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.readyMin = max(minReady, 1)
+	s.readyMax = max(maxReady, s.readyMin)
+	s.readyTarget = s.clampTargetLocked(s.readyTarget)
+	s.broadcastLocked()
+	s.mu.Unlock()
+}
+
+// SetReadyLimit caps the idle session target at the per-lease limit the
+// relay advertised, so the SDK does not dial sessions it would reject.
+func (s *ClientStream) SetReadyLimit(limit int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.readyLimit = max(limit, 0)
+	s.readyTarget = s.clampTargetLocked(s.readyTarget)
+	s.broadcastLocked()
+	s.mu.Unlock()
+}
+
+// ReadyTarget returns how many idle reverse sessions the stream currently
+// keeps open.
+func (s *ClientStream) ReadyTarget() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyTarget
+}
+
 func (s *ClientStream) ActiveSessions() int {
 	if s == nil {
 		return 0
@@ -99,6 +238,16 @@ func (s *ClientStream) runSession(
 	open func(context.Context) (net.Conn, error),
 	currentTLSConfig func() *tls.Config,
 ) (bool, error) {
+	if !s.acquireReady(ctx) {
+		return false, ctx.Err()
+	}
+	held := true
+	defer func() {
+		if held {
+			s.releaseReady()
+		}
+	}()
+
 	conn, err := open(ctx)
 	if err != nil {
 		return false, err
@@ -106,6 +255,11 @@ func (s *ClientStream) runSession(
 	s.sessionOpened()
 	defer s.sessionClosed()
 
+	if mux, ok := conn.(MultiplexedConn); ok {
+		return s.runCarrier(ctx, newMuxSession(mux.Conn, false, 2*s.handshakeTimeout), currentTLSConfig)
+	}
+	s.declineMux()
+
 	var marker [1]byte
 	for {
 		_ = conn.SetReadDeadline(time.Now().Add(2 * s.handshakeTimeout))
@@ -118,25 +272,135 @@ func (s *ClientStream) runSession(
 		switch marker[0] {
 		case types.MarkerKeepalive:
 			continue
-		case types.MarkerTLSStart:
-			if err := s.activate(ctx, conn, currentTLSConfig); err != nil {
+		case types.MarkerDemand:
+			demand, err := types.ReadReadyDemand(conn)
+			if err != nil {
+				_ = conn.Close()
+				return false, err
+			}
+			if s.applyDemand(demand) {
+				held = false
+				_ = conn.Close()
+				return false, nil
+			}
+			continue
+		}
+
+		if marker[0] == types.MarkerPortStart {
+			indexed, err := s.readPortIndex(conn)
+			if err != nil {
 				_ = conn.Close()
 				return true, err
 			}
-			return true, nil
-		case types.MarkerRawStart:
-			if err := s.activateRaw(ctx, conn); err != nil {
+			conn = indexed
+		}
+		if s.proxyHeaders.Load() {
+			proxied, err := s.readProxyHeader(conn)
+			if err != nil {
 				_ = conn.Close()
 				return true, err
 			}
-			return true, nil
-		default:
+			conn = proxied
+		}
+		if err := s.activateMarker(ctx, conn, marker[0], currentTLSConfig); err != nil {
 			_ = conn.Close()
-			return false, fmt.Errorf("unexpected reverse marker: 0x%02x", marker[0])
+			return !errors.Is(err, errUnexpectedMarker), err
+		}
+		return true, nil
+	}
+}
+
+// streamAcceptor is the SDK side of a streamCarrier: it yields the streams
+// the relay opens, and GoAway asks the relay to open no more while the
+// streams in flight finish.
+type streamAcceptor interface {
+	AcceptStream(ctx context.Context) (net.Conn, error)
+	GoAway()
+}
+
+// runCarrier accepts streams on a carrier connection until it fails. Each
+// stream is activated like a single-session connection. When ctx ends the
+// carrier stops taking new streams but stays open for the ones in flight.
+func (s *ClientStream) runCarrier(ctx context.Context, carrier streamAcceptor, currentTLSConfig func() *tls.Config) (bool, error) {
+	defer carrier.GoAway()
+
+	claimed := false
+	for {
+		stream, err := carrier.AcceptStream(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return claimed, ctxErr
+			}
+			return claimed, err
+		}
+		claimed = true
+		go s.serveCarrierStream(ctx, stream, currentTLSConfig)
+	}
+}
+
+func (s *ClientStream) serveCarrierStream(ctx context.Context, stream net.Conn, currentTLSConfig func() *tls.Config) {
+	var marker [1]byte
+	_ = stream.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	if _, err := io.ReadFull(stream, marker[:]); err != nil {
+		_ = stream.Close()
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	conn := stream
+	if marker[0] == types.MarkerPortStart {
+		indexed, err := s.readPortIndex(conn)
+		if err != nil {
+			_ = stream.Close()
+			return
+		}
+		conn = indexed
+	}
+	if s.proxyHeaders.Load() {
+		proxied, err := s.readProxyHeader(conn)
+		if err != nil {
+			_ = stream.Close()
+			return
 		}
+		conn = proxied
+	}
+	if err := s.activateMarker(ctx, conn, marker[0], currentTLSConfig); err != nil {
+		_ = conn.Close()
 	}
 }
 
+func (s *ClientStream) activateMarker(ctx context.Context, conn net.Conn, marker byte, currentTLSConfig func() *tls.Config) error {
+	switch marker {
+	case types.MarkerTLSStart:
+		return s.activate(ctx, conn, currentTLSConfig)
+	case types.MarkerRawStart, types.MarkerPortStart:
+		return s.activateRaw(ctx, conn)
+	default:
+		return fmt.Errorf("%w: 0x%02x", errUnexpectedMarker, marker)
+	}
+}
+
+func (s *ClientStream) readPortIndex(conn net.Conn) (net.Conn, error) {
+	var index [2]byte
+	_ = conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	_, err := io.ReadFull(conn, index[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("read port index: %w", err)
+	}
+	return &portConn{Conn: conn, index: int(index[0])<<8 | int(index[1])}, nil
+}
+
+func (s *ClientStream) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	header, err := types.ReadProxyHeader(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	return &proxiedConn{Conn: conn, header: header}, nil
+}
+
 func (s *ClientStream) activate(ctx context.Context, conn net.Conn, currentTLSConfig func() *tls.Config) error {
 	var tlsCfg *tls.Config
 	if currentTLSConfig != nil {
@@ -172,6 +436,127 @@ func (s *ClientStream) activateRaw(ctx context.Context, conn net.Conn) error {
 	}
 }
 
+// acquireMux serialises RunLoops while multiplexing is requested so only
+// one of them holds the shared connection; the others wait until it ends or
+// the relay turns out not to support multiplexing. owned reports whether the
+// caller must call releaseMux.
+func (s *ClientStream) acquireMux(ctx context.Context) (owned bool, ok bool) {
+	for {
+		s.mu.Lock()
+		if !s.multiplex || s.muxLegacy {
+			s.mu.Unlock()
+			return false, true
+		}
+		if !s.muxBusy {
+			s.muxBusy = true
+			s.mu.Unlock()
+			return true, true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, false
+		case <-changed:
+		}
+	}
+}
+
+func (s *ClientStream) releaseMux() {
+	s.mu.Lock()
+	s.muxBusy = false
+	s.broadcastLocked()
+	s.mu.Unlock()
+}
+
+// declineMux records that the relay answered without multiplexing, which
+// releases the RunLoops waiting in acquireMux to dial their own sessions.
+func (s *ClientStream) declineMux() {
+	s.mu.Lock()
+	if s.multiplex && !s.muxLegacy {
+		s.muxLegacy = true
+		s.broadcastLocked()
+	}
+	s.mu.Unlock()
+}
+
+// acquireReady blocks until fewer sessions are idle than the target and
+// reserves a slot for one more.
+func (s *ClientStream) acquireReady(ctx context.Context) bool {
+	for {
+		s.mu.Lock()
+		if s.idle < s.readyTarget {
+			s.idle++
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+func (s *ClientStream) releaseReady() {
+	s.mu.Lock()
+	s.idle--
+	s.broadcastLocked()
+	s.mu.Unlock()
+}
+
+// applyDemand moves the idle target from a relay demand signal: it shrinks
+// by one after a minute without claims and doubles while claims wait. It
+// reports whether the calling idle session is surplus, in which case its
+// slot has already been released and it should close.
+func (s *ClientStream) applyDemand(demand types.ReadyDemand) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.demandAt) >= demandAdjustInterval {
+		s.demandAt = now
+		target := s.readyTarget
+		switch {
+		case demand.ClaimsPerMinute == 0:
+			target--
+		case demand.Waiting > 0 || time.Duration(demand.ClaimWaitMS)*time.Millisecond >= demandGrowWait:
+			target *= 2
+		}
+		if demand.ReadyLimit > 0 {
+			s.readyLimit = demand.ReadyLimit
+		}
+		if target = s.clampTargetLocked(target); target != s.readyTarget {
+			s.readyTarget = target
+			s.broadcastLocked()
+		}
+	}
+
+	if s.idle > s.readyTarget {
+		s.idle--
+		s.broadcastLocked()
+		return true
+	}
+	return false
+}
+
+func (s *ClientStream) clampTargetLocked(target int) int {
+	upper := s.readyMax
+	if s.readyLimit > 0 {
+		upper = min(upper, s.readyLimit)
+	}
+	return max(min(target, upper), min(s.readyMin, upper))
+}
+
+func (s *ClientStream) broadcastLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
 func (s *ClientStream) sessionOpened() {
 	if s == nil {
 		return
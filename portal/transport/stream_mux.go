@@ -0,0 +1,568 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+var (
+	errMuxFull        = errors.New("mux session has no free streams")
+	errMuxGoingAway   = errors.New("mux session is going away")
+	errMuxStreamReset = errors.New("mux stream reset by peer")
+)
+
+// muxSession runs the framed protocol described in types/mux.go over one
+// reverse connection. The relay side opens streams and the SDK side accepts
+// them; everything else is symmetric.
+type muxSession struct {
+	conn        net.Conn
+	opener      bool
+	readTimeout time.Duration
+	streams     map[uint32]*muxStream
+	nextID      uint32
+	accepted    chan *muxStream
+	done        chan struct{}
+	goingAway   bool
+	peerAway    bool
+	closeOnce   sync.Once
+	writeMu     sync.Mutex
+	mu          sync.Mutex
+}
+
+// newMuxSession starts reading frames from conn. A positive readTimeout
+// closes the session when the peer sends nothing, not even pings, for that
+// long.
+func newMuxSession(conn net.Conn, opener bool, readTimeout time.Duration) *muxSession {
+	m := &muxSession{
+		conn:        conn,
+		opener:      opener,
+		readTimeout: readTimeout,
+		streams:     make(map[uint32]*muxStream),
+		nextID:      1,
+		accepted:    make(chan *muxStream, types.MuxMaxStreams),
+		done:        make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *muxSession) Kind() string {
+	return "mux"
+}
+
+func (m *muxSession) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+
+func (m *muxSession) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *muxSession) IsClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Available returns how many more streams OpenStream would accept right now.
+func (m *muxSession) Available() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.goingAway || m.peerAway || m.IsClosed() {
+		return 0
+	}
+	return types.MuxMaxStreams - len(m.streams)
+}
+
+func (m *muxSession) OpenStream() (carrierStream, error) {
+	m.mu.Lock()
+	switch {
+	case m.IsClosed():
+		m.mu.Unlock()
+		return nil, net.ErrClosed
+	case m.goingAway || m.peerAway:
+		m.mu.Unlock()
+		return nil, errMuxGoingAway
+	case len(m.streams) >= types.MuxMaxStreams:
+		m.mu.Unlock()
+		return nil, errMuxFull
+	}
+	id := m.nextID
+	m.nextID += 2
+	stream := newMuxStream(m, id)
+	m.streams[id] = stream
+	m.mu.Unlock()
+
+	if err := m.writeFrame(types.MuxFrameOpen, id, nil); err != nil {
+		m.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (m *muxSession) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.done:
+		return nil, net.ErrClosed
+	case stream := <-m.accepted:
+		return stream, nil
+	}
+}
+
+// GoAway tells the peer to open no more streams and closes the session once
+// the streams already open have finished.
+func (m *muxSession) GoAway() {
+	m.mu.Lock()
+	if m.goingAway {
+		m.mu.Unlock()
+		return
+	}
+	m.goingAway = true
+	idle := len(m.streams) == 0
+	m.mu.Unlock()
+
+	_ = m.writeFrame(types.MuxFrameGoAway, 0, nil)
+	if idle {
+		_ = m.Close()
+	}
+}
+
+func (m *muxSession) Close() error {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		streams := m.streams
+		m.streams = make(map[uint32]*muxStream)
+		m.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.fail(net.ErrClosed)
+		}
+		close(m.done)
+		_ = m.conn.Close()
+	})
+	return nil
+}
+
+func (m *muxSession) runKeepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if err := m.writeFrame(types.MuxFramePing, 0, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *muxSession) writeFrame(frameType byte, streamID uint32, payload []byte) error {
+	frame := types.EncodeMuxFrame(frameType, streamID, payload)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if m.IsClosed() {
+		return net.ErrClosed
+	}
+	_ = m.conn.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
+	_, err := m.conn.Write(frame)
+	_ = m.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		go m.Close()
+	}
+	return err
+}
+
+func (m *muxSession) readLoop() {
+	defer m.Close()
+
+	reader := bufio.NewReaderSize(m.conn, bridgeBufferSize)
+	for {
+		if m.readTimeout > 0 {
+			_ = m.conn.SetReadDeadline(time.Now().Add(m.readTimeout))
+		}
+		header, payload, err := types.ReadMuxFrame(reader)
+		if err != nil {
+			return
+		}
+		if err := m.handleFrame(header, payload); err != nil {
+			return
+		}
+	}
+}
+
+func (m *muxSession) handleFrame(header types.MuxFrameHeader, payload []byte) error {
+	switch header.Type {
+	case types.MuxFramePing:
+		return nil
+	case types.MuxFrameGoAway:
+		m.mu.Lock()
+		m.peerAway = true
+		m.mu.Unlock()
+		return nil
+	case types.MuxFrameOpen:
+		return m.acceptOpen(header.StreamID)
+	}
+
+	m.mu.Lock()
+	stream := m.streams[header.StreamID]
+	m.mu.Unlock()
+	if stream == nil {
+		// The stream already closed on this side. Data still in flight gets a
+		// reset so the peer's writer stops instead of waiting for credit.
+		if header.Type == types.MuxFrameData {
+			_ = m.writeFrame(types.MuxFrameReset, header.StreamID, nil)
+		}
+		return nil
+	}
+
+	switch header.Type {
+	case types.MuxFrameData:
+		return stream.receive(payload)
+	case types.MuxFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("mux window frame for stream %d has %d bytes", header.StreamID, len(payload))
+		}
+		stream.addCredit(int(binary.BigEndian.Uint32(payload)))
+	case types.MuxFrameClose:
+		stream.remoteClose()
+	case types.MuxFrameReset:
+		stream.fail(errMuxStreamReset)
+		m.removeStream(header.StreamID)
+	default:
+		return fmt.Errorf("unknown mux frame type 0x%02x", header.Type)
+	}
+	return nil
+}
+
+func (m *muxSession) acceptOpen(id uint32) error {
+	if m.opener || id%2 == 0 {
+		return fmt.Errorf("unexpected mux open for stream %d", id)
+	}
+
+	m.mu.Lock()
+	if _, exists := m.streams[id]; exists {
+		m.mu.Unlock()
+		return fmt.Errorf("mux stream %d opened twice", id)
+	}
+	if m.goingAway || len(m.streams) >= types.MuxMaxStreams {
+		m.mu.Unlock()
+		return m.writeFrame(types.MuxFrameReset, id, nil)
+	}
+	stream := newMuxStream(m, id)
+	m.streams[id] = stream
+	m.mu.Unlock()
+
+	select {
+	case m.accepted <- stream:
+		return nil
+	default:
+		m.removeStream(id)
+		return m.writeFrame(types.MuxFrameReset, id, nil)
+	}
+}
+
+func (m *muxSession) removeStream(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	idle := m.goingAway && len(m.streams) == 0
+	m.mu.Unlock()
+
+	if idle {
+		_ = m.Close()
+	}
+}
+
+// muxStream is one logical reverse session inside a muxSession. Close sends
+// a half-close and forgets the stream; data the peer sends afterwards is
+// answered with a reset, matching how a TCP socket behaves.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	recv          bytes.Buffer
+	recvWindow    int
+	unacked       int
+	sendWindow    int
+	remoteClosed  bool
+	localClosed   bool
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+	done          chan struct{}
+	doneOnce      sync.Once
+	mu            sync.Mutex
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    session,
+		id:         id,
+		recvWindow: types.MuxInitialWindow,
+		sendWindow: types.MuxInitialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// Done is closed once the stream is closed locally, reset, or its session
+// ends.
+func (s *muxStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.recv.Len() > 0 {
+			n, _ := s.recv.Read(p)
+			s.unacked += n
+			credit := 0
+			if s.unacked >= types.MuxInitialWindow/2 && !s.remoteClosed {
+				credit = s.unacked
+				s.unacked = 0
+				s.recvWindow += credit
+			}
+			s.mu.Unlock()
+
+			if credit > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(credit))
+				_ = s.session.writeFrame(types.MuxFrameWindow, s.id, payload[:])
+			}
+			return n, nil
+		}
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		case s.remoteClosed:
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err := s.wait(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return written, net.ErrClosed
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		case s.localClosed:
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := s.wait(s.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p)-written, s.sendWindow, types.MuxMaxFramePayload)
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.session.writeFrame(types.MuxFrameData, s.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream; the peer reads EOF once it has consumed
+// the data already sent.
+func (s *muxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed || s.err != nil || s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	finished := s.remoteClosed
+	s.mu.Unlock()
+
+	err := s.session.writeFrame(types.MuxFrameClose, s.id, nil)
+	if finished {
+		s.session.removeStream(s.id)
+	}
+	return err
+}
+
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sendClose := s.err == nil && !s.localClosed
+	s.localClosed = true
+	s.mu.Unlock()
+
+	notify(s.readable)
+	notify(s.writable)
+	if sendClose {
+		_ = s.session.writeFrame(types.MuxFrameClose, s.id, nil)
+	}
+	s.session.removeStream(s.id)
+	s.finish()
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readable)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writable)
+	return nil
+}
+
+func (s *muxStream) receive(payload []byte) error {
+	s.mu.Lock()
+	if s.remoteClosed {
+		s.mu.Unlock()
+		return fmt.Errorf("mux stream %d received data after close", s.id)
+	}
+	if len(payload) > s.recvWindow {
+		s.mu.Unlock()
+		return fmt.Errorf("mux stream %d exceeded its flow control window", s.id)
+	}
+	s.recvWindow -= len(payload)
+	if !s.closed && s.err == nil {
+		s.recv.Write(payload)
+	}
+	s.mu.Unlock()
+
+	notify(s.readable)
+	return nil
+}
+
+func (s *muxStream) addCredit(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writable)
+}
+
+func (s *muxStream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	finished := s.localClosed
+	s.mu.Unlock()
+
+	notify(s.readable)
+	if finished {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *muxStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	notify(s.readable)
+	notify(s.writable)
+	s.finish()
+}
+
+func (s *muxStream) finish() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+func (s *muxStream) wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+		case <-s.done:
+		}
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-s.done:
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
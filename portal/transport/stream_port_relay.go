@@ -8,51 +8,101 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/portal/metrics"
+	"github.com/gosuda/portal/v2/portal/policy"
+	"github.com/gosuda/portal/v2/types"
 )
 
 const defaultTCPPortClaimTimeout = 10 * time.Second
 
-// RelayTCPPort owns a TCP listener on an allocated port for one lease.
+// RelayTCPPort owns TCP listeners on the allocated ports of one lease.
 // Incoming connections are bridged to reverse sessions claimed from the
 // associated RelayStream using raw TCP (no TLS).
 type RelayTCPPort struct {
 	identityKey string
-	port        int
-	listener    net.Listener
+	ports       []int
+	markers     []int
+	listeners   []net.Listener
 	stream      *RelayStream
+	bps         *policy.BPSManager
+	connLimits  *policy.ConnLimiter
+	quota       *policy.QuotaMeter
+	ipFilter    *policy.IPFilter
+	ingressACL  *policy.IngressACL
+	timeouts    types.ConnTimeouts
+	proxyTrust  ProxyTrustFunc
+	recordConn  AccessRecorder
 
 	cancel    context.CancelFunc
 	closeOnce sync.Once
 }
 
-func NewRelayTCPPort(identityKey string, port int, stream *RelayStream) *RelayTCPPort {
+// RelayTCPPortOptions configures the public TCP ports of one lease. With
+// Markers, connections on each port claim their session with
+// MarkerPortStart and the given RegisterResponse.Ports index so the tenant
+// can tell the ports apart; without them sessions start with
+// MarkerRawStart. ProxyTrust names the peers whose PROXY headers are
+// accepted. ConnLimits, IPFilter, IngressACL and Quota reject connections
+// before a session is claimed, and Quota also cuts the ones that use it up.
+// RecordConn receives each connection once it closes.
+type RelayTCPPortOptions struct {
+	BPS        *policy.BPSManager
+	Markers    []int
+	ProxyTrust ProxyTrustFunc
+	ConnLimits *policy.ConnLimiter
+	IPFilter   *policy.IPFilter
+	IngressACL *policy.IngressACL
+	Quota      *policy.QuotaMeter
+	Timeouts   types.ConnTimeouts
+	RecordConn AccessRecorder
+}
+
+func NewRelayTCPPort(identityKey string, ports []int, stream *RelayStream, opts RelayTCPPortOptions) *RelayTCPPort {
 	return &RelayTCPPort{
 		identityKey: identityKey,
-		port:        port,
+		ports:       ports,
+		markers:     opts.Markers,
 		stream:      stream,
+		bps:         opts.BPS,
+		connLimits:  opts.ConnLimits,
+		quota:       opts.Quota,
+		ipFilter:    opts.IPFilter,
+		ingressACL:  opts.IngressACL,
+		timeouts:    opts.Timeouts,
+		proxyTrust:  opts.ProxyTrust,
+		recordConn:  opts.RecordConn,
 	}
 }
 
 func (t *RelayTCPPort) Start(ctx context.Context) error {
-	if t == nil || t.port <= 0 {
+	if t == nil || len(t.ports) == 0 {
 		return nil
 	}
 
-	addr := &net.TCPAddr{Port: t.port}
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return err
+	listeners := make([]net.Listener, 0, len(t.ports))
+	for _, port := range t.ports {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, NewProxyProtocolListener(listener, t.proxyTrust))
 	}
-	t.listener = listener
+	t.listeners = listeners
 
 	relayCtx, cancel := context.WithCancel(ctx)
 	t.cancel = cancel
-	go t.acceptLoop(relayCtx)
+	for i, listener := range listeners {
+		go t.acceptLoop(relayCtx, listener, i)
+	}
 
 	log.Info().
 		Str("component", "tcp-port-relay").
 		Str("identity_key", t.identityKey).
-		Int("port", t.port).
+		Ints("ports", t.ports).
 		Msg("tcp port relay started")
 
 	return nil
@@ -67,27 +117,35 @@ func (t *RelayTCPPort) Close() {
 		if t.cancel != nil {
 			t.cancel()
 		}
-		if t.listener != nil {
-			_ = t.listener.Close()
+		for _, listener := range t.listeners {
+			_ = listener.Close()
 		}
 		log.Info().
 			Str("component", "tcp-port-relay").
 			Str("identity_key", t.identityKey).
-			Int("port", t.port).
+			Ints("ports", t.ports).
 			Msg("tcp port relay stopped")
 	})
 }
 
+// TCPPort returns the first public port of the lease.
 func (t *RelayTCPPort) TCPPort() int {
-	if t == nil {
+	if t == nil || len(t.ports) == 0 {
 		return 0
 	}
-	return t.port
+	return t.ports[0]
+}
+
+func (t *RelayTCPPort) TCPPorts() []int {
+	if t == nil {
+		return nil
+	}
+	return append([]int(nil), t.ports...)
 }
 
-func (t *RelayTCPPort) acceptLoop(ctx context.Context) {
+func (t *RelayTCPPort) acceptLoop(ctx context.Context, listener net.Listener, i int) {
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if ctx.Err() != nil {
 				return
@@ -104,59 +162,93 @@ func (t *RelayTCPPort) acceptLoop(ctx context.Context) {
 			return
 		}
 
-		go t.handleConn(ctx, conn)
+		go t.handleConn(ctx, conn, i)
 	}
 }
 
-func (t *RelayTCPPort) handleConn(ctx context.Context, conn net.Conn) {
+func (t *RelayTCPPort) handleConn(ctx context.Context, conn net.Conn, i int) {
+	if err := proxyHeaderError(conn); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if reason := t.ipFilter.IngressBlockReason(RemoteIP(conn)); reason != "" {
+		metrics.IngressBlocked.With("tcp", reason).Inc()
+		_ = conn.Close()
+		return
+	}
+
+	startedAt := time.Now()
+	entry := types.AccessLogEntry{
+		Time:      startedAt.UTC(),
+		ClientIP:  RemoteIP(conn),
+		Transport: "tcp",
+	}
+	defer func() {
+		if t.recordConn != nil {
+			entry.DurationMS = time.Since(startedAt).Milliseconds()
+			t.recordConn(entry)
+		}
+	}()
+
+	if !t.ingressACL.Allows(entry.ClientIP) {
+		metrics.IngressBlocked.With("tcp", policy.IngressBlockLease).Inc()
+		entry.CloseReason = CloseReasonRejected
+		_ = conn.Close()
+		return
+	}
+	if t.quota.Exceeded() {
+		metrics.ConnRejects.With(t.identityKey, "tcp", CloseReasonQuota).Inc()
+		entry.CloseReason = CloseReasonQuota
+		_ = conn.Close()
+		return
+	}
+	release, reason := t.connLimits.Acquire(t.identityKey, entry.ClientIP)
+	if reason != "" {
+		metrics.ConnRejects.With(t.identityKey, "tcp", reason).Inc()
+		entry.CloseReason = CloseReasonRejected
+		_ = conn.Close()
+		return
+	}
+	defer release()
+
 	claimCtx, cancel := context.WithTimeout(ctx, defaultTCPPortClaimTimeout)
 	defer cancel()
 
-	session, err := t.stream.ClaimRaw(claimCtx)
+	var session net.Conn
+	var err error
+	if i < len(t.markers) {
+		session, err = t.stream.ClaimRawPort(claimCtx, t.markers[i])
+	} else {
+		session, err = t.stream.ClaimRaw(claimCtx)
+	}
+	entry.ClaimWaitMS = time.Since(startedAt).Milliseconds()
 	if err != nil {
+		entry.CloseReason = CloseReasonClaimFailed
 		_ = conn.Close()
 		log.Warn().
 			Str("component", "tcp-port-relay").
 			Str("identity_key", t.identityKey).
+			Str("remote_addr", conn.RemoteAddr().String()).
 			Err(err).
 			Msg("failed to claim reverse session for tcp port connection")
 		return
 	}
-
-	bridgeConns(conn, session)
-}
-
-// bridgeConns copies data bidirectionally between two connections.
-func bridgeConns(left, right net.Conn) {
-	defer left.Close()
-	defer right.Close()
-
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		copyAndCloseWrite(right, left)
-	}()
-	copyAndCloseWrite(left, right)
-	<-done
-}
-
-func copyAndCloseWrite(dst, src net.Conn) {
-	buf := make([]byte, 32*1024)
-	for {
-		nr, readErr := src.Read(buf)
-		if nr > 0 {
-			if _, writeErr := dst.Write(buf[:nr]); writeErr != nil {
-				break
-			}
-		}
-		if readErr != nil {
-			break
-		}
-	}
-	type closeWriter interface {
-		CloseWrite() error
-	}
-	if cw, ok := dst.(closeWriter); ok {
-		_ = cw.CloseWrite()
+	if err := t.stream.WriteProxyHeader(session, NewProxyHeader(conn, "")); err != nil {
+		entry.CloseReason = CloseReasonTenantError
+		_ = session.Close()
+		_ = conn.Close()
+		return
 	}
+
+	limiter, releaseLimiter := t.bps.AcquireLimiter(t.identityKey)
+	defer releaseLimiter()
+	stats := BridgeConns(ctx, conn, session, BridgeOptions{
+		Limiter:   limiter,
+		Quota:     t.quota,
+		Evicted:   t.stream.Evicted(),
+		LeaseKey:  t.identityKey,
+		Timeouts:  t.timeouts,
+		Transport: "tcp",
+	})
+	entry.BytesIn, entry.BytesOut, entry.CloseReason = stats.BytesIn, stats.BytesOut, stats.Reason
 }
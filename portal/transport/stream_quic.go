@@ -0,0 +1,211 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/gosuda/portal/v2/types"
+)
+
+const quicControlLimit = 4096
+
+// quicStreamSet tracks the streams open on one QUIC connection and closes the
+// connection once it is going away and the last stream has finished. Both
+// the relay carrier and the SDK acceptor build on it.
+type quicStreamSet struct {
+	conn      *quic.Conn
+	control   *quic.Stream
+	streams   int
+	goingAway bool
+	mu        sync.Mutex
+}
+
+func (q *quicStreamSet) Kind() string {
+	return "quic"
+}
+
+func (q *quicStreamSet) RemoteAddr() net.Addr {
+	return q.conn.RemoteAddr()
+}
+
+func (q *quicStreamSet) Done() <-chan struct{} {
+	return q.conn.Context().Done()
+}
+
+func (q *quicStreamSet) Available() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.goingAway || q.conn.Context().Err() != nil {
+		return 0
+	}
+	return types.MuxMaxStreams - q.streams
+}
+
+func (q *quicStreamSet) reserve() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case q.goingAway:
+		return errMuxGoingAway
+	case q.streams >= types.MuxMaxStreams:
+		return errMuxFull
+	}
+	q.streams++
+	return nil
+}
+
+func (q *quicStreamSet) release() {
+	q.mu.Lock()
+	q.streams--
+	idle := q.goingAway && q.streams == 0
+	q.mu.Unlock()
+
+	if idle {
+		_ = q.conn.CloseWithError(0, "going away")
+	}
+}
+
+// markGoingAway reports whether this call switched the set to going away.
+func (q *quicStreamSet) markGoingAway() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.goingAway {
+		return false
+	}
+	q.goingAway = true
+	if q.streams == 0 {
+		_ = q.conn.CloseWithError(0, "going away")
+	}
+	return true
+}
+
+func (q *quicStreamSet) wrap(stream *quic.Stream) *quicStreamConn {
+	return &quicStreamConn{
+		Stream:  stream,
+		conn:    q.conn,
+		release: q.release,
+		done:    make(chan struct{}),
+	}
+}
+
+// quicCarrier is the relay side of a QUIC stream transport connection. The
+// SDK keeps the control stream open and sends a go-away message on it when
+// it stops taking new streams.
+type quicCarrier struct {
+	quicStreamSet
+}
+
+func newQUICCarrier(conn *quic.Conn, control *quic.Stream) *quicCarrier {
+	c := &quicCarrier{quicStreamSet{conn: conn, control: control}}
+	go c.readControl()
+	return c
+}
+
+func (c *quicCarrier) OpenStream() (carrierStream, error) {
+	if err := c.reserve(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(c.conn.Context(), defaultSessionWriteLimit)
+	defer cancel()
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	return c.wrap(stream), nil
+}
+
+func (c *quicCarrier) GoAway() {
+	c.markGoingAway()
+}
+
+func (c *quicCarrier) readControl() {
+	decoder := json.NewDecoder(io.LimitReader(c.control, quicControlLimit))
+	for {
+		var msg types.QUICControlMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.GoAway {
+			c.markGoingAway()
+			return
+		}
+	}
+}
+
+// quicAcceptor is the SDK side of a QUIC stream transport connection.
+type quicAcceptor struct {
+	quicStreamSet
+}
+
+// newQUICAcceptor wraps a QUIC connection whose control stream was accepted
+// for stream transport by the relay.
+func newQUICAcceptor(conn *quic.Conn, control *quic.Stream) *quicAcceptor {
+	return &quicAcceptor{quicStreamSet{conn: conn, control: control}}
+}
+
+func (a *quicAcceptor) AcceptStream(ctx context.Context) (net.Conn, error) {
+	stream, err := a.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.reserve(); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return a.wrap(stream), nil
+}
+
+func (a *quicAcceptor) GoAway() {
+	if !a.markGoingAway() {
+		return
+	}
+	_ = a.control.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
+	_ = json.NewEncoder(a.control).Encode(types.QUICControlMessage{GoAway: true})
+}
+
+// quicStreamConn adapts a QUIC stream to net.Conn. Close stops both
+// directions, while CloseWrite only sends FIN, matching a TCP socket.
+type quicStreamConn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	release   func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicStreamConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *quicStreamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+		close(c.done)
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
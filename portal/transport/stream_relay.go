@@ -8,8 +8,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/rs/zerolog/log"
 
+	"github.com/gosuda/portal/v2/portal/metrics"
 	"github.com/gosuda/portal/v2/types"
 )
 
@@ -17,13 +19,24 @@ const defaultSessionWriteLimit = 5 * time.Second
 
 var errStreamFull = errors.New("stream ready queue full")
 
+// ErrStreamDraining is returned by claims and offers on a draining stream.
+var ErrStreamDraining = errors.New("stream is draining")
+
 type RelayStream struct {
 	notify       chan struct{}
+	evicted      chan struct{}
 	identityKey  string
 	ready        []*relaySession
+	carriers     []streamCarrier
 	idleInterval time.Duration
 	readyLimit   int
+	active       int
+	waiting      int
+	claimWait    time.Duration
+	claims       claimCounter
 	closedErr    error
+	draining     bool
+	proxyHeaders bool
 	mu           sync.Mutex
 }
 
@@ -33,14 +46,28 @@ func NewRelayStream(identityKey string, idleInterval time.Duration, readyLimit i
 		idleInterval: idleInterval,
 		readyLimit:   readyLimit,
 		notify:       make(chan struct{}, 1),
+		evicted:      make(chan struct{}),
 	}
 }
 
 func (b *RelayStream) OfferConn(conn net.Conn) error {
+	return b.offerSession(conn, false)
+}
+
+// OfferDemandConn is OfferConn for an SDK that asked for demand signals:
+// the idle session carries MarkerDemand frames instead of keepalives.
+func (b *RelayStream) OfferDemandConn(conn net.Conn) error {
+	return b.offerSession(conn, true)
+}
+
+func (b *RelayStream) offerSession(conn net.Conn, demand bool) error {
 	if conn == nil {
 		return errors.New("reverse connection is required")
 	}
 	session := newRelaySession(conn, b.idleInterval)
+	if demand {
+		session.demand = b.Demand
+	}
 
 	b.mu.Lock()
 	if b.closedErr != nil {
@@ -49,8 +76,13 @@ func (b *RelayStream) OfferConn(conn net.Conn) error {
 		_ = session.Close()
 		return err
 	}
+	if b.draining {
+		b.mu.Unlock()
+		_ = session.Close()
+		return ErrStreamDraining
+	}
 
-	if b.readyLimit > 0 && len(b.ready) >= b.readyLimit {
+	if b.readyLimit > 0 && len(b.ready)+len(b.carriers) >= b.readyLimit {
 		b.mu.Unlock()
 		_ = session.Close()
 		return errStreamFull
@@ -65,15 +97,93 @@ func (b *RelayStream) OfferConn(conn net.Conn) error {
 	return nil
 }
 
+// streamCarrier is a reverse connection that carries many sessions at once,
+// such as a multiplexed TCP connection or a QUIC connection. Claims open a
+// stream on a carrier instead of consuming an idle single-session connection.
+type streamCarrier interface {
+	Kind() string
+	Available() int
+	OpenStream() (carrierStream, error)
+	GoAway()
+	Done() <-chan struct{}
+	RemoteAddr() net.Addr
+}
+
+// carrierStream is one claimed session on a streamCarrier. Done is closed
+// once the stream has finished so the relay can release its active slot.
+type carrierStream interface {
+	net.Conn
+	Done() <-chan struct{}
+}
+
+// OfferMux adds a reverse connection that negotiated stream multiplexing.
+// One connection serves up to types.MuxMaxStreams concurrent sessions.
+func (b *RelayStream) OfferMux(conn net.Conn) error {
+	if conn == nil {
+		return errors.New("reverse connection is required")
+	}
+	session := newMuxSession(conn, true, 0)
+	if err := b.offerCarrier(session); err != nil {
+		return err
+	}
+	go session.runKeepalive(b.idleInterval)
+	return nil
+}
+
+// OfferQUIC adds a QUIC connection whose control stream asked for stream
+// transport. Each claim opens a new QUIC stream on it.
+func (b *RelayStream) OfferQUIC(conn *quic.Conn, control *quic.Stream) error {
+	if conn == nil || control == nil {
+		return errors.New("quic connection is required")
+	}
+	return b.offerCarrier(newQUICCarrier(conn, control))
+}
+
+func (b *RelayStream) offerCarrier(carrier streamCarrier) error {
+	b.mu.Lock()
+	var err error
+	switch {
+	case b.closedErr != nil:
+		err = b.closedErr
+	case b.draining:
+		err = ErrStreamDraining
+	case b.readyLimit > 0 && len(b.ready)+len(b.carriers) >= b.readyLimit:
+		err = errStreamFull
+	}
+	if err != nil {
+		b.mu.Unlock()
+		carrier.GoAway()
+		return err
+	}
+	b.carriers = append(b.carriers, carrier)
+	b.signalLocked()
+	b.mu.Unlock()
+
+	go b.watchCarrier(carrier)
+	return nil
+}
+
 func (b *RelayStream) Claim(ctx context.Context) (net.Conn, error) {
-	return b.claimWithMarker(ctx, types.MarkerTLSStart)
+	return b.claimWithMarker(ctx, []byte{types.MarkerTLSStart})
 }
 
 func (b *RelayStream) ClaimRaw(ctx context.Context) (net.Conn, error) {
-	return b.claimWithMarker(ctx, types.MarkerRawStart)
+	return b.claimWithMarker(ctx, []byte{types.MarkerRawStart})
 }
 
-func (b *RelayStream) claimWithMarker(ctx context.Context, marker byte) (net.Conn, error) {
+// ClaimRawPort claims a raw session for the public port at index of the
+// lease's RegisterResponse.Ports.
+func (b *RelayStream) ClaimRawPort(ctx context.Context, index int) (net.Conn, error) {
+	return b.claimWithMarker(ctx, []byte{types.MarkerPortStart, byte(index >> 8), byte(index)})
+}
+
+func (b *RelayStream) claimWithMarker(ctx context.Context, marker []byte) (net.Conn, error) {
+	startedAt := time.Now()
+	markerLabel := "tls"
+	if marker[0] != types.MarkerTLSStart {
+		markerLabel = "raw"
+	}
+
 	for {
 		b.mu.Lock()
 		if b.closedErr != nil {
@@ -81,6 +191,22 @@ func (b *RelayStream) claimWithMarker(ctx context.Context, marker byte) (net.Con
 			b.mu.Unlock()
 			return nil, err
 		}
+		if b.draining {
+			b.mu.Unlock()
+			return nil, ErrStreamDraining
+		}
+
+		if carrier := b.pickCarrierLocked(); carrier != nil {
+			b.mu.Unlock()
+
+			stream, err := b.openCarrierStream(carrier, marker)
+			if err != nil {
+				continue
+			}
+			b.recordClaim(time.Since(startedAt))
+			metrics.ClaimDuration.With(markerLabel, "ok").ObserveDuration(time.Since(startedAt))
+			return stream, nil
+		}
 
 		if len(b.ready) > 0 {
 			session := b.ready[0]
@@ -94,14 +220,35 @@ func (b *RelayStream) claimWithMarker(ctx context.Context, marker byte) (net.Con
 				_ = session.Close()
 				continue
 			}
+			b.mu.Lock()
+			if !session.IsClosed() {
+				session.counted = true
+				b.active++
+			}
+			b.mu.Unlock()
+			b.recordClaim(time.Since(startedAt))
+			metrics.ClaimDuration.With(markerLabel, "ok").ObserveDuration(time.Since(startedAt))
 			return session, nil
 		}
+		b.waiting++
 		b.mu.Unlock()
 
 		select {
 		case <-ctx.Done():
+			b.mu.Lock()
+			b.waiting--
+			b.mu.Unlock()
+			outcome := "canceled"
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				outcome = "timeout"
+				metrics.ClaimTimeouts.With(b.identityKey).Inc()
+			}
+			metrics.ClaimDuration.With(markerLabel, outcome).ObserveDuration(time.Since(startedAt))
 			return nil, ctx.Err()
 		case <-b.notify:
+			b.mu.Lock()
+			b.waiting--
+			b.mu.Unlock()
 		}
 	}
 }
@@ -109,6 +256,7 @@ func (b *RelayStream) claimWithMarker(ctx context.Context, marker byte) (net.Con
 func (b *RelayStream) Close() {
 	b.mu.Lock()
 	sessions := b.ready
+	carriers := b.carriers
 	b.ready = nil
 	if b.closedErr == nil {
 		b.closedErr = net.ErrClosed
@@ -119,12 +267,194 @@ func (b *RelayStream) Close() {
 	for _, session := range sessions {
 		_ = session.Close()
 	}
+	for _, carrier := range carriers {
+		carrier.GoAway()
+	}
 }
 
+// Evict closes the stream and cuts the claimed sessions still bridging
+// traffic through Evicted.
+func (b *RelayStream) Evict() {
+	b.mu.Lock()
+	select {
+	case <-b.evicted:
+	default:
+		close(b.evicted)
+	}
+	b.mu.Unlock()
+	b.Close()
+}
+
+// Evicted is closed once the stream has been evicted.
+func (b *RelayStream) Evicted() <-chan struct{} {
+	return b.evicted
+}
+
+// Drain stops the stream from accepting new reverse sessions and claims and
+// closes the idle ones. Sessions already claimed keep running; carriers close
+// once their last stream finishes.
+func (b *RelayStream) Drain() {
+	b.mu.Lock()
+	sessions := b.ready
+	carriers := b.carriers
+	b.ready = nil
+	b.draining = true
+	b.signalLocked()
+	b.mu.Unlock()
+
+	for _, session := range sessions {
+		_ = session.Close()
+	}
+	for _, carrier := range carriers {
+		carrier.GoAway()
+	}
+}
+
+func (b *RelayStream) Draining() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.draining
+}
+
+// ActiveCount returns the number of claimed sessions still bridging traffic.
+func (b *RelayStream) ActiveCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// ReadyCount returns how many claims the stream can serve without waiting:
+// idle single-session connections plus free streams on carriers.
 func (b *RelayStream) ReadyCount() int {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	return len(b.ready)
+	count := len(b.ready)
+	for _, carrier := range b.carriers {
+		count += carrier.Available()
+	}
+	return count
+}
+
+// ReadyLimit returns the most idle sessions and carriers the stream keeps.
+func (b *RelayStream) ReadyLimit() int {
+	return b.readyLimit
+}
+
+// Demand reports recent claim pressure for SDKs that size their idle pool
+// from it.
+func (b *RelayStream) Demand() types.ReadyDemand {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return types.ReadyDemand{
+		Ready:           len(b.ready),
+		Waiting:         b.waiting,
+		ReadyLimit:      b.readyLimit,
+		ClaimWaitMS:     int(b.claimWait / time.Millisecond),
+		ClaimsPerMinute: b.claims.perMinute(time.Now()),
+	}
+}
+
+// recordClaim folds one claim wait into a moving average weighted 1/8
+// toward the newest claim.
+func (b *RelayStream) recordClaim(wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.claims.total == 0 {
+		b.claimWait = wait
+	} else {
+		b.claimWait += (wait - b.claimWait) / 8
+	}
+	b.claims.add(time.Now())
+}
+
+// claimCounter counts claims in whole-minute buckets and reports the last
+// complete minute, or the current one when it is already busier.
+type claimCounter struct {
+	start    time.Time
+	current  int
+	previous int
+	total    int
+}
+
+func (c *claimCounter) add(now time.Time) {
+	c.rotate(now)
+	c.current++
+	c.total++
+}
+
+func (c *claimCounter) perMinute(now time.Time) int {
+	c.rotate(now)
+	return max(c.previous, c.current)
+}
+
+func (c *claimCounter) rotate(now time.Time) {
+	elapsed := now.Sub(c.start)
+	switch {
+	case c.start.IsZero():
+		c.start = now
+	case elapsed >= 2*time.Minute:
+		c.start, c.current, c.previous = now, 0, 0
+	case elapsed >= time.Minute:
+		c.start, c.previous, c.current = c.start.Add(time.Minute), c.current, 0
+	}
+}
+
+// pickCarrierLocked returns the carrier with the most free streams, if any
+// can take another one.
+func (b *RelayStream) pickCarrierLocked() streamCarrier {
+	var best streamCarrier
+	bestFree := 0
+	for _, carrier := range b.carriers {
+		if free := carrier.Available(); free > bestFree {
+			best, bestFree = carrier, free
+		}
+	}
+	return best
+}
+
+func (b *RelayStream) openCarrierStream(carrier streamCarrier, marker []byte) (net.Conn, error) {
+	stream, err := carrier.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	_ = stream.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
+	_, err = stream.Write(marker)
+	_ = stream.SetWriteDeadline(time.Time{})
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.active++
+	b.mu.Unlock()
+	go func() {
+		<-stream.Done()
+		b.mu.Lock()
+		b.active--
+		b.mu.Unlock()
+	}()
+	return stream, nil
+}
+
+func (b *RelayStream) watchCarrier(carrier streamCarrier) {
+	<-carrier.Done()
+
+	b.mu.Lock()
+	for i := range b.carriers {
+		if b.carriers[i] == carrier {
+			b.carriers = append(b.carriers[:i], b.carriers[i+1:]...)
+			break
+		}
+	}
+	log.Info().
+		Str("identity_key", b.identityKey).
+		Str("remote_addr", carrier.RemoteAddr().String()).
+		Str("transport", carrier.Kind()).
+		Int("carriers", len(b.carriers)).
+		Msg("sdk reverse carrier disconnected")
+	b.signalLocked()
+	b.mu.Unlock()
 }
 
 func (b *RelayStream) watchSession(session *relaySession) {
@@ -133,6 +463,10 @@ func (b *RelayStream) watchSession(session *relaySession) {
 	var readyCount int
 
 	b.mu.Lock()
+	if session.counted {
+		session.counted = false
+		b.active--
+	}
 	for i := range b.ready {
 		if b.ready[i] == session {
 			b.ready = append(b.ready[:i], b.ready[i+1:]...)
@@ -171,6 +505,8 @@ type relaySession struct {
 	done          chan struct{}
 	idleInterval  time.Duration
 	state         sessionState
+	counted       bool
+	demand        func() types.ReadyDemand
 	closeOnce     sync.Once
 	mu            sync.Mutex
 }
@@ -254,10 +590,10 @@ func (s *relaySession) StartIdle() {
 }
 
 func (s *relaySession) Activate() error {
-	return s.activateWithMarker(types.MarkerTLSStart)
+	return s.activateWithMarker([]byte{types.MarkerTLSStart})
 }
 
-func (s *relaySession) activateWithMarker(marker byte) error {
+func (s *relaySession) activateWithMarker(marker []byte) error {
 	s.mu.Lock()
 	if s.state != sessionIdle {
 		state := s.state
@@ -284,7 +620,7 @@ func (s *relaySession) activateWithMarker(marker byte) error {
 		return net.ErrClosed
 	}
 	_ = s.conn.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
-	_, err := s.conn.Write([]byte{marker})
+	_, err := s.conn.Write(marker)
 	_ = s.conn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		_ = s.Close()
@@ -318,7 +654,14 @@ func (s *relaySession) Close() error {
 }
 
 func (s *relaySession) runKeepalive(stop <-chan struct{}, done chan<- struct{}) {
-	defer close(done)
+	var writeErr error
+	defer func() {
+		// Close waits on done, so it must only run once done is closed.
+		close(done)
+		if writeErr != nil {
+			_ = s.Close()
+		}
+	}()
 
 	ticker := time.NewTicker(s.idleInterval)
 	defer ticker.Stop()
@@ -332,17 +675,20 @@ func (s *relaySession) runKeepalive(stop <-chan struct{}, done chan<- struct{})
 		case <-ticker.C:
 		}
 
+		frame := []byte{types.MarkerKeepalive}
+		if s.demand != nil {
+			frame = append([]byte{types.MarkerDemand}, s.demand().Encode()...)
+		}
 		s.mu.Lock()
 		if s.state != sessionIdle {
 			s.mu.Unlock()
 			return
 		}
 		_ = s.conn.SetWriteDeadline(time.Now().Add(defaultSessionWriteLimit))
-		_, err := s.conn.Write([]byte{types.MarkerKeepalive})
+		_, writeErr = s.conn.Write(frame)
 		_ = s.conn.SetWriteDeadline(time.Time{})
 		s.mu.Unlock()
-		if err != nil {
-			_ = s.Close()
+		if writeErr != nil {
 			return
 		}
 	}
@@ -19,6 +19,7 @@ import (
 	"github.com/quic-go/quic-go"
 
 	"github.com/gosuda/portal/v2/portal/keyless"
+	"github.com/gosuda/portal/v2/portal/transport"
 	"github.com/gosuda/portal/v2/types"
 	"github.com/gosuda/portal/v2/utils"
 )
@@ -30,6 +31,8 @@ const (
 	defaultLeaseTTL            = 30 * time.Second
 	defaultRenewBefore         = 30 * time.Second
 	defaultReadyTarget         = 2
+	defaultReadyMin            = 1
+	defaultReadyMax            = 8
 	defaultRetryWait           = 3 * time.Second
 	defaultHTTPShutdownTimeout = 5 * time.Second
 )
@@ -49,6 +52,17 @@ type apiClient struct {
 	metadata         types.LeaseMetadata
 	resolvedPublicIP string
 	sniPort          int
+	proxyProtocol    bool
+	multiplex        bool
+	customDomains    []string
+	aliases          []string
+	wildcard         bool
+	instanceID       string
+	replicaWeight    int
+	replicaPolicy    string
+	ports            []types.PortRequest
+	connTimeouts     types.ConnTimeouts
+	ingress          types.IngressRules
 }
 
 func newApiClient(relayURL string, cfg ListenerConfig) (*apiClient, error) {
@@ -62,6 +76,11 @@ func newApiClient(relayURL string, cfg ListenerConfig) (*apiClient, error) {
 		return nil, fmt.Errorf("parse relay url: %w", err)
 	}
 
+	ingress, err := utils.NormalizeIngressRules(cfg.Ingress)
+	if err != nil {
+		return nil, err
+	}
+
 	dialTimeout := utils.DurationOrDefault(cfg.DialTimeout, defaultDialTimeout)
 	requestTimeout := utils.DurationOrDefault(cfg.RequestTimeout, defaultRequestTimeout)
 
@@ -72,6 +91,17 @@ func newApiClient(relayURL string, cfg ListenerConfig) (*apiClient, error) {
 		rootCAPEM:      append([]byte(nil), cfg.RootCAPEM...),
 		identity:       cfg.Identity.Copy(),
 		metadata:       cfg.Metadata.Copy(),
+		proxyProtocol:  cfg.ProxyProtocol,
+		multiplex:      cfg.Multiplex,
+		customDomains:  append([]string(nil), cfg.CustomDomains...),
+		aliases:        append([]string(nil), cfg.Aliases...),
+		wildcard:       cfg.Wildcard,
+		instanceID:     cfg.InstanceID,
+		replicaWeight:  cfg.ReplicaWeight,
+		replicaPolicy:  cfg.ReplicaPolicy,
+		ports:          append([]types.PortRequest(nil), cfg.Ports...),
+		connTimeouts:   cfg.ConnTimeouts,
+		ingress:        ingress,
 	}, nil
 }
 
@@ -96,11 +126,31 @@ func (a *apiClient) registerLease(ctx context.Context, ttl time.Duration, udpEna
 		TTL:        int(ttl / time.Second),
 		UDPEnabled: udpEnabled,
 		TCPEnabled: tcpEnabled,
+
+		ProxyProtocol: a.proxyProtocol,
+		CustomDomains: append([]string(nil), a.customDomains...),
+		Aliases:       append([]string(nil), a.aliases...),
+		Wildcard:      a.wildcard,
+		InstanceID:    a.instanceID,
+		ReplicaWeight: a.replicaWeight,
+		ReplicaPolicy: a.replicaPolicy,
+		ConnTimeouts:  a.connTimeouts,
+		Ingress:       a.ingress,
+	}
+	if udpEnabled {
+		challengeReq.DatagramVersion = types.DatagramVersion2
+	}
+	if len(a.ports) > 0 {
+		challengeReq.Ports = append([]types.PortRequest(nil), a.ports...)
 	}
 	if err := utils.HTTPDoAPIPath(ctx, a.httpClient, a.baseURL, http.MethodPost, types.PathSDKRegisterChallenge, challengeReq, nil, &challenge); err != nil {
 		return types.RegisterResponse{}, err
 	}
 
+	if err := verifyChallengeResources(challenge.SIWEMessage, a.ingress.SIWEResources()); err != nil {
+		return types.RegisterResponse{}, err
+	}
+
 	signature, err := utils.SignEthereumPersonalMessage(challenge.SIWEMessage, a.identity.PrivateKey)
 	if err != nil {
 		return types.RegisterResponse{}, err
@@ -135,6 +185,9 @@ func (a *apiClient) registerLease(ctx context.Context, ttl time.Duration, udpEna
 		}
 		sniPort = resp.SNIPort
 	}
+	if resp.QUICStreams && resp.SNIPort > 0 {
+		sniPort = resp.SNIPort
+	}
 
 	a.mu.Lock()
 	a.accessToken = resp.AccessToken
@@ -198,6 +251,27 @@ func (a *apiClient) ensureCompatible(ctx context.Context, httpClient *http.Clien
 	return nil
 }
 
+// verifyChallengeResources checks that the SIWE message lists every
+// resource the register request must be signed with, so a relay cannot drop
+// the ingress rules of the lease and still obtain the owner's signature.
+func verifyChallengeResources(message string, resources []string) error {
+	if len(resources) == 0 {
+		return nil
+	}
+	lines := make(map[string]struct{})
+	for _, line := range strings.Split(message, "\n") {
+		if resource, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok {
+			lines[resource] = struct{}{}
+		}
+	}
+	for _, resource := range resources {
+		if _, ok := lines[resource]; !ok {
+			return fmt.Errorf("relay register challenge does not cover resource %q", resource)
+		}
+	}
+	return nil
+}
+
 func (a *apiClient) renewLease(ctx context.Context, ttl time.Duration) error {
 	if err := a.ensureHTTPClient(ctx); err != nil {
 		return err
@@ -231,6 +305,38 @@ func (a *apiClient) renewLease(ctx context.Context, ttl time.Duration) error {
 	return nil
 }
 
+// currentAccessToken returns the lease access token, which renewals rotate.
+func (a *apiClient) currentAccessToken() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.accessToken
+}
+
+func (a *apiClient) domainCertificate(ctx context.Context, hostname string) (types.DomainCertificateResponse, error) {
+	if err := a.ensureHTTPClient(ctx); err != nil {
+		return types.DomainCertificateResponse{}, err
+	}
+
+	a.mu.RLock()
+	accessToken := a.accessToken
+	a.mu.RUnlock()
+	if strings.TrimSpace(accessToken) == "" {
+		return types.DomainCertificateResponse{}, errors.New("access token is not available")
+	}
+
+	var resp types.DomainCertificateResponse
+	if err := utils.HTTPDoAPIPath(ctx, a.httpClient, a.baseURL, http.MethodPost, types.PathSDKDomainCertificate, types.DomainCertificateRequest{
+		AccessToken: accessToken,
+		Hostname:    hostname,
+	}, nil, &resp); err != nil {
+		return types.DomainCertificateResponse{}, err
+	}
+	if strings.TrimSpace(resp.CertificatePEM) == "" || strings.TrimSpace(resp.KeyID) == "" {
+		return types.DomainCertificateResponse{}, errors.New("relay returned incomplete domain certificate")
+	}
+	return resp, nil
+}
+
 func (a *apiClient) unregisterLease(ctx context.Context) error {
 	a.mu.RLock()
 	accessToken := a.accessToken
@@ -240,6 +346,21 @@ func (a *apiClient) unregisterLease(ctx context.Context) error {
 	}, nil, nil)
 }
 
+func (a *apiClient) drainLease(ctx context.Context, timeout time.Duration) (types.DrainResponse, error) {
+	a.mu.RLock()
+	accessToken := a.accessToken
+	a.mu.RUnlock()
+
+	var resp types.DrainResponse
+	if err := utils.HTTPDoAPIPath(ctx, a.httpClient, a.baseURL, http.MethodPost, types.PathSDKDrain, types.DrainRequest{
+		AccessToken: accessToken,
+		Timeout:     int(max(timeout, time.Second) / time.Second),
+	}, nil, &resp); err != nil {
+		return types.DrainResponse{}, err
+	}
+	return resp, nil
+}
+
 func (a *apiClient) openReverseSession(ctx context.Context) (net.Conn, error) {
 	if err := a.ensureHTTPClient(ctx); err != nil {
 		return nil, err
@@ -266,6 +387,10 @@ func (a *apiClient) openReverseSession(ctx context.Context) (net.Conn, error) {
 	a.mu.RUnlock()
 	req.Header.Set(types.HeaderAccessToken, accessToken)
 	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set(types.HeaderReadyDemand, "1")
+	if a.multiplex {
+		req.Header.Set(types.HeaderStreamMux, types.StreamMuxVersion)
+	}
 
 	if writeErr := req.Write(conn); writeErr != nil {
 		_ = conn.Close()
@@ -286,6 +411,9 @@ func (a *apiClient) openReverseSession(ctx context.Context) (net.Conn, error) {
 		return nil, apiErr
 	}
 
+	if a.multiplex && resp.Header.Get(types.HeaderStreamMux) == types.StreamMuxVersion {
+		return transport.MultiplexedConn{Conn: wrapBufferedConn(conn, reader)}, nil
+	}
 	return wrapBufferedConn(conn, reader), nil
 }
 
@@ -314,25 +442,47 @@ func (c *bufferedConn) Read(p []byte) (int, error) {
 
 // openQUICSession opens a QUIC connection to the relay for datagram transport.
 func (a *apiClient) openQUICSession(ctx context.Context, accessToken string) (*quic.Conn, error) {
+	conn, _, err := a.dialQUICTunnel(ctx, types.QUICControlMessage{
+		AccessToken: accessToken,
+	}, &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: 15 * time.Second,
+		MaxIdleTimeout:  60 * time.Second,
+	})
+	return conn, err
+}
+
+// openQUICStreams opens a QUIC connection to the relay for stream transport
+// and returns it with the control stream the relay accepted it on.
+func (a *apiClient) openQUICStreams(ctx context.Context) (*quic.Conn, *quic.Stream, error) {
+	a.mu.RLock()
+	accessToken := a.accessToken
+	a.mu.RUnlock()
+
+	return a.dialQUICTunnel(ctx, types.QUICControlMessage{
+		AccessToken: accessToken,
+		Mode:        types.QUICModeStream,
+	}, &quic.Config{
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIdleTimeout:     60 * time.Second,
+		MaxIncomingStreams: types.MuxMaxStreams,
+	})
+}
+
+func (a *apiClient) dialQUICTunnel(ctx context.Context, controlMsg types.QUICControlMessage, quicConf *quic.Config) (*quic.Conn, *quic.Stream, error) {
 	if err := a.ensureHTTPClient(ctx); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	tlsConf := a.rawTLSConfig.Clone()
 	tlsConf.NextProtos = []string{"portal-tunnel"}
 
-	quicConf := &quic.Config{
-		EnableDatagrams: true,
-		KeepAlivePeriod: 15 * time.Second,
-		MaxIdleTimeout:  60 * time.Second,
-	}
-
 	a.mu.RLock()
 	sniPort := a.sniPort
 	a.mu.RUnlock()
 
 	if sniPort <= 0 {
-		return nil, errors.New("sni port is not available")
+		return nil, nil, errors.New("sni port is not available")
 	}
 	host := strings.TrimSpace(a.baseURL.Hostname())
 	if host == "" {
@@ -341,33 +491,31 @@ func (a *apiClient) openQUICSession(ctx context.Context, accessToken string) (*q
 	dialAddr := net.JoinHostPort(host, fmt.Sprintf("%d", sniPort))
 	conn, err := quic.DialAddr(ctx, dialAddr, tlsConf, quicConf)
 	if err != nil {
-		return nil, fmt.Errorf("quic dial: %w", err)
+		return nil, nil, fmt.Errorf("quic dial: %w", err)
 	}
 
 	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		_ = conn.CloseWithError(1, "stream open failed")
-		return nil, fmt.Errorf("open control stream: %w", err)
+		return nil, nil, fmt.Errorf("open control stream: %w", err)
 	}
 
-	controlMsg := types.QUICControlMessage{
-		AccessToken: accessToken,
-	}
 	if err := json.NewEncoder(stream).Encode(controlMsg); err != nil {
 		_ = conn.CloseWithError(1, "control write failed")
-		return nil, fmt.Errorf("write control: %w", err)
+		return nil, nil, fmt.Errorf("write control: %w", err)
 	}
 
 	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
 	var resp types.QUICControlResponse
 	if err := json.NewDecoder(io.LimitReader(stream, 4096)).Decode(&resp); err != nil {
 		_ = conn.CloseWithError(1, "control read failed")
-		return nil, fmt.Errorf("read control response: %w", err)
+		return nil, nil, fmt.Errorf("read control response: %w", err)
 	}
+	_ = stream.SetReadDeadline(time.Time{})
 	if !resp.OK {
 		_ = conn.CloseWithError(1, resp.Error)
-		return nil, fmt.Errorf("quic connect rejected: %s", resp.Error)
+		return nil, nil, fmt.Errorf("quic connect rejected: %s", resp.Error)
 	}
 
-	return conn, nil
+	return conn, stream, nil
 }
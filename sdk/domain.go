@@ -0,0 +1,212 @@
+package sdk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/portal/keyless"
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	defaultDomainCertRetryWait   = 30 * time.Second
+	defaultDomainCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// domainCertificates serves TLS certificates for custom domains and lease
+// wildcards. Certificates supplied by the application win; the rest are
+// issued by the relay and signed through its keyless signer.
+type domainCertificates struct {
+	supplied []*tls.Certificate
+	issued   map[string]*tls.Certificate
+	closers  map[string]io.Closer
+	closed   bool
+	mu       sync.RWMutex
+}
+
+func newDomainCertificates(supplied []tls.Certificate) (*domainCertificates, error) {
+	d := &domainCertificates{
+		issued:  make(map[string]*tls.Certificate),
+		closers: make(map[string]io.Closer),
+	}
+
+	for i := range supplied {
+		cert := &supplied[i]
+		if cert.Leaf == nil {
+			if len(cert.Certificate) == 0 {
+				return nil, errors.New("custom domain certificate is empty")
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("parse custom domain certificate: %w", err)
+			}
+			cert.Leaf = leaf
+		}
+		d.supplied = append(d.supplied, cert)
+	}
+	return d, nil
+}
+
+// suppliedFor returns the application certificate covering hostname, which
+// may be a wildcard route such as *.name.root.
+func (d *domainCertificates) suppliedFor(hostname string) *tls.Certificate {
+	if d == nil {
+		return nil
+	}
+	probe := utils.NormalizeHostname(hostname)
+	if rest, ok := strings.CutPrefix(probe, "*."); ok {
+		probe = "probe." + rest
+	}
+	for _, cert := range d.supplied {
+		if cert.Leaf.VerifyHostname(probe) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// relayIssued lists the hostnames that have no application certificate.
+func (d *domainCertificates) relayIssued(hostnames []string) []string {
+	out := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		if d.suppliedFor(hostname) == nil {
+			out = append(out, hostname)
+		}
+	}
+	return out
+}
+
+func (d *domainCertificates) set(hostname string, cert *tls.Certificate, closer io.Closer) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return
+	}
+	previous := d.closers[hostname]
+	d.issued[hostname] = cert
+	d.closers[hostname] = closer
+	d.mu.Unlock()
+
+	if previous != nil {
+		_ = previous.Close()
+	}
+}
+
+func (d *domainCertificates) get(serverName string) *tls.Certificate {
+	serverName = utils.NormalizeHostname(serverName)
+	if cert := d.suppliedFor(serverName); cert != nil {
+		return cert
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if cert, ok := d.issued[serverName]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		return d.issued["*."+parent]
+	}
+	return nil
+}
+
+// wrap returns a copy of conf that picks a custom domain certificate by SNI
+// and falls back to the relay certificate.
+func (d *domainCertificates) wrap(conf *tls.Config) *tls.Config {
+	wrapped := conf.Clone()
+	wrapped.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return d.get(hello.ServerName), nil
+	}
+	return wrapped
+}
+
+func (d *domainCertificates) close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	closers := d.closers
+	d.closers = make(map[string]io.Closer)
+	d.issued = make(map[string]*tls.Certificate)
+	d.closed = true
+	d.mu.Unlock()
+
+	var closeErr error
+	for _, closer := range closers {
+		if closer != nil {
+			closeErr = errors.Join(closeErr, closer.Close())
+		}
+	}
+	return closeErr
+}
+
+// runDomainCertificateLoop keeps a relay-issued certificate for hostname
+// loaded, polling while the relay is still issuing it and refreshing it
+// ahead of expiry.
+func (l *Listener) runDomainCertificateLoop(ctx context.Context, hostname string) {
+	for {
+		wait := defaultDomainCertRetryWait
+		notAfter, err := l.refreshDomainCertificate(ctx, hostname)
+		switch {
+		case err == nil:
+			wait = max(time.Until(notAfter)-defaultDomainCertRenewBefore, defaultDomainCertRetryWait)
+		case errors.Is(err, context.Canceled), errors.Is(err, net.ErrClosed):
+			return
+		case errors.Is(err, &types.APIRequestError{Code: types.APIErrorCodeFeatureUnavailable}):
+			log.Warn().
+				Str("relay_url", l.api.baseURL.String()).
+				Str("hostname", hostname).
+				Msg("relay cannot issue custom domain certificates; supply one with the listener config")
+			return
+		case errors.Is(err, &types.APIRequestError{Code: types.APIErrorCodeCertificatePending}):
+			log.Debug().
+				Str("relay_url", l.api.baseURL.String()).
+				Str("hostname", hostname).
+				Msg("custom domain certificate pending")
+		default:
+			log.Warn().
+				Err(err).
+				Str("relay_url", l.api.baseURL.String()).
+				Str("hostname", hostname).
+				Msg("fetch custom domain certificate")
+		}
+
+		if !utils.SleepOrDone(ctx, wait) {
+			return
+		}
+	}
+}
+
+func (l *Listener) refreshDomainCertificate(ctx context.Context, hostname string) (time.Time, error) {
+	requestCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	resp, err := l.api.domainCertificate(requestCtx, hostname)
+	cancel()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	cert, closer, err := keyless.BuildDomainCertificate(l.api.baseURL.String(), []byte(resp.CertificatePEM), resp.KeyID, l.api.currentAccessToken)
+	if err != nil {
+		return time.Time{}, err
+	}
+	l.domainCerts.set(hostname, &cert, closer)
+	log.Info().
+		Str("relay_url", l.api.baseURL.String()).
+		Str("hostname", hostname).
+		Time("not_after", resp.NotAfter).
+		Msg("custom domain certificate loaded")
+	return resp.NotAfter, nil
+}
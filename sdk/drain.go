@@ -0,0 +1,101 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gosuda/portal/v2/types"
+	"github.com/gosuda/portal/v2/utils"
+)
+
+const (
+	defaultDrainTimeout      = 30 * time.Second
+	defaultDrainPollInterval = time.Second
+)
+
+// Drain retires the listener without dropping traffic. The relay stops
+// routing new connections to it, handing them to other replicas of the
+// lease, while connections already accepted keep running. The relay
+// unregisters the lease once those connections finish or the ctx deadline
+// passes (30s when ctx has none); Drain then closes the listener.
+func (l *Listener) Drain(ctx context.Context) error {
+	if !l.draining.CompareAndSwap(false, true) || l.closed() {
+		return l.Close()
+	}
+
+	l.mu.Lock()
+	stopSessions := l.stopSessions
+	registered := l.hostname != ""
+	l.mu.Unlock()
+	if stopSessions != nil {
+		stopSessions()
+	}
+	if !registered {
+		return l.Close()
+	}
+
+	timeout := defaultDrainTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	for {
+		requestCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		resp, err := l.api.drainLease(requestCtx, timeout)
+		cancel()
+		switch {
+		case err == nil:
+			log.Debug().
+				Str("relay_url", l.api.baseURL.String()).
+				Str("address", l.Address()).
+				Int("active", resp.Active).
+				Time("deadline", resp.Deadline).
+				Msg("lease draining")
+		case errors.Is(err, &types.APIRequestError{Code: types.APIErrorCodeLeaseNotFound}):
+			// The relay has already unregistered the idle lease.
+			l.mu.Lock()
+			l.hostname = ""
+			l.mu.Unlock()
+			return l.Close()
+		case ctx.Err() != nil:
+			return l.Close()
+		default:
+			log.Warn().
+				Err(err).
+				Str("relay_url", l.api.baseURL.String()).
+				Str("address", l.Address()).
+				Msg("drain lease failed; closing listener")
+			return l.Close()
+		}
+
+		if !utils.SleepOrDone(ctx, defaultDrainPollInterval) {
+			return l.Close()
+		}
+	}
+}
+
+// Drain drains every relay listener concurrently and then closes the
+// exposure. See Listener.Drain.
+func (e *Exposure) Drain(ctx context.Context) error {
+	e.listenerMu.RLock()
+	listeners := make([]*Listener, 0, len(e.relayListeners))
+	for _, listener := range e.relayListeners {
+		if listener != nil {
+			listeners = append(listeners, listener)
+		}
+	}
+	e.listenerMu.RUnlock()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Go(func() {
+			errs[i] = listener.Drain(ctx)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errors.Join(errs...), e.Close())
+}
@@ -2,6 +2,7 @@ package sdk
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -24,14 +25,27 @@ type Exposure struct {
 	cancel context.CancelFunc
 	done   <-chan struct{}
 
-	identity   types.Identity
-	TargetAddr string
-	UDPAddr    string
-	udpEnabled bool
-	tcpEnabled bool
-	banMITM    bool
-	metadata   types.LeaseMetadata
-	rootCAPEM  []byte
+	identity      types.Identity
+	TargetAddr    string
+	UDPAddr       string
+	udpEnabled    bool
+	tcpEnabled    bool
+	banMITM       bool
+	proxyProtocol bool
+	multiplex     bool
+	transportMode string
+	metadata      types.LeaseMetadata
+	rootCAPEM     []byte
+	aliases       []string
+	wildcard      bool
+	customDomains []string
+	domainCerts   []tls.Certificate
+	instanceID    string
+	replicaWeight int
+	replicaPolicy string
+	ports         []types.PortRequest
+	connTimeouts  types.ConnTimeouts
+	ingress       types.IngressRules
 
 	accepted  chan net.Conn
 	datagrams chan types.DatagramFrame
@@ -45,18 +59,34 @@ type Exposure struct {
 }
 
 type ExposeConfig struct {
-	RelayURLs    []string
-	IdentityPath string
-	IdentityJSON string
-	Name         string
-	TargetAddr   string
-	UDPAddr      string
-	UDPEnabled   bool
-	TCPEnabled   bool
-	BanMITM      bool
-	Discovery    bool
-	Metadata     types.LeaseMetadata
-	RootCAPEM    []byte
+	RelayURLs     []string
+	IdentityPath  string
+	IdentityJSON  string
+	Name          string
+	TargetAddr    string
+	UDPAddr       string
+	UDPEnabled    bool
+	TCPEnabled    bool
+	BanMITM       bool
+	ProxyProtocol bool
+	Multiplex     bool
+	Discovery     bool
+	Metadata      types.LeaseMetadata
+	RootCAPEM     []byte
+
+	Aliases                  []string
+	Wildcard                 bool
+	CustomDomains            []string
+	CustomDomainCertificates []tls.Certificate
+	StreamTransport          string
+
+	InstanceID    string
+	ReplicaWeight int
+	ReplicaPolicy string
+
+	Ports        []types.PortRequest
+	ConnTimeouts types.ConnTimeouts
+	Ingress      types.IngressRules
 }
 
 // Expose creates relay listeners for each normalized relay URL and exposes a
@@ -86,6 +116,8 @@ func Expose(ctx context.Context, cfg ExposeConfig) (*Exposure, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid target value %q: %w", cfg.TargetAddr, err)
 	}
+	cfg.UDPEnabled = cfg.UDPEnabled || hasPortProtocol(cfg.Ports, types.PortProtocolUDP)
+	cfg.TCPEnabled = cfg.TCPEnabled || hasPortProtocol(cfg.Ports, types.PortProtocolTCP)
 	udpAddr := cfg.UDPAddr
 	if cfg.UDPEnabled {
 		udpAddr, err = utils.NormalizeLoopbackTarget(utils.StringOrDefault(udpAddr, targetAddr))
@@ -104,8 +136,21 @@ func Expose(ctx context.Context, cfg ExposeConfig) (*Exposure, error) {
 		udpEnabled:     cfg.UDPEnabled,
 		tcpEnabled:     cfg.TCPEnabled,
 		banMITM:        cfg.BanMITM,
+		proxyProtocol:  cfg.ProxyProtocol,
+		multiplex:      cfg.Multiplex,
+		transportMode:  cfg.StreamTransport,
 		metadata:       cfg.Metadata.Copy(),
 		rootCAPEM:      append([]byte(nil), cfg.RootCAPEM...),
+		aliases:        append([]string(nil), cfg.Aliases...),
+		wildcard:       cfg.Wildcard,
+		customDomains:  append([]string(nil), cfg.CustomDomains...),
+		domainCerts:    append([]tls.Certificate(nil), cfg.CustomDomainCertificates...),
+		instanceID:     cfg.InstanceID,
+		replicaWeight:  cfg.ReplicaWeight,
+		replicaPolicy:  cfg.ReplicaPolicy,
+		ports:          append([]types.PortRequest(nil), cfg.Ports...),
+		connTimeouts:   cfg.ConnTimeouts,
+		ingress:        cfg.Ingress,
 		accepted:       make(chan net.Conn, max(len(relayURLs)*defaultReadyTarget*2, 1)),
 		datagrams:      make(chan types.DatagramFrame, max(len(relayURLs)*32, 1)),
 		relaySet:       discovery.NewRelaySet(),
@@ -181,6 +226,10 @@ func (c *exposureConn) Close() error {
 	return closeErr
 }
 
+func (c *exposureConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 func (e *Exposure) Accept() (net.Conn, error) {
 	select {
 	case <-e.done:
@@ -274,13 +323,27 @@ func (e *Exposure) reconcileRelayListeners(failOnError bool) error {
 	}
 	for _, relayURL := range missingRelayURLs {
 		listener, err := NewListener(context.Background(), relayURL, ListenerConfig{
-			Identity:   e.identity.Copy(),
-			UDPEnabled: e.udpEnabled,
-			TCPEnabled: e.tcpEnabled,
-			BanMITM:    e.banMITM,
-			Metadata:   e.metadata.Copy(),
-			RootCAPEM:  append([]byte(nil), e.rootCAPEM...),
-			relaySet:   e.relaySet,
+			Identity:      e.identity.Copy(),
+			UDPEnabled:    e.udpEnabled,
+			TCPEnabled:    e.tcpEnabled,
+			BanMITM:       e.banMITM,
+			Metadata:      e.metadata.Copy(),
+			ProxyProtocol: e.proxyProtocol,
+			Multiplex:     e.multiplex,
+			RootCAPEM:     append([]byte(nil), e.rootCAPEM...),
+			relaySet:      e.relaySet,
+
+			Aliases:                  append([]string(nil), e.aliases...),
+			Wildcard:                 e.wildcard,
+			CustomDomains:            append([]string(nil), e.customDomains...),
+			CustomDomainCertificates: append([]tls.Certificate(nil), e.domainCerts...),
+			InstanceID:               e.instanceID,
+			ReplicaWeight:            e.replicaWeight,
+			ReplicaPolicy:            e.replicaPolicy,
+			Ports:                    append([]types.PortRequest(nil), e.ports...),
+			ConnTimeouts:             e.connTimeouts,
+			Ingress:                  e.ingress,
+			StreamTransport:          e.transportMode,
 		})
 		if err != nil {
 			if failOnError {
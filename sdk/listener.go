@@ -4,11 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -22,21 +24,36 @@ import (
 )
 
 type ListenerConfig struct {
-	Identity         types.Identity
-	UDPEnabled       bool
-	TCPEnabled       bool
-	BanMITM          bool
-	Metadata         types.LeaseMetadata
-	RootCAPEM        []byte
-	DialTimeout      time.Duration
-	RequestTimeout   time.Duration
-	HandshakeTimeout time.Duration
-	LeaseTTL         time.Duration
-	RenewBefore      time.Duration
-	ReadyTarget      int
-	RetryCount       int
-	RetryWait        time.Duration
-	relaySet         *discovery.RelaySet
+	Identity                 types.Identity
+	UDPEnabled               bool
+	TCPEnabled               bool
+	BanMITM                  bool
+	ProxyProtocol            bool
+	Multiplex                bool
+	StreamTransport          string
+	Metadata                 types.LeaseMetadata
+	Aliases                  []string
+	Wildcard                 bool
+	CustomDomains            []string
+	CustomDomainCertificates []tls.Certificate
+	InstanceID               string
+	ReplicaWeight            int
+	ReplicaPolicy            string
+	Ports                    []types.PortRequest
+	ConnTimeouts             types.ConnTimeouts
+	Ingress                  types.IngressRules
+	RootCAPEM                []byte
+	DialTimeout              time.Duration
+	RequestTimeout           time.Duration
+	HandshakeTimeout         time.Duration
+	LeaseTTL                 time.Duration
+	RenewBefore              time.Duration
+	ReadyTarget              int
+	ReadyMin                 int
+	ReadyMax                 int
+	RetryCount               int
+	RetryWait                time.Duration
+	relaySet                 *discovery.RelaySet
 }
 
 type Listener struct {
@@ -52,28 +69,51 @@ type Listener struct {
 	stream      *transport.ClientStream
 	datagram    *transport.ClientDatagram
 	mitmManager *mitmManager
+	domainCerts *domainCertificates
 
 	registered   chan struct{}
 	closeOnce    sync.Once
 	registerOnce sync.Once
-
-	banMITM    bool
-	tcpEnabled bool
-	identity   types.Identity
-	relaySet   *discovery.RelaySet
-	mu         sync.Mutex
-	hostname   string
-	udpAddr    string
-	metadata   types.LeaseMetadata
-	tlsConfig  *tls.Config
-	tlsCloser  io.Closer
+	draining     atomic.Bool
+	stopSessions context.CancelFunc
+
+	banMITM       bool
+	tcpEnabled    bool
+	quicTransport bool
+	identity      types.Identity
+	relaySet      *discovery.RelaySet
+	mu            sync.Mutex
+	hostname      string
+	aliases       []string
+	wildcard      string
+	customDomains []string
+	udpAddr       string
+	ports         []types.PortMapping
+	offlinePage   bool
+	quicStreams   bool
+	metadata      types.LeaseMetadata
+	tlsConfig     *tls.Config
+	tlsCloser     io.Closer
 }
 
 // NewListener creates one relay listener and its dedicated relay transport for one relay URL.
 // Only local config validation fails immediately; relay startup runs in the background until ready.
 func NewListener(ctx context.Context, relayURL string, cfg ListenerConfig) (*Listener, error) {
+	if !types.IsStreamTransport(cfg.StreamTransport) {
+		return nil, fmt.Errorf("unknown stream transport %q", cfg.StreamTransport)
+	}
+
+	if hasPortProtocol(cfg.Ports, types.PortProtocolUDP) {
+		cfg.UDPEnabled = true
+	}
+	if hasPortProtocol(cfg.Ports, types.PortProtocolTCP) {
+		cfg.TCPEnabled = true
+	}
+
 	listenerCtx, cancel := context.WithCancel(ctx)
 	readyTarget := utils.IntOrDefault(cfg.ReadyTarget, defaultReadyTarget)
+	readyMin := utils.IntOrDefault(cfg.ReadyMin, min(defaultReadyMin, readyTarget))
+	readyMax := utils.IntOrDefault(cfg.ReadyMax, max(defaultReadyMax, readyTarget))
 	leaseTTL := utils.DurationOrDefault(cfg.LeaseTTL, defaultLeaseTTL)
 	handshakeTimeout := utils.DurationOrDefault(cfg.HandshakeTimeout, defaultHandshakeTimeout)
 	renewBefore := utils.DurationOrDefault(cfg.RenewBefore, defaultRenewBefore)
@@ -84,6 +124,11 @@ func NewListener(ctx context.Context, relayURL string, cfg ListenerConfig) (*Lis
 		cancel()
 		return nil, err
 	}
+	domainCerts, err := newDomainCertificates(cfg.CustomDomainCertificates)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
 	l := &Listener{
 		doneCh:      listenerCtx.Done(),
@@ -99,9 +144,13 @@ func NewListener(ctx context.Context, relayURL string, cfg ListenerConfig) (*Lis
 		banMITM:     cfg.BanMITM,
 		tcpEnabled:  cfg.TCPEnabled,
 		relaySet:    cfg.relaySet,
+		domainCerts: domainCerts,
 	}
+	l.quicTransport = cfg.StreamTransport == types.StreamTransportQUIC
 	l.mitmManager = newMITMManager(listenerCtx, l)
 	l.stream = transport.NewClientStream(readyTarget, handshakeTimeout)
+	l.stream.SetReadyBounds(readyMin, readyMax)
+	l.stream.SetMultiplex(cfg.Multiplex)
 	if cfg.UDPEnabled {
 		l.datagram = transport.NewClientDatagram(func(err error) {
 			log.Info().
@@ -115,34 +164,38 @@ func NewListener(ctx context.Context, relayURL string, cfg ListenerConfig) (*Lis
 		})
 	}
 
-	go l.runStartup(listenerCtx, readyTarget)
+	go l.runStartup(listenerCtx, readyMax)
 	return l, nil
 }
 
-func (l *Listener) runStartup(ctx context.Context, readyTarget int) {
+func (l *Listener) runStartup(ctx context.Context, readyMax int) {
 	var retries int
 
 	for {
 		err := l.registerAndConfigure(ctx)
 		switch {
 		case err == nil:
-			for range readyTarget {
-				go l.stream.RunLoop(
-					ctx,
-					func(ctx context.Context) (net.Conn, error) {
-						return l.api.openReverseSession(ctx)
-					},
-					func() *tls.Config {
-						l.mu.Lock()
-						defer l.mu.Unlock()
-						return l.tlsConfig
-					},
-					l.retryOrClose,
-				)
-			}
+			sessionCtx, stopSessions := context.WithCancel(ctx)
+			l.mu.Lock()
+			l.stopSessions = stopSessions
+			l.mu.Unlock()
+			l.startReverseSessions(sessionCtx, readyMax)
 			go l.runRenewLoop(ctx)
+			for _, hostname := range l.domainCerts.relayIssued(l.certificateHostnames()) {
+				go l.runDomainCertificateLoop(ctx, hostname)
+			}
 			publicURL := l.PublicURL()
 			event := log.Info().Str("address", l.Address())
+			if l.OfflinePage() {
+				event = event.Bool("relay_offline_page", true)
+			}
+			if ports := l.Ports(); len(ports) > 0 {
+				addrs := make([]string, 0, len(ports))
+				for _, mapping := range ports {
+					addrs = append(addrs, mapping.Protocol+"://"+mapping.Addr)
+				}
+				event = event.Strs("ports", addrs)
+			}
 			if publicURL != "" {
 				event.
 					Msg("service ready at " + publicURL)
@@ -174,6 +227,42 @@ func (l *Listener) runStartup(ctx context.Context, readyTarget int) {
 	}
 }
 
+// startReverseSessions runs the stream transport: one QUIC connection when
+// requested and offered by the relay, otherwise readyMax TCP loops that
+// ClientStream gates to its current idle target.
+func (l *Listener) startReverseSessions(ctx context.Context, readyMax int) {
+	currentTLSConfig := func() *tls.Config {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.tlsConfig
+	}
+
+	if l.quicTransport {
+		l.mu.Lock()
+		quicStreams := l.quicStreams
+		l.mu.Unlock()
+		if quicStreams {
+			go l.stream.RunQUICLoop(ctx, l.api.openQUICStreams, currentTLSConfig, l.retryOrClose)
+			return
+		}
+		log.Warn().
+			Str("relay_url", l.api.baseURL.String()).
+			Str("address", l.Address()).
+			Msg("relay does not offer quic stream transport; using tcp reverse sessions")
+	}
+
+	for range readyMax {
+		go l.stream.RunLoop(
+			ctx,
+			func(ctx context.Context) (net.Conn, error) {
+				return l.api.openReverseSession(ctx)
+			},
+			currentTLSConfig,
+			l.retryOrClose,
+		)
+	}
+}
+
 func (l *Listener) Close() error {
 	var closeErr error
 	l.closeOnce.Do(func() {
@@ -190,6 +279,7 @@ func (l *Listener) Close() error {
 		api := l.api
 		l.hostname = ""
 		l.udpAddr = ""
+		l.ports = nil
 		l.tlsConfig = nil
 		l.tlsCloser = nil
 		l.mu.Unlock()
@@ -213,6 +303,7 @@ func (l *Listener) Close() error {
 		if tlsCloser != nil {
 			closeErr = errors.Join(closeErr, tlsCloser.Close())
 		}
+		closeErr = errors.Join(closeErr, l.domainCerts.close())
 		if api != nil {
 			api.close()
 		}
@@ -325,6 +416,55 @@ func (l *Listener) Hostname() string {
 	return l.hostname
 }
 
+// Aliases returns the extra hostnames under the relay root host, including
+// the wildcard route when one was requested.
+func (l *Listener) Aliases() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	aliases := append([]string(nil), l.aliases...)
+	if l.wildcard != "" {
+		aliases = append(aliases, l.wildcard)
+	}
+	return aliases
+}
+
+// OfflinePage reports whether the relay answers for this lease with its own
+// "service offline" page, terminating TLS with the relay certificate, while
+// no reverse session is available. Traffic that reaches the listener is
+// never affected.
+func (l *Listener) OfflinePage() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.offlinePage
+}
+
+// CustomDomains returns the custom domains the relay verified for the lease.
+func (l *Listener) CustomDomains() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.customDomains...)
+}
+
+// Ports returns the public ports the relay granted for ListenerConfig.Ports,
+// in request order.
+func (l *Listener) Ports() []types.PortMapping {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]types.PortMapping(nil), l.ports...)
+}
+
+// certificateHostnames lists the routes that the relay certificate does not
+// cover.
+func (l *Listener) certificateHostnames() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hostnames := append([]string(nil), l.customDomains...)
+	if l.wildcard != "" {
+		hostnames = append(hostnames, l.wildcard)
+	}
+	return hostnames
+}
+
 func (l *Listener) Metadata() types.LeaseMetadata {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -432,6 +572,10 @@ func (l *Listener) renewLease(ctx context.Context) error {
 	if !errors.Is(err, &types.APIRequestError{Code: types.APIErrorCodeLeaseNotFound}) {
 		return err
 	}
+	if l.draining.Load() {
+		// The relay unregistered the drained lease; do not register it again.
+		return net.ErrClosed
+	}
 
 	requestCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -453,11 +597,21 @@ func (l *Listener) registerAndConfigure(ctx context.Context) error {
 			Message: "relay did not enable required udp support",
 		}
 	}
-	tlsConf, tlsCloser, err := keyless.BuildClientTLSConfig(l.api.baseURL.String(), []string{resp.Hostname})
+	if len(l.api.ports) > 0 && len(resp.Ports) != len(l.api.ports) {
+		_ = l.api.unregisterLease(context.Background())
+		return &types.APIRequestError{
+			Code:    types.APIErrorCodeFeatureUnavailable,
+			Message: "relay did not grant the requested ports",
+		}
+	}
+	tlsConf, tlsCloser, err := keyless.BuildClientTLSConfig(l.api.baseURL.String(), append([]string{resp.Hostname}, resp.Aliases...))
 	if err != nil {
 		_ = l.api.unregisterLease(context.Background())
 		return err
 	}
+	if len(resp.CustomDomains) > 0 || resp.WildcardHostname != "" {
+		tlsConf = l.domainCerts.wrap(tlsConf)
+	}
 
 	if ctx.Err() != nil {
 		_ = l.api.unregisterLease(context.Background())
@@ -481,15 +635,24 @@ func (l *Listener) registerAndConfigure(ctx context.Context) error {
 	l.identity.Name = resp.Identity.Name
 	l.identity.Address = resp.Identity.Address
 	l.hostname = resp.Hostname
+	l.aliases = append([]string(nil), resp.Aliases...)
+	l.wildcard = resp.WildcardHostname
+	l.customDomains = append([]string(nil), resp.CustomDomains...)
 	l.udpAddr = resp.UDPAddr
+	l.ports = append([]types.PortMapping(nil), resp.Ports...)
+	l.offlinePage = resp.OfflinePage
+	l.quicStreams = resp.QUICStreams
 	l.tlsConfig = tlsConf
 	l.tlsCloser = tlsCloser
 	l.mu.Unlock()
+	l.stream.SetProxyHeaders(resp.ProxyProtocol)
+	l.stream.SetReadyLimit(resp.ReadyLimit)
 
 	if oldCloser != nil {
 		_ = oldCloser.Close()
 	}
 	if datagram != nil {
+		datagram.SetVersion(types.NegotiateDatagramVersion(resp.DatagramVersion))
 		datagram.Clear("lease updated")
 	}
 	l.registerOnce.Do(func() { close(l.registered) })
@@ -557,3 +720,25 @@ func (l *Listener) BanMITM() bool {
 	}
 	return l.banMITM
 }
+
+// PortIndex returns the index in Listener.Ports of the public port an
+// accepted raw TCP connection arrived on. It reports false for connections
+// of leases registered without ListenerConfig.Ports.
+func PortIndex(conn net.Conn) (int, bool) {
+	return transport.PortIndexOf(conn)
+}
+
+// ProxyHeader returns the PROXY header the relay sent ahead of an accepted
+// connection when the lease was registered with ProxyProtocol.
+func ProxyHeader(conn net.Conn) (types.ProxyHeader, bool) {
+	return transport.ProxyHeaderOf(conn)
+}
+
+func hasPortProtocol(ports []types.PortRequest, protocol string) bool {
+	for _, port := range ports {
+		if port.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
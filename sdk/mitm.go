@@ -382,3 +382,7 @@ func (c *mitmProbeConn) Write(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+func (c *mitmProbeConn) NetConn() net.Conn {
+	return c.Conn
+}
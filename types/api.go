@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -63,11 +64,23 @@ type RegisterRequest struct {
 }
 
 type RegisterChallengeRequest struct {
-	Identity   Identity      `json:"identity"`
-	Metadata   LeaseMetadata `json:"metadata"`
-	TTL        int           `json:"ttl,omitempty"`
-	UDPEnabled bool          `json:"udp_enabled,omitempty"`
-	TCPEnabled bool          `json:"tcp_enabled,omitempty"`
+	Identity      Identity      `json:"identity"`
+	Metadata      LeaseMetadata `json:"metadata"`
+	TTL           int           `json:"ttl,omitempty"`
+	UDPEnabled    bool          `json:"udp_enabled,omitempty"`
+	TCPEnabled    bool          `json:"tcp_enabled,omitempty"`
+	ProxyProtocol bool          `json:"proxy_protocol,omitempty"`
+	CustomDomains []string      `json:"custom_domains,omitempty"`
+	Aliases       []string      `json:"aliases,omitempty"`
+	Wildcard      bool          `json:"wildcard,omitempty"`
+	InstanceID    string        `json:"instance_id,omitempty"`
+	ReplicaWeight int           `json:"replica_weight,omitempty"`
+	ReplicaPolicy string        `json:"replica_policy,omitempty"`
+
+	DatagramVersion int           `json:"datagram_version,omitempty"`
+	Ports           []PortRequest `json:"ports,omitempty"`
+	ConnTimeouts    ConnTimeouts  `json:"conn_timeouts,omitzero"`
+	Ingress         IngressRules  `json:"ingress,omitzero"`
 }
 
 type RegisterChallengeResponse struct {
@@ -77,15 +90,130 @@ type RegisterChallengeResponse struct {
 }
 
 type RegisterResponse struct {
-	Identity    Identity  `json:"identity"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	Hostname    string    `json:"hostname"`
-	AccessToken string    `json:"access_token"`
-	SNIPort     int       `json:"sni_port,omitempty"`
-	UDPAddr     string    `json:"udp_addr,omitempty"`
-	UDPEnabled  bool      `json:"udp_enabled,omitempty"`
-	TCPAddr     string    `json:"tcp_addr,omitempty"`
-	TCPEnabled  bool      `json:"tcp_enabled,omitempty"`
+	Identity      Identity  `json:"identity"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Hostname      string    `json:"hostname"`
+	AccessToken   string    `json:"access_token"`
+	SNIPort       int       `json:"sni_port,omitempty"`
+	UDPAddr       string    `json:"udp_addr,omitempty"`
+	UDPEnabled    bool      `json:"udp_enabled,omitempty"`
+	TCPAddr       string    `json:"tcp_addr,omitempty"`
+	TCPEnabled    bool      `json:"tcp_enabled,omitempty"`
+	ProxyProtocol bool      `json:"proxy_protocol,omitempty"`
+	OfflinePage   bool      `json:"offline_page,omitempty"`
+	QUICStreams   bool      `json:"quic_streams,omitempty"`
+	ReadyLimit    int       `json:"ready_limit,omitempty"`
+	CustomDomains []string  `json:"custom_domains,omitempty"`
+	Aliases       []string  `json:"aliases,omitempty"`
+
+	WildcardHostname string `json:"wildcard_hostname,omitempty"`
+	InstanceID       string `json:"instance_id,omitempty"`
+	DatagramVersion  int    `json:"datagram_version,omitempty"`
+
+	Ports        []PortMapping `json:"ports,omitempty"`
+	ConnTimeouts ConnTimeouts  `json:"conn_timeouts,omitzero"`
+}
+
+// Port protocols name the transport of a PortRequest or PortMapping.
+const (
+	PortProtocolTCP = "tcp"
+	PortProtocolUDP = "udp"
+)
+
+// PortRequest asks the relay for one public TCP or UDP port. Port names a
+// preferred port number; the relay grants another free port when it is
+// taken or outside the relay's range.
+type PortRequest struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port,omitempty"`
+}
+
+// PortMapping is one public port the relay granted. RegisterResponse.Ports
+// lists them in request order, and reverse sessions and datagram flows name
+// the port they arrived on by its index in that list.
+type PortMapping struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Addr     string `json:"addr"`
+}
+
+// ConnTimeouts bounds bridged SNI and raw TCP connections, in seconds; zero
+// disables a bound. IdleSeconds closes a connection that moved no data in
+// either direction for that long, LifetimeSeconds closes any connection after
+// that long, and DrainSeconds closes the remaining direction once one side
+// has half-closed.
+type ConnTimeouts struct {
+	IdleSeconds     int `json:"idle_seconds,omitempty"`
+	LifetimeSeconds int `json:"lifetime_seconds,omitempty"`
+	DrainSeconds    int `json:"drain_seconds,omitempty"`
+}
+
+func (t ConnTimeouts) Idle() time.Duration {
+	return time.Duration(max(t.IdleSeconds, 0)) * time.Second
+}
+
+func (t ConnTimeouts) Lifetime() time.Duration {
+	return time.Duration(max(t.LifetimeSeconds, 0)) * time.Second
+}
+
+func (t ConnTimeouts) Drain() time.Duration {
+	return time.Duration(max(t.DrainSeconds, 0)) * time.Second
+}
+
+// Within returns t with each positive field replacing the matching default
+// and capped at the matching ceiling when the ceiling is positive. Fields t
+// leaves at zero keep the default.
+func (t ConnTimeouts) Within(defaults, ceiling ConnTimeouts) ConnTimeouts {
+	pick := func(requested, fallback, limit int) int {
+		if requested <= 0 {
+			return fallback
+		}
+		if limit > 0 {
+			return min(requested, limit)
+		}
+		return requested
+	}
+	return ConnTimeouts{
+		IdleSeconds:     pick(t.IdleSeconds, defaults.IdleSeconds, ceiling.IdleSeconds),
+		LifetimeSeconds: pick(t.LifetimeSeconds, defaults.LifetimeSeconds, ceiling.LifetimeSeconds),
+		DrainSeconds:    pick(t.DrainSeconds, defaults.DrainSeconds, ceiling.DrainSeconds),
+	}
+}
+
+// MaxIngressRules caps the allow and deny entries of one lease together.
+const MaxIngressRules = 64
+
+// ingressResourcePrefix starts the SIWE resource URIs that carry ingress
+// rules in a register challenge.
+const ingressResourcePrefix = "urn:portal:ingress:"
+
+// IngressRules lets a tenant restrict which client IPs reach its lease.
+// Entries are IPv4 or IPv6 addresses or CIDR ranges. A non-empty Allow
+// admits only matching clients; Deny refuses matching clients even when
+// Allow admits them.
+type IngressRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func (r IngressRules) IsZero() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// SIWEResources lists the rules as the resource URIs of the register SIWE
+// message, so the signature of the lease owner covers them.
+func (r IngressRules) SIWEResources() []string {
+	if r.IsZero() {
+		return nil
+	}
+	out := make([]string, 0, len(r.Allow)+len(r.Deny))
+	for _, entry := range r.Allow {
+		out = append(out, ingressResourcePrefix+"allow:"+entry)
+	}
+	for _, entry := range r.Deny {
+		out = append(out, ingressResourcePrefix+"deny:"+entry)
+	}
+	return out
 }
 
 type DiscoveryResponse struct {
@@ -96,7 +224,9 @@ type DiscoveryResponse struct {
 }
 
 type QUICControlMessage struct {
-	AccessToken string `json:"access_token"`
+	AccessToken string `json:"access_token,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	GoAway      bool   `json:"go_away,omitempty"`
 }
 
 type QUICControlResponse struct {
@@ -119,6 +249,28 @@ type UnregisterRequest struct {
 	AccessToken string `json:"access_token"`
 }
 
+type DrainRequest struct {
+	AccessToken string `json:"access_token"`
+	Timeout     int    `json:"timeout,omitempty"`
+}
+
+type DrainResponse struct {
+	Deadline time.Time `json:"deadline"`
+	Active   int       `json:"active"`
+}
+
+type DomainCertificateRequest struct {
+	AccessToken string `json:"access_token"`
+	Hostname    string `json:"hostname"`
+}
+
+type DomainCertificateResponse struct {
+	Hostname       string    `json:"hostname"`
+	KeyID          string    `json:"key_id"`
+	CertificatePEM string    `json:"certificate_pem"`
+	NotAfter       time.Time `json:"not_after"`
+}
+
 type DomainResponse struct {
 	ProtocolVersion string `json:"protocol_version"`
 	ReleaseVersion  string `json:"release_version"`
@@ -130,17 +282,44 @@ type TunnelStatusResponse struct {
 	ServiceAlive bool   `json:"service_alive"`
 }
 
+// AdminLoginRequest opens an admin session with either the admin secret
+// key or a signed AdminLoginChallengeResponse.
 type AdminLoginRequest struct {
-	Key string `json:"key"`
+	Key           string `json:"key,omitempty"`
+	ChallengeID   string `json:"challenge_id,omitempty"`
+	SIWEMessage   string `json:"siwe_message,omitempty"`
+	SIWESignature string `json:"siwe_signature,omitempty"`
+}
+
+type AdminLoginChallengeRequest struct {
+	Address string `json:"address"`
+}
+
+type AdminLoginChallengeResponse struct {
+	ChallengeID string    `json:"challenge_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	SIWEMessage string    `json:"siwe_message"`
 }
 
+// Roles of SIWE admin operators. Viewers can read the admin API, moderators
+// can also act on leases and IP rules, and owners can do everything,
+// including changing relay settings and managing API tokens.
+const (
+	AdminRoleViewer    = "viewer"
+	AdminRoleModerator = "moderator"
+	AdminRoleOwner     = "owner"
+)
+
 type AdminLoginResponse struct {
 	Success bool `json:"success,omitempty"`
 }
 
 type AdminAuthStatusResponse struct {
-	Authenticated bool `json:"authenticated"`
-	AuthEnabled   bool `json:"auth_enabled"`
+	Authenticated   bool   `json:"authenticated"`
+	AuthEnabled     bool   `json:"auth_enabled"`
+	KeyLoginEnabled bool   `json:"key_login_enabled"`
+	Address         string `json:"address,omitempty"`
+	Role            string `json:"role,omitempty"`
 }
 
 type AdminSnapshotResponse struct {
@@ -149,6 +328,53 @@ type AdminSnapshotResponse struct {
 	Leases             []AdminLease                 `json:"leases,omitempty"`
 	UDP                AdminUDPSettingsResponse     `json:"udp"`
 	TCPPort            AdminTCPPortSettingsResponse `json:"tcp_port"`
+	ConnLimits         ConnLimits                   `json:"conn_limits"`
+	Quotas             QuotaLimits                  `json:"quotas"`
+	IPRules            AdminIPRulesResponse         `json:"ip_rules"`
+}
+
+// AdminIPRulesResponse lists the banned and ingress-denied IP addresses and
+// CIDR ranges. Banned entries are refused everywhere; ingress deny entries
+// only on public SNI, raw TCP and UDP ingress.
+type AdminIPRulesResponse struct {
+	BannedIPs   []string `json:"banned_ips"`
+	IngressDeny []string `json:"ingress_deny"`
+}
+
+// Scopes an admin API token can be granted. AdminScopeRead covers every GET
+// request on the admin API and /metrics; the others cover changes to leases,
+// relay settings and IP rules.
+const (
+	AdminScopeRead     = "read"
+	AdminScopeLeases   = "leases"
+	AdminScopeSettings = "settings"
+	AdminScopeIPs      = "ips"
+)
+
+// AdminToken describes an admin API token without its secret.
+type AdminToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+type AdminTokenCreateRequest struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// AdminTokenCreateResponse carries the token secret, which the relay only
+// returns once.
+type AdminTokenCreateResponse struct {
+	AdminToken
+	Token string `json:"token"`
+}
+
+type AdminTokensResponse struct {
+	Tokens []AdminToken `json:"tokens"`
 }
 
 type AdminApprovalModeRequest struct {
@@ -171,6 +397,10 @@ type AdminBPSRequest struct {
 	BPS int64 `json:"bps"`
 }
 
+type AdminEvictRequest struct {
+	CooldownSeconds int `json:"cooldown_seconds,omitempty"`
+}
+
 type AdminUDPSettingsRequest struct {
 	Enabled   bool `json:"enabled"`
 	MaxLeases int  `json:"max_leases"`
@@ -190,3 +420,121 @@ type AdminTCPPortSettingsResponse struct {
 	Enabled   bool `json:"enabled"`
 	MaxLeases int  `json:"max_leases"`
 }
+
+// ConnLimits bounds public SNI and raw TCP connections; zero disables a
+// limit. MaxPerLease caps the concurrent bridged connections of a lease,
+// RatePerIP the new connections per second one client IP may open to a
+// lease, and MaxPerIP the concurrent connections of one client IP across the
+// relay.
+type ConnLimits struct {
+	MaxPerLease int `json:"max_per_lease"`
+	RatePerIP   int `json:"rate_per_ip"`
+	MaxPerIP    int `json:"max_per_ip"`
+}
+
+// Normalize clamps negative limits to zero.
+func (l ConnLimits) Normalize() ConnLimits {
+	return ConnLimits{
+		MaxPerLease: max(l.MaxPerLease, 0),
+		RatePerIP:   max(l.RatePerIP, 0),
+		MaxPerIP:    max(l.MaxPerIP, 0),
+	}
+}
+
+func (l ConnLimits) IsZero() bool {
+	return l == ConnLimits{}
+}
+
+// QuotaLimits bounds what one wallet address may use of the relay; zero
+// disables a limit. MaxLeasesPerAddress caps the concurrent leases of an
+// address and MaxLeasesPerIP those registered from one client IP across the
+// relay. MaxTTLSeconds caps the lease TTL a tunnel may request, and
+// DailyBytes and MonthlyBytes the bytes relayed for an address per UTC day
+// and month. In a per-address override a zero field inherits the relay
+// default, so an override replaces limits but cannot lift one to
+// unlimited, and MaxLeasesPerIP is relay-wide and never overridden.
+type QuotaLimits struct {
+	MaxLeasesPerAddress int   `json:"max_leases_per_address"`
+	MaxLeasesPerIP      int   `json:"max_leases_per_ip"`
+	MaxTTLSeconds       int   `json:"max_ttl_seconds"`
+	DailyBytes          int64 `json:"daily_bytes"`
+	MonthlyBytes        int64 `json:"monthly_bytes"`
+}
+
+// Normalize clamps negative limits to zero.
+func (l QuotaLimits) Normalize() QuotaLimits {
+	return QuotaLimits{
+		MaxLeasesPerAddress: max(l.MaxLeasesPerAddress, 0),
+		MaxLeasesPerIP:      max(l.MaxLeasesPerIP, 0),
+		MaxTTLSeconds:       max(l.MaxTTLSeconds, 0),
+		DailyBytes:          max(l.DailyBytes, 0),
+		MonthlyBytes:        max(l.MonthlyBytes, 0),
+	}
+}
+
+func (l QuotaLimits) IsZero() bool {
+	return l == QuotaLimits{}
+}
+
+// QuotaUsage is the traffic relayed for one address in the UTC day
+// ("2006-01-02") and month ("2006-01") it names, counted in both directions.
+type QuotaUsage struct {
+	Address    string `json:"address"`
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// AdminQuotaUsage is the usage of one address with the limits in effect for
+// it, its override if any, and its live lease count.
+type AdminQuotaUsage struct {
+	QuotaUsage
+	Limits   QuotaLimits  `json:"limits"`
+	Override *QuotaLimits `json:"override,omitempty"`
+	Leases   int          `json:"leases"`
+	Exceeded bool         `json:"exceeded"`
+}
+
+type AdminQuotasResponse struct {
+	Defaults QuotaLimits       `json:"defaults"`
+	Usage    []AdminQuotaUsage `json:"usage"`
+}
+
+// AccessLogEntry records one tenant connection or UDP flow handled by the
+// relay. BytesIn counts client-to-tenant bytes and BytesOut the reverse.
+type AccessLogEntry struct {
+	Time        time.Time `json:"time"`
+	LeaseKey    string    `json:"lease_key,omitempty"`
+	InstanceID  string    `json:"instance_id,omitempty"`
+	Hostname    string    `json:"hostname,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	Transport   string    `json:"transport"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	DurationMS  int64     `json:"duration_ms"`
+	ClaimWaitMS int64     `json:"claim_wait_ms,omitempty"`
+	CloseReason string    `json:"close_reason"`
+}
+
+type AdminAccessLogResponse struct {
+	Entries []AccessLogEntry `json:"entries"`
+}
+
+// AdminAuditEntry records one admin mutation. Actor is the operator address,
+// "token:<id>" for an API token or "admin_key" for the admin secret key.
+// Target is the identity key, IP entry or token ID acted on, and Old and New
+// hold its state before and after the change.
+type AdminAuditEntry struct {
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	ClientIP string          `json:"client_ip,omitempty"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target,omitempty"`
+	Old      json.RawMessage `json:"old,omitempty"`
+	New      json.RawMessage `json:"new,omitempty"`
+}
+
+type AdminAuditResponse struct {
+	Entries []AdminAuditEntry `json:"entries"`
+}
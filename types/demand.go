@@ -0,0 +1,59 @@
+package types
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// HeaderReadyDemand on /sdk/connect asks the relay to replace keepalive
+// markers on the idle session with MarkerDemand frames.
+const HeaderReadyDemand = "X-Portal-Ready-Demand"
+
+// ReadyDemandSize is the payload length that follows MarkerDemand.
+const ReadyDemandSize = 14
+
+// ReadyDemand is the relay's view of claim pressure on one lease. The SDK
+// uses it to grow its idle session pool while claims wait and to shrink it
+// while nothing is claimed.
+type ReadyDemand struct {
+	Ready           int
+	Waiting         int
+	ReadyLimit      int
+	ClaimWaitMS     int
+	ClaimsPerMinute int
+}
+
+// Encode serialises d without the leading marker, saturating each field.
+func (d ReadyDemand) Encode() []byte {
+	out := make([]byte, ReadyDemandSize)
+	binary.BigEndian.PutUint16(out[0:2], saturate16(d.Ready))
+	binary.BigEndian.PutUint16(out[2:4], saturate16(d.Waiting))
+	binary.BigEndian.PutUint16(out[4:6], saturate16(d.ReadyLimit))
+	binary.BigEndian.PutUint32(out[6:10], saturate32(d.ClaimWaitMS))
+	binary.BigEndian.PutUint32(out[10:14], saturate32(d.ClaimsPerMinute))
+	return out
+}
+
+// ReadReadyDemand reads the payload that follows MarkerDemand.
+func ReadReadyDemand(r io.Reader) (ReadyDemand, error) {
+	var buf [ReadyDemandSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return ReadyDemand{}, err
+	}
+	return ReadyDemand{
+		Ready:           int(binary.BigEndian.Uint16(buf[0:2])),
+		Waiting:         int(binary.BigEndian.Uint16(buf[2:4])),
+		ReadyLimit:      int(binary.BigEndian.Uint16(buf[4:6])),
+		ClaimWaitMS:     int(binary.BigEndian.Uint32(buf[6:10])),
+		ClaimsPerMinute: int(binary.BigEndian.Uint32(buf[10:14])),
+	}, nil
+}
+
+func saturate16(v int) uint16 {
+	return uint16(min(max(v, 0), math.MaxUint16))
+}
+
+func saturate32(v int) uint32 {
+	return uint32(min(max(int64(v), 0), math.MaxUint32))
+}
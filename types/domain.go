@@ -0,0 +1,26 @@
+package types
+
+import "strings"
+
+// Custom domain ownership is proven with a TXT record at
+// CustomDomainChallengeLabel + "." + hostname whose value is
+// CustomDomainChallengeValuePrefix followed by the lease's SIWE address.
+const (
+	CustomDomainChallengeLabel       = "_portal-challenge"
+	CustomDomainChallengeValuePrefix = "portal-address="
+	MaxCustomDomains                 = 8
+)
+
+// MaxLeaseAliases caps the extra names one lease may claim under the root host.
+const MaxLeaseAliases = 16
+
+// CustomDomainChallengeName returns the TXT record name checked for hostname.
+func CustomDomainChallengeName(hostname string) string {
+	return CustomDomainChallengeLabel + "." + hostname
+}
+
+// CustomDomainChallengeValue returns the TXT record value that binds a
+// custom domain to address.
+func CustomDomainChallengeValue(address string) string {
+	return CustomDomainChallengeValuePrefix + strings.ToLower(strings.TrimSpace(address))
+}
@@ -2,22 +2,29 @@ package types
 
 const (
 	APIErrorCodeAuthDisabled            = "auth_disabled"
+	APIErrorCodeCertificatePending      = "certificate_pending"
+	APIErrorCodeDomainVerification      = "domain_verification_failed"
 	APIErrorCodeFeatureUnavailable      = "feature_unavailable"
+	APIErrorCodeForbidden               = "forbidden"
 	APIErrorCodeHijackFailed            = "hijack_failed"
 	APIErrorCodeHijackUnsupported       = "hijack_unsupported"
 	APIErrorCodeHostnameConflict        = "hostname_conflict"
 	APIErrorCodeHTTP11Only              = "http11_only"
 	APIErrorCodeInvalidAddress          = "invalid_address"
 	APIErrorCodeInvalidIP               = "invalid_ip"
+	APIErrorCodeInvalidIngressRules     = "invalid_ingress_rules"
 	APIErrorCodeInvalidJSON             = "invalid_json"
 	APIErrorCodeInvalidKey              = "invalid_key"
 	APIErrorCodeInvalidMode             = "invalid_mode"
 	APIErrorCodeInvalidRequest          = "invalid_request"
 	APIErrorCodeInternal                = "internal"
 	APIErrorCodeIPBanned                = "ip_banned"
+	APIErrorCodeLeaseDraining           = "lease_draining"
+	APIErrorCodeLeaseEvicted            = "lease_evicted"
 	APIErrorCodeLeaseNotFound           = "lease_not_found"
 	APIErrorCodeLeaseRejected           = "lease_rejected"
 	APIErrorCodeMethodNotAllowed        = "method_not_allowed"
+	APIErrorCodeQuotaExceeded           = "quota_exceeded"
 	APIErrorCodeSessionCreateFailed     = "session_create_failed"
 	APIErrorCodeUnauthorized            = "unauthorized"
 	APIErrorCodeUDPPortExhausted        = "udp_port_exhausted"
@@ -26,6 +33,7 @@ const (
 	APIErrorCodeTCPPortExhausted        = "tcp_port_exhausted"
 	APIErrorCodeTCPPortDisabled         = "tcp_port_disabled"
 	APIErrorCodeTCPPortCapacityExceeded = "tcp_port_capacity_exceeded"
+	APIErrorCodeTooManyPorts            = "too_many_ports"
 	APIErrorCodeTransportMismatch       = "transport_mismatch"
 
 	MITMProbeReasonExporterMismatch = "tls_exporter_mismatch"
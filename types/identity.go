@@ -51,16 +51,22 @@ func (m LeaseMetadata) Copy() LeaseMetadata {
 }
 
 type Lease struct {
-	Name        string `json:"name,omitempty"`
-	ExpiresAt   time.Time
-	FirstSeenAt time.Time
-	LastSeenAt  time.Time
-	Hostname    string
-	UDPEnabled  bool
-	TCPEnabled  bool
-	TCPAddr     string
-	Metadata    LeaseMetadata
-	Ready       int
+	Name          string `json:"name,omitempty"`
+	ExpiresAt     time.Time
+	FirstSeenAt   time.Time
+	LastSeenAt    time.Time
+	Hostname      string
+	CustomDomains []string `json:"custom_domains,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+	Wildcard      string   `json:"wildcard,omitempty"`
+	UDPEnabled    bool
+	TCPEnabled    bool
+	TCPAddr       string
+	Ports         []PortMapping `json:"ports,omitempty"`
+	Metadata      LeaseMetadata
+	Ready         int
+	Replicas      int  `json:"replicas,omitempty"`
+	OfflinePage   bool `json:"offline_page,omitempty"`
 }
 
 type AdminLease struct {
@@ -68,6 +74,7 @@ type AdminLease struct {
 	IdentityKey string `json:"identity_key,omitempty"`
 	Address     string `json:"address,omitempty"`
 	BPS         int64
+	ConnLimits  *ConnLimits `json:"conn_limits,omitempty"`
 	ClientIP    string
 	ReportedIP  string
 	IsApproved  bool
@@ -0,0 +1,104 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stream multiplexing lets one /sdk/connect connection carry many reverse
+// sessions. The SDK requests it by sending HeaderStreamMux with
+// StreamMuxVersion; a relay that agrees echoes the header on the 200
+// response and both sides switch to mux frames. Without the echo the
+// connection keeps the single-session marker protocol.
+//
+// Frame layout: [type u8][stream id u32][payload length u32][payload].
+// The relay opens streams with odd IDs. Every stream begins with one of the
+// Marker*Start bytes as its first data byte, followed by the PROXY header
+// when negotiated, exactly like a single-session connection after its
+// activation marker. Each direction of a stream starts with
+// MuxInitialWindow bytes of credit and the receiver returns credit with
+// MuxFrameWindow frames as the application consumes data. MuxFrameClose
+// half-closes one direction, MuxFrameReset aborts a stream, and
+// MuxFrameGoAway (stream 0) asks the peer to open no further streams.
+const (
+	HeaderStreamMux  = "X-Portal-Stream-Mux"
+	StreamMuxVersion = "1"
+
+	MuxFrameOpen   = byte(0x01)
+	MuxFrameData   = byte(0x02)
+	MuxFrameWindow = byte(0x03)
+	MuxFrameClose  = byte(0x04)
+	MuxFrameReset  = byte(0x05)
+	MuxFramePing   = byte(0x06)
+	MuxFrameGoAway = byte(0x07)
+
+	MuxFrameHeaderSize = 9
+	MuxMaxFramePayload = 16 << 10
+	MuxInitialWindow   = 256 << 10
+	MuxMaxStreams      = 256
+)
+
+// Stream transports select how reverse sessions reach the relay. TCP uses
+// /sdk/connect connections, optionally multiplexed. QUIC keeps one
+// connection to the relay's tunnel listener, sends a QUICControlMessage
+// with Mode QUICModeStream, and receives each claim as a relay-opened QUIC
+// stream that starts with the activation marker like a mux stream.
+const (
+	StreamTransportTCP  = "tcp"
+	StreamTransportQUIC = "quic"
+
+	QUICModeStream = "stream"
+)
+
+// IsStreamTransport reports whether transport names a known stream
+// transport. The empty string selects TCP.
+func IsStreamTransport(transport string) bool {
+	switch transport {
+	case "", StreamTransportTCP, StreamTransportQUIC:
+		return true
+	default:
+		return false
+	}
+}
+
+var ErrMuxFrameTooLarge = errors.New("mux frame exceeds maximum payload")
+
+type MuxFrameHeader struct {
+	Type     byte
+	StreamID uint32
+	Length   uint32
+}
+
+// EncodeMuxFrame serialises one frame.
+func EncodeMuxFrame(frameType byte, streamID uint32, payload []byte) []byte {
+	out := make([]byte, MuxFrameHeaderSize+len(payload))
+	out[0] = frameType
+	binary.BigEndian.PutUint32(out[1:5], streamID)
+	binary.BigEndian.PutUint32(out[5:9], uint32(len(payload)))
+	copy(out[MuxFrameHeaderSize:], payload)
+	return out
+}
+
+// ReadMuxFrame reads one frame from r. The returned payload is freshly
+// allocated.
+func ReadMuxFrame(r io.Reader) (MuxFrameHeader, []byte, error) {
+	var buf [MuxFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return MuxFrameHeader{}, nil, err
+	}
+	header := MuxFrameHeader{
+		Type:     buf[0],
+		StreamID: binary.BigEndian.Uint32(buf[1:5]),
+		Length:   binary.BigEndian.Uint32(buf[5:9]),
+	}
+	if header.Length > MuxMaxFramePayload {
+		return header, nil, fmt.Errorf("%w: %d bytes", ErrMuxFrameTooLarge, header.Length)
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return header, nil, err
+	}
+	return header, payload, nil
+}
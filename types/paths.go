@@ -3,6 +3,7 @@ package types
 const (
 	PathV1Sign            = "/v1/sign"
 	PathHealthz           = "/healthz"
+	PathMetrics           = "/metrics"
 	PathRoot              = "/"
 	PathAssetsPrefix      = "/assets/"
 	PathApp               = "/app"
@@ -13,13 +14,23 @@ const (
 	PathAdminLeases       = "/admin/leases"
 	PathAdminLeasesPrefix = "/admin/leases/"
 	PathAdminLogin        = "/admin/login"
+	PathAdminLoginSIWE    = "/admin/login/challenge"
 	PathAdminLogout       = "/admin/logout"
 	PathAdminAuthStatus   = "/admin/auth/status"
 	PathAdminApproval     = "/admin/settings/approval-mode"
 	PathAdminLandingPage  = "/admin/settings/landing-page"
 	PathAdminUDP          = "/admin/settings/udp"
 	PathAdminTCPPort      = "/admin/settings/tcp-port"
+	PathAdminConnLimits   = "/admin/settings/conn-limits"
+	PathAdminQuotaLimits  = "/admin/settings/quotas"
+	PathAdminQuotas       = "/admin/quotas"
+	PathAdminQuotasPrefix = "/admin/quotas/"
+	PathAdminIPs          = "/admin/ips"
 	PathAdminIPsPrefix    = "/admin/ips/"
+	PathAdminAccessLog    = "/admin/access-log"
+	PathAdminAudit        = "/admin/audit"
+	PathAdminTokens       = "/admin/tokens"
+	PathAdminTokensPrefix = "/admin/tokens/"
 	PathInstallShell      = "/install.sh"
 	PathInstallPowerShell = "/install.ps1"
 	PathInstallBinPrefix  = "/install/bin/"
@@ -28,10 +39,12 @@ const (
 
 	PathSDKPrefix            = "/sdk/"
 	PathSDKDomain            = "/sdk/domain"
+	PathSDKDomainCertificate = "/sdk/domain/certificate"
 	PathSDKRegisterChallenge = "/sdk/register/challenge"
 	PathSDKRegister          = "/sdk/register"
 	PathSDKRenew             = "/sdk/renew"
 	PathSDKUnregister        = "/sdk/unregister"
+	PathSDKDrain             = "/sdk/drain"
 	PathSDKConnect           = "/sdk/connect"
 	PathDiscovery            = "/discovery"
 )
@@ -0,0 +1,292 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol framing as specified by HAProxy
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt).
+const (
+	ProxyHeaderV1Prefix = "PROXY "
+
+	proxyV1MaxLength   = 107
+	proxyV2HeaderLen   = 16
+	proxyV2MaxPayload  = 4096
+	proxyV2VersionMask = 0xF0
+	proxyV2Version     = 0x20
+	proxyV2CmdLocal    = 0x00
+	proxyV2CmdProxy    = 0x01
+
+	proxyV2FamUnspec = 0x00
+	proxyV2FamTCP4   = 0x11
+	proxyV2FamUDP4   = 0x12
+	proxyV2FamTCP6   = 0x21
+	proxyV2FamUDP6   = 0x22
+
+	proxyV2TLVAuthority = 0x02
+	proxyV2TLVUniqueID  = 0x05
+	proxyV2MaxUniqueID  = 128
+)
+
+// ProxyHeaderV2Signature is the fixed 12-byte prefix of every PROXY v2 header.
+var ProxyHeaderV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	ErrProxyHeaderInvalid     = errors.New("invalid proxy protocol header")
+	ErrProxyHeaderUnsupported = errors.New("unsupported proxy protocol header")
+)
+
+// ProxyHeader describes the original client of a relayed connection.
+// Source and Destination are *net.TCPAddr or *net.UDPAddr; a nil Source
+// encodes a LOCAL (v2) or UNKNOWN (v1) header. ServerName and ConnectionID
+// travel as the v2 AUTHORITY and UNIQUE_ID TLVs and are dropped by v1.
+type ProxyHeader struct {
+	Source       net.Addr
+	Destination  net.Addr
+	ServerName   string
+	ConnectionID string
+	Version      int
+}
+
+// EncodeProxyHeaderV2 serialises h as a binary PROXY v2 header.
+func EncodeProxyHeaderV2(h ProxyHeader) ([]byte, error) {
+	family, src, dst, srcPort, dstPort, err := proxyAddrs(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.ConnectionID) > proxyV2MaxUniqueID {
+		return nil, fmt.Errorf("%w: connection id exceeds %d bytes", ErrProxyHeaderInvalid, proxyV2MaxUniqueID)
+	}
+
+	var payload bytes.Buffer
+	if family != proxyV2FamUnspec {
+		payload.Write(src)
+		payload.Write(dst)
+		_ = binary.Write(&payload, binary.BigEndian, srcPort)
+		_ = binary.Write(&payload, binary.BigEndian, dstPort)
+	}
+	writeProxyTLV(&payload, proxyV2TLVAuthority, h.ServerName)
+	writeProxyTLV(&payload, proxyV2TLVUniqueID, h.ConnectionID)
+	if payload.Len() > proxyV2MaxPayload {
+		return nil, fmt.Errorf("%w: header too large", ErrProxyHeaderInvalid)
+	}
+
+	command := byte(proxyV2Version | proxyV2CmdProxy)
+	if family == proxyV2FamUnspec {
+		command = proxyV2Version | proxyV2CmdLocal
+	}
+	out := make([]byte, 0, proxyV2HeaderLen+payload.Len())
+	out = append(out, ProxyHeaderV2Signature...)
+	out = append(out, command, family)
+	out = binary.BigEndian.AppendUint16(out, uint16(payload.Len()))
+	return append(out, payload.Bytes()...), nil
+}
+
+// EncodeProxyHeaderV1 serialises h as a text PROXY v1 header. Only TCP
+// addresses are representable; anything else becomes "PROXY UNKNOWN".
+func EncodeProxyHeaderV1(h ProxyHeader) []byte {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	if !srcOK || !dstOK || src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP4"
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		proto = "TCP6"
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)
+}
+
+// ReadProxyHeader reads exactly one PROXY v1 or v2 header from r without
+// consuming any bytes past it, so r can be handed to TLS afterwards.
+func ReadProxyHeader(r io.Reader) (ProxyHeader, error) {
+	var prefix [6]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return ProxyHeader{}, err
+	}
+
+	switch {
+	case bytes.Equal(prefix[:], ProxyHeaderV2Signature[:6]):
+		return readProxyHeaderV2(r, prefix[:])
+	case string(prefix[:]) == ProxyHeaderV1Prefix:
+		return readProxyHeaderV1(r)
+	default:
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+}
+
+func readProxyHeaderV2(r io.Reader, prefix []byte) (ProxyHeader, error) {
+	head := make([]byte, proxyV2HeaderLen)
+	copy(head, prefix)
+	if _, err := io.ReadFull(r, head[len(prefix):]); err != nil {
+		return ProxyHeader{}, err
+	}
+	if !bytes.Equal(head[:12], ProxyHeaderV2Signature) || head[12]&proxyV2VersionMask != proxyV2Version {
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+
+	length := int(binary.BigEndian.Uint16(head[14:16]))
+	if length > proxyV2MaxPayload {
+		return ProxyHeader{}, fmt.Errorf("%w: header too large", ErrProxyHeaderInvalid)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return ProxyHeader{}, err
+	}
+
+	h := ProxyHeader{Version: 2}
+	command, family := head[12]&^proxyV2VersionMask, head[13]
+	if command != proxyV2CmdLocal && command != proxyV2CmdProxy {
+		return ProxyHeader{}, ErrProxyHeaderUnsupported
+	}
+
+	addrLen := 0
+	switch family {
+	case proxyV2FamTCP4, proxyV2FamUDP4:
+		addrLen = 2*net.IPv4len + 4
+	case proxyV2FamTCP6, proxyV2FamUDP6:
+		addrLen = 2*net.IPv6len + 4
+	case proxyV2FamUnspec:
+	default:
+		return ProxyHeader{}, ErrProxyHeaderUnsupported
+	}
+	if len(payload) < addrLen {
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+	// LOCAL headers keep their address block and TLVs, but the addresses
+	// must not replace the real connection endpoints.
+	if addrLen > 0 && command == proxyV2CmdProxy {
+		ipLen := (addrLen - 4) / 2
+		srcIP := net.IP(bytes.Clone(payload[:ipLen]))
+		dstIP := net.IP(bytes.Clone(payload[ipLen : 2*ipLen]))
+		srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+		if family == proxyV2FamUDP4 || family == proxyV2FamUDP6 {
+			h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		} else {
+			h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		}
+	}
+
+	tlvs := payload[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return ProxyHeader{}, ErrProxyHeaderInvalid
+		}
+		tlvType, tlvLen := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+tlvLen {
+			return ProxyHeader{}, ErrProxyHeaderInvalid
+		}
+		value := string(tlvs[3 : 3+tlvLen])
+		switch tlvType {
+		case proxyV2TLVAuthority:
+			h.ServerName = value
+		case proxyV2TLVUniqueID:
+			h.ConnectionID = value
+		}
+		tlvs = tlvs[3+tlvLen:]
+	}
+	return h, nil
+}
+
+func readProxyHeaderV1(r io.Reader) (ProxyHeader, error) {
+	line := []byte(ProxyHeaderV1Prefix)
+	var b [1]byte
+	for len(line) < proxyV1MaxLength {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return ProxyHeader{}, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	h := ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return ProxyHeader{}, ErrProxyHeaderInvalid
+	}
+	h.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+func proxyAddrs(h ProxyHeader) (family byte, src, dst net.IP, srcPort, dstPort uint16, err error) {
+	if h.Source == nil || h.Destination == nil {
+		return proxyV2FamUnspec, nil, nil, 0, 0, nil
+	}
+
+	var (
+		srcIP, dstIP net.IP
+		sPort, dPort int
+		udp          bool
+	)
+	switch addr := h.Source.(type) {
+	case *net.TCPAddr:
+		srcIP, sPort = addr.IP, addr.Port
+	case *net.UDPAddr:
+		srcIP, sPort, udp = addr.IP, addr.Port, true
+	default:
+		return proxyV2FamUnspec, nil, nil, 0, 0, nil
+	}
+	switch addr := h.Destination.(type) {
+	case *net.TCPAddr:
+		dstIP, dPort = addr.IP, addr.Port
+	case *net.UDPAddr:
+		dstIP, dPort = addr.IP, addr.Port
+	default:
+		return proxyV2FamUnspec, nil, nil, 0, 0, nil
+	}
+
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		family = proxyV2FamTCP4
+		if udp {
+			family = proxyV2FamUDP4
+		}
+		return family, src4, dst4, uint16(sPort), uint16(dPort), nil
+	}
+	src16, dst16 := srcIP.To16(), dstIP.To16()
+	if src16 == nil || dst16 == nil {
+		return 0, nil, nil, 0, 0, fmt.Errorf("%w: invalid address", ErrProxyHeaderInvalid)
+	}
+	family = proxyV2FamTCP6
+	if udp {
+		family = proxyV2FamUDP6
+	}
+	return family, src16, dst16, uint16(sPort), uint16(dPort), nil
+}
+
+func writeProxyTLV(buf *bytes.Buffer, tlvType byte, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteByte(tlvType)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
@@ -0,0 +1,24 @@
+package types
+
+// Replica policies choose which instance of a replica group receives the
+// next claim for a hostname shared by several registrations of one identity.
+const (
+	ReplicaPolicyRoundRobin = "round_robin"
+	ReplicaPolicyLeastReady = "least_ready"
+	ReplicaPolicyWeighted   = "weighted"
+)
+
+// MaxReplicaWeight caps the share one replica may request under the
+// weighted policy.
+const MaxReplicaWeight = 1000
+
+// IsReplicaPolicy reports whether policy names a known replica policy. The
+// empty string selects round robin.
+func IsReplicaPolicy(policy string) bool {
+	switch policy {
+	case "", ReplicaPolicyRoundRobin, ReplicaPolicyLeastReady, ReplicaPolicyWeighted:
+		return true
+	default:
+		return false
+	}
+}
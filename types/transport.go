@@ -3,21 +3,63 @@ package types
 import (
 	"encoding/binary"
 	"errors"
+	"net"
 )
 
 // errDatagramTooSmall is returned when a datagram payload is too short to
 // contain a valid flow ID varint.
 var errDatagramTooSmall = errors.New("datagram too small to decode")
 
+var errDatagramKind = errors.New("unknown datagram frame kind")
+
+var errDatagramFragment = errors.New("invalid datagram fragment")
+
+// ErrDatagramTooLarge is returned when a datagram does not fit in one QUIC
+// DATAGRAM frame and cannot be fragmented.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// Datagram wire versions are negotiated at lease registration. Version 1
+// frames are [flowID varint][payload]. Version 2 frames start with a kind
+// byte: DatagramKindData is followed by [flowID varint][payload], and
+// DatagramKindFlow by [flowID varint][ip length u8][ip][port u16]
+// [port index u16], which announces the client address of a flow and the
+// RegisterResponse.Ports index of the public port it arrived on. The relay
+// sends a flow frame before the first data frame of each flow and repeats it
+// while the flow stays active, because QUIC datagrams may be lost.
+//
+// A version 2 payload that does not fit in one QUIC DATAGRAM frame travels as
+// DatagramKindFragment frames: [flowID varint][packet id u16][index u8]
+// [count u8][chunk]. The receiver reassembles the chunks of one packet ID
+// and drops the packet if any chunk is missing after a short timeout.
+const (
+	DatagramVersion1 = 1
+	DatagramVersion2 = 2
+
+	DatagramKindData     = byte(0x00)
+	DatagramKindFlow     = byte(0x01)
+	DatagramKindFragment = byte(0x02)
+
+	DatagramFragmentHeaderSize = 4
+	MaxDatagramPayload         = 64 << 10
+)
+
+// NegotiateDatagramVersion returns the wire version a relay uses for a peer
+// that asked for requested: the highest version both sides support.
+func NegotiateDatagramVersion(requested int) int {
+	return min(max(requested, DatagramVersion1), DatagramVersion2)
+}
+
 // DatagramFrame carries one relayed datagram.
-// Wire encoding uses only FlowID and Payload with layout:
-// [flowID varint][payload bytes]
+// Only FlowID and Payload travel with every frame; Source and PortIndex are
+// what the relay announced for the flow, when version 2 is in use.
 type DatagramFrame struct {
-	FlowID   uint32
-	Payload  []byte
-	Address  string
-	RelayURL string
-	UDPAddr  string
+	FlowID    uint32
+	Payload   []byte
+	Source    *net.UDPAddr
+	PortIndex int
+	Address   string
+	RelayURL  string
+	UDPAddr   string
 }
 
 // EncodeDatagram serialises a flow-framed datagram for transmission.
@@ -41,3 +83,105 @@ func DecodeDatagram(data []byte) (DatagramFrame, error) {
 		Payload: data[n:],
 	}, nil
 }
+
+// EncodeDatagramData serialises a data frame for the given wire version.
+func EncodeDatagramData(version int, flowID uint32, payload []byte) []byte {
+	if version < DatagramVersion2 {
+		return EncodeDatagram(flowID, payload)
+	}
+	out := make([]byte, 1, 1+binary.MaxVarintLen32+len(payload))
+	out[0] = DatagramKindData
+	out = binary.AppendUvarint(out, uint64(flowID))
+	return append(out, payload...)
+}
+
+// EncodeDatagramFlow serialises a version 2 frame announcing addr as the
+// client of flowID on the public port at portIndex.
+func EncodeDatagramFlow(flowID uint32, addr *net.UDPAddr, portIndex int) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	out := make([]byte, 1, 1+binary.MaxVarintLen32+1+len(ip)+4)
+	out[0] = DatagramKindFlow
+	out = binary.AppendUvarint(out, uint64(flowID))
+	out = append(out, byte(len(ip)))
+	out = append(out, ip...)
+	out = binary.BigEndian.AppendUint16(out, uint16(addr.Port))
+	return binary.BigEndian.AppendUint16(out, uint16(portIndex))
+}
+
+// EncodeDatagramFragment serialises chunk index of count chunks of packetID.
+func EncodeDatagramFragment(flowID uint32, packetID uint16, index, count byte, chunk []byte) []byte {
+	out := make([]byte, 1, 1+binary.MaxVarintLen32+DatagramFragmentHeaderSize+len(chunk))
+	out[0] = DatagramKindFragment
+	out = binary.AppendUvarint(out, uint64(flowID))
+	out = binary.BigEndian.AppendUint16(out, packetID)
+	out = append(out, index, count)
+	return append(out, chunk...)
+}
+
+// DatagramFragment identifies one chunk of a fragmented payload.
+type DatagramFragment struct {
+	PacketID uint16
+	Index    byte
+	Count    byte
+}
+
+// SplitDatagramFragment separates the fragment header from the chunk in the
+// payload of a DatagramKindFragment frame.
+func SplitDatagramFragment(payload []byte) (DatagramFragment, []byte, error) {
+	if len(payload) < DatagramFragmentHeaderSize {
+		return DatagramFragment{}, nil, errDatagramTooSmall
+	}
+	fragment := DatagramFragment{
+		PacketID: binary.BigEndian.Uint16(payload),
+		Index:    payload[2],
+		Count:    payload[3],
+	}
+	if fragment.Count == 0 || fragment.Index >= fragment.Count {
+		return DatagramFragment{}, nil, errDatagramFragment
+	}
+	return fragment, payload[DatagramFragmentHeaderSize:], nil
+}
+
+// DecodeDatagramFrame deserialises a frame of the given wire version and
+// reports its kind. Flow frames return the announced address as Source, the
+// port index as PortIndex and no payload; fragment frames return the payload
+// for SplitDatagramFragment.
+func DecodeDatagramFrame(version int, data []byte) (DatagramFrame, byte, error) {
+	if version < DatagramVersion2 {
+		frame, err := DecodeDatagram(data)
+		return frame, DatagramKindData, err
+	}
+	if len(data) == 0 {
+		return DatagramFrame{}, 0, errDatagramTooSmall
+	}
+	kind := data[0]
+	frame, err := DecodeDatagram(data[1:])
+	if err != nil {
+		return DatagramFrame{}, kind, err
+	}
+	switch kind {
+	case DatagramKindData, DatagramKindFragment:
+		return frame, kind, nil
+	case DatagramKindFlow:
+		body := frame.Payload
+		if len(body) == 0 {
+			return DatagramFrame{}, kind, errDatagramTooSmall
+		}
+		ipLen := int(body[0])
+		if ipLen != net.IPv4len && ipLen != net.IPv6len || len(body) != 1+ipLen+4 {
+			return DatagramFrame{}, kind, errDatagramTooSmall
+		}
+		frame.Source = &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), body[1:1+ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(body[1+ipLen:])),
+		}
+		frame.PortIndex = int(binary.BigEndian.Uint16(body[3+ipLen:]))
+		frame.Payload = nil
+		return frame, kind, nil
+	default:
+		return DatagramFrame{}, kind, errDatagramKind
+	}
+}
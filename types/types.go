@@ -9,4 +9,6 @@ const (
 	MarkerKeepalive   = byte(0x00)
 	MarkerRawStart    = byte(0x01)
 	MarkerTLSStart    = byte(0x02)
+	MarkerDemand      = byte(0x03)
+	MarkerPortStart   = byte(0x04)
 )
@@ -277,6 +277,26 @@ func NormalizeIdentityKeyBPS(inputs map[string]int64) map[string]int64 {
 	return out
 }
 
+func NormalizeIdentityKeyConnLimits(inputs map[string]types.ConnLimits) map[string]types.ConnLimits {
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	out := make(map[string]types.ConnLimits, len(inputs))
+	for input, limits := range inputs {
+		key := NormalizeIdentityKey(input)
+		limits = limits.Normalize()
+		if key == "" || limits.IsZero() {
+			continue
+		}
+		out[key] = limits
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
 func ResolveLeaseIdentity(identity types.Identity) (types.Identity, error) {
 	resolved := identity.Copy()
 
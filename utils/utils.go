@@ -22,6 +22,8 @@ import (
 	"unicode"
 
 	"golang.org/x/net/idna"
+
+	"github.com/gosuda/portal/v2/types"
 )
 
 func SplitCSV(raw string) []string {
@@ -375,6 +377,37 @@ func LeaseHostname(name, rootHost string) (string, error) {
 	return label + "." + rootHost, nil
 }
 
+// NormalizeCustomDomain validates a tenant-owned hostname. It must be a
+// fully qualified name of at least two labels outside rootHost.
+func NormalizeCustomDomain(raw, rootHost string) (string, error) {
+	hostname := NormalizeHostname(raw)
+	if hostname == "" {
+		return "", errors.New("custom domain is required")
+	}
+	ascii, err := idna.Lookup.ToASCII(hostname)
+	if err != nil {
+		return "", fmt.Errorf("custom domain %q is invalid", raw)
+	}
+	hostname = NormalizeHostname(ascii)
+	if len(hostname) > 253 || net.ParseIP(hostname) != nil {
+		return "", fmt.Errorf("custom domain %q is invalid", raw)
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("custom domain %q must be fully qualified", raw)
+	}
+	for _, label := range labels {
+		if validated, err := NormalizeDNSLabel(label); err != nil || validated != label {
+			return "", fmt.Errorf("custom domain %q is invalid", raw)
+		}
+	}
+	if HostnameMatchesBaseDomain(hostname, rootHost) {
+		return "", fmt.Errorf("custom domain %q must be outside %s", raw, NormalizeBaseDomain(rootHost))
+	}
+	return hostname, nil
+}
+
 func DecodeBase64URLString(encoded string) (string, error) {
 	decoded, err := base64.URLEncoding.DecodeString(encoded)
 	if err == nil {
@@ -556,6 +589,60 @@ func NormalizeIPPrefixes(inputs []string) []string {
 	})
 }
 
+// ParseIPRule parses an IPv4 or IPv6 address or CIDR range. It returns the
+// canonical text of the rule, which is a bare address for a single host and
+// a masked prefix otherwise, and the prefix the rule covers.
+func ParseIPRule(raw string) (string, netip.Prefix, bool) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return "", netip.Prefix{}, false
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefix = prefix.Masked()
+		return prefix.String(), prefix, true
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return "", netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return addr.String(), netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// NormalizeIngressRules rewrites every entry of rules to its canonical text
+// and drops duplicates. It fails on an invalid entry or when the rules exceed
+// types.MaxIngressRules.
+func NormalizeIngressRules(rules types.IngressRules) (types.IngressRules, error) {
+	if len(rules.Allow)+len(rules.Deny) > types.MaxIngressRules {
+		return types.IngressRules{}, fmt.Errorf("at most %d ingress rules are allowed", types.MaxIngressRules)
+	}
+	normalize := func(entries []string) ([]string, error) {
+		for _, entry := range entries {
+			if _, _, ok := ParseIPRule(entry); !ok {
+				return nil, fmt.Errorf("invalid ingress rule %q: expected an IP address or CIDR range", entry)
+			}
+		}
+		return normalizeUniqueStrings(entries, func(entry string) string {
+			key, _, _ := ParseIPRule(entry)
+			return key
+		}), nil
+	}
+
+	allow, err := normalize(rules.Allow)
+	if err != nil {
+		return types.IngressRules{}, err
+	}
+	deny, err := normalize(rules.Deny)
+	if err != nil {
+		return types.IngressRules{}, err
+	}
+	return types.IngressRules{Allow: allow, Deny: deny}, nil
+}
+
 func normalizeUniqueStrings(inputs []string, normalize func(string) string) []string {
 	if len(inputs) == 0 {
 		return nil
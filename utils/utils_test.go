@@ -173,6 +173,57 @@ func TestLeaseHostname(t *testing.T) {
 	}
 }
 
+func TestNormalizeCustomDomain(t *testing.T) {
+	t.Parallel()
+
+	got, err := NormalizeCustomDomain("Shop.Example.NET.", "portal.example.com")
+	if err != nil {
+		t.Fatalf("NormalizeCustomDomain() error = %v", err)
+	}
+	if got != "shop.example.net" {
+		t.Fatalf("NormalizeCustomDomain() = %q, want %q", got, "shop.example.net")
+	}
+
+	for _, raw := range []string{"localhost", "203.0.113.10", "demo.portal.example.com", "bad_label.example.net"} {
+		if _, err := NormalizeCustomDomain(raw, "portal.example.com"); err == nil {
+			t.Fatalf("NormalizeCustomDomain(%q) error = nil, want error", raw)
+		}
+	}
+}
+
+func TestParseIPRule(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		raw        string
+		wantKey    string
+		wantPrefix string
+	}{
+		{raw: " 203.0.113.10 ", wantKey: "203.0.113.10", wantPrefix: "203.0.113.10/32"},
+		{raw: "203.0.113.77/24", wantKey: "203.0.113.0/24", wantPrefix: "203.0.113.0/24"},
+		{raw: "2001:DB8::1", wantKey: "2001:db8::1", wantPrefix: "2001:db8::1/128"},
+		{raw: "2001:db8:abcd::1/48", wantKey: "2001:db8:abcd::/48", wantPrefix: "2001:db8:abcd::/48"},
+		{raw: "fe80::1%eth0", wantKey: "fe80::1", wantPrefix: "fe80::1/128"},
+		{raw: "::ffff:198.51.100.7", wantKey: "198.51.100.7", wantPrefix: "198.51.100.7/32"},
+		{raw: "::ffff:198.51.100.0/120", wantKey: "198.51.100.0/24", wantPrefix: "198.51.100.0/24"},
+	}
+	for _, tc := range tests {
+		key, prefix, ok := ParseIPRule(tc.raw)
+		if !ok {
+			t.Fatalf("ParseIPRule(%q) ok = false, want true", tc.raw)
+		}
+		if key != tc.wantKey || prefix.String() != tc.wantPrefix {
+			t.Fatalf("ParseIPRule(%q) = (%q, %s), want (%q, %s)", tc.raw, key, prefix, tc.wantKey, tc.wantPrefix)
+		}
+	}
+
+	for _, raw := range []string{"", "portal.example.com", "203.0.113.300", "203.0.113.0/33", "2001:db8::/129"} {
+		if _, _, ok := ParseIPRule(raw); ok {
+			t.Fatalf("ParseIPRule(%q) ok = true, want false", raw)
+		}
+	}
+}
+
 func TestDecodeBase64URLString(t *testing.T) {
 	t.Parallel()
 